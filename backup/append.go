@@ -0,0 +1,85 @@
+package backup
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// _AppendRuns is the PAX global record of appended archives counting the
+// runs they hold.
+const _AppendRuns = "TARBU.runs"
+
+func (config *Config) isAppendValid() error {
+	for _, e := range config.Entries {
+		if !e.Append {
+			continue
+		}
+		if e.Incremental || e.Type != "" || e.numbered() {
+			return fmt.Errorf("appended entries can't be incremental, typed or numbered. name=%s", e.Name)
+		}
+	}
+	return nil
+}
+
+// appendBase returns the newest archive of ent for the run to append to,
+// and the runs it holds. The name is empty when a fresh archive is due:
+// there is none yet, it wasn't appended to or it holds FullEvery runs.
+func (config *Config) appendBase(b storage.Backend, ent *Entry) (string, int, error) {
+	gens, err := generations(b, ent)
+	if err != nil || len(gens) == 0 {
+		return "", 0, err
+	}
+	name := gens[len(gens)-1].Name
+	tr, err := config.openTar(b, ent, name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer tr.Close()
+	hdr, err := tar.NewReader(tr).Next()
+	if err != nil {
+		return "", 0, fmt.Errorf("archive is malformed. archive=%s err=%s", b.Location(name), err)
+	}
+	runs, err := strconv.Atoi(hdr.PAXRecords[_AppendRuns])
+	if hdr.Typeflag != tar.TypeXGlobalHeader || err != nil {
+		return "", 0, nil
+	}
+	every := ent.FullEvery
+	if every == 0 {
+		every = _FullEvery
+	}
+	if runs >= every {
+		return "", 0, nil
+	}
+	return name, runs, nil
+}
+
+// openTar opens the plain tar stream of name of ent in b.
+func (config *Config) openTar(b storage.Backend, ent *Entry, name string) (io.ReadCloser, error) {
+	r, err := config.openArchive(b, ent, name)
+	if err != nil {
+		return nil, err
+	}
+	tr, err := decompress(r)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("%s. archive=%s", err, b.Location(name))
+	}
+	return &plainTar{tr, r}, nil
+}
+
+type plainTar struct {
+	io.ReadCloser
+	archive io.Closer
+}
+
+func (p *plainTar) Close() error {
+	err := p.ReadCloser.Close()
+	if cerr := p.archive.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
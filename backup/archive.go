@@ -0,0 +1,144 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/k3nju/tarbu/internal/archiver"
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// archiveStats summarizes a scanned archive.
+type archiveStats struct {
+	Members int
+	Bytes   int64
+}
+
+// scanArchive reads a compressed tar stream to its end and calls fn for
+// every member. It is meant for whatever bytes a destination returns: memory is
+// bounded by archive/tar's header limits no matter the member sizes, and
+// malformed input, including a panic while decoding, is an error.
+func scanArchive(r io.Reader, fn func(hdr *tar.Header, body io.Reader) error) (stats archiveStats, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = fmt.Errorf("archive is malformed. err=%v", v)
+		}
+	}()
+
+	zr, err := decompress(r)
+	if err != nil {
+		return stats, err
+	}
+	defer func() {
+		// a failing decompressor explains the broken stream
+		if cerr := zr.Close(); cerr != nil {
+			err = cerr
+		}
+	}()
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("archive is malformed. member=%d err=%s", stats.Members, err)
+		}
+		if hdr.Size < 0 {
+			return stats, fmt.Errorf("archive member has a negative size. name=%q", hdr.Name)
+		}
+		stats.Members++
+		body := &countingReader{r: tr}
+		if fn != nil {
+			if err := fn(hdr, body); err != nil {
+				return stats, err
+			}
+		}
+		// read what fn left, so truncated bodies are caught
+		if _, err := io.Copy(ioutil.Discard, body); err != nil {
+			return stats, fmt.Errorf("archive member is truncated. name=%q err=%s", hdr.Name, err)
+		}
+		stats.Bytes += body.n
+	}
+	// a concatenated gzip member with trailing garbage fails here
+	if _, err := io.Copy(ioutil.Discard, zr); err != nil {
+		return stats, fmt.Errorf("archive has a broken trailer. err=%s", err)
+	}
+	return stats, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// archivedStats counts the files of the tree as they are archived, what
+// verifyWritten expects to read back.
+type archivedStats struct {
+	members int
+	// files and bytes are the regular files, hard links included
+	files int
+	bytes int64
+}
+
+func (a *archivedStats) hook(opts *archiver.Options) {
+	archived := opts.Archived
+	opts.Archived = func(name string, fi os.FileInfo) {
+		a.members++
+		if fi.Mode().IsRegular() {
+			a.files++
+			a.bytes += fi.Size()
+		}
+		if archived != nil {
+			archived(name, fi)
+		}
+	}
+}
+
+// verifyWritten reads the archive name of ent to its end, and compares
+// its members with want unless it is nil.
+func (config *Config) verifyWritten(b storage.Backend, ent *Entry, name string, want *archivedStats) error {
+	r, err := config.openArchive(b, ent, name)
+	if err != nil {
+		return err
+	}
+	got := &archivedStats{}
+	sizes := map[string]int64{}
+	_, err = scanArchive(bufio.NewReader(r), func(hdr *tar.Header, body io.Reader) error {
+		switch hdr.Typeflag {
+		case tar.TypeXGlobalHeader:
+			return nil
+		case tar.TypeReg:
+			sizes[hdr.Name] = hdr.Size
+			got.files++
+			got.bytes += hdr.Size
+		case tar.TypeLink:
+			got.files++
+			got.bytes += sizes[hdr.Linkname]
+		}
+		got.members++
+		return nil
+	})
+	if cerr := r.Close(); cerr != nil {
+		return fmt.Errorf("archive verification failed. err=%s", cerr)
+	}
+	if err != nil {
+		return fmt.Errorf("archive verification failed. err=%s", err)
+	}
+	if want != nil && *got != *want {
+		return fmt.Errorf("archive verification failed. members=%d files=%d bytes=%d archived_members=%d archived_files=%d archived_bytes=%d",
+			got.members, got.files, got.bytes, want.members, want.files, want.bytes)
+	}
+	return nil
+}
@@ -0,0 +1,443 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+func makeArchive(t testing.TB, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(zw)
+	for name, body := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestScanArchiveTruncated(t *testing.T) {
+	data := makeArchive(t, map[string]string{"a": "hello", "b": string(bytes.Repeat([]byte("x"), 1<<16))})
+	stats, err := scanArchive(bytes.NewReader(data), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Members != 2 || stats.Bytes != 5+1<<16 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+	for _, n := range []int{0, 10, len(data) / 2, len(data) - 1} {
+		if _, err := scanArchive(bytes.NewReader(data[:n]), nil); err == nil {
+			t.Fatalf("archive truncated to %d bytes was accepted", n)
+		}
+	}
+}
+
+func FuzzScanArchive(f *testing.F) {
+	f.Add(makeArchive(f, map[string]string{"a": "hello"}))
+	f.Add(makeArchive(f, map[string]string{"dir/long/name": "x", "b": ""}))
+	f.Add([]byte{0x1f, 0x8b})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// only errors are allowed, never a panic or a hang
+		scanArchive(bytes.NewReader(data), nil)
+	})
+}
+
+func TestExpectedFiles(t *testing.T) {
+	m := storage.NewMemory()
+	ent := &Entry{Name: "www"}
+	m.Objects["www.tar.gz.100"] = makeArchive(t, map[string]string{"./a": "hello"})
+	want, err := (&Config{}).expectedFiles(m, ent, "www.tar.gz.100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256([]byte("hello")); len(want) != 1 || want["./a"] != hex.EncodeToString(sum[:]) {
+		t.Fatalf("expectedFiles returned %v", want)
+	}
+
+	// the manifest wins over the archive
+	if err := writeManifest(m, ent, &manifest{Entry: "www", Time: 100, Files: []manifestFile{{Name: "./b", SHA256: "00"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if want, err = (&Config{}).expectedFiles(m, ent, "www.tar.gz.100"); err != nil || len(want) != 1 || want["./b"] != "00" {
+		t.Fatalf("expectedFiles returned %v, err=%v", want, err)
+	}
+}
+
+func TestExtractNative(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	for _, h := range []*tar.Header{
+		{Name: "./d/", Mode: 0750, Typeflag: tar.TypeDir},
+		{Name: "./d/a", Mode: 0640, Size: 5, Typeflag: tar.TypeReg},
+		{Name: "./d/l", Linkname: "a", Typeflag: tar.TypeSymlink},
+		{Name: "./d/h", Linkname: "./d/a", Typeflag: tar.TypeLink},
+	} {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if h.Size > 0 {
+			tw.Write([]byte("hello"))
+		}
+	}
+	tw.Close()
+
+	dir := t.TempDir()
+	if _, err := extractNative(bytes.NewReader(buf.Bytes()), dir, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, "d/h")); err != nil || string(data) != "hello" {
+		t.Fatalf("hard link reads %q, err=%v", data, err)
+	}
+	if l, err := os.Readlink(filepath.Join(dir, "d/l")); err != nil || l != "a" {
+		t.Fatalf("symlink points to %q, err=%v", l, err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "d")); err != nil || fi.Mode().Perm() != 0750 {
+		t.Fatalf("directory mode is %v, err=%v", fi.Mode(), err)
+	}
+
+	buf.Reset()
+	tw = tar.NewWriter(buf)
+	tw.WriteHeader(&tar.Header{Name: "../evil", Mode: 0644, Typeflag: tar.TypeReg})
+	tw.Close()
+	if _, err := extractNative(bytes.NewReader(buf.Bytes()), dir, nil, false); err == nil {
+		t.Fatal("member leaving the directory was extracted")
+	}
+
+	// members can't go through symlinks earlier members made
+	for name, hdrs := range map[string][]*tar.Header{
+		"file": {
+			{Name: "x", Typeflag: tar.TypeSymlink},
+			{Name: "x/pwned", Mode: 0644, Typeflag: tar.TypeReg},
+		},
+		"dir": {
+			{Name: "x", Typeflag: tar.TypeSymlink},
+			{Name: "x/sub/", Mode: 0755, Typeflag: tar.TypeDir},
+		},
+		"hard link": {
+			{Name: "x", Typeflag: tar.TypeSymlink},
+			{Name: "h", Linkname: "x/secret", Typeflag: tar.TypeLink},
+		},
+		"replaced dir": {
+			{Name: "x/", Mode: 0700, Typeflag: tar.TypeDir},
+			{Name: "x", Typeflag: tar.TypeSymlink},
+		},
+	} {
+		outside := t.TempDir()
+		ioutil.WriteFile(filepath.Join(outside, "secret"), nil, 0644)
+		os.Chmod(outside, 0755)
+		buf.Reset()
+		tw = tar.NewWriter(buf)
+		for _, h := range hdrs {
+			if h.Typeflag == tar.TypeSymlink {
+				h.Linkname = outside
+			}
+			tw.WriteHeader(h)
+		}
+		tw.Close()
+		_, err := extractNative(bytes.NewReader(buf.Bytes()), t.TempDir(), nil, false)
+		if name != "replaced dir" && err == nil {
+			t.Errorf("%s: member through a symlink was extracted", name)
+		}
+		entries, _ := ioutil.ReadDir(outside)
+		if fi, _ := os.Stat(outside); len(entries) != 1 || fi.Mode().Perm() != 0755 {
+			t.Errorf("%s: directory behind the symlink was changed, entries=%d mode=%v", name, len(entries), fi.Mode())
+		}
+	}
+
+	// includes take their subtrees and end reading after them
+	buf.Reset()
+	tw = tar.NewWriter(buf)
+	for _, n := range []string{"srv/", "srv/a", "srv/b/", "srv/b/1", "srv/b/2", "srv/c"} {
+		h := &tar.Header{Name: n, Mode: 0644, Typeflag: tar.TypeReg}
+		if strings.HasSuffix(n, "/") {
+			h.Mode, h.Typeflag = 0755, tar.TypeDir
+		}
+		tw.WriteHeader(h)
+	}
+	tw.Close()
+	f := &memberFilter{}
+	for _, p := range []string{"/srv/b/1", "./srv/b/"} {
+		if err := f.Set(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir = t.TempDir()
+	stopped, err := extractNative(bytes.NewReader(buf.Bytes()), dir, f, true)
+	if err != nil || !stopped || f.extracted != 3 || !reflect.DeepEqual(f.paths, []string{"srv/b"}) {
+		t.Fatalf("stopped=%v extracted=%d paths=%v err=%v", stopped, f.extracted, f.paths, err)
+	}
+	for n, want := range map[string]bool{"srv/b/2": true, "srv/a": false, "srv/c": false} {
+		if _, err := os.Lstat(filepath.Join(dir, n)); (err == nil) != want {
+			t.Errorf("%s extracted=%v, want %v", n, err == nil, want)
+		}
+	}
+}
+
+func TestFindGenerations(t *testing.T) {
+	m := storage.NewMemory()
+	config := &Config{dst: m}
+	ent := &Entry{Name: "etc", Index: true}
+	for i, sum := range []string{"aa", "aa", "bb"} {
+		ts := int64(100 * (i + 1))
+		m.Objects[fmt.Sprintf("etc.tar.gz.%d", ts)] = nil
+		files := []manifestFile{{Name: "./etc/nginx/nginx.conf", SHA256: sum}, {Name: "./etc/hosts", SHA256: "cc"}}
+		if err := writeManifest(m, ent, &manifest{Entry: "etc", Time: ts, Files: files}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.Objects["etc.tar.gz.50"] = nil
+
+	found, err := config.findGenerations(ent, "nginx.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changed []bool
+	for _, r := range found {
+		changed = append(changed, r.Changed)
+	}
+	if want := []bool{true, false, true}; !reflect.DeepEqual(changed, want) {
+		t.Fatalf("found %+v", found)
+	}
+	for _, p := range []string{"/etc/hosts", "etc/*", "hosts"} {
+		if found, err := config.findGenerations(ent, p); err != nil || len(found) != 3 || found[0].Name != "./etc/hosts" {
+			t.Errorf("pattern %s found %+v, err=%v", p, found, err)
+		}
+	}
+	if found, _ := config.findGenerations(ent, "nginx/hosts"); len(found) != 0 {
+		t.Errorf("found %+v", found)
+	}
+}
+
+func TestDiffGenerations(t *testing.T) {
+	m := storage.NewMemory()
+	config := &Config{dst: m}
+	ent := &Entry{Name: "etc", Index: true}
+	gens := [][]manifestFile{
+		{{Name: "./etc/hosts", Size: 10, SHA256: "aa"}, {Name: "./etc/motd", Size: 5, SHA256: "bb"}, {Name: "./etc/passwd", Size: 3, SHA256: "cc"}},
+		{{Name: "./etc/hosts", Size: 10, SHA256: "aa"}, {Name: "./etc/motd", Size: 5, SHA256: "dd"}, {Name: "./etc/group", Size: 7, SHA256: "ee"}},
+	}
+	for i, files := range gens {
+		ts := int64(100 * (i + 1))
+		m.Objects[fmt.Sprintf("etc.tar.gz.%d", ts)] = nil
+		if err := writeManifest(m, ent, &manifest{Entry: "etc", Time: ts, Files: files}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old, err := config.diffSide(ent, "100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cur, err := config.diffSide(ent, "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []diffRecord{
+		{Name: "etc/group", Change: "added", NewSize: 7},
+		{Name: "etc/motd", Change: "modified", OldSize: 5, NewSize: 5},
+		{Name: "etc/passwd", Change: "removed", OldSize: 3},
+	}
+	if got := diffFiles(old, cur); !reflect.DeepEqual(got, want) {
+		t.Fatalf("diff is %+v", got)
+	}
+	// source files aren't hashed, size and mtime decide
+	live := map[string]diffFile{"etc/hosts": {Size: 10}, "etc/motd": {Size: 5}, "etc/group": {Size: 7}}
+	if got := diffFiles(cur, live); len(got) != 0 {
+		t.Errorf("diff against live is %+v", got)
+	}
+}
+
+func TestRestoreCommandFlags(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		err  string
+	}{
+		{[]string{"www"}, "-to or -in-place is required"},
+		{[]string{"-to", "/tmp/x", "-in-place", "www"}, "-in-place and -to are exclusive"},
+		{[]string{"-to", "/tmp/x"}, "entry is required"},
+		{[]string{"-to", "/tmp/x", "-relabel", "chcon", "www"}, "unknown relabel mode"},
+	} {
+		if err := restoreCommand(tc.args); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("args %v: err=%v, want %s", tc.args, err, tc.err)
+		}
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		err   string
+	}{
+		{"yes\n", ""},
+		{"Y\n", ""},
+		{"no\n", "Pruning cancelled"},
+		{"\n", "Pruning cancelled"},
+		{"", "Pruning needs confirmation, pass -yes"},
+	} {
+		var out bytes.Buffer
+		p := &prompter{bufio.NewReader(strings.NewReader(tc.input)), &out}
+		err := p.confirm("Pruning")
+		if (err == nil) != (tc.err == "") || err != nil && err.Error() != tc.err {
+			t.Errorf("answer %q: err=%v, want %q", tc.input, err, tc.err)
+		}
+	}
+
+	var out bytes.Buffer
+	affected := make([]string, _ConfirmPreview+5)
+	for i := range affected {
+		affected[i] = fmt.Sprintf("/srv/file%d", i)
+	}
+	listAffected(&out, "Cleaning", affected)
+	if lines := strings.Split(strings.TrimSpace(out.String()), "\n"); len(lines) != _ConfirmPreview+2 ||
+		lines[0] != "Cleaning affects 25 paths:" || lines[len(lines)-1] != "  ... and 5 more" {
+		t.Errorf("preview is\n%s", out.String())
+	}
+
+	if err := confirm("Restoring", affected[:2], true); err != nil {
+		t.Fatalf("-yes wasn't enough: %v", err)
+	}
+	// go test runs with stdin on /dev/null, a character device
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	defer r.Close()
+	defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+	os.Stdin = r
+	if err := confirm("Restoring", affected[:2], false); err == nil || !strings.Contains(err.Error(), "pass -yes") {
+		t.Fatalf("confirmation without a terminal returned %v", err)
+	}
+
+	// destructive commands delete nothing unconfirmed
+	dst := t.TempDir()
+	for _, n := range []string{"www.tar.gz.100", "www.tar.gz.200", "www.tar.gz.300", "www.tar.gz.50.sha256"} {
+		if err := os.WriteFile(filepath.Join(dst, n), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "tarbu.json")
+	config := fmt.Sprintf(`{"Dst": %q, "KeepGen": 1, "KeepGenIncludesCurrent": true, "Entries": [{"Name": "www", "Path": "/srv/www"}]}`, dst)
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, run := range []func([]string) error{pruneCommand, cleanCommand} {
+		before, _ := filepath.Glob(filepath.Join(dst, "*"))
+		if err := run([]string{"-config", path}); err == nil || !strings.Contains(err.Error(), "pass -yes") {
+			t.Fatalf("unconfirmed run returned %v", err)
+		}
+		if after, _ := filepath.Glob(filepath.Join(dst, "*")); !reflect.DeepEqual(after, before) {
+			t.Fatalf("unconfirmed run deleted %v", before)
+		}
+		if err := run([]string{"-config", path, "-yes"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if left, _ := filepath.Glob(filepath.Join(dst, "*")); len(left) != 1 || filepath.Base(left[0]) != "www.tar.gz.300" {
+		t.Errorf("left %v, want the newest archive", left)
+	}
+}
+
+// openCounter counts the opens of each object of a backend.
+type openCounter struct {
+	storage.Backend
+	opens map[string]int
+}
+
+func (c *openCounter) Open(name string) (io.ReadCloser, error) {
+	c.opens[name]++
+	return c.Backend.Open(name)
+}
+
+func TestRestoreConfirmed(t *testing.T) {
+	archive := makeArchive(t, map[string]string{"./a": "hello", "./b": "x"})
+	for _, tc := range []struct {
+		name     string
+		manifest bool
+		verify   bool
+		include  string
+		corrupt  bool
+		// opens counts the reads of the archive
+		opens       int
+		overwritten []string
+		verified    bool
+		err         string
+	}{
+		{name: "verify lists the members", verify: true, opens: 2, overwritten: []string{"a"}, verified: true},
+		{name: "no verify", opens: 1, overwritten: []string{"srv"}},
+		{name: "manifest", manifest: true, verify: true, opens: 2, overwritten: []string{"a"}},
+		{name: "include", include: "b", opens: 1},
+		{name: "corrupt", verify: true, corrupt: true, opens: 1, err: "archive"},
+	} {
+		m := storage.NewMemory()
+		b := &openCounter{m, map[string]int{}}
+		ent := &Entry{Name: "www", Path: "/srv"}
+		config := &Config{}
+		m.Objects["www.tar.gz.100"] = archive
+		if tc.corrupt {
+			m.Objects["www.tar.gz.100"] = archive[:len(archive)/2]
+		}
+		if tc.manifest {
+			if err := writeManifest(m, ent, &manifest{Entry: "www", Time: 100, Files: []manifestFile{{Name: "./a"}, {Name: "./b"}}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var include *memberFilter
+		if tc.include != "" {
+			include = &memberFilter{}
+			include.Set(tc.include)
+		}
+		to := t.TempDir()
+		for _, n := range []string{"a", "srv"} {
+			os.WriteFile(filepath.Join(to, n), []byte("old"), 0644)
+		}
+
+		overwritten, verified, err := config.overwritten(b, ent, "www.tar.gz.100", to, tc.verify, include)
+		var got []string
+		for _, p := range overwritten {
+			got = append(got, strings.TrimPrefix(p, to+string(filepath.Separator)))
+		}
+		if tc.err == "" && (err != nil || !reflect.DeepEqual(got, tc.overwritten) || verified != tc.verified) {
+			t.Errorf("%s: overwritten=%v verified=%v err=%v", tc.name, got, verified, err)
+		}
+
+		b.opens = map[string]int{}
+		err = config.restoreConfirmed(b, ent, "www.tar.gz.100", to, nil, tc.verify, include, true)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: err=%v, want %s", tc.name, err, tc.err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if n := b.opens["www.tar.gz.100"]; n != tc.opens {
+			t.Errorf("%s: archive read %d times, want %d", tc.name, n, tc.opens)
+		}
+		if data, _ := os.ReadFile(filepath.Join(to, "a")); tc.err == "" && tc.include == "" && string(data) != "hello" {
+			t.Errorf("%s: a reads %q", tc.name, data)
+		}
+	}
+}
@@ -0,0 +1,314 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// _AttestationDir holds the attestations of runs in config.Dst.
+const _AttestationDir = ".tarbu-attestations"
+
+// _AttestationType is the payload type of attestation envelopes.
+const _AttestationType = "application/vnd.tarbu.attestation.v1+json"
+
+// attestationConfig signs a record of every run for compliance evidence.
+type attestationConfig struct {
+	// Key is a file holding the hex encoded ed25519 seed, made by tarbu
+	// attest keygen.
+	Key string
+
+	// key is Key read by isValid
+	key ed25519.PrivateKey
+}
+
+func (config *Config) isAttestationValid() error {
+	a := config.Attestation
+	if a == nil {
+		return nil
+	}
+	if a.Key == "" {
+		return fmt.Errorf("config.Attestation.Key is required")
+	}
+	key, err := readAttestationKey(a.Key)
+	if err != nil {
+		return err
+	}
+	a.key = key
+	return nil
+}
+
+func readAttestationKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading attestation key failed. path=%s err=%s", path, err)
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("attestation key must be %d hex encoded bytes. path=%s", ed25519.SeedSize, path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// attestation is what a run states it did, and under which policy.
+type attestation struct {
+	RunID string
+	Host  string
+	Start time.Time
+	End   time.Time
+	// ConfigSHA256 is the hash of the config as read, which holds
+	// secrets and so isn't included
+	ConfigSHA256 string
+	Entries      []attestedEntry
+}
+
+type attestedEntry struct {
+	Entry string
+	// Status is succeeded, failed or skipped, as in Report
+	Status  string
+	Archive string `json:",omitempty"`
+	Size    int64  `json:",omitempty"`
+	SHA256  string `json:",omitempty"`
+	Error   string `json:",omitempty"`
+	Policy  attestedPolicy
+}
+
+// attestedPolicy is the retention and protection the entry ran with.
+type attestedPolicy struct {
+	Dst         string
+	KeepGen     int
+	KeepDaily   int    `json:",omitempty"`
+	KeepWeekly  int    `json:",omitempty"`
+	KeepMonthly int    `json:",omitempty"`
+	MaxAge      string `json:",omitempty"`
+	Compression string `json:",omitempty"`
+	Encryption  string `json:",omitempty"`
+	Incremental bool   `json:",omitempty"`
+	Repository  bool   `json:",omitempty"`
+	Schedule    string `json:",omitempty"`
+}
+
+// envelope is a DSSE envelope, which in-toto and sigstore tooling reads.
+type envelope struct {
+	PayloadType string              `json:"payloadType"`
+	Payload     string              `json:"payload"`
+	Signatures  []envelopeSignature `json:"signatures"`
+}
+
+type envelopeSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+// pae is the DSSE pre-authentication encoding signatures are made over.
+func pae(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// keyID names a public key in envelopes, the start of its sha256.
+func keyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// attest builds the attestation of a run from its results.
+func (config *Config) attest(results []result, start time.Time) *attestation {
+	host, _ := os.Hostname()
+	sum := sha256.Sum256(config.raw)
+	a := &attestation{
+		RunID:        config.runID,
+		Host:         host,
+		Start:        start,
+		End:          time.Now(),
+		ConfigSHA256: hex.EncodeToString(sum[:]),
+		Entries:      []attestedEntry{},
+	}
+	for _, r := range results {
+		e := attestedEntry{Entry: r.name}
+		switch {
+		case r.skipped != "":
+			e.Status, e.Error = "skipped", r.skipped
+		case r.err != nil:
+			e.Status, e.Error = "failed", r.err.Error()
+		default:
+			e.Status, e.Archive, e.Size, e.SHA256 = "succeeded", r.archive, r.size, r.sha256
+		}
+		if ent := config.findEntry(r.name); ent != nil {
+			e.Policy = attestedPolicy{
+				Dst:         config.entryDst(ent),
+				KeepGen:     config.keepGen(ent),
+				KeepDaily:   ent.KeepDaily,
+				KeepWeekly:  ent.KeepWeekly,
+				KeepMonthly: ent.KeepMonthly,
+				MaxAge:      ent.MaxAge,
+				Compression: ent.Compression,
+				Incremental: ent.Incremental,
+				Repository:  ent.Repository,
+				Schedule:    ent.Schedule,
+			}
+			if config.Encrypt != nil {
+				e.Policy.Encryption = config.Encrypt.Tool
+			}
+		}
+		a.Entries = append(a.Entries, e)
+	}
+	return a
+}
+
+// signAttestation returns a as a signed envelope.
+func signAttestation(a *attestation, key ed25519.PrivateKey) ([]byte, error) {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	env := envelope{
+		PayloadType: _AttestationType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []envelopeSignature{{
+			KeyID: keyID(key.Public().(ed25519.PublicKey)),
+			Sig:   base64.StdEncoding.EncodeToString(ed25519.Sign(key, pae(_AttestationType, payload))),
+		}},
+	}
+	return json.MarshalIndent(env, "", "  ")
+}
+
+// writeAttestation stores the signed attestation of a run in config.Dst.
+func (config *Config) writeAttestation(results []result, start time.Time) error {
+	if config.Attestation == nil {
+		return nil
+	}
+	data, err := signAttestation(config.attest(results, start), config.Attestation.key)
+	if err != nil {
+		return err
+	}
+	b, err := config.backend()
+	if err != nil {
+		return err
+	}
+	b = storage.Sub(b, _AttestationDir)
+	name := fmt.Sprintf("%d.%s.json", start.Unix(), config.runID)
+	if err := b.Put(name, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	logDebug("Wrote attestation", "file", b.Location(name))
+	return nil
+}
+
+// verifyAttestation checks the signature of an envelope with pub and
+// returns the attestation it holds.
+func verifyAttestation(data []byte, pub ed25519.PublicKey) (*attestation, error) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return nil, fmt.Errorf("attestation isn't an envelope. err=%s", err)
+	}
+	if env.PayloadType != _AttestationType {
+		return nil, fmt.Errorf("unknown attestation payload type. type=%s", env.PayloadType)
+	}
+	payload, err := base64.StdEncoding.DecodeString(env.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("attestation payload is broken. err=%s", err)
+	}
+	ok := false
+	for _, s := range env.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err == nil && s.KeyID == keyID(pub) && ed25519.Verify(pub, pae(env.PayloadType, payload), sig) {
+			ok = true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("attestation isn't signed by the key. keyid=%s", keyID(pub))
+	}
+	a := &attestation{}
+	if err := json.Unmarshal(payload, a); err != nil {
+		return nil, fmt.Errorf("attestation payload is broken. err=%s", err)
+	}
+	return a, nil
+}
+
+// attestCommand makes attestation keys and verifies attestations.
+func attestCommand(args []string) error {
+	const usage = "usage: tarbu attest keygen|verify [flags]"
+	if len(args) < 1 {
+		return fmt.Errorf(usage)
+	}
+	switch args[0] {
+	case "keygen":
+		return attestKeygenCommand(args[1:])
+	case "verify":
+		return attestVerifyCommand(args[1:])
+	}
+	return fmt.Errorf(usage)
+}
+
+func attestKeygenCommand(args []string) error {
+	fs := flag.NewFlagSet("attest keygen", flag.ExitOnError)
+	out := fs.String("o", "", "file to write the private key to, the public key goes to <file>.pub")
+	fs.Parse(args)
+
+	if *out == "" {
+		fs.Usage()
+		return fmt.Errorf("-o is required")
+	}
+	if _, err := os.Stat(*out); err == nil {
+		return fmt.Errorf("attestation key already exists. path=%s", *out)
+	}
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*out, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(*out+".pub", []byte(hex.EncodeToString(pub)+"\n"), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote attestation key to %s, public key to %s.pub: keyid=%s\n", *out, *out, keyID(pub))
+	return nil
+}
+
+func attestVerifyCommand(args []string) error {
+	fs := flag.NewFlagSet("attest verify", flag.ExitOnError)
+	pubPath := fs.String("pub", "", "public key file written by attest keygen")
+	asJSON := fs.Bool("json", false, "print the verified attestation as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu attest verify -pub file [-json] <attestation>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *pubPath == "" || fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("-pub and the attestation are required")
+	}
+	data, err := ioutil.ReadFile(*pubPath)
+	if err != nil {
+		return err
+	}
+	pub, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return fmt.Errorf("public key must be %d hex encoded bytes. path=%s", ed25519.PublicKeySize, *pubPath)
+	}
+	if data, err = ioutil.ReadFile(fs.Arg(0)); err != nil {
+		return err
+	}
+	a, err := verifyAttestation(data, pub)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(os.Stdout, a)
+	}
+	printSuccess("Attestation verified: run=%s host=%s start=%s entries=%d keyid=%s", a.RunID, a.Host, a.Start.Format(time.RFC3339), len(a.Entries), keyID(pub))
+	return nil
+}
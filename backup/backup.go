@@ -0,0 +1,1677 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/archiver"
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// _SecurityAttrOpts makes tar store and restore file capabilities and
+// SELinux labels.
+var _SecurityAttrOpts = []string{"--xattrs", "--xattrs-include=security.capability", "--selinux"}
+
+// _ExtendedAttrOpts makes tar restore all extended attributes and POSIX
+// ACLs.
+var _ExtendedAttrOpts = []string{"--xattrs", "--xattrs-include=*", "--acls", "--selinux"}
+
+// Entry is what a Config archives, files, directories or a database
+// dump. Its exported fields are the keys of an entry of the JSON config.
+type Entry struct {
+	Name string
+	Path string
+	// Dst and KeepGen override config.Dst and config.KeepGen for the
+	// entry, e.g. to keep fewer generations of a large dataset on a disk
+	// of its own. The run history stays in config.Dst.
+	Dst     string `json:",omitempty"`
+	KeepGen int    `json:",omitempty"`
+	// Paths archives several trees into the entry's archive instead of
+	// Path, e.g. ["/etc", "/home/*/.config"]. Glob patterns are expanded
+	// every run and members keep their absolute names.
+	Paths []string `json:",omitempty"`
+	// Priority orders the entries under config.Scheduling "priority",
+	// higher first. Entries of the same priority keep the config order.
+	Priority int `json:",omitempty"`
+	// Suffix replaces the compression suffix between the name and the
+	// timestamp of the entry's legacy archive names, e.g. ".tgz-" names
+	// them www.tgz-1700000000. It can't end with a digit, which would
+	// run into the timestamp.
+	Suffix string `json:",omitempty"`
+	// Compression is "gzip", the default, "zstd", "xz", "bzip2" or
+	// "none", naming archives .tar.gz., .tar.zst. and so on unless
+	// Suffix is set. CompressionLevel is passed to the compressor, zero
+	// takes its default. Set them in config.Defaults for every entry.
+	Compression      string `json:",omitempty"`
+	CompressionLevel int    `json:",omitempty"`
+	// CompressionWorkers is the number of threads of zstd and xz, their
+	// default when zero.
+	CompressionWorkers int `json:",omitempty"`
+	// ArchiveWorkers archives with this many workers, for trees of
+	// millions of small files: gzip compresses blocks in parallel like
+	// pigz, zstd and xz run as many threads, and as many goroutines read
+	// files ahead. ReadWorkers and CompressionWorkers win where set.
+	ArchiveWorkers int `json:",omitempty"`
+	// HashCheck hashes the sources that are regular files before and
+	// after archiving, as read from the snapshot if any, to detect
+	// modification during backup.
+	HashCheck bool `json:",omitempty"`
+	// VerifyAfterWrite reads every archive back once written, through
+	// decompression and decryption to the last member, and compares its
+	// files and their sizes with what was archived. A failed archive is
+	// deleted before retention runs. Encrypted archives are decrypted
+	// with config.Encrypt.Identity or the gpg keyring.
+	VerifyAfterWrite bool `json:",omitempty"`
+	// SpecialFiles is the policy for sockets, FIFOs and device nodes,
+	// one of "skip", "warn" or "fail". Empty archives FIFOs and device
+	// nodes; sockets are always skipped.
+	SpecialFiles string `json:",omitempty"`
+	// ChangedFiles is the policy for files that vanish or change while
+	// archived, one of "ignore", "warn", "retry" or "fail", the default.
+	// retry reads small files once more and fails if they change again.
+	ChangedFiles string `json:",omitempty"`
+	// ExcludeVCS skips .git, .hg, .svn and other VCS directories.
+	ExcludeVCS bool `json:",omitempty"`
+	// MaxFileSize, e.g. "4G", leaves out larger regular files, such as
+	// VM images in home directories.
+	MaxFileSize string `json:",omitempty"`
+	// SkipOlderThan, e.g. "365d", leaves out files last modified longer
+	// ago. Directories are kept.
+	SkipOlderThan string `json:",omitempty"`
+	// SkipDevices leaves out block and character devices, SkipSockets
+	// reports the sockets that are never archived among the files left
+	// out. What filters leave out is counted in the summary.
+	SkipDevices bool `json:",omitempty"`
+	SkipSockets bool `json:",omitempty"`
+	// FollowSymlinks archives what symbolic links point to, walking
+	// into linked directories, instead of the links.
+	FollowSymlinks bool `json:",omitempty"`
+	// Exclude lists gitignore style patterns of paths below Path to
+	// skip, e.g. "node_modules/", "*.log" or "/cache".
+	Exclude []string `json:",omitempty"`
+	// ReadWorkers reads small files ahead with this many goroutines,
+	// for trees of many small files on fast disks.
+	ReadWorkers int `json:",omitempty"`
+	// InodeOrder reads each directory in inode order to reduce seeking
+	// on spinning disks. Archive members are then not sorted by name.
+	InodeOrder bool `json:",omitempty"`
+	// PageCache is "keep", the default, "drop" to drop the cached pages
+	// of files once archived, or "direct" to also read large files with
+	// O_DIRECT, so backing up hundreds of GB doesn't evict the page cache
+	// of the workload. Linux only.
+	PageCache string `json:",omitempty"`
+	// MaxReadMBps and MaxWriteMBps limit the entry instead of the limits
+	// of the config, e.g. higher for a large media tree than for the
+	// rest. The entry doesn't count against the config limits then.
+	MaxReadMBps  float64 `json:",omitempty"`
+	MaxWriteMBps float64 `json:",omitempty"`
+	// Incremental archives only the files changed since the last full
+	// backup, by size and mtime. Every FullEvery runs, 7 by default, a
+	// full backup is taken again.
+	Incremental bool `json:",omitempty"`
+	FullEvery   int  `json:",omitempty"`
+	// Index writes the list of the archived files with their sizes,
+	// mtimes and hashes next to each archive, as incremental entries
+	// do, so tarbu find can tell which generations hold a file without
+	// extracting anything.
+	Index bool `json:",omitempty"`
+	// Append is experimental. Each run copies the newest archive and
+	// appends the files new or changed since, like tar -u, then deletes
+	// the copied archive, so the source is barely read. Every FullEvery
+	// runs a fresh archive is started. Deleted files stay in the archive
+	// until then, so it suits append-only trees like log directories.
+	Append bool `json:",omitempty"`
+	// Repository backs the entry up into a content-addressed repository
+	// under Dst instead of archives: files are cut into chunks stored
+	// once, and each run writes a snapshot naming its chunks, so mostly
+	// unchanged trees take little space per run. Snapshots beyond KeepGen
+	// are forgotten by runs, tarbu repo prune deletes the chunks no
+	// snapshot names anymore. tarbu repo restore restores a snapshot.
+	Repository bool `json:",omitempty"`
+	// SplitSize, e.g. "4G", writes archives in parts of up to so many
+	// bytes, <archive>.part001, <archive>.part002 and so on, for FAT
+	// drives, optical media or object stores limiting the object size.
+	// Retention, restore and listings take a part set as one generation.
+	SplitSize string `json:",omitempty"`
+	// KeepDaily, KeepWeekly and KeepMonthly keep the newest generation of
+	// each of the last so many days, ISO weeks and months having one, on
+	// top of the newest config.KeepGen. MaxAge, e.g. "90d", deletes older
+	// generations whatever the other rules say. The newest generation is
+	// always kept. Set, they take precedence over RetentionHook and
+	// RetentionExpr for the entry.
+	KeepDaily   int    `json:",omitempty"`
+	KeepWeekly  int    `json:",omitempty"`
+	KeepMonthly int    `json:",omitempty"`
+	MaxAge      string `json:",omitempty"`
+	// SecurityAttrs records file capabilities and SELinux labels.
+	SecurityAttrs bool `json:",omitempty"`
+	// PreserveExtended records all extended attributes and POSIX ACLs,
+	// which restore applies again. Hard links are always archived as
+	// links. Linux only.
+	PreserveExtended bool `json:",omitempty"`
+	// Freeze is a mountpoint frozen with fsfreeze while archiving.
+	// Quiesce and Resume are commands run before and after it.
+	Freeze  string   `json:",omitempty"`
+	Quiesce []string `json:",omitempty"`
+	Resume  []string `json:",omitempty"`
+	// Snapshot archives the source from a snapshot of its LVM, Btrfs or
+	// ZFS volume, taken while quiesced. See volumeSnapshot.
+	Snapshot *volumeSnapshot `json:",omitempty"`
+	// Heavy entries are subject to config.OnBattery.
+	Heavy bool `json:",omitempty"`
+	// Naming is "timestamp", the default, or "numbered" for logrotate
+	// style names: <suffix>1 is the newest archive, renamed to 2 by the
+	// next run and so on up to KeepGen. restore -ts takes the number.
+	Naming string `json:",omitempty"`
+	// NameTemplate names timestamped archives instead of
+	// <name><suffix><unix>, e.g. "{name}-{date:2006-01-02T150405}-{seq}.tar.gz",
+	// see nameTemplate. Archives named before it was set are still
+	// listed, restored and pruned.
+	NameTemplate string `json:",omitempty"`
+	// Schedule is a cron expression, e.g. "0 3 * * *", of when tarbu
+	// daemon backs the entry up, in config.TimeZone. Runs without the
+	// daemon ignore it and back up every entry.
+	Schedule string `json:",omitempty"`
+	// PreCmd runs before the entry is dumped or archived, PostCmd after
+	// it was archived or failed to, with TARBU_STATUS set to succeeded
+	// or failed. Both are killed after CmdTimeout. PreCmdFailure is
+	// "fail", the default, "skip" to skip the entry, or "abort" to also
+	// skip the entries not started yet. A failing PostCmd is a warning.
+	PreCmd        []string `json:",omitempty"`
+	PostCmd       []string `json:",omitempty"`
+	PreCmdFailure string   `json:",omitempty"`
+	CmdTimeout    string   `json:",omitempty"`
+	// Timeout fails the entry when archiving it takes longer, e.g. "2h",
+	// so a hung filesystem doesn't hold up the run forever.
+	Timeout string `json:",omitempty"`
+	// Retries archives the entry again after failures that may pass, up
+	// to so many times. The first retry waits RetryDelay, 30s by
+	// default, every further one twice as long as the one before.
+	Retries    int    `json:",omitempty"`
+	RetryDelay string `json:",omitempty"`
+
+	// Type selects a dumper producing the data to archive instead of
+	// reading Path, see dumpers.
+	Type string `json:",omitempty"`
+	// URI is the connection string of typed entries, URIFile a file
+	// holding it. Args are passed on to the dump tool.
+	URI     string   `json:",omitempty"`
+	URIFile string   `json:",omitempty"`
+	Args    []string `json:",omitempty"`
+	// SchemaOnly dumps the schema of a postgres or ldap entry without
+	// the data. The archives go under the sub-name <Name>.schema with
+	// their own retention, so frequent schema dumps can share Dst with
+	// the full dumps of the same database.
+	SchemaOnly bool `json:",omitempty"`
+
+	// exclude is Exclude compiled by isValid
+	exclude *archiver.Excluder
+	// maxAge is MaxAge parsed by isValid
+	maxAge time.Duration
+	// maxFileSize and skipOlderThan are MaxFileSize and SkipOlderThan
+	// parsed by isValid
+	maxFileSize   int64
+	skipOlderThan time.Duration
+	// relative archives the contents of Path with names relative to it
+	relative bool
+	// pvc is set on discovered k8s-pvc entries
+	pvc *pvcSource
+	// cmdTimeout is CmdTimeout parsed by isValid
+	cmdTimeout time.Duration
+	// timeout is Timeout parsed by isValid
+	timeout time.Duration
+	// retryDelay is RetryDelay parsed by isValid
+	retryDelay time.Duration
+	// compressionWorkers is CompressionWorkers or the one of the config
+	compressionWorkers int
+	// archiveWorkers is ArchiveWorkers or the one of the config
+	archiveWorkers int
+	// cron is Schedule parsed by isValid
+	cron *cronSchedule
+	// splitSize is SplitSize parsed by isValid
+	splitSize int64
+	// nameTemplate is NameTemplate parsed by parseConfig
+	nameTemplate *nameTemplate
+	// readLimit and writeLimit throttle the entry, nil when unlimited
+	readLimit  *throttle
+	writeLimit *throttle
+}
+
+// suffix returns the archive suffix placed between Name and the timestamp.
+func (ent *Entry) suffix() string {
+	if ent.Suffix == "" {
+		return ent.codec().suffix
+	}
+	return ent.Suffix
+}
+
+// Config is a tarbu config, as LoadConfig reads it from a file or as a
+// program embedding tarbu builds it, see Prepare. Its exported fields
+// are the keys of the JSON config.
+type Config struct {
+	// Dst is a directory, or a s3://, sftp://, ssh://, webdav:// or
+	// webdavs:// URL. ssh:// needs tarbu on the host, which stores the
+	// archives through tarbu receive. A profile query parameter names
+	// the Credentials to use. In versioned S3 buckets retention leaves
+	// delete markers, with versions=purge it deletes every version, see
+	// tarbu purge-versions.
+	Dst string
+	// KeepGen is the number of generations retention keeps, counting the
+	// archive just written. With KeepGenIncludesCurrent false, KeepGen
+	// older generations are kept on top of it.
+	KeepGen                int
+	KeepGenIncludesCurrent *bool `json:",omitempty"`
+	// FutureArchives orders archives dated after now, left by a clock
+	// that was ahead: "ignore", the default, neither counts nor deletes
+	// them, "oldest" deletes them first and "newest" trusts their date.
+	// They are warned about either way.
+	FutureArchives string `json:",omitempty"`
+	// PerEntrySubdir puts the archives of each entry in a directory of
+	// Dst named after it, the run history stays at the top.
+	PerEntrySubdir bool `json:",omitempty"`
+	// Scheduling is the order entries start in: "config", the default,
+	// the order of config.Entries, "priority" the highest entry Priority
+	// first, and "largest" the most bytes first, counted before the run.
+	Scheduling string `json:",omitempty"`
+	// MaxConcurrent is the number of entries archived at once, GOMAXPROCS
+	// by default. Scheduling decides which entries go first.
+	MaxConcurrent int `json:",omitempty"`
+	// PreScan counts files and bytes of every entry before archiving.
+	PreScan bool `json:",omitempty"`
+	// RetentionHook is a command deciding which generations to keep
+	// instead of KeepGen, see expiredByHook.
+	RetentionHook []string `json:",omitempty"`
+	// RetentionExpr is evaluated per generation, which is kept when it
+	// is true. See retentionExpr for the syntax.
+	RetentionExpr string `json:",omitempty"`
+	// TrashRetention, e.g. "7d", moves the generations retention and
+	// tarbu prune delete to the .trash directory of their destination,
+	// which they are deleted from once trashed for so long. Archives are
+	// restored from there by moving them back and dropping the time
+	// prefix of their name.
+	TrashRetention string `json:",omitempty"`
+	// StateDir keeps the run history in a local directory instead of
+	// Dst, e.g. when Dst is an append-only bucket. StaleAfter, e.g.
+	// "26h", is how old the last successful backup of an entry may be
+	// before tarbu status flags it.
+	StateDir   string `json:",omitempty"`
+	StaleAfter string `json:",omitempty"`
+	// Replicas are further destinations every new archive is copied to,
+	// see replicaConfig and tarbu sync.
+	Replicas []*replicaConfig `json:",omitempty"`
+	// ErrorReporting sends panics and internal errors to trackers.
+	ErrorReporting *errorReporting `json:",omitempty"`
+	// Notify sends the summary of each run by email, to webhooks, to
+	// Slack or through the transports registered with registerNotifier.
+	Notify []*notifyConfig `json:",omitempty"`
+	// Attestation writes a signed record of every run, its entries,
+	// archive hashes, destinations and retention policy, to
+	// .tarbu-attestations in Dst, for compliance evidence.
+	Attestation *attestationConfig `json:",omitempty"`
+	// MetricsFile is rewritten after every run with Prometheus metrics
+	// of the entries, for the node_exporter textfile collector.
+	MetricsFile string `json:",omitempty"`
+	// OnBattery is "skip" to skip heavy entries on battery power, or
+	// "wait" to wait up to BatteryWait for AC power before skipping.
+	OnBattery   string `json:",omitempty"`
+	BatteryWait string `json:",omitempty"`
+	// TmpDir holds staged dumps and other temporary files instead of the
+	// OS default. Staging fails when it has less than TmpMinFree free.
+	TmpDir     string `json:",omitempty"`
+	TmpMinFree string `json:",omitempty"`
+	// UploadRetries tries failed uploads to remote destinations again,
+	// up to so many times, from a copy of the archive in TmpDir instead
+	// of archiving again like entry Retries. The first retry waits
+	// UploadRetryDelay, 30s by default, each one after twice as long.
+	UploadRetries    int    `json:",omitempty"`
+	UploadRetryDelay string `json:",omitempty"`
+	// Spool keeps those copies in a local directory instead of TmpDir
+	// until they are uploaded, also without UploadRetries. Uploads a
+	// crash or a reboot stopped carry on with the next run, S3 ones from
+	// the last part uploaded. SpoolUpload is when archives are uploaded
+	// from there: "" before their entry finishes, "async" while the next
+	// entries run, the run waiting for them before it ends, or "flush"
+	// by tarbu flush only.
+	Spool       string `json:",omitempty"`
+	SpoolUpload string `json:",omitempty"`
+	// ReachableWait is how long runs wait for remote destinations that
+	// don't answer, a VPN being down say, e.g. 15m. Those still
+	// unreachable then keep the archives in the Spool for a later run or
+	// tarbu flush, and fail the run without one.
+	ReachableWait string `json:",omitempty"`
+	// DstMinFree fails runs early when Dst has less space left, where
+	// the backend tells. S3 doesn't.
+	DstMinFree string `json:",omitempty"`
+	// MinFreeSpace checks the destination before every entry: it must
+	// have room for the estimated archive, the largest generation of the
+	// entry or else the size of its files, and MinFreeSpace left over.
+	// Entries archived at the same time count each other's estimates.
+	MinFreeSpace string `json:",omitempty"`
+	// BufferSize is the read and write buffer of each entry, default 64K.
+	BufferSize string `json:",omitempty"`
+	// ReadWorkers, CompressionWorkers and ArchiveWorkers apply to the
+	// entries not setting their own, CompressionWorkers to zstd and xz
+	// entries only.
+	ReadWorkers        int `json:",omitempty"`
+	CompressionWorkers int `json:",omitempty"`
+	ArchiveWorkers     int `json:",omitempty"`
+	// MaxMemory bounds the buffer and compressor memory of entries
+	// archived concurrently. Entries wait for memory instead of all
+	// starting at once.
+	MaxMemory string `json:",omitempty"`
+	// MaxReadMBps and MaxWriteMBps limit how fast a run reads sources
+	// and writes archives, in MiB/s shared by all entries, so backups of
+	// busy hosts leave the application disk bandwidth. Entries can set
+	// limits of their own. Zero doesn't limit.
+	MaxReadMBps  float64 `json:",omitempty"`
+	MaxWriteMBps float64 `json:",omitempty"`
+	// Lock keeps runs from overlapping: "dst", the default, lets one run
+	// at a time back up to Dst, "entry" one run at a time back up each
+	// entry, and "none" doesn't lock. Locks are flocks on files of
+	// LockDir, the OS temporary directory by default, so runs of other
+	// hosts sharing a remote Dst aren't seen.
+	Lock    string `json:",omitempty"`
+	LockDir string `json:",omitempty"`
+	// Lease claims each entry with an object in Dst while it is backed
+	// up and pruned, so hosts sharing Dst with the same entry names take
+	// turns. Leases of hosts that died expire after LeaseTTL, 10m by
+	// default, and are renewed meanwhile. -wait applies to them too.
+	Lease    bool   `json:",omitempty"`
+	LeaseTTL string `json:",omitempty"`
+	// CatchUp makes tarbu daemon back up, like anacron, the entries
+	// whose scheduled run was missed while it wasn't running, judged by
+	// the run history. They start CatchUpDelay, 1m by default, after the
+	// daemon plus up to CatchUpJitter more, so booting hosts settle and
+	// hosts sharing Dst don't all start at once.
+	CatchUp       bool   `json:",omitempty"`
+	CatchUpDelay  string `json:",omitempty"`
+	CatchUpJitter string `json:",omitempty"`
+	// VerifySample makes tarbu daemon re-verify a random share of the
+	// older generations, weekly by default.
+	VerifySample *verifySample `json:",omitempty"`
+	// SelfBackup adds an entry archiving the config itself, with the
+	// catalog, key metadata and StateDir run history, to Dst and the Dst
+	// of every entry. With Encrypt it is encrypted like the others.
+	SelfBackup bool `json:",omitempty"`
+	// ReadOnly refuses anything writing to Dst, for audit invocations
+	// limited to listing and reporting.
+	ReadOnly bool `json:",omitempty"`
+	// TimeZone is the IANA zone, e.g. "UTC" or "Europe/Berlin", times are
+	// shown in by list, stats and report. The local zone by default.
+	TimeZone string `json:",omitempty"`
+	// ContainerDiscovery adds entries for labeled volumes and containers.
+	ContainerDiscovery *containerDiscovery `json:",omitempty"`
+	// Kubernetes adds a snapshot based entry for every selected PVC.
+	Kubernetes *kubernetesDiscovery `json:",omitempty"`
+	// Credentials are named profiles of remote destination secrets.
+	Credentials map[string]*storage.Credentials `json:",omitempty"`
+	// Encrypt encrypts archives with age or gpg.
+	Encrypt *encryptConfig `json:",omitempty"`
+	// Defaults holds entry fields applied to every entry and template.
+	Defaults  json.RawMessage  `json:",omitempty"`
+	Templates []*entryTemplate `json:",omitempty"`
+	Entries   []*Entry
+
+	// raw is the config as read
+	raw []byte
+	// prepared is set once the config is expanded
+	prepared bool
+	// discovered is set once discover added its entries
+	discovered bool
+	// retentionExpr is RetentionExpr compiled by isValid
+	retentionExpr *retentionExpr
+	// staleAfter is StaleAfter parsed by isValid
+	staleAfter time.Duration
+	// trashRetention is TrashRetention parsed by isValid
+	trashRetention time.Duration
+	// batteryWait is BatteryWait parsed by isValid
+	batteryWait time.Duration
+	// tmpMinFree is TmpMinFree parsed by isValid
+	tmpMinFree int64
+	// uploadRetryDelay is UploadRetryDelay parsed by isUploadValid
+	uploadRetryDelay time.Duration
+	// queued wakes up the uploads of SpoolUpload async
+	queued chan struct{}
+	// reachableWait is ReachableWait parsed by isDstWritable
+	reachableWait time.Duration
+	// dstMinFree is DstMinFree parsed by isValid
+	dstMinFree int64
+	// space holds the free space estimates of the run, nil without
+	// MinFreeSpace
+	space *spaceLedger
+	// bufferSize is BufferSize parsed by isValid
+	bufferSize int
+	// memory is the MaxMemory budget, nil when unbounded
+	memory *memoryBudget
+	// readLimit and writeLimit throttle the whole run, nil when unlimited
+	readLimit  *throttle
+	writeLimit *throttle
+	// profiler is set up by readConfig for the backup command
+	profiler *profiler
+	// runID identifies the backup run, see runID
+	runID string
+	// dst is the backend of Dst, opened by backend
+	dst storage.Backend
+	// entryDsts are the backends of the Dst of entries, see dstBackend
+	entryDsts map[string]storage.Backend
+	// location is TimeZone loaded by loadConfig, time.Local if nil
+	location *time.Location
+	// clock names archives and ages generations, the system clock if nil
+	clock clock
+	// aborted is set atomically when a PreCmd aborts the run
+	aborted int32
+	// stream receives the archive instead of Dst, see backupCommand
+	stream io.Writer
+	// dryRun plans the run without writing, see plan
+	dryRun bool
+	// progress is set up by readConfig for the backup command
+	progress *progress
+	// summaryPath is the -summary-json file, - for stdout
+	summaryPath string
+	// lockWait is how long -wait waits for a lock held by another run
+	lockWait time.Duration
+	// ctx is done when the run is interrupted, see cancelOnSignal, and
+	// signal is the signal that interrupted it
+	ctx    context.Context
+	signal os.Signal
+	// leaseTTL is LeaseTTL parsed by isValid
+	leaseTTL time.Duration
+	// catchUpDelay and catchUpJitter are CatchUpDelay and CatchUpJitter
+	// parsed by isValid
+	catchUpDelay  time.Duration
+	catchUpJitter time.Duration
+}
+
+func (config *Config) isValid() error {
+	if err := config.isDstWritable(); err != nil {
+		return err
+	}
+
+	if err := config.isNameDuplicated(); err != nil {
+		return err
+	}
+
+	if err := config.isSubdirValid(); err != nil {
+		return err
+	}
+
+	if err := config.isSchedulingValid(); err != nil {
+		return err
+	}
+
+	if err := config.isScheduleValid(); err != nil {
+		return err
+	}
+
+	if err := config.isSuffixValid(); err != nil {
+		return err
+	}
+
+	if err := config.isSpecialFilesValid(); err != nil {
+		return err
+	}
+
+	if err := config.isFiltersValid(); err != nil {
+		return err
+	}
+
+	if err := config.isRetentionValid(); err != nil {
+		return err
+	}
+
+	if err := config.isHistoryValid(); err != nil {
+		return err
+	}
+
+	if err := config.isVerifySampleValid(); err != nil {
+		return err
+	}
+
+	if err := config.isErrorReportingValid(); err != nil {
+		return err
+	}
+
+	if err := config.isNotifyValid(); err != nil {
+		return err
+	}
+
+	if err := config.isAttestationValid(); err != nil {
+		return err
+	}
+
+	if err := config.isOnBatteryValid(); err != nil {
+		return err
+	}
+
+	if err := config.isTypeValid(); err != nil {
+		return err
+	}
+
+	if err := config.isNamingValid(); err != nil {
+		return err
+	}
+
+	if err := config.isAppendValid(); err != nil {
+		return err
+	}
+
+	if err := config.isRepositoryValid(); err != nil {
+		return err
+	}
+
+	if err := config.isSplitValid(); err != nil {
+		return err
+	}
+
+	if err := config.isPathsValid(); err != nil {
+		return err
+	}
+
+	if err := config.isFreezeValid(); err != nil {
+		return err
+	}
+
+	if err := config.isVolumeSnapshotValid(); err != nil {
+		return err
+	}
+
+	if err := config.isEncryptValid(); err != nil {
+		return err
+	}
+
+	if err := config.isIncrementalValid(); err != nil {
+		return err
+	}
+
+	if err := config.isLockValid(); err != nil {
+		return err
+	}
+
+	if err := config.isLeaseValid(); err != nil {
+		return err
+	}
+
+	if err := config.isTmpDirValid(); err != nil {
+		return err
+	}
+
+	if err := config.isMinFreeSpaceValid(); err != nil {
+		return err
+	}
+
+	if err := config.isMemoryValid(); err != nil {
+		return err
+	}
+
+	if err := config.isThrottleValid(); err != nil {
+		return err
+	}
+
+	if err := config.isExcludeValid(); err != nil {
+		return err
+	}
+
+	if err := config.isCmdValid(); err != nil {
+		return err
+	}
+
+	if err := config.isTimeoutValid(); err != nil {
+		return err
+	}
+
+	if err := config.isRetryValid(); err != nil {
+		return err
+	}
+
+	if err := config.isCompressionValid(); err != nil {
+		return err
+	}
+
+	if err := config.isReplicasValid(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// isDstWritable checks config.Dst and the Dst of every entry before
+// anything is uploaded: remote backends must answer a listing and take
+// a probe object, and every backend telling its free space must have
+// DstMinFree left.
+func (config *Config) isDstWritable() error {
+	if config.DstMinFree != "" {
+		n, err := parseSize(config.DstMinFree)
+		if err != nil {
+			return fmt.Errorf("config.DstMinFree is invalid. err=%s", err)
+		}
+		config.dstMinFree = n
+	}
+	if config.ReachableWait != "" {
+		d, err := parseDuration(config.ReachableWait)
+		if err != nil || d < 0 {
+			return fmt.Errorf("config.ReachableWait is invalid. reachable_wait=%s", config.ReachableWait)
+		}
+		config.reachableWait = d
+	}
+	for _, dst := range config.destinations() {
+		if err := config.checkDst(dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (config *Config) checkDst(dst string) error {
+	if !storage.IsRemote(dst) {
+		if err := isDirWritable("config.Dst", dst); err != nil {
+			return err
+		}
+	}
+	b, err := config.dstBackend(dst)
+	if err != nil {
+		return err
+	}
+	if storage.IsRemote(dst) {
+		if err := config.reachDst(dst, b); err != nil {
+			var ie *InterruptedError
+			if errors.As(err, &ie) {
+				return err
+			}
+			u, ok := b.(*storage.Uploader)
+			if !ok || u.GoOffline() != nil {
+				return fmt.Errorf("config.Dst can't be listed. dst=%s err=%s", dst, err)
+			}
+			printWarning("config.Dst is unreachable, archives wait in the spool: dst=%s spool=%s err=%s", dst, config.Spool, err)
+			return nil
+		}
+		if !config.isReadOnly() && !config.dryRun {
+			probe := fmt.Sprintf(".tarbu-probe.%d", os.Getpid())
+			if err := b.Put(probe, strings.NewReader("")); err != nil {
+				return fmt.Errorf("config.Dst isn't writable. dst=%s err=%s", dst, err)
+			}
+			if err := b.Delete(probe); err != nil {
+				return fmt.Errorf("config.Dst refuses deletes. dst=%s err=%s", dst, err)
+			}
+			if u, ok := b.(*storage.Uploader); ok && config.SpoolUpload != "flush" {
+				flushUploads(dst, u)
+			}
+		}
+	}
+	if config.dstMinFree == 0 {
+		return nil
+	}
+	free, err := storage.Free(b)
+	if err != nil {
+		return fmt.Errorf("config.Dst free space is unknown. dst=%s err=%s", dst, err)
+	}
+	if free >= 0 && free < config.dstMinFree {
+		return fmt.Errorf("not enough free space in config.Dst. dst=%s free=%d min=%d", dst, free, config.dstMinFree)
+	}
+	return nil
+}
+
+// _ReachablePoll is how often reachDst lists a destination again.
+const _ReachablePoll = 30 * time.Second
+
+// reachDst lists the remote destination b until it answers or
+// ReachableWait is over, returning the last error then.
+func (config *Config) reachDst(dst string, b storage.Backend) error {
+	deadline := time.Now().Add(config.reachableWait)
+	for {
+		_, err := b.List("")
+		left := time.Until(deadline)
+		if err == nil || left <= 0 {
+			return err
+		}
+		wait := _ReachablePoll
+		if wait > left {
+			wait = left
+		}
+		logs.event(levelWarn, _ColorYellow, "Destination unreachable", "dst", dst, "retry_in", wait, "err", err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-config.runContext().Done():
+			timer.Stop()
+			return &InterruptedError{Signal: config.signal}
+		}
+	}
+}
+
+func isDirWritable(what, dir string) error {
+	var err error
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not directory. dir=%s", what, dir)
+	}
+
+	err = dirWritable(dir)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (config *Config) isTmpDirValid() error {
+	if config.TmpDir != "" {
+		if err := isDirWritable("config.TmpDir", config.TmpDir); err != nil {
+			return err
+		}
+	}
+	if config.TmpMinFree != "" {
+		n, err := parseSize(config.TmpMinFree)
+		if err != nil {
+			return fmt.Errorf("config.TmpMinFree is invalid. err=%s", err)
+		}
+		config.tmpMinFree = n
+	}
+	return config.checkTmpFree()
+}
+
+// tmpDir returns the directory for temporary files.
+func (config *Config) tmpDir() string {
+	if config.TmpDir != "" {
+		return config.TmpDir
+	}
+	return os.TempDir()
+}
+
+// checkTmpFree fails when tmpDir has less than TmpMinFree available.
+func (config *Config) checkTmpFree() error {
+	if config.tmpMinFree == 0 {
+		return nil
+	}
+	free, err := freeSpace(config.tmpDir())
+	if err != nil {
+		return err
+	}
+	if free < config.tmpMinFree {
+		return fmt.Errorf("not enough free space in temporary directory. dir=%s free=%d min=%d", config.tmpDir(), free, config.tmpMinFree)
+	}
+	return nil
+}
+
+func (config *Config) isNameDuplicated() error {
+	m := map[string]struct{}{}
+
+	for _, e := range config.Entries {
+		_, exists := m[e.Name]
+		if exists {
+			return fmt.Errorf("duplicated name found in config.Entries. name=%s", e.Name)
+		}
+		m[e.Name] = struct{}{}
+	}
+
+	return nil
+}
+
+// isSubdirValid checks entry names make directories of Dst with
+// PerEntrySubdir.
+func (config *Config) isSubdirValid() error {
+	if !config.PerEntrySubdir {
+		return nil
+	}
+	for _, e := range config.Entries {
+		if e.Name == "" || e.Name == "." || e.Name == ".." || strings.ContainsAny(e.Name, `/\`) {
+			return fmt.Errorf("entry name is not a directory name. name=%s", e.Name)
+		}
+	}
+	return nil
+}
+
+func (config *Config) isSuffixValid() error {
+	for _, e := range config.Entries {
+		if strings.ContainsRune(e.Suffix, filepath.Separator) {
+			return fmt.Errorf("entry suffix must not contain path separator. name=%s suffix=%s", e.Name, e.Suffix)
+		}
+		// a trailing digit would run into the timestamp
+		if n := len(e.Suffix); n > 0 && e.Suffix[n-1] >= '0' && e.Suffix[n-1] <= '9' {
+			return fmt.Errorf("entry suffix must not end with digit. name=%s suffix=%s", e.Name, e.Suffix)
+		}
+	}
+	return nil
+}
+
+// archiveOptions are the archiver options of ent before the callbacks
+// of the run, which tarbu files lists with too.
+func (config *Config) archiveOptions(ent *Entry) *archiver.Options {
+	opts := &archiver.Options{
+		BufferSize:     config.bufferSize,
+		ReadWorkers:    config.readWorkers(ent),
+		InodeOrder:     ent.InodeOrder,
+		Relative:       ent.relative,
+		ExcludeVCS:     ent.ExcludeVCS,
+		Exclude:        ent.exclude,
+		SecurityAttrs:  ent.SecurityAttrs,
+		Extended:       ent.PreserveExtended,
+		NoCompress:     ent.codec().tool != "" || ent.Compression == "none",
+		DropCache:      ent.PageCache == "drop",
+		DirectIO:       ent.PageCache == "direct",
+		Read:           config.readThrottle(ent),
+		Skip:           config.skipper(ent),
+		FollowSymlinks: ent.FollowSymlinks,
+	}
+	if ent.codec().tool == "" {
+		opts.Level = ent.CompressionLevel
+	}
+	if !opts.NoCompress {
+		opts.GzipWorkers = ent.archiveWorkers
+	}
+	return opts
+}
+
+// readWorkers is the ReadWorkers of ent or else of the config, or else
+// ArchiveWorkers.
+func (config *Config) readWorkers(ent *Entry) int {
+	if ent.ReadWorkers != 0 {
+		return ent.ReadWorkers
+	}
+	if config.ReadWorkers != 0 {
+		return config.ReadWorkers
+	}
+	return ent.archiveWorkers
+}
+
+func (config *Config) isExcludeValid() error {
+	for _, e := range config.Entries {
+		if len(e.Exclude) == 0 {
+			continue
+		}
+		ex, err := archiver.NewExcluder(e.Exclude)
+		if err != nil {
+			return fmt.Errorf("entry exclude is invalid. name=%s err=%s", e.Name, err)
+		}
+		e.exclude = ex
+	}
+	return nil
+}
+
+func (config *Config) isIncrementalValid() error {
+	for _, e := range config.Entries {
+		if e.FullEvery < 0 {
+			return fmt.Errorf("entry full every must not be negative. name=%s full_every=%d", e.Name, e.FullEvery)
+		}
+		// dumps are new files every run
+		if e.Incremental && e.Type != "" {
+			return fmt.Errorf("typed entries can't be incremental. name=%s type=%s", e.Name, e.Type)
+		}
+		// the file lists go by the timestamp and describe one run
+		if e.Index && (e.numbered() || e.Append || e.Repository) {
+			return fmt.Errorf("numbered, appended and repository entries can't be indexed. name=%s", e.Name)
+		}
+	}
+	return nil
+}
+
+func (config *Config) isOnBatteryValid() error {
+	switch config.OnBattery {
+	case "", "skip":
+	case "wait":
+		d, err := parseDuration(config.BatteryWait)
+		if err != nil {
+			return fmt.Errorf("config.BatteryWait is invalid. err=%s", err)
+		}
+		config.batteryWait = d
+	default:
+		return fmt.Errorf("unknown config.OnBattery. policy=%s", config.OnBattery)
+	}
+	return nil
+}
+
+func (config *Config) isRetentionValid() error {
+	if len(config.RetentionHook) > 0 && config.RetentionExpr != "" {
+		return fmt.Errorf("config.RetentionHook and config.RetentionExpr are exclusive")
+	}
+	// hooks and expressions decide instead of KeepGen, unless entries
+	// set their own
+	byKeepGen := len(config.RetentionHook) == 0 && config.RetentionExpr == ""
+	warned := false
+	for _, e := range config.Entries {
+		if e.KeepGen < 0 {
+			return fmt.Errorf("entry KeepGen must be at least 1. name=%s keep_gen=%d", e.Name, e.KeepGen)
+		}
+		if e.KeepGen == 0 && !byKeepGen {
+			continue
+		}
+		if e.KeepGen == 0 && config.KeepGen < 1 {
+			return fmt.Errorf("config.KeepGen must be at least 1. keep_gen=%d", config.KeepGen)
+		}
+		if config.keepGen(e) == 1 && !warned {
+			printWarning("Config warning: KeepGen=1 keeps only the archive just written, set KeepGenIncludesCurrent to false to keep the previous one too")
+			warned = true
+		}
+	}
+	switch config.FutureArchives {
+	case "", "ignore", "oldest", "newest":
+	default:
+		return fmt.Errorf("unknown config.FutureArchives. policy=%s", config.FutureArchives)
+	}
+	if config.TrashRetention != "" {
+		d, err := parseDuration(config.TrashRetention)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("config.TrashRetention is invalid. trash_retention=%s", config.TrashRetention)
+		}
+		config.trashRetention = d
+	}
+	if config.RetentionExpr != "" {
+		expr, err := compileRetentionExpr(config.RetentionExpr)
+		if err != nil {
+			return fmt.Errorf("config.RetentionExpr is invalid. err=%s", err)
+		}
+		config.retentionExpr = expr
+	}
+	for _, e := range config.Entries {
+		if e.KeepDaily < 0 || e.KeepWeekly < 0 || e.KeepMonthly < 0 {
+			return fmt.Errorf("entry retention counts must not be negative. name=%s", e.Name)
+		}
+		if e.MaxAge == "" {
+			continue
+		}
+		d, err := parseDuration(e.MaxAge)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("entry max age is invalid. name=%s max_age=%s", e.Name, e.MaxAge)
+		}
+		e.maxAge = d
+	}
+	return nil
+}
+
+func (config *Config) isSpecialFilesValid() error {
+	for _, e := range config.Entries {
+		switch e.SpecialFiles {
+		case "", "skip", "warn", "fail":
+		default:
+			return fmt.Errorf("unknown entry special files policy. name=%s policy=%s", e.Name, e.SpecialFiles)
+		}
+		switch e.ChangedFiles {
+		case "", "ignore", "warn", "retry", "fail":
+		default:
+			return fmt.Errorf("unknown entry changed files policy. name=%s policy=%s", e.Name, e.ChangedFiles)
+		}
+		switch e.PageCache {
+		case "", "keep", "drop", "direct":
+		default:
+			return fmt.Errorf("unknown entry page cache policy. name=%s policy=%s", e.Name, e.PageCache)
+		}
+	}
+	return nil
+}
+
+func (config *Config) isSchedulingValid() error {
+	if config.MaxConcurrent < 0 {
+		return fmt.Errorf("config.MaxConcurrent must not be negative. max_concurrent=%d", config.MaxConcurrent)
+	}
+	switch config.Scheduling {
+	case "", "config", "priority", "largest":
+		return nil
+	}
+	return fmt.Errorf("unknown config.Scheduling. scheduling=%s", config.Scheduling)
+}
+
+// workers returns how many entries are archived at once.
+func (config *Config) workers() int {
+	n := config.MaxConcurrent
+	if n == 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	if n > len(config.Entries) {
+		n = len(config.Entries)
+	}
+	return n
+}
+
+// schedule returns entry indexes in the order they should be started.
+// cs is the census from scanEntries, longest-first scheduling requires it.
+func (config *Config) schedule(cs []*census) []int {
+	order := make([]int, len(config.Entries))
+	for i := range order {
+		order[i] = i
+	}
+
+	switch config.Scheduling {
+	case "priority":
+		sort.SliceStable(order, func(i, j int) bool {
+			return config.Entries[order[i]].Priority > config.Entries[order[j]].Priority
+		})
+	case "largest":
+		sizes := make([]int64, len(config.Entries))
+		for i, c := range cs {
+			// unreadable sources sort last and fail when archived
+			if c != nil {
+				sizes[i] = c.bytes
+			}
+		}
+		sort.SliceStable(order, func(i, j int) bool {
+			return sizes[order[i]] > sizes[order[j]]
+		})
+	}
+
+	return order
+}
+
+func readConfig() (*Config, error) {
+	var configPath string
+	flag.StringVar(&configPath, "config", "", "path to json, yaml or toml config file, directory of them, or - for json on stdin")
+	configDir := flag.String("config-dir", "", "directory of config fragments merged into -config, e.g. /etc/tarbu.d")
+	lf := &logFlags{}
+	lf.register(flag.CommandLine)
+	dryRun := flag.Bool("dry-run", false, "print the archives that would be created and deleted without writing anything")
+	fakeNow := flag.String("fake-now", "", "run as if started at this unix time or RFC 3339 time, for debugging naming and retention")
+	summaryPath := flag.String("summary-json", "", "write the run summary as JSON to this file, or - for stdout")
+	wait := flag.Duration("wait", 0, "wait this long for the lock of another run, like 10m, instead of failing right away")
+	prof := &profiler{}
+	prof.register(flag.CommandLine)
+	prog := &progress{}
+	prog.register(flag.CommandLine)
+	flag.Parse()
+	if err := lf.setup(); err != nil {
+		return nil, err
+	}
+	if err := prog.setup(); err != nil {
+		return nil, err
+	}
+
+	var config *Config
+	var err error
+	if *configDir != "" {
+		config, err = loadConfigDir(configPath, *configDir)
+	} else {
+		config, err = loadConfig(configPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if *fakeNow != "" {
+		t, err := parseFakeNow(*fakeNow)
+		if err != nil {
+			return nil, err
+		}
+		config.clock = offsetClock(time.Until(t))
+	}
+	config.profiler = prof
+	config.progress = prog
+	config.dryRun = *dryRun
+	config.summaryPath = *summaryPath
+	config.lockWait = *wait
+	config.runID = runID()
+	if err := config.discover(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// loadConfig reads the config at configPath, see readConfigData.
+func loadConfig(configPath string) (*Config, error) {
+	data, err := readConfigData(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+// parseConfig decodes a config read as JSON and prepares it.
+func parseConfig(data []byte) (*Config, error) {
+	var err error
+
+	// raw keeps sealed values sealed, e.g. in self backups
+	config := &Config{raw: data}
+	if data, err = unsealConfig(data); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	if err := config.prepare(data); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// prepare expands the config decoded from data, see Prepare.
+func (config *Config) prepare(data []byte) error {
+	if err := config.expandEntries(data); err != nil {
+		return err
+	}
+	config.nameSchemaEntries()
+	if err := config.loadTimeZone(); err != nil {
+		return err
+	}
+	if err := config.expandVariables(); err != nil {
+		return err
+	}
+	config.expandHomes()
+	if err := config.parseNameTemplates(); err != nil {
+		return err
+	}
+	config.prepared = true
+	return nil
+}
+
+// discover adds the entries of ContainerDiscovery and Kubernetes. Only
+// backup runs discover, the other commands don't run docker or kubectl.
+func (config *Config) discover() error {
+	if config.discovered {
+		return nil
+	}
+	if err := config.discoverContainers(); err != nil {
+		return err
+	}
+	if err := config.discoverPVCs(); err != nil {
+		return err
+	}
+	config.discovered = true
+	// Defaults may give discovered entries a NameTemplate
+	return config.parseNameTemplates()
+}
+
+type result struct {
+	name string
+	err  error
+	// skipped is the reason the entry was not backed up
+	skipped  string
+	warnings []string
+	// changed and vanished count files let through by ChangedFiles
+	changed  int
+	vanished int
+	// filtered counts the files filters left out, filteredPaths are
+	// the first of them
+	filtered      int
+	filteredPaths []string
+	census        *census
+	// progress counts what the entry archived, nil unless reported
+	progress *entryProgress
+	archive  string
+	size     int64
+	sha256   string
+	// pruned counts the generations retention deleted
+	pruned   int
+	start    time.Time
+	duration time.Duration
+	// verified is "ok" or "corrupt" for results of a verification
+	// sample, see verifySample
+	verified string
+}
+type resultCh chan result
+
+// tsSortable sorts archive paths of ent by their genKey.
+type tsSortable struct {
+	ent   *Entry
+	paths []string
+}
+
+func (a tsSortable) Len() int      { return len(a.paths) }
+func (a tsSortable) Swap(i, j int) { a.paths[i], a.paths[j] = a.paths[j], a.paths[i] }
+func (a tsSortable) Less(i, j int) bool {
+	// generations lists only names with a key
+	ki, _ := generationKey(a.ent, a.paths[i])
+	kj, _ := generationKey(a.ent, a.paths[j])
+	return ki.before(kj)
+}
+
+func notDigit(r rune) bool { return r < '0' || r > '9' }
+
+func backupImpl(ch resultCh, i int, config *Config, c *census, battery bool) {
+	ent := config.Entries[i]
+
+	r := result{name: ent.Name, census: c, start: config.now()}
+	defer func() {
+		r.duration = config.now().Sub(r.start)
+		ch <- r
+	}()
+	// a panic fails this entry only
+	defer config.recoverEntry(&r)
+
+	if config.isAborted() {
+		r.skipped = "run aborted by a pre command"
+		return
+	}
+	if config.runContext().Err() != nil {
+		r.err = &InterruptedError{Entry: ent.Name, Signal: config.signal}
+		return
+	}
+	if battery && ent.Heavy {
+		r.skipped = "heavy entry on battery power"
+		return
+	}
+	lock, err := config.lockEntry(ent)
+	if err != nil {
+		r.err = err
+		return
+	}
+	defer lock.release()
+	lease, err := config.leaseEntry(ent)
+	if err != nil {
+		r.err = err
+		return
+	}
+	defer lease.release()
+	if config.memory != nil {
+		defer config.memory.release(config.memory.acquire(config.entryMemory(ent)))
+	}
+	logDebug("Backup started", "entry", ent.Name, "run", config.runID)
+	if !config.preCmd(&r, ent) {
+		return
+	}
+	r.err = config.archiveRetrying(&r, ent)
+	config.postCmd(&r, ent)
+}
+
+func backupEntryImpl(ctx context.Context, r *result, config *Config, ent *Entry) error {
+	// do backup
+	var b storage.Backend
+	var name, final string
+	var err error
+	tgz := _StreamLocation
+	if config.stream == nil {
+		if b, name, final, err = config.prepareArchive(r, ent); err != nil {
+			return err
+		}
+		tgz = b.Location(name)
+	}
+	meta := config.newArchiveMeta(ent, r.start)
+	if ent.Type != "" {
+		staged, dir, err := config.stage(ent)
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		ent = staged
+	}
+	roots, err := ent.sources()
+	if err != nil {
+		return err
+	}
+	for _, p := range roots {
+		if _, err = os.Stat(p); err != nil {
+			return &SourceReadError{p, err}
+		}
+	}
+	opts := config.archiveOptions(ent)
+	opts.Context = ctx
+	// callbacks run on the walk and the writer goroutines
+	mu := &sync.Mutex{}
+	switch ent.SpecialFiles {
+	case "skip":
+		opts.Special = func(string) error { return nil }
+	case "warn":
+		opts.Special = func(p string) error {
+			mu.Lock()
+			defer mu.Unlock()
+			r.warnings = append(r.warnings, fmt.Sprintf("special file skipped. path=%s", p))
+			return nil
+		}
+	case "fail":
+		opts.Special = func(p string) error {
+			return &SourceReadError{p, fmt.Errorf("special file found")}
+		}
+	}
+	if skip := opts.Skip; skip != nil {
+		opts.Skip = func(p string, fi os.FileInfo) bool {
+			if !skip(p, fi) {
+				return false
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			r.filtered++
+			if len(r.filteredPaths) < _FilteredPaths {
+				r.filteredPaths = append(r.filteredPaths, p)
+			}
+			return true
+		}
+	}
+	switch ent.ChangedFiles {
+	case "ignore", "warn":
+		opts.Changed = func(e *archiver.ChangeError) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if e.Vanished {
+				r.vanished++
+			} else {
+				r.changed++
+			}
+			if ent.ChangedFiles == "warn" {
+				r.warnings = append(r.warnings, e.Error())
+			}
+			return nil
+		}
+	case "retry":
+		opts.Retry = true
+	}
+	r.progress = config.progress.track(ent.Name, r.census)
+	defer config.progress.untrack(r.progress)
+	r.progress.hook(opts)
+	written := &archivedStats{}
+	written.hook(opts)
+	if ent.Snapshot != nil {
+		snap, err := config.snapshotSource(ent)
+		if err != nil {
+			return &SourceReadError{ent.Path, err}
+		}
+		defer func() {
+			if err := snap.release(); err != nil {
+				r.warnings = append(r.warnings, fmt.Sprintf("removing snapshot failed. err=%s", err))
+			}
+		}()
+		if roots, err = snap.roots(roots); err != nil {
+			return &SourceReadError{ent.Path, err}
+		}
+		opts.Snapshot, opts.SnapshotOf = snap.dir, snap.mount
+	}
+	if ent.Repository {
+		return config.snapshot(ctx, r, ent, roots, opts)
+	}
+	var before map[string][]byte
+	if ent.HashCheck {
+		if before, err = hashRoots(roots); err != nil {
+			return err
+		}
+	}
+	var m *manifest
+	if (ent.Incremental || ent.Index) && config.stream == nil {
+		var base *manifest
+		if ent.Incremental {
+			if base, err = config.incrementalBase(b, ent); err != nil {
+				return &DestinationWriteError{config.entryDst(ent), err}
+			}
+		}
+		k := archiveKey(ent, name)
+		m = &manifest{RunID: config.runID, Entry: ent.Name, Time: k.ts, Seq: k.seq}
+		m.track(opts, base)
+	}
+	prev := ""
+	if ent.Append {
+		var runs int
+		if prev, runs, err = config.appendBase(b, ent); err != nil {
+			return &DestinationWriteError{config.entryDst(ent), err}
+		}
+		opts.Global = map[string]string{_AppendRuns: strconv.Itoa(runs + 1)}
+		if prev != "" {
+			tr, err := config.openTar(b, ent, prev)
+			if err != nil {
+				return &DestinationWriteError{config.entryDst(ent), err}
+			}
+			defer tr.Close()
+			opts.Append = tr
+		}
+	}
+	release, err := config.reserveSpace(b, ent, roots, r.census)
+	if err != nil {
+		return err
+	}
+	defer release()
+	// snapshots were quiesced for
+	resume := func() error { return nil }
+	if ent.Snapshot == nil {
+		if resume, err = quiesce(ent); err != nil {
+			return &SourceReadError{ent.Path, err}
+		}
+	}
+	put := func(write func(io.Writer) error) (int64, []byte, error) { return putArchive(b, name, write) }
+	if config.stream != nil {
+		put = config.streamArchive
+	}
+	size, sum, err := put(func(w io.Writer) error {
+		w = config.writeThrottle(ent, &ctxWriter{ctx, r.progress.writer(w)})
+		write := func(w io.Writer) error {
+			return writeCompressed(ent, w, func(w io.Writer) error { return archiver.WriteRoots(w, roots, opts) })
+		}
+		if config.archiveSuffix(ent) != ent.suffix() {
+			return config.writeEncrypted(w, write)
+		}
+		return write(w)
+	})
+	if rerr := resume(); rerr != nil {
+		r.warnings = append(r.warnings, fmt.Sprintf("resuming source failed. err=%s", rerr))
+	}
+	switch e := err.(type) {
+	case nil:
+	case *archiver.WriteError:
+		return &DestinationWriteError{tgz, e.Err}
+	case *archiver.AppendError:
+		return &DestinationWriteError{b.Location(prev), e.Err}
+	case *archiver.SourceError:
+		return &SourceReadError{e.Path, e.Err}
+	default:
+		return err
+	}
+	if config.stream != nil {
+		r.archive, r.size, r.sha256 = tgz, size, hex.EncodeToString(sum)
+		return nil
+	}
+	if ent.VerifyAfterWrite {
+		want := written
+		// appended archives hold members copied from the old one
+		if ent.Append && prev != "" {
+			want = nil
+		}
+		if err := config.verifyWritten(b, ent, name, want); err != nil {
+			b.Delete(name)
+			return &DestinationWriteError{tgz, err}
+		}
+	}
+	if err := writeChecksum(b, name, sum); err != nil {
+		b.Delete(name)
+		return err
+	}
+	meta.End, meta.Files, meta.Bytes = config.now(), written.files, written.bytes
+	if err := writeMeta(b, name, meta); err != nil {
+		b.Delete(name, checksumName(name))
+		return err
+	}
+	if m != nil {
+		if err := writeManifest(b, ent, m); err != nil {
+			b.Delete(name, checksumName(name), metaName(name))
+			return err
+		}
+	}
+	r.archive = b.Location(final)
+	r.size = size
+	r.sha256 = hex.EncodeToString(sum)
+	for _, p := range roots {
+		sum, ok := before[p]
+		if !ok {
+			continue
+		}
+		after, err := hashFile(p)
+		if err != nil {
+			return &SourceReadError{p, err}
+		}
+		if !bytes.Equal(sum, after) {
+			r.warnings = append(r.warnings, fmt.Sprintf("source changed during backup, archive may be inconsistent. path=%s archive=%s", p, r.archive))
+		}
+	}
+	// the new archive holds everything the appended one did
+	if prev != "" {
+		if err := b.Delete(append(sidecars(ent, prev), prev)...); err != nil {
+			return &RetentionError{config.entryDst(ent), err}
+		}
+	}
+	// delete old backups
+	if ent.numbered() {
+		r.pruned, err = config.rotate(b, ent)
+	} else {
+		r.pruned, err = config.prune(b, ent)
+	}
+	if err != nil {
+		return err
+	}
+	config.replicate(r, b, ent, final)
+	return nil
+}
+
+// prepareArchive returns the destination of the archive of ent, the name
+// it is written to and the one it ends up with, after deleting what runs
+// killed while writing left behind.
+func (config *Config) prepareArchive(r *result, ent *Entry) (storage.Backend, string, string, error) {
+	b, err := config.entryBackend(ent)
+	if err != nil {
+		return nil, "", "", &DestinationWriteError{config.entryDst(ent), err}
+	}
+	name, err := config.archiveName(b, ent)
+	if err != nil {
+		return nil, "", "", &DestinationWriteError{config.entryDst(ent), err}
+	}
+	final := name
+	if ent.numbered() {
+		// rotate moves it to 1
+		name = slotName(name, 0)
+	}
+	orphans, err := cleanTmp(b, ent)
+	if err != nil {
+		return nil, "", "", &RetentionError{config.entryDst(ent), err}
+	}
+	for _, o := range orphans {
+		r.warnings = append(r.warnings, fmt.Sprintf("removed temporary archive of a killed run. file=%s", o))
+	}
+	return b, name, final, nil
+}
+
+// hashRoots hashes the roots that are regular files, for HashCheck.
+func hashRoots(roots []string) (map[string][]byte, error) {
+	sums := map[string][]byte{}
+	for _, p := range roots {
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil, &SourceReadError{p, err}
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		if sums[p], err = hashFile(p); err != nil {
+			return nil, &SourceReadError{p, err}
+		}
+	}
+	return sums, nil
+}
+
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func backup(config *Config) []result {
+	start := time.Now()
+	wg := &sync.WaitGroup{}
+	rch := make(resultCh)
+
+	var cs []*census
+	if config.PreScan || config.Scheduling == "largest" || config.progress.enabled() {
+		cs = config.scanEntries()
+	} else {
+		cs = make([]*census, len(config.Entries))
+	}
+
+	battery := config.powerCheck()
+	waitUploads := config.startUploads()
+
+	// workers take entries in schedule order
+	jobs := make(chan int)
+	go func() {
+		for _, i := range config.schedule(cs) {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+	for w := 0; w < config.workers(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				backupImpl(rch, i, config, cs[i], battery)
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(rch)
+	}()
+
+	var results []result
+	for r := range rch {
+		for _, w := range r.warnings {
+			logs.event(levelWarn, _ColorYellow, "Backup warning", "entry", r.name, "run", config.runID, "warn", w)
+		}
+		if r.skipped != "" {
+			logs.event(levelWarn, _ColorYellow, "Backup skipped", "entry", r.name, "run", config.runID, "reason", r.skipped)
+		} else if r.err != nil {
+			// panics were reported when recovered
+			if errorKind(r.err) == "unknown" {
+				config.reportError(r.err.Error(), nil, map[string]string{"entry": r.name})
+			}
+			logs.event(levelError, _ColorRed, "Backup failed", "entry", r.name, "run", config.runID,
+				"start", r.start, "duration", r.duration, "kind", errorKind(r.err), "err", r.err)
+		} else {
+			fields := []interface{}{"entry", r.name, "run", config.runID, "start", r.start, "duration", r.duration}
+			if r.census != nil {
+				fields = append(fields, "files", r.census.files, "data", logSize(r.census.bytes))
+			}
+			if r.archive != "" {
+				fields = append(fields, "archive", r.archive, "size", logSize(r.size))
+			}
+			if r.changed > 0 || r.vanished > 0 {
+				fields = append(fields, "changed", r.changed, "vanished", r.vanished)
+			}
+			if r.filtered > 0 {
+				fields = append(fields, "filtered", r.filtered)
+			}
+			if r.sha256 != "" {
+				fields = append(fields, "sha256", r.sha256)
+			}
+			logs.event(levelInfo, _ColorGreen, "Backup succeeded", fields...)
+		}
+		results = append(results, r)
+	}
+	config.reportInterrupted(results)
+
+	if err := config.appendHistory(results); err != nil {
+		printWarning("Recording run history failed: err=%s", err)
+	}
+	if err := config.writeAttestation(results, start); err != nil {
+		printWarning("Writing run attestation failed: err=%s", err)
+	}
+	waitUploads()
+	s := config.summarize(results, start)
+	config.notify(s)
+	if config.summaryPath != "" {
+		if err := writeSummary(config.summaryPath, s); err != nil {
+			printWarning("Writing run summary failed: file=%s err=%s", config.summaryPath, err)
+		}
+	}
+	if config.MetricsFile != "" {
+		if err := config.writeMetricsFile(); err != nil {
+			printWarning("Writing metrics failed: file=%s err=%s", config.MetricsFile, err)
+		}
+	}
+
+	return results
+}
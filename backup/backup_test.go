@@ -0,0 +1,2777 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/archiver"
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// readArchive returns the headers of a .tar.gz by member name.
+func readArchive(t *testing.T, path string) map[string]*tar.Header {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdrs := map[string]*tar.Header{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return hdrs
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdrs[strings.TrimSuffix(hdr.Name, "/")] = hdr
+	}
+}
+
+func TestBackupLongAndNonUTF8Names(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "src")
+	dst := filepath.Join(base, "dst")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// 8 levels of 40 bytes go well past the 100 byte ustar name field
+	deep := src
+	for i := 0; i < 8; i++ {
+		deep = filepath.Join(deep, strings.Repeat(string(rune('a'+i)), 40))
+	}
+	names := []string{
+		filepath.Join(deep, "file"),
+		filepath.Join(src, "caf\xe9"),
+		filepath.Join(src, "\xff\xfe-not-utf8"),
+		filepath.Join(src, "日本語"),
+	}
+	if err := os.MkdirAll(deep, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range names {
+		if err := os.WriteFile(n, []byte(n), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ent := &Entry{Name: "deep", Path: src}
+	config := &Config{Dst: dst, KeepGen: 1, Entries: []*Entry{ent}}
+	r := &result{name: ent.Name}
+	if err := backupEntryImpl(context.Background(), r, config, ent); err != nil {
+		t.Fatal(err)
+	}
+
+	hdrs := readArchive(t, r.archive)
+	pax := false
+	for _, n := range names {
+		member := strings.TrimPrefix(n, "/")
+		hdr, ok := hdrs[member]
+		if !ok {
+			t.Fatalf("member missing from archive. name=%q", member)
+		}
+		if hdr.Format == tar.FormatPAX {
+			pax = true
+		}
+	}
+	if !pax {
+		t.Fatal("archive does not use PAX headers")
+	}
+}
+
+func TestLockRun(t *testing.T) {
+	config := &Config{Dst: "/backup", LockDir: t.TempDir()}
+	lock, err := config.lockRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.lockWait = 1500 * time.Millisecond
+	start := time.Now()
+	_, err = config.lockRun()
+	if _, ok := err.(*LockError); !ok || time.Since(start) < config.lockWait {
+		t.Fatalf("second lock got err=%v after %s", err, time.Since(start))
+	}
+	if classify(err).code != _ExitLocked {
+		t.Errorf("exit code of %v is %d", err, classify(err).code)
+	}
+
+	// entries lock on their own
+	config.Lock = "entry"
+	if l, err := config.lockEntry(&Entry{Name: "www"}); err != nil {
+		t.Fatal(err)
+	} else {
+		l.release()
+	}
+	lock.release()
+	config.Lock = ""
+	if lock, err = config.lockRun(); err != nil {
+		t.Fatalf("released lock not taken: %s", err)
+	}
+	lock.release()
+}
+
+func TestThrottle(t *testing.T) {
+	config := &Config{MaxWriteMBps: 16, Entries: []*Entry{{Name: "www", MaxWriteMBps: 2}, {Name: "etc"}}}
+	if err := config.isThrottleValid(); err != nil {
+		t.Fatal(err)
+	}
+	if config.readThrottle(config.Entries[0]) != nil || config.writeThrottle(config.Entries[1], ioutil.Discard) == ioutil.Discard {
+		t.Fatal("limits not applied as configured")
+	}
+	// the first quarter second of the entry rate passes at once, 1M more
+	// takes half a second
+	w := config.writeThrottle(config.Entries[0], ioutil.Discard)
+	start := time.Now()
+	buf := make([]byte, 64<<10)
+	for i := 0; i < 24; i++ {
+		w.Write(buf)
+	}
+	if d := time.Since(start); d < 400*time.Millisecond || d > 2*time.Second {
+		t.Errorf("1.5M at 2M/s took %s", d)
+	}
+
+	// an entry limit replaces, rather than adds to, the one of the run
+	config = &Config{MaxWriteMBps: 1, Entries: []*Entry{{Name: "media", MaxWriteMBps: 64}}}
+	if err := config.isThrottleValid(); err != nil {
+		t.Fatal(err)
+	}
+	w = config.writeThrottle(config.Entries[0], ioutil.Discard)
+	start = time.Now()
+	for i := 0; i < 24; i++ {
+		w.Write(buf)
+	}
+	if d := time.Since(start); d > 200*time.Millisecond {
+		t.Errorf("1.5M at 64M/s took %s", d)
+	}
+
+	config = &Config{Entries: []*Entry{{Name: "www", MaxReadMBps: -1}}}
+	if err := config.isThrottleValid(); err == nil {
+		t.Error("negative MaxReadMBps accepted")
+	}
+}
+
+// busyBackend records how many Puts of archives run at once.
+type busyBackend struct {
+	storage.Backend
+	mu         sync.Mutex
+	busy, peak int
+}
+
+func (b *busyBackend) Put(name string, r io.Reader) error {
+	if strings.Contains(name, ".meta.json") || strings.HasSuffix(name, ".sha256") {
+		return b.Backend.Put(name, r)
+	}
+	b.mu.Lock()
+	b.busy++
+	if b.busy > b.peak {
+		b.peak = b.busy
+	}
+	b.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	err := b.Backend.Put(name, r)
+	b.mu.Lock()
+	b.busy--
+	b.mu.Unlock()
+	return err
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	for _, tc := range []struct {
+		max, entries, want int
+	}{
+		{0, 1000, runtime.GOMAXPROCS(0)},
+		{0, 1, 1},
+		{2, 5, 2},
+		{8, 3, 3},
+	} {
+		config := &Config{MaxConcurrent: tc.max, Entries: make([]*Entry, tc.entries)}
+		if n := config.workers(); n != tc.want {
+			t.Errorf("MaxConcurrent=%d with %d entries: %d workers, want %d", tc.max, tc.entries, n, tc.want)
+		}
+	}
+	if err := (&Config{MaxConcurrent: -1}).isSchedulingValid(); err == nil {
+		t.Error("negative MaxConcurrent accepted")
+	}
+
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := &busyBackend{Backend: &storage.Local{Dir: dst}}
+	cfg := &Config{Dst: dst, dst: b, KeepGen: 1, MaxConcurrent: 2}
+	for _, n := range []string{"a", "b", "c", "d", "e"} {
+		cfg.Entries = append(cfg.Entries, &Entry{Name: n, Path: src})
+	}
+	rep, err := Run(context.Background(), cfg)
+	if err != nil || rep.Succeeded != 5 {
+		t.Fatalf("report is %+v, err=%v", rep, err)
+	}
+	if b.peak != 2 {
+		t.Errorf("%d entries archived at once, want 2", b.peak)
+	}
+}
+
+// orderBackend records the order archives are put in.
+type orderBackend struct {
+	storage.Backend
+	mu    sync.Mutex
+	names []string
+}
+
+func (b *orderBackend) Put(name string, r io.Reader) error {
+	if i := strings.Index(name, ".tar"); i > 0 && !strings.Contains(name, ".meta.json") && !strings.HasSuffix(name, ".sha256") {
+		b.mu.Lock()
+		b.names = append(b.names, name[:i])
+		b.mu.Unlock()
+	}
+	return b.Backend.Put(name, r)
+}
+
+func TestScheduling(t *testing.T) {
+	small, large := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(small, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(large, "file"), bytes.Repeat([]byte("data"), 1<<16), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		scheduling string
+		want       string
+	}{
+		{"", "a,b,c"},
+		{"priority", "c,a,b"},
+		{"largest", "b,a,c"},
+	} {
+		dst := t.TempDir()
+		b := &orderBackend{Backend: &storage.Local{Dir: dst}}
+		cfg := &Config{Dst: dst, dst: b, StateDir: t.TempDir(), KeepGen: 1, MaxConcurrent: 1, Scheduling: tc.scheduling, Entries: []*Entry{
+			{Name: "a", Path: small},
+			{Name: "b", Path: large},
+			{Name: "c", Path: small, Priority: 1},
+		}}
+		rep, err := Run(context.Background(), cfg)
+		if err != nil || rep.Succeeded != 3 {
+			t.Fatalf("%s: report is %+v, err=%v", tc.scheduling, rep, err)
+		}
+		if got := strings.Join(b.names, ","); got != tc.want {
+			t.Errorf("scheduling %q started %s, want %s", tc.scheduling, got, tc.want)
+		}
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	for _, tc := range []struct {
+		buffer, max string
+		size        int
+		err         string
+	}{
+		{"", "", _DefaultBufferSize, ""},
+		{"4K", "512M", 4 << 10, ""},
+		{"100", "", 0, "config.BufferSize must be a size of at least 512 bytes"},
+		{"big", "", 0, "config.BufferSize must be a size of at least 512 bytes"},
+		{"", "lots", 0, "config.MaxMemory is invalid"},
+	} {
+		config := &Config{BufferSize: tc.buffer, MaxMemory: tc.max}
+		err := config.isMemoryValid()
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q %q: err=%v, want %s", tc.buffer, tc.max, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || config.bufferSize != tc.size || (config.memory != nil) != (tc.max != "") {
+			t.Errorf("%q %q: buffer %d, budget %v, err=%v", tc.buffer, tc.max, config.bufferSize, config.memory, err)
+		}
+	}
+
+	config := &Config{bufferSize: 4 << 10}
+	if n := config.entryMemory(&Entry{}); n != 8<<10+_CompressorMemory {
+		t.Errorf("entry memory %d", n)
+	}
+	if n := config.entryMemory(&Entry{archiveWorkers: 4}); n != 8<<10+archiver.GzipMemory(4) {
+		t.Errorf("parallel gzip entry memory %d", n)
+	}
+
+	b := newMemoryBudget(100)
+	if n := b.acquire(250); n != 100 {
+		t.Fatalf("an entry over the budget acquired %d, want all of it", n)
+	}
+	b.release(100)
+	first := b.acquire(60)
+	acquired := make(chan int64)
+	go func() { acquired <- b.acquire(60) }()
+	select {
+	case <-acquired:
+		t.Fatal("second entry didn't wait for memory")
+	case <-time.After(50 * time.Millisecond):
+	}
+	b.release(first)
+	select {
+	case n := <-acquired:
+		if n != 60 {
+			t.Errorf("second entry acquired %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("second entry still waits after the release")
+	}
+}
+
+func TestOnBattery(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		supplies map[string]map[string]string
+		want     bool
+	}{
+		{"no supplies", nil, false},
+		{"discharging", map[string]map[string]string{
+			"BAT0": {"type": "Battery", "status": "Discharging"},
+			"AC":   {"type": "Mains", "online": "0"},
+		}, true},
+		{"charging", map[string]map[string]string{
+			"BAT0": {"type": "Battery", "status": "Charging"},
+		}, false},
+		{"plugged in", map[string]map[string]string{
+			"BAT0": {"type": "Battery", "status": "Discharging"},
+			"AC":   {"type": "Mains", "online": "1"},
+		}, false},
+		{"usb power", map[string]map[string]string{
+			"BAT0": {"type": "Battery", "status": "Discharging"},
+			"usb":  {"type": "USB", "online": "1"},
+		}, false},
+		{"unreadable battery", map[string]map[string]string{
+			"BAT0": {"type": "Battery"},
+		}, false},
+	} {
+		dir := t.TempDir()
+		for s, files := range tc.supplies {
+			if err := os.Mkdir(filepath.Join(dir, s), 0755); err != nil {
+				t.Fatal(err)
+			}
+			for f, v := range files {
+				if err := os.WriteFile(filepath.Join(dir, s, f), []byte(v+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		if got := linuxOnBattery(dir); got != tc.want {
+			t.Errorf("%s: on battery %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	for _, tc := range []struct {
+		policy, wait string
+		err          string
+	}{
+		{"", "", ""},
+		{"skip", "", ""},
+		{"wait", "10m", ""},
+		{"wait", "soon", "config.BatteryWait is invalid"},
+		{"defer", "", "unknown config.OnBattery"},
+	} {
+		config := &Config{OnBattery: tc.policy, BatteryWait: tc.wait}
+		err := config.isOnBatteryValid()
+		if (err == nil) != (tc.err == "") || err != nil && !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s %s: err=%v, want %q", tc.policy, tc.wait, err, tc.err)
+		}
+	}
+
+	// on battery only heavy entries are skipped
+	src := t.TempDir()
+	config := &Config{dst: storage.NewMemory(), KeepGen: 1, OnBattery: "skip", Entries: []*Entry{
+		{Name: "photos", Path: src, Heavy: true},
+		{Name: "notes", Path: src},
+	}}
+	if !config.hasHeavyEntries() || (&Config{Entries: config.Entries[1:]}).hasHeavyEntries() {
+		t.Error("hasHeavyEntries misses the heavy entry")
+	}
+	ch := make(resultCh, len(config.Entries))
+	for i := range config.Entries {
+		backupImpl(ch, i, config, nil, true)
+	}
+	if r := <-ch; r.name != "photos" || r.skipped != "heavy entry on battery power" || r.err != nil {
+		t.Errorf("photos result %+v, want skipped", r)
+	}
+	if r := <-ch; r.name != "notes" || r.skipped != "" || r.err != nil {
+		t.Errorf("notes result %+v, want backed up", r)
+	}
+}
+
+func TestEntryCmds(t *testing.T) {
+	for _, tc := range []struct {
+		policy, timeout string
+		err             string
+	}{
+		{"", "", ""},
+		{"abort", "30s", ""},
+		{"retry", "", "unknown entry pre command failure policy"},
+		{"skip", "soon", "entry command timeout is invalid"},
+		{"fail", "-1s", "entry command timeout is invalid"},
+	} {
+		config := &Config{Entries: []*Entry{{Name: "db", PreCmdFailure: tc.policy, CmdTimeout: tc.timeout}}}
+		err := config.isCmdValid()
+		if (err == nil) != (tc.err == "") || err != nil && !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q %q: err=%v, want %q", tc.policy, tc.timeout, err, tc.err)
+		}
+	}
+
+	src, out := t.TempDir(), t.TempDir()
+	post := func(name string) []string {
+		return []string{"sh", "-c", `echo "$TARBU_ENTRY $TARBU_STATUS" > ` + filepath.Join(out, name)}
+	}
+	fail := []string{"sh", "-c", "echo quiesce failed >&2; exit 1"}
+	config := &Config{dst: storage.NewMemory(), KeepGen: 1, Entries: []*Entry{
+		{Name: "ok", Path: src, PreCmd: []string{"true"}, PostCmd: post("ok")},
+		{Name: "failed", Path: src, PreCmd: fail, PostCmd: post("failed")},
+		{Name: "missing", Path: filepath.Join(src, "missing"), PostCmd: post("missing")},
+		{Name: "skipped", Path: src, PreCmd: fail, PreCmdFailure: "skip"},
+		{Name: "slow", Path: src, PreCmd: []string{"sleep", "5"}, CmdTimeout: "100ms"},
+		{Name: "postfail", Path: src, PostCmd: fail},
+		{Name: "abort", Path: src, PreCmd: fail, PreCmdFailure: "abort"},
+		{Name: "after", Path: src},
+	}}
+	if err := config.isCmdValid(); err != nil {
+		t.Fatal(err)
+	}
+	ch := make(resultCh, len(config.Entries))
+	results := map[string]result{}
+	for i := range config.Entries {
+		backupImpl(ch, i, config, nil, false)
+		r := <-ch
+		results[r.name] = r
+	}
+
+	if r := results["ok"]; r.err != nil || r.archive == "" {
+		t.Errorf("ok: err=%v archive=%q", r.err, r.archive)
+	}
+	if r := results["failed"]; errorKind(r.err) != "source-read" || !strings.Contains(r.err.Error(), "quiesce failed") || r.archive != "" {
+		t.Errorf("failed: err=%v archive=%q", r.err, r.archive)
+	}
+	if r := results["missing"]; r.err == nil {
+		t.Error("missing: archived")
+	}
+	// nothing to clean up after a failed PreCmd
+	for name, want := range map[string]string{"ok": "ok succeeded\n", "missing": "missing failed\n", "failed": ""} {
+		if data, _ := os.ReadFile(filepath.Join(out, name)); string(data) != want {
+			t.Errorf("%s: post command saw %q, want %q", name, data, want)
+		}
+	}
+	if r := results["skipped"]; r.err != nil || !strings.HasPrefix(r.skipped, "pre command failed.") {
+		t.Errorf("skipped: err=%v skipped=%q", r.err, r.skipped)
+	}
+	if r := results["slow"]; r.err == nil || !strings.Contains(r.err.Error(), "timed out. timeout=100ms") {
+		t.Errorf("slow: err=%v", r.err)
+	}
+	if r := results["postfail"]; r.err != nil || len(r.warnings) != 1 || !strings.HasPrefix(r.warnings[0], "post command failed.") {
+		t.Errorf("postfail: err=%v warnings=%q", r.err, r.warnings)
+	}
+	if r := results["abort"]; r.err == nil || !config.isAborted() {
+		t.Errorf("abort: err=%v aborted=%v", r.err, config.isAborted())
+	}
+	if r := results["after"]; r.skipped != "run aborted by a pre command" {
+		t.Errorf("after: err=%v skipped=%q", r.err, r.skipped)
+	}
+}
+
+func TestMongoDump(t *testing.T) {
+	log := stubCommand(t, "mongodump", `if [ -n "$MONGODUMP_FAIL" ]; then echo "connection refused" >&2; exit 1; fi
+for a; do case "$a" in --archive=*) printf dump > "${a#--archive=}";; esac; done
+`)
+	uriFile := filepath.Join(t.TempDir(), "uri")
+	if err := os.WriteFile(uriFile, []byte("mongodb://tarbu:secret@db/app\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		ent  Entry
+		args string
+	}{
+		{"local", Entry{Name: "db"}, ""},
+		{"uri", Entry{Name: "db", URI: "mongodb://db", Args: []string{"--gzip"}}, " --uri=mongodb://db --gzip"},
+		{"uri file", Entry{Name: "db", URIFile: uriFile}, " --uri=mongodb://tarbu:secret@db/app"},
+	} {
+		os.Remove(log)
+		dir := t.TempDir()
+		if err := dumpMongoDB(&tc.ent, dir); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		want := "--archive=" + filepath.Join(dir, "db.archive") + tc.args
+		if calls := stubCalls(t, log); len(calls) != 1 || calls[0] != want {
+			t.Errorf("%s: mongodump called with %q, want %q", tc.name, calls, want)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "db.archive")); err != nil || string(data) != "dump" {
+			t.Errorf("%s: dump is %q, err=%v", tc.name, data, err)
+		}
+	}
+	if err := dumpMongoDB(&Entry{Name: "db", URIFile: filepath.Join(t.TempDir(), "missing")}, t.TempDir()); err == nil {
+		t.Error("dumped without the URIFile")
+	}
+
+	// the dump is what the entry's archive holds
+	m := storage.NewMemory()
+	config := &Config{dst: m, KeepGen: 1, TmpDir: t.TempDir(), Entries: []*Entry{{Name: "db", Type: "mongodb"}}}
+	ch := make(resultCh, 1)
+	backupImpl(ch, 0, config, nil, false)
+	r := <-ch
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	rc, err := config.openArchive(m, config.Entries[0], filepath.Base(r.archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var members []string
+	if _, err := scanArchive(bufio.NewReader(rc), func(hdr *tar.Header, body io.Reader) error {
+		members = append(members, hdr.Name)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(members, " ") != "./ ./db.archive" {
+		t.Errorf("archive holds %q", members)
+	}
+
+	t.Setenv("MONGODUMP_FAIL", "1")
+	backupImpl(ch, 0, config, nil, false)
+	if r := <-ch; r.err == nil || !strings.Contains(r.err.Error(), "mongodump failed") || !strings.Contains(r.err.Error(), "connection refused") {
+		t.Errorf("failing mongodump: err=%v", r.err)
+	}
+}
+
+func TestArchiveEntryTimeout(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "src")
+	dst := filepath.Join(base, "dst")
+	for _, d := range []string{src, dst} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(src, "big"), make([]byte, 4<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// at 1M/s the archive takes seconds, the timeout stops it first
+	ent := &Entry{Name: "big", Path: src, Compression: "none", Timeout: "300ms", MaxReadMBps: 1}
+	config := &Config{Dst: dst, KeepGen: 1, Entries: []*Entry{ent}}
+	if err := config.isTimeoutValid(); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.isThrottleValid(); err != nil {
+		t.Fatal(err)
+	}
+	err := config.archiveEntry(&result{name: ent.Name}, ent)
+	if errorKind(err) != "timeout" {
+		t.Fatalf("got err=%v, want a timeout", err)
+	}
+	left, _ := filepath.Glob(filepath.Join(dst, "*"))
+	if len(left) > 0 {
+		t.Errorf("partial archive left. files=%q", left)
+	}
+}
+
+func TestArchiveRetrying(t *testing.T) {
+	base := t.TempDir()
+	src := filepath.Join(base, "src")
+	dst := filepath.Join(base, "dst")
+	if err := os.Mkdir(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// the source shows up during the first wait, like a remount
+	ent := &Entry{Name: "nfs", Path: src, Retries: 2, RetryDelay: "200ms"}
+	config := &Config{Dst: dst, KeepGen: 1, Entries: []*Entry{ent}}
+	if err := config.isRetryValid(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.Mkdir(src, 0755)
+	}()
+	r := &result{name: ent.Name}
+	if err := config.archiveRetrying(r, ent); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.warnings) != 1 || !strings.HasPrefix(r.warnings[0], "attempt 1 failed.") {
+		t.Errorf("warnings %q", r.warnings)
+	}
+
+	if retryable(&LockError{What: "entry nfs"}) || !retryable(&UploadError{Dst: "s3://b"}) {
+		t.Error("retryable misclassifies errors")
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	errIO := errors.New("i/o error")
+	for _, tc := range []struct {
+		err  error
+		kind string
+		code int
+	}{
+		{&SourceReadError{"/srv", errIO}, "source-read", _ExitSourceRead},
+		{fmt.Errorf("entry www: %w", &DestinationWriteError{"/backup", errIO}), "destination-write", _ExitDestinationWrite},
+		{&CompressionError{errIO}, "compression", _ExitCompression},
+		{&EncryptionError{"age", errIO}, "encryption", _ExitEncryption},
+		{&RetentionError{"/backup", errIO}, "retention", _ExitRetention},
+		{&UploadError{"s3://b", errIO}, "upload", _ExitUpload},
+		{&LockError{What: "run"}, "locked", _ExitLocked},
+		{&InterruptedError{Entry: "www", Signal: syscall.SIGTERM}, "interrupted", _ExitInterrupted},
+		{&InterruptedError{Entry: "www", Timeout: time.Minute}, "timeout", _ExitTimeout},
+		{&panicError{"boom"}, "panic", _ExitFailure},
+		{errIO, "unknown", _ExitFailure},
+	} {
+		if c := classify(tc.err); c.kind != tc.kind || c.code != tc.code {
+			t.Errorf("%v: classified %+v, want %s %d", tc.err, c, tc.kind, tc.code)
+		}
+	}
+
+	ok, skipped := result{name: "ok"}, result{name: "skipped", skipped: "heavy entry on battery power"}
+	src1, src2 := result{name: "a", err: &SourceReadError{"/a", errIO}}, result{name: "b", err: &SourceReadError{"/b", errIO}}
+	upload := result{name: "c", err: &UploadError{"s3://b", errIO}}
+	for _, tc := range []struct {
+		name    string
+		results []result
+		want    int
+	}{
+		{"no entries", nil, _ExitOK},
+		{"all succeeded", []result{ok, ok}, _ExitOK},
+		{"only skipped", []result{skipped}, _ExitOK},
+		{"partial", []result{ok, src1}, _ExitPartial},
+		{"skipped and failed", []result{skipped, src1}, _ExitSourceRead},
+		{"same kind", []result{src1, src2}, _ExitSourceRead},
+		{"mixed kinds", []result{src1, upload}, _ExitFailure},
+	} {
+		if code := exitCode(tc.results); code != tc.want {
+			t.Errorf("%s: exit code %d, want %d", tc.name, code, tc.want)
+		}
+	}
+
+	config := &Config{runID: "r1"}
+	rep := config.summarize([]result{
+		{name: "ok", archive: "/backup/ok.tar.gz.1", size: 100, duration: 2 * time.Second, pruned: 1},
+		skipped, upload,
+	}, time.Now())
+	if rep.RunID != "r1" || rep.Succeeded != 1 || rep.Failed != 1 || rep.Skipped != 1 || rep.Bytes != 100 || rep.Pruned != 1 ||
+		rep.ExitCode != _ExitPartial || len(rep.Entries) != 3 {
+		t.Fatalf("report is %+v", rep)
+	}
+	for i, want := range []ReportEntry{
+		{Entry: "ok", Status: "succeeded", Archive: "/backup/ok.tar.gz.1", Size: 100, Duration: 2},
+		{Entry: "skipped", Status: "skipped", Error: "heavy entry on battery power"},
+		{Entry: "c", Status: "failed", Error: upload.err.Error()},
+	} {
+		if !reflect.DeepEqual(rep.Entries[i], want) {
+			t.Errorf("entry %+v, want %+v", rep.Entries[i], want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "summary.json")
+	if err := writeSummary(path, rep); err != nil {
+		t.Fatal(err)
+	}
+	var read Report
+	if data, err := os.ReadFile(path); err != nil || json.Unmarshal(data, &read) != nil || read.ExitCode != _ExitPartial || len(read.Entries) != 3 {
+		t.Errorf("summary reads %+v, err=%v", read, err)
+	}
+	if err := writeSummary(filepath.Join(path, "summary.json"), rep); err == nil {
+		t.Error("summary written below a file")
+	}
+}
+
+// recordingNotifier keeps the summaries it is sent.
+type recordingNotifier struct {
+	sent []*Report
+}
+
+func (rn *recordingNotifier) Validate(n *notifyConfig) error {
+	if n.Options["channel"] == "" {
+		return fmt.Errorf("channel option is required")
+	}
+	return nil
+}
+
+func (rn *recordingNotifier) Send(n *notifyConfig, s *Report) error {
+	rn.sent = append(rn.sent, s)
+	return nil
+}
+
+func TestRegisteredNotifier(t *testing.T) {
+	rn := &recordingNotifier{}
+	registerNotifier("recording", rn)
+	defer delete(notifiers, "recording")
+
+	config := &Config{Notify: []*notifyConfig{{Type: "recording"}}}
+	if err := config.isNotifyValid(); err == nil {
+		t.Error("missing channel option accepted")
+	}
+	config.Notify[0].Options = map[string]string{"channel": "backups"}
+	if err := config.isNotifyValid(); err != nil {
+		t.Fatal(err)
+	}
+	config.notify(&Report{Succeeded: 1})
+	config.notify(&Report{Failed: 1})
+	if len(rn.sent) != 1 || rn.sent[0].Failed != 1 {
+		t.Errorf("sent %d summaries, want the failed run only", len(rn.sent))
+	}
+}
+
+// errorSink records the requests of an error tracker, failing them while
+// fail is set.
+type errorSink struct {
+	mu     sync.Mutex
+	bodies []map[string]interface{}
+	auth   []string
+	fail   bool
+}
+
+func (s *errorSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var body map[string]interface{}
+	json.NewDecoder(r.Body).Decode(&body)
+	s.bodies = append(s.bodies, body)
+	s.auth = append(s.auth, r.Header.Get("X-Sentry-Auth"))
+}
+
+func TestErrorReporting(t *testing.T) {
+	for _, tc := range []struct {
+		dsn      string
+		endpoint string
+		err      string
+	}{
+		{"https://key@sentry.example.com/42", "https://sentry.example.com/api/42/store/", ""},
+		{"https://key@example.com/sentry/42", "https://example.com/sentry/api/42/store/", ""},
+		{"https://sentry.example.com/42", "", "public key is missing"},
+		{"https://key@sentry.example.com/", "", "project id is missing"},
+		{"https://key@sentry.example.com:port/42", "", "invalid port"},
+	} {
+		endpoint, auth, err := sentryEndpoint(tc.dsn)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: err=%v, want %s", tc.dsn, err, tc.err)
+			}
+			config := &Config{ErrorReporting: &errorReporting{SentryDSN: tc.dsn}}
+			if err := config.isErrorReportingValid(); err == nil {
+				t.Errorf("%s: invalid DSN accepted", tc.dsn)
+			}
+			continue
+		}
+		if err != nil || endpoint != tc.endpoint || !strings.Contains(auth, "sentry_key=key") {
+			t.Errorf("%s: endpoint %s, auth %q, err=%v", tc.dsn, endpoint, auth, err)
+		}
+	}
+
+	webhook, sentry := &errorSink{}, &errorSink{}
+	whSrv, sentrySrv := httptest.NewServer(webhook), httptest.NewServer(sentry)
+	defer whSrv.Close()
+	defer sentrySrv.Close()
+	config := &Config{runID: "r1", ErrorReporting: &errorReporting{
+		Webhook:   whSrv.URL,
+		SentryDSN: strings.Replace(sentrySrv.URL, "://", "://key@", 1) + "/7",
+	}}
+	if err := config.isErrorReportingValid(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the panic is reported with its stack, then raised again
+	func() {
+		defer func() {
+			if v := recover(); v != "boom" {
+				t.Errorf("recovered %v, want the panic raised again", v)
+			}
+		}()
+		defer config.recoverAndReport(map[string]string{"entry": "www"})
+		panic("boom")
+	}()
+	if len(webhook.bodies) != 1 || len(sentry.bodies) != 1 {
+		t.Fatalf("trackers got %d and %d events, want 1", len(webhook.bodies), len(sentry.bodies))
+	}
+	ev := webhook.bodies[0]
+	ctx, _ := ev["Context"].(map[string]interface{})
+	if ev["Message"] != "panic: boom" || !strings.Contains(fmt.Sprint(ev["Stack"]), "TestErrorReporting") ||
+		ctx["entry"] != "www" || ctx["run_id"] != "r1" || ctx["hostname"] == nil {
+		t.Errorf("webhook event is %v", ev)
+	}
+	tags, _ := sentry.bodies[0]["tags"].(map[string]interface{})
+	if sentry.bodies[0]["message"] != "panic: boom" || tags["entry"] != "www" || !strings.Contains(sentry.auth[0], "sentry_key=key") {
+		t.Errorf("sentry event is %v, auth %q", sentry.bodies[0], sentry.auth[0])
+	}
+
+	// failed deliveries are only warned about
+	for _, s := range []*errorSink{webhook, sentry} {
+		s.mu.Lock()
+		s.fail = true
+		s.mu.Unlock()
+	}
+	config.reportError("internal error", nil, nil)
+	if len(webhook.bodies) != 1 || len(sentry.bodies) != 1 {
+		t.Error("failed deliveries were recorded")
+	}
+	(&Config{}).reportError("not configured", nil, nil)
+}
+
+// panickyBackend panics storing archives of the given entry.
+type panickyBackend struct {
+	storage.Backend
+	entry string
+}
+
+func (b panickyBackend) Put(name string, r io.Reader) error {
+	if strings.HasPrefix(name, b.entry) {
+		panic("bad timestamp")
+	}
+	return b.Backend.Put(name, r)
+}
+
+func TestRecoverEntry(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	webhook := &errorSink{}
+	srv := httptest.NewServer(webhook)
+	defer srv.Close()
+	m := storage.NewMemory()
+	config := &Config{
+		dst:            panickyBackend{m, "www"},
+		KeepGen:        1,
+		Entries:        []*Entry{{Name: "www", Path: src}, {Name: "db", Path: src}},
+		ErrorReporting: &errorReporting{Webhook: srv.URL},
+	}
+
+	var results []result
+	for _, ent := range config.Entries {
+		r := result{name: ent.Name}
+		r.err = config.archiveEntry(&r, ent)
+		results = append(results, r)
+	}
+	var pe *panicError
+	if !errors.As(results[0].err, &pe) || errorKind(results[0].err) != "panic" || pe.Error() != "panic: bad timestamp" {
+		t.Fatalf("www failed with %v, want the panic", results[0].err)
+	}
+	if results[1].err != nil {
+		t.Fatalf("db failed with %v", results[1].err)
+	}
+	objs, _ := m.List("")
+	for _, o := range objs {
+		if !strings.HasPrefix(o.Name, "db") {
+			t.Errorf("stored %s, want the db archive only", o.Name)
+		}
+	}
+	if len(objs) == 0 {
+		t.Error("db archive wasn't stored")
+	}
+	if len(webhook.bodies) != 1 || webhook.bodies[0]["Message"] != "panic: bad timestamp" {
+		t.Errorf("reported %v, want the panic", webhook.bodies)
+	}
+	if code := exitCode(results); code != _ExitPartial {
+		t.Errorf("exit code %d, want %d", code, _ExitPartial)
+	}
+	if code := exitCode(results[:1]); code != _ExitFailure {
+		t.Errorf("exit code %d, want %d", code, _ExitFailure)
+	}
+}
+
+func TestSelfBackup(t *testing.T) {
+	dir := t.TempDir()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "attest.key")
+	if err := os.WriteFile(keyPath, []byte(hex.EncodeToString(key.Seed())), 0600); err != nil {
+		t.Fatal(err)
+	}
+	state := filepath.Join(dir, "state")
+	if err := os.Mkdir(state, 0700); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		dst:         memoryBackend("www.tar.gz.100"),
+		TmpDir:      dir,
+		StateDir:    state,
+		KeepGen:     1,
+		raw:         []byte(`{"Dst":"/backup"}`),
+		Entries:     []*Entry{{Name: "www"}},
+		Attestation: &attestationConfig{Key: keyPath},
+		runID:       "run1",
+	}
+	if err := config.appendHistory([]result{{name: "www"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	self, err := config.addSelfEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(config.Entries); n != 2 || config.Entries[1].Name != _SelfEntry {
+		t.Fatalf("entries %v, want www and %s", config.Entries, _SelfEntry)
+	}
+	if entries := config.entriesWithSelf(); len(entries) != 2 {
+		t.Errorf("entriesWithSelf returned %d entries, want the self entry once", len(entries))
+	}
+	for _, name := range []string{_SelfConfig, _SelfCatalog, _SelfKeys, _HistoryFile} {
+		if _, err := os.Stat(filepath.Join(self, name)); err != nil {
+			t.Errorf("%s wasn't staged: %v", name, err)
+		}
+	}
+	catalog, _ := os.ReadFile(filepath.Join(self, _SelfCatalog))
+	if !strings.Contains(string(catalog), "www.tar.gz.100") {
+		t.Errorf("catalog %q, want the www archive", catalog)
+	}
+	data, _ := os.ReadFile(filepath.Join(self, _SelfKeys))
+	var keys selfKeys
+	if err := json.Unmarshal(data, &keys); err != nil {
+		t.Fatal(err)
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	if a := keys.Attestation; a == nil || a.Key != keyPath || a.KeyID != keyID(pub) {
+		t.Errorf("attestation key %+v, want %s of %s", a, keyID(pub), keyPath)
+	}
+	if strings.Contains(string(data), hex.EncodeToString(key.Seed())) {
+		t.Error("keys.json holds the attestation seed")
+	}
+}
+
+func TestSelfBackupDestinations(t *testing.T) {
+	src, dst, other := t.TempDir(), t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		encrypt string
+	}{
+		{"plain", ""},
+		{"encrypted", `,"Encrypt":{"Tool":"gpg","PassphraseEnv":"TARBU_TEST_PASSPHRASE"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dec := &Config{}
+			if tc.encrypt != "" {
+				if _, err := exec.LookPath("gpg"); err != nil {
+					t.Skip("gpg not found")
+				}
+				t.Setenv("GNUPGHOME", t.TempDir())
+				t.Setenv("TARBU_TEST_PASSPHRASE", "correct horse")
+				dec.Encrypt = &encryptConfig{PassphraseEnv: "TARBU_TEST_PASSPHRASE"}
+			}
+			data := fmt.Sprintf(`{"Dst":%q,"KeepGen":1,"SelfBackup":true%s,"Entries":[{"Name":"www","Path":%q},{"Name":"db","Path":%q,"Dst":%q}]}`,
+				dst, tc.encrypt, src, src, other)
+			cfg, err := parseConfig([]byte(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.TmpDir = t.TempDir()
+			rep, err := Run(context.Background(), cfg)
+			if err != nil || rep.Failed != 0 {
+				t.Fatalf("report is %+v, err=%v", rep, err)
+			}
+			for _, d := range []string{dst, other} {
+				b := &storage.Local{Dir: d}
+				gens, err := generations(b, &Entry{Name: _SelfEntry})
+				if err != nil || len(gens) != 1 {
+					t.Fatalf("%s has self backups %v, err=%v", d, gens, err)
+				}
+				if encrypted := encryption(&Entry{Name: _SelfEntry}, gens[0].Name) != ""; encrypted != (tc.encrypt != "") {
+					t.Errorf("%s: self backup %s, want it encrypted with the others: %v", d, gens[0].Name, tc.encrypt != "")
+				}
+				got, err := dec.readSelfConfig(b, gens[0].Name)
+				if err != nil || string(got) != data {
+					t.Errorf("%s: recovered %s, err=%v", d, got, err)
+				}
+				if tc.encrypt != "" {
+					if _, err := (&Config{}).readSelfConfig(b, gens[0].Name); err == nil {
+						t.Errorf("%s: encrypted self backup read without the passphrase", d)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAttestation(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{KeepGen: 3, Dst: "/backup", raw: []byte(`{}`), runID: "run1",
+		Entries: []*Entry{{Name: "www"}}}
+	results := []result{{name: "www", archive: "/backup/www.tar.gz.100", sha256: "abc"}}
+	data, err := signAttestation(config.attest(results, time.Unix(100, 0)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := verifyAttestation(data, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.Entries) != 1 || a.Entries[0].SHA256 != "abc" || a.Entries[0].Policy.KeepGen != 3 || a.RunID != "run1" {
+		t.Errorf("attestation doesn't hold the run: %+v", a)
+	}
+
+	other, _, _ := ed25519.GenerateKey(nil)
+	if _, err := verifyAttestation(data, other); err == nil {
+		t.Error("attestation verified with another key")
+	}
+	tampered := bytes.Replace(data, []byte(`"payload": "`), []byte(`"payload": "e`), 1)
+	if _, err := verifyAttestation(tampered, pub); err == nil {
+		t.Error("tampered attestation verified")
+	}
+}
+
+func TestSelftest(t *testing.T) {
+	dir := t.TempDir()
+	if err := (&Config{}).selftest(&Entry{SplitSize: "256K", Index: true}, dir, true); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restore missing a file fails the comparison
+	src := filepath.Join(dir, "src")
+	restored := filepath.Join(dir, "out", src)
+	if err := os.Remove(filepath.Join(restored, "empty")); err != nil {
+		t.Fatal(err)
+	}
+	fi, _ := os.Stat(src)
+	os.Chtimes(restored, fi.ModTime(), fi.ModTime())
+	if diffs, err := compareTrees(src, restored); err != nil || len(diffs) != 1 || !strings.Contains(diffs[0], "file=empty") {
+		t.Errorf("compareTrees returned %v, err=%v", diffs, err)
+	}
+}
+
+func TestScanSources(t *testing.T) {
+	src := t.TempDir()
+	old := time.Now().AddDate(-2, 0, 0)
+	for _, f := range []struct {
+		name string
+		size int
+		old  bool
+	}{{"a", 10, false}, {"big", 5000, false}, {"old", 20, true}, {"skip.log", 30, false}, {".git/HEAD", 40, false}, {"sub/b", 50, false}} {
+		p := filepath.Join(src, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, bytes.Repeat([]byte{'x'}, f.size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if f.old {
+			os.Chtimes(p, old, old)
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		ent   *Entry
+		files int64
+		bytes int64
+	}{
+		{"everything", &Entry{Path: src}, 6, 5150},
+		{"exclude", &Entry{Path: src, Exclude: []string{"*.log"}}, 5, 5120},
+		{"exclude vcs", &Entry{Path: src, ExcludeVCS: true}, 5, 5110},
+		{"max file size", &Entry{Path: src, MaxFileSize: "1K"}, 5, 150},
+		{"skip older than", &Entry{Path: src, SkipOlderThan: "365d"}, 5, 5130},
+		{"paths", &Entry{Paths: []string{filepath.Join(src, "a"), filepath.Join(src, "sub")}}, 2, 60},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.ent.Name = "census"
+			config := &Config{Entries: []*Entry{tc.ent}}
+			if err := config.isExcludeValid(); err != nil {
+				t.Fatal(err)
+			}
+			if err := config.isFiltersValid(); err != nil {
+				t.Fatal(err)
+			}
+			roots, err := tc.ent.sources()
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := config.scanSources(tc.ent, roots)
+			if err != nil || c.files != tc.files || c.bytes != tc.bytes {
+				t.Errorf("census is %+v, err=%v, want %d files of %d bytes", c, err, tc.files, tc.bytes)
+			}
+		})
+	}
+	config := &Config{}
+	if _, err := config.scanSources(&Entry{Name: "missing"}, []string{filepath.Join(src, "missing")}); err == nil {
+		t.Error("census of a missing source succeeded")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	for i := 0; i < 3; i++ {
+		if err := os.WriteFile(filepath.Join(src, fmt.Sprint(i)), bytes.Repeat([]byte{'x'}, 1000), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ent := &Entry{Name: "progress", Path: src}
+	config := &Config{Dst: dst, KeepGen: 1, Entries: []*Entry{ent}, progress: &progress{mode: "log", interval: time.Minute}}
+	c, err := config.scanSources(ent, []string{src})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &result{name: ent.Name, census: &c}
+	if err := backupEntryImpl(context.Background(), r, config, ent); err != nil {
+		t.Fatal(err)
+	}
+	e := r.progress
+	if e == nil || e.files != 3 || e.read != 3000 || e.written != r.size {
+		t.Fatalf("progress counted %+v, size=%d", e, r.size)
+	}
+	if pct := e.percent(); pct != 99 {
+		t.Errorf("percent=%d, want 99 until done", pct)
+	}
+	if len(config.progress.entries) != 0 {
+		t.Errorf("entry still tracked after the backup")
+	}
+
+	// log events go above the bars
+	var buf bytes.Buffer
+	p := &progress{mode: "bars", entries: []*entryProgress{e}}
+	l := &logger{w: &buf, bars: p}
+	p.draw(&buf)
+	l.event(levelInfo, "", "Backup succeeded")
+	out := buf.String()
+	if n := strings.Count(out, "progress "); n != 2 || !strings.Contains(out, "\x1b[1A\x1b[JBackup succeeded\n") {
+		t.Errorf("bars drawn as %q", out)
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name  string
+		tool  string
+		setup func(t *testing.T) string
+	}{
+		{"gpg passphrase", "gpg", func(t *testing.T) string {
+			t.Setenv("TARBU_TEST_PASSPHRASE", "correct horse")
+			return `{"Tool":"gpg","PassphraseEnv":"TARBU_TEST_PASSPHRASE"}`
+		}},
+		{"gpg passphrase file", "gpg", func(t *testing.T) string {
+			path := filepath.Join(t.TempDir(), "passphrase")
+			if err := os.WriteFile(path, []byte("correct horse\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			return fmt.Sprintf(`{"Tool":"gpg","PassphraseFile":%q}`, path)
+		}},
+		{"gpg recipient", "gpg", func(t *testing.T) string {
+			out, err := exec.Command("gpg", "--batch", "--passphrase", "", "--quick-gen-key", "tarbu@example.com", "future-default", "default", "never").CombinedOutput()
+			if err != nil {
+				t.Fatalf("generating a key failed: %s", out)
+			}
+			return `{"Tool":"gpg","Recipients":["tarbu@example.com"]}`
+		}},
+		{"age", "age", func(t *testing.T) string {
+			if _, err := exec.LookPath("age-keygen"); err != nil {
+				t.Skip("age-keygen not found")
+			}
+			identity := filepath.Join(t.TempDir(), "identity")
+			if out, err := exec.Command("age-keygen", "-o", identity).CombinedOutput(); err != nil {
+				t.Fatalf("generating an identity failed: %s", out)
+			}
+			out, err := exec.Command("age-keygen", "-y", identity).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			return fmt.Sprintf(`{"Tool":"age","Recipients":[%q],"Identity":%q}`, strings.TrimSpace(string(out)), identity)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := exec.LookPath(tc.tool); err != nil {
+				t.Skip(tc.tool + " not found")
+			}
+			t.Setenv("GNUPGHOME", t.TempDir())
+			dst := t.TempDir()
+			cfg, err := parseConfig([]byte(fmt.Sprintf(`{"Dst":%q,"KeepGen":2,"Encrypt":%s,"Entries":[{"Name":"www","Path":%q,"VerifyAfterWrite":true}]}`,
+				dst, tc.setup(t), src)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.TmpDir = t.TempDir()
+			rep, err := Run(context.Background(), cfg)
+			if err != nil || rep.Failed != 0 {
+				t.Fatalf("report is %+v, err=%v", rep, err)
+			}
+			b, ent := &storage.Local{Dir: dst}, cfg.Entries[0]
+			name := filepath.Base(rep.Entries[0].Archive)
+			if tool := encryption(ent, name); tool != tc.tool {
+				t.Fatalf("archive %s is encrypted with %q, want %s", name, tool, tc.tool)
+			}
+			if err := cfg.verifyArchive(b, ent, name); err != nil {
+				t.Fatal(err)
+			}
+			to := t.TempDir()
+			if _, err := Restore(cfg, "www", RestoreOptions{To: to}); err != nil {
+				t.Fatal(err)
+			}
+			if data, err := os.ReadFile(filepath.Join(to, strings.TrimPrefix(src, "/"), "file")); err != nil || string(data) != "data" {
+				t.Fatalf("restored file reads %q, err=%v", data, err)
+			}
+
+			if tc.name == "gpg passphrase" {
+				t.Setenv("TARBU_TEST_PASSPHRASE", "wrong")
+				if err := cfg.verifyArchive(b, ent, name); err == nil {
+					t.Error("archive decrypted with a wrong passphrase")
+				}
+			}
+		})
+	}
+}
+
+func TestRun(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Dst: dst, KeepGen: 1, Entries: []*Entry{{Name: "lib", Path: src}}}
+	rep, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Succeeded != 1 || rep.ExitCode != 0 || len(rep.Entries) != 1 || rep.Entries[0].Archive == "" {
+		t.Fatalf("report is %+v", rep)
+	}
+	if _, err := Run(context.Background(), &Config{Entries: []*Entry{{Name: "lib", Path: src}}}); err == nil {
+		t.Error("config without Dst ran")
+	}
+
+	// configs built in code are prepared as config files are
+	t.Setenv("TARBU_TEST_DST", dst)
+	if err := os.Mkdir(filepath.Join(dst, "built"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg = &Config{
+		Dst:      "${TARBU_TEST_DST}/built",
+		TimeZone: "UTC",
+		Defaults: json.RawMessage(`{"NameTemplate": "{name}-{date:20060102}-{seq}", "KeepGen": 3}`),
+		Entries:  []*Entry{{Name: "lib", Path: src}},
+	}
+	if rep, err = Run(context.Background(), cfg); err != nil || rep.Succeeded != 1 {
+		t.Fatalf("report is %+v, err=%v", rep, err)
+	}
+	want := filepath.Join(dst, "built", "lib-"+time.Now().UTC().Format("20060102")+"-0")
+	if rep.Entries[0].Archive != want || cfg.Entries[0].KeepGen != 3 {
+		t.Fatalf("archive is %s, want %s, KeepGen=%d", rep.Entries[0].Archive, want, cfg.Entries[0].KeepGen)
+	}
+
+	// a generation is picked by the key restore -ts takes
+	key, err := generationKey(cfg.Entries[0], want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to := t.TempDir()
+	for _, tc := range []struct {
+		name  string
+		entry string
+		opts  RestoreOptions
+		err   string
+	}{
+		{"no directory", "lib", RestoreOptions{}, "restore directory is required"},
+		{"unknown entry", "www", RestoreOptions{To: to}, "entry not found"},
+		{"missing generation", "lib", RestoreOptions{To: to, TS: "1"}, "generation not found"},
+		{"missing later run", "lib", RestoreOptions{To: to, TS: "1-2"}, "generation not found"},
+		{"include matching nothing", "lib", RestoreOptions{To: to, Include: []string{"nothing"}}, "no member matches"},
+		{"generation by key", "lib", RestoreOptions{To: t.TempDir(), TS: key.String()}, ""},
+		{"whole archive", "lib", RestoreOptions{To: to}, ""},
+	} {
+		loc, err := Restore(cfg, tc.entry, tc.opts)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: err=%v, want %s", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || loc != want {
+			t.Fatalf("%s: restored %s, err=%v", tc.name, loc, err)
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(to, strings.TrimPrefix(src, "/"), "file")); err != nil || string(data) != "data" {
+		t.Fatalf("restored file reads %q, err=%v", data, err)
+	}
+}
+
+func TestRestoreRelabel(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(t.TempDir(), "tarbu.json")
+	data := fmt.Sprintf(`{"Dst":%q,"KeepGen":2,"Entries":[{"Name":"www","Path":%q}]}`, dst, src)
+	if err := os.WriteFile(configPath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseConfig([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep, err := Run(context.Background(), cfg); err != nil || rep.Succeeded != 1 {
+		t.Fatalf("report is %+v, err=%v", rep, err)
+	}
+
+	log := stubCommand(t, "restorecon", `if [ -n "$RESTORECON_FAIL" ]; then echo "no policy" >&2; exit 1; fi`)
+	to := t.TempDir()
+	if err := restoreCommand([]string{"-config", configPath, "-to", to, "-relabel", "restorecon", "www"}); err != nil {
+		t.Fatal(err)
+	}
+	target := filepath.Join(to, strings.TrimPrefix(src, "/"))
+	if calls := stubCalls(t, log); len(calls) != 1 || calls[0] != "-R "+target {
+		t.Errorf("restorecon called with %q, want -R %s", calls, target)
+	}
+	if data, err := os.ReadFile(filepath.Join(target, "file")); err != nil || string(data) != "data" {
+		t.Fatalf("restored file reads %q, err=%v", data, err)
+	}
+
+	t.Setenv("RESTORECON_FAIL", "1")
+	err = restoreCommand([]string{"-config", configPath, "-to", t.TempDir(), "-relabel", "restorecon", "www"})
+	if err == nil || !strings.Contains(err.Error(), "restorecon failed") || !strings.Contains(err.Error(), "no policy") {
+		t.Errorf("failing restorecon: err=%v", err)
+	}
+	os.Remove(log)
+	if err := restoreCommand([]string{"-config", configPath, "-to", t.TempDir(), "-relabel", "fixfiles", "www"}); err == nil || !strings.Contains(err.Error(), "unknown relabel mode") {
+		t.Errorf("unknown relabel mode: err=%v", err)
+	}
+	if err := restoreCommand([]string{"-config", configPath, "-to", t.TempDir(), "www"}); err != nil {
+		t.Fatal(err)
+	}
+	if calls := stubCalls(t, log); len(calls) != 0 {
+		t.Errorf("restore without -relabel ran restorecon %q", calls)
+	}
+}
+
+func TestRestoreOpts(t *testing.T) {
+	for _, tc := range []struct {
+		ent      Entry
+		recorded bool
+		want     []string
+	}{
+		{Entry{}, false, nil},
+		{Entry{}, true, _SecurityAttrOpts},
+		{Entry{SecurityAttrs: true}, false, _SecurityAttrOpts},
+		{Entry{PreserveExtended: true}, false, _ExtendedAttrOpts},
+		{Entry{PreserveExtended: true, SecurityAttrs: true}, true, _ExtendedAttrOpts},
+	} {
+		if got := tc.ent.restoreOpts(tc.recorded); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("SecurityAttrs=%v PreserveExtended=%v recorded=%v: options %q, want %q",
+				tc.ent.SecurityAttrs, tc.ent.PreserveExtended, tc.recorded, got, tc.want)
+		}
+	}
+
+	// -relabel recorded restores what SecurityAttrs archived
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(t.TempDir(), "tarbu.json")
+	data := fmt.Sprintf(`{"Dst":%q,"KeepGen":2,"Entries":[{"Name":"www","Path":%q,"SecurityAttrs":true}]}`, dst, src)
+	if err := os.WriteFile(configPath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := parseConfig([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep, err := Run(context.Background(), cfg); err != nil || rep.Succeeded != 1 {
+		t.Fatalf("report is %+v, err=%v", rep, err)
+	}
+	to := t.TempDir()
+	if err := restoreCommand([]string{"-config", configPath, "-to", to, "-relabel", "recorded", "www"}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(to, strings.TrimPrefix(src, "/"), "file")); err != nil || string(data) != "data" {
+		t.Fatalf("restored file reads %q, err=%v", data, err)
+	}
+}
+
+func TestRunID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	a, b := newRunID(), newRunID()
+	if !uuid.MatchString(a) || a == b {
+		t.Fatalf("run IDs %s and %s, want distinct UUIDs", a, b)
+	}
+	t.Setenv(_RunIDEnv, "")
+	if id := runID(); !uuid.MatchString(id) || os.Getenv(_RunIDEnv) != id {
+		t.Fatalf("run ID %s, exported %s", id, os.Getenv(_RunIDEnv))
+	}
+
+	// a scheduler's ID ends up in the report, the history and the sidecar
+	t.Setenv(_RunIDEnv, "ci-42")
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{Dst: dst, StateDir: t.TempDir(), KeepGen: 1, Entries: []*Entry{{Name: "lib", Path: src}}}
+	rep, err := Run(context.Background(), cfg)
+	if err != nil || rep.Succeeded != 1 {
+		t.Fatalf("report is %+v, err=%v", rep, err)
+	}
+	if rep.RunID != "ci-42" {
+		t.Errorf("report run ID %s", rep.RunID)
+	}
+	records, err := cfg.readHistory(time.Time{})
+	if err != nil || len(records) != 1 || records[0].RunID != "ci-42" {
+		t.Errorf("history %+v, err=%v", records, err)
+	}
+	m, err := readMeta(&storage.Local{Dir: dst}, filepath.Base(rep.Entries[0].Archive))
+	if err != nil || m.RunID != "ci-42" {
+		t.Errorf("metadata %+v, err=%v", m, err)
+	}
+}
+
+func TestSchemaOnly(t *testing.T) {
+	// the dump tools write their arguments into the dump
+	bin := t.TempDir()
+	for tool, script := range map[string]string{
+		"pg_dump": "#!/bin/sh\nfor a; do case $a in --file=*) f=${a#--file=};; esac; done\necho \"$@\" > \"$f\"\n",
+		"slapcat": "#!/bin/sh\necho \"$@\" > \"$2\"\n",
+	} {
+		if err := os.WriteFile(filepath.Join(bin, tool), []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	dst := t.TempDir()
+	cfg := &Config{Dst: dst, KeepGen: 2, Entries: []*Entry{
+		{Name: "db", Type: "postgres", URI: "postgres://db.example.com/app"},
+		{Name: "db", Type: "postgres", URI: "postgres://db.example.com/app", SchemaOnly: true, KeepGen: 24},
+		{Name: "dir", Type: "ldap", SchemaOnly: true},
+	}}
+	if err := cfg.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	// naming again keeps a single sub-name
+	cfg.nameSchemaEntries()
+	var names []string
+	for _, e := range cfg.Entries {
+		names = append(names, e.Name)
+	}
+	if want := []string{"db", "db.schema", "dir.schema"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("entries %q, want %q", names, want)
+	}
+
+	for _, tc := range []struct {
+		ent  *Entry
+		dump string
+		want string
+	}{
+		{cfg.Entries[0], "db.sql", "--dbname=postgres://db.example.com/app\n"},
+		{cfg.Entries[1], "db.schema.sql", "--dbname=postgres://db.example.com/app --schema-only\n"},
+		{cfg.Entries[2], "dir.schema.ldif", "-n 0 -s cn=schema,cn=config\n"},
+	} {
+		staged, dir, err := cfg.stage(tc.ent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		data, err := os.ReadFile(filepath.Join(staged.Path, tc.dump))
+		if err != nil || !strings.HasSuffix(string(data), tc.want) {
+			t.Errorf("%s: dump %q, err=%v, want arguments ending in %q", tc.ent.Name, data, err, tc.want)
+		}
+	}
+
+	// full and schema dumps are separate generations
+	rep, err := Run(context.Background(), cfg)
+	if err != nil || rep.Succeeded != 3 {
+		t.Fatalf("report is %+v, err=%v", rep, err)
+	}
+	b := &storage.Local{Dir: dst}
+	for _, name := range []string{"db", "db.schema"} {
+		if gens, err := generations(b, &Entry{Name: name}); err != nil || len(gens) != 1 {
+			t.Errorf("%s has generations %v, err=%v", name, gens, err)
+		}
+	}
+
+	for _, ent := range []*Entry{
+		{Name: "cache", Type: "redis", SchemaOnly: true},
+		{Name: "www", Path: "/srv/www", SchemaOnly: true},
+	} {
+		config := &Config{Entries: []*Entry{ent}}
+		if err := config.isTypeValid(); err == nil || !strings.Contains(err.Error(), "has no schema-only dump") {
+			t.Errorf("%s: err=%v, want no schema-only dump", ent.Name, err)
+		}
+	}
+}
+
+func TestVolumeSnapshot(t *testing.T) {
+	// a btrfs copying the subvolume stands in for the real one
+	bin := t.TempDir()
+	script := "#!/bin/sh\nif [ \"$2\" = snapshot ]; then cp -a \"$4\" /tmp/snap.$$ && mv /tmp/snap.$$ \"$5\"; else rm -rf \"$3\"; fi\n"
+	if err := os.WriteFile(filepath.Join(bin, "btrfs"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	vol, dst := t.TempDir(), t.TempDir()
+	src := filepath.Join(vol, "data")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ent := &Entry{Name: "vol", Path: src, Snapshot: &volumeSnapshot{Type: "btrfs", Volume: vol}}
+	config := &Config{Dst: dst, KeepGen: 1, Entries: []*Entry{ent}, runID: "0123456789"}
+	if err := config.isValid(); err != nil {
+		t.Fatal(err)
+	}
+	r := &result{name: ent.Name}
+	if err := backupEntryImpl(context.Background(), r, config, ent); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readArchive(t, r.archive)[strings.TrimPrefix(src, "/")+"/file"]; !ok {
+		t.Errorf("snapshot not archived under the source path")
+	}
+	if left, _ := filepath.Glob(filepath.Join(vol, ".tarbu-*")); len(left) != 0 || len(r.warnings) != 0 {
+		t.Errorf("snapshot left behind %v, warnings=%v", left, r.warnings)
+	}
+
+	ent.Snapshot = &volumeSnapshot{Type: "lvm", Volume: "vg/lv", Mount: "/srv"}
+	if err := config.isVolumeSnapshotValid(); err == nil {
+		t.Error("path outside the snapshot mount passed")
+	}
+}
+
+func TestTemplateDiscover(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"x.conf", "y.conf", "z.txt"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		name string
+		t    entryTemplate
+		want []templateVars
+		err  string
+	}{
+		{"items", entryTemplate{Items: []string{"a", "b"}}, []templateVars{{"h", "a", "a", ""}, {"h", "b", "b", ""}}, ""},
+		{"glob", entryTemplate{Glob: filepath.Join(dir, "*.conf")},
+			[]templateVars{{"h", "x.conf", filepath.Join(dir, "x.conf"), ""}, {"h", "y.conf", filepath.Join(dir, "y.conf"), ""}}, ""},
+		{"command", entryTemplate{Command: []string{"printf", "db1\n\n  db2 \n"}}, []templateVars{{"h", "db1", "db1", ""}, {"h", "db2", "db2", ""}}, ""},
+		{"all", entryTemplate{Items: []string{"a"}, Glob: filepath.Join(dir, "z*"), Command: []string{"echo", "db1"}},
+			[]templateVars{{"h", "a", "a", ""}, {"h", "z.txt", filepath.Join(dir, "z.txt"), ""}, {"h", "db1", "db1", ""}}, ""},
+		{"nothing matched", entryTemplate{Glob: filepath.Join(dir, "*.none")}, nil, ""},
+		{"bad glob", entryTemplate{Glob: "["}, nil, "syntax error in pattern"},
+		{"failing command", entryTemplate{Command: []string{"sh", "-c", "echo oops >&2; exit 1"}}, nil, "discovery command failed"},
+	} {
+		got, err := tc.t.discover("h")
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: err=%v, want %s", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: discovered %+v, err=%v, want %+v", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestExpandEntries(t *testing.T) {
+	host, _ := os.Hostname()
+	type expanded struct {
+		Name, Path, Dst string
+		Exclude         []string
+		KeepGen         int
+	}
+	for _, tc := range []struct {
+		name string
+		data string
+		want []expanded
+		err  string
+	}{
+		{"defaults", `{"Defaults": {"KeepGen": 3}, "Entries": [{"Name": "etc", "Path": "/etc"}, {"Name": "www", "Path": "/var/www", "KeepGen": 5}]}`,
+			[]expanded{{"etc", "/etc", "", nil, 3}, {"www", "/var/www", "", nil, 5}}, ""},
+		{"template", `{"Defaults": {"KeepGen": 3}, "Entries": [{"Name": "etc", "Path": "/etc"}],
+			"Templates": [{"Items": ["app1", "app2"], "Entry": {"Name": "{{.Item}}-{{.Hostname}}", "Path": "/srv/{{.Item}}",
+				"Dst": "/backup/{{base .Path}}", "Exclude": ["{{.Entry}}.log", "tmp/"]}}]}`,
+			[]expanded{
+				{"etc", "/etc", "", nil, 3},
+				{"app1-" + host, "/srv/app1", "/backup/app1", []string{"app1-" + host + ".log", "tmp/"}, 3},
+				{"app2-" + host, "/srv/app2", "/backup/app2", []string{"app2-" + host + ".log", "tmp/"}, 3},
+			}, ""},
+		{"no items", `{"Templates": [{"Items": [], "Entry": {"Name": "{{.Item}}"}}]}`, nil, ""},
+		{"unknown variable in name", `{"Templates": [{"Items": ["a"], "Entry": {"Name": "{{.Host}}"}}]}`, nil, "config.Templates[0] is invalid. item=a"},
+		{"unknown variable in field", `{"Templates": [{"Items": ["a"], "Entry": {"Name": "a", "Path": "{{.Nope}}"}}]}`, nil, "can't evaluate field Nope"},
+		{"broken template", `{"Templates": [{"Items": ["a"], "Entry": {"Name": "{{.Item"}}]}`, nil, "config.Templates[0] is invalid. item=a"},
+		{"failing discovery", `{"Templates": [{"Command": ["false"], "Entry": {"Name": "a"}}]}`, nil, "config.Templates[0] discovery failed"},
+		{"broken defaults", `{"Defaults": {"KeepGen": "3"}, "Entries": [{"Name": "etc"}]}`, nil, "config.Defaults is invalid"},
+	} {
+		config := &Config{}
+		if err := json.Unmarshal([]byte(tc.data), config); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		err := config.expandEntries([]byte(tc.data))
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: err=%v, want %s", tc.name, err, tc.err)
+			}
+			continue
+		}
+		var got []expanded
+		for _, e := range config.Entries {
+			got = append(got, expanded{e.Name, e.Path, e.Dst, e.Exclude, e.KeepGen})
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: expanded to %+v, err=%v, want %+v", tc.name, got, err, tc.want)
+		}
+	}
+
+	// entries built in code get the Defaults they don't state
+	config := &Config{Defaults: json.RawMessage(`{"KeepGen": 3, "Compression": "zstd"}`),
+		Entries: []*Entry{{Name: "etc", Path: "/etc"}, {Name: "www", Path: "/var/www", KeepGen: 5}}}
+	if err := config.expandEntries(nil); err != nil {
+		t.Fatal(err)
+	}
+	if e := config.Entries; len(e) != 2 || e[0].KeepGen != 3 || e[1].KeepGen != 5 || e[1].Compression != "zstd" || e[1].Path != "/var/www" {
+		t.Errorf("entries built in code expanded to %+v %+v", e[0], e[1])
+	}
+}
+
+func TestExpandVariables(t *testing.T) {
+	defer os.Unsetenv("TARBU_TEST_SITE")
+	os.Setenv("TARBU_TEST_SITE", "tokyo")
+	host, _ := os.Hostname()
+	config := &Config{
+		Dst:     "/backups/${TARBU_TEST_SITE}/${HOSTNAME}",
+		clock:   offsetClock(time.Until(time.Date(2024, 5, 6, 7, 8, 9, 0, time.Local))),
+		Entries: []*Entry{{Name: "etc-${DATE:200601}", Path: "/etc", Paths: []string{"/srv/${TARBU_TEST_ZONE:-a}"}, Dst: "$$x ${DATE}"}},
+	}
+	if err := config.expandVariables(); err != nil {
+		t.Fatal(err)
+	}
+	e := config.Entries[0]
+	if config.Dst != "/backups/tokyo/"+host || e.Name != "etc-202405" || e.Paths[0] != "/srv/a" || e.Dst != "$x 2024-05-06" {
+		t.Fatalf("expanded to dst=%s entry=%+v", config.Dst, e)
+	}
+	for _, s := range []string{"${TARBU_TEST_UNSET}", "${TARBU_TEST_SITE"} {
+		if _, err := expandVars(s, func(string) (string, bool) { return "", false }); err == nil {
+			t.Errorf("%s expanded", s)
+		}
+	}
+}
+
+func TestVerifyAfterWrite(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "file"), filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	ent := &Entry{Name: "verify", Path: src, VerifyAfterWrite: true}
+	config := &Config{Dst: dst, KeepGen: 2, Entries: []*Entry{ent}}
+	r := &result{name: ent.Name}
+	if err := backupEntryImpl(context.Background(), r, config, ent); err != nil {
+		t.Fatal(err)
+	}
+	b, err := config.entryBackend(ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Base(r.archive)
+	// the directory and both names
+	if err := config.verifyWritten(b, ent, name, &archivedStats{3, 2, 8}); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.verifyWritten(b, ent, name, &archivedStats{3, 2, 9}); err == nil {
+		t.Error("archive with missing bytes verified")
+	}
+	data, err := os.ReadFile(r.archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(r.archive, data[:len(data)/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.verifyWritten(b, ent, name, nil); err == nil {
+		t.Error("truncated archive verified")
+	}
+}
+
+func TestVerifySample(t *testing.T) {
+	tarball := &bytes.Buffer{}
+	if err := archiver.Write(tarball, t.TempDir(), &archiver.Options{Relative: true, NoCompress: true}); err != nil {
+		t.Fatal(err)
+	}
+	ent := &Entry{Name: "www"}
+	gz := &bytes.Buffer{}
+	if err := copyTar(gz, bytes.NewReader(tarball.Bytes()), ent); err != nil {
+		t.Fatal(err)
+	}
+	m := storage.NewMemory()
+	for _, name := range []string{"www.tar.gz.100", "www.tar.gz.200", "www.tar.gz.300", "www.tar.gz.400"} {
+		m.Objects[name] = gz.Bytes()
+		sum := sha256.Sum256(gz.Bytes())
+		if err := writeChecksum(m, name, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// bit rot in the middle generation
+	m.Objects["www.tar.gz.200"] = append([]byte{}, gz.Bytes()...)
+	m.Objects["www.tar.gz.200"][20] ^= 0xff
+
+	rn := &recordingNotifier{}
+	registerNotifier("recording", rn)
+	defer delete(notifiers, "recording")
+	config := &Config{dst: m, Dst: "memory://", Entries: []*Entry{ent},
+		VerifySample: &verifySample{Percent: 50},
+		Notify:       []*notifyConfig{{Type: "recording"}}}
+	if err := config.isVerifySampleValid(); err != nil {
+		t.Fatal(err)
+	}
+	if config.VerifySample.every != _VerifySampleEvery {
+		t.Errorf("cadence %s, want weekly", config.VerifySample.every)
+	}
+	for _, v := range []*verifySample{{Percent: 0}, {Percent: 101}, {Percent: 10, Every: "weekly"}} {
+		if err := (&Config{VerifySample: v}).isVerifySampleValid(); err == nil {
+			t.Errorf("%+v is valid", v)
+		}
+	}
+
+	// half the old generations, rounded up, the newest never
+	picked, err := config.sample(rand.New(rand.NewSource(1)))
+	if err != nil || len(picked) != 2 {
+		t.Fatalf("sampled %d generations, err=%v", len(picked), err)
+	}
+	for _, p := range picked {
+		if p.gen.Name == "www.tar.gz.400" {
+			t.Error("newest generation sampled")
+		}
+	}
+
+	config.VerifySample.Percent = 100
+	now := time.Now()
+	results := config.verifySample(rand.New(rand.NewSource(1)))
+	status := map[string]string{}
+	for _, r := range results {
+		status[filepath.Base(r.archive)] = r.verified
+	}
+	if want := map[string]string{"www.tar.gz.100": "ok", "www.tar.gz.200": "corrupt", "www.tar.gz.300": "ok"}; !reflect.DeepEqual(status, want) {
+		t.Fatalf("verified %v, want %v", status, want)
+	}
+	if len(rn.sent) != 1 || rn.sent[0].Failed != 1 {
+		t.Errorf("sent %d alerts, want one with the corrupt archive", len(rn.sent))
+	}
+
+	// recorded apart from the backups, and shown by the catalog
+	if records, err := config.readHistory(time.Time{}); err != nil || len(records) != 0 {
+		t.Errorf("backup history has %d records, err=%v", len(records), err)
+	}
+	if next := config.nextVerify(now.Add(time.Hour)); next.Before(now.Add(_VerifySampleEvery)) || next.After(time.Now().Add(_VerifySampleEvery)) {
+		t.Errorf("next sample at %s, want a week after this one", next)
+	}
+	records, err := config.inventory(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog := map[string]string{}
+	for _, rec := range records {
+		catalog[filepath.Base(rec.Path)] = rec.Verify
+	}
+	if want := map[string]string{"www.tar.gz.100": "ok", "www.tar.gz.200": "corrupt", "www.tar.gz.300": "ok", "www.tar.gz.400": ""}; !reflect.DeepEqual(catalog, want) {
+		t.Errorf("catalog shows %v, want %v", catalog, want)
+	}
+}
+
+func TestHashCheck(t *testing.T) {
+	src := t.TempDir()
+	file, dir, link := filepath.Join(src, "file"), filepath.Join(src, "dir"), filepath.Join(src, "link")
+	if err := os.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(file, link); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		roots   []string
+		hashed  []string
+		wantErr bool
+	}{
+		{"file", []string{file}, []string{file}, false},
+		{"directory", []string{dir}, nil, false},
+		{"symlink", []string{link}, nil, false},
+		{"several", []string{dir, file, link}, []string{file}, false},
+		{"missing", []string{file, filepath.Join(src, "missing")}, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sums, err := hashRoots(tc.roots)
+			var sre *SourceReadError
+			if tc.wantErr {
+				if !errors.As(err, &sre) {
+					t.Fatalf("hashRoots returned %v, want a source read error", err)
+				}
+				return
+			}
+			if err != nil || len(sums) != len(tc.hashed) {
+				t.Fatalf("hashRoots returned %d sums, err=%v", len(sums), err)
+			}
+			for _, p := range tc.hashed {
+				if hex.EncodeToString(sums[p]) != "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7" {
+					t.Errorf("%s hashed to %x", p, sums[p])
+				}
+			}
+		})
+	}
+
+	// every regular file root is checked, not only Path
+	ent := &Entry{Name: "hashed", Paths: []string{dir, file}, HashCheck: true}
+	config := &Config{Dst: t.TempDir(), KeepGen: 1, Entries: []*Entry{ent}}
+	r := &result{name: ent.Name}
+	if err := backupEntryImpl(context.Background(), r, config, ent); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.warnings) != 0 {
+		t.Errorf("unchanged sources warned: %q", r.warnings)
+	}
+}
+
+func TestArchiveMeta(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := storage.NewMemory()
+	ent := &Entry{Name: "meta", Path: src, Naming: "numbered"}
+	config := &Config{dst: m, KeepGen: 2, Entries: []*Entry{ent}, runID: "run"}
+	for i := 0; i < 3; i++ {
+		if err := backupEntryImpl(context.Background(), &result{name: ent.Name}, config, ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// rotation moves the metadata with the archives
+	for _, slot := range []string{"1", "2"} {
+		meta, err := readMeta(m, "meta.tar.gz."+slot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, _ := os.Hostname()
+		if meta.Entry != "meta" || meta.Hostname != host || meta.RunID != "run" || len(meta.Source) != 1 || meta.Source[0] != src ||
+			meta.Files != 1 || meta.Bytes != 4 || meta.Version != Version || meta.End.IsZero() {
+			t.Errorf("metadata of slot %s is %+v", slot, meta)
+		}
+	}
+	if _, ok := m.Objects["meta.tar.gz.3.meta.json"]; ok {
+		t.Error("metadata of the expired archive is left")
+	}
+}
+
+func TestReplicas(t *testing.T) {
+	src, dst, rdst := t.TempDir(), t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ent := &Entry{Name: "rep", Path: src}
+	config := &Config{Dst: dst, KeepGen: 3, Entries: []*Entry{ent}, Replicas: []*replicaConfig{{Dst: rdst, KeepGen: 1}}}
+	if err := config.isReplicasValid(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		config.clock = fixedClock(now.Add(time.Duration(i) * time.Minute))
+		r := &result{name: ent.Name}
+		if err := backupEntryImpl(context.Background(), r, config, ent); err != nil {
+			t.Fatal(err)
+		}
+		if len(r.warnings) > 0 {
+			t.Fatal(r.warnings)
+		}
+	}
+	newest := fmt.Sprintf("rep.tar.gz.%d", now.Add(2*time.Minute).Unix())
+	// the replica keeps its own single generation
+	names := func(dir string) []string {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, fi := range fis {
+			names = append(names, fi.Name())
+		}
+		return names
+	}
+	want := []string{newest, newest + ".meta.json", newest + ".sha256"}
+	if got := names(rdst); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("replica holds %v, want %v", got, want)
+	}
+	if got := names(dst); len(got) != 9 {
+		t.Fatalf("primary holds %v", got)
+	}
+
+	// sync copies back what the replica keeps only
+	for _, n := range want {
+		os.Remove(filepath.Join(rdst, n))
+	}
+	b, _ := config.entryBackend(ent)
+	rep := config.Replicas[0]
+	missing, err := config.missingGenerations(b, rep.backend, rep.replicaEntry(ent))
+	if err != nil || len(missing) != 1 || missing[0] != newest {
+		t.Fatalf("missing %v, err=%v", missing, err)
+	}
+}
+
+func TestFilters(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	for name, size := range map[string]int{"small": 10, "image.qcow2": 2000, "old": 10} {
+		if err := os.WriteFile(filepath.Join(src, name), bytes.Repeat([]byte{'x'}, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	past := time.Now().Add(-400 * 24 * time.Hour)
+	if err := os.Chtimes(filepath.Join(src, "old"), past, past); err != nil {
+		t.Fatal(err)
+	}
+	ent := &Entry{Name: "filters", Path: src, MaxFileSize: "1K", SkipOlderThan: "365d"}
+	config := &Config{Dst: dst, KeepGen: 1, Entries: []*Entry{ent}}
+	if err := config.isFiltersValid(); err != nil {
+		t.Fatal(err)
+	}
+	r := &result{name: ent.Name}
+	if err := backupEntryImpl(context.Background(), r, config, ent); err != nil {
+		t.Fatal(err)
+	}
+	hdrs := readArchive(t, r.archive)
+	base := strings.TrimPrefix(filepath.ToSlash(src), "/") + "/"
+	if _, ok := hdrs[base+"small"]; !ok || len(hdrs) != 2 {
+		t.Fatalf("archived %v", hdrs)
+	}
+	s := config.summarize([]result{*r}, time.Now())
+	if e := s.Entries[0]; e.Filtered != 2 || len(e.FilteredPaths) != 2 {
+		t.Fatalf("summary entry is %+v", e)
+	}
+
+	typed := &Config{Entries: []*Entry{{Name: "db", Type: "postgres", MaxFileSize: "1G"}}}
+	if err := typed.isFiltersValid(); err == nil {
+		t.Error("filters on a dump are valid")
+	}
+}
+
+// brokenOpen is a backend whose objects can be listed but not read.
+type brokenOpen struct {
+	*storage.Memory
+}
+
+func (b brokenOpen) Open(name string) (io.ReadCloser, error) {
+	return nil, fmt.Errorf("connection reset")
+}
+
+func TestCatalog(t *testing.T) {
+	m := storage.NewMemory()
+	m.Objects["www.tar.gz.1700000000"] = []byte("data")
+	m.Objects["www.tar.gz.1700000000.sha256"] = []byte("sum")
+	m.Objects["www.tar.gz.1700000100"] = []byte("more data")
+	m.Objects["db.tar.gz.1"] = []byte("dump")
+	m.Objects[_SelfEntry+".tar.gz.1700000200"] = []byte("config")
+	entries := []*Entry{{Name: "www"}, {Name: "db", Naming: "numbered"}, {Name: "empty"}}
+	config := &Config{dst: m, Dst: "memory://", Entries: entries}
+
+	for _, tc := range []struct {
+		name     string
+		backend  storage.Backend
+		checksum bool
+		want     []string
+		wantErr  bool
+	}{
+		{"checksums", m, true, []string{
+			"entry,time,size,sha256,destination,path,verified,verify",
+			"www,2023-11-14T22:13:20Z,4,3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7,memory://,memory://www.tar.gz.1700000000",
+			"www,2023-11-14T22:15:00Z,9,",
+			"db,,4,",
+			_SelfEntry + ",2023-11-14T22:16:40Z,6,",
+		}, false},
+		{"no checksums", m, false, []string{
+			"entry,time,size,sha256,destination,path,verified,verify",
+			"www,2023-11-14T22:13:20Z,4,,memory://,memory://www.tar.gz.1700000000",
+		}, false},
+		{"unreadable archives", brokenOpen{m}, true, nil, true},
+		{"unreadable archives unhashed", brokenOpen{m}, false, []string{"www,2023-11-14T22:13:20Z,4,,"}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config.dst = tc.backend
+			records, err := config.inventory(tc.checksum)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("inventory returned %d records", len(records))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 4 {
+				t.Fatalf("inventory returned %+v", records)
+			}
+			var buf bytes.Buffer
+			if err := writeCatalogCSV(&buf, records); err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(buf.String(), "\n")
+			for _, w := range tc.want {
+				found := false
+				for _, l := range lines {
+					found = found || strings.HasPrefix(l, w)
+				}
+				if !found {
+					t.Errorf("no line starts with %q in\n%s", w, buf.String())
+				}
+			}
+		})
+	}
+}
+
+// jsonKeys returns the sorted keys of the JSON object data.
+func jsonKeys(t *testing.T, data []byte) []string {
+	t.Helper()
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestInspectJSON(t *testing.T) {
+	now := time.Unix(1700000300, 0)
+	m := storage.NewMemory()
+	m.Objects["www.tar.gz.1700000000"] = []byte("data")
+	m.Objects["www.tar.gz.1700000100"] = []byte("more data")
+	m.Objects["db.tar.gz.1"] = []byte("dump")
+	m.Objects["db.tar.gz.2"] = []byte("dump2")
+	if err := writeMeta(m, "www.tar.gz.1700000100", &archiveMeta{Entry: "www", RunID: "r1"}); err != nil {
+		t.Fatal(err)
+	}
+	entries := []*Entry{{Name: "www"}, {Name: "db", Naming: "numbered"}, {Name: "empty"}}
+	config := &Config{dst: m, Dst: "memory://", Entries: entries, clock: fixedClock(now)}
+
+	stats, err := config.stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 3 || stats[0].Generations != 2 || stats[0].Bytes != 13 || stats[0].Oldest.Unix() != 1700000000 ||
+		stats[0].Newest.Unix() != 1700000100 || stats[1].Bytes != 9 || stats[1].Oldest != nil || stats[2].Generations != 0 {
+		t.Fatalf("stats are %+v", stats)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		names   []string
+		entries []string
+		err     string
+	}{
+		{"every entry", nil, []string{"www", "db", "empty"}, ""},
+		{"named", []string{"db"}, []string{"db"}, ""},
+		{"unknown", []string{"mail"}, nil, "entry not found. name=mail"},
+	} {
+		list, err := config.list(tc.names)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: err=%v, want %s", tc.name, err, tc.err)
+			}
+			continue
+		}
+		var got []string
+		for _, le := range list {
+			got = append(got, le.Entry)
+		}
+		if err != nil || !reflect.DeepEqual(got, tc.entries) {
+			t.Errorf("%s: listed %q, err=%v, want %q", tc.name, got, err, tc.entries)
+		}
+	}
+	// numbered slots count up with age
+	list, _ := config.list([]string{"www", "db"})
+	www, db := list[0].Generations, list[1].Generations
+	if len(www) != 2 || *www[1].Age != 200 || www[0].Meta != nil || www[1].Meta.RunID != "r1" || db[0].Slot != 2 || db[0].Time != nil {
+		t.Fatalf("list is %+v", list)
+	}
+
+	// the field names are the schema scripts rely on
+	for _, tc := range []struct {
+		v    interface{}
+		keys []string
+	}{
+		{stats[0], []string{"Bytes", "Entry", "Generations", "Newest", "Oldest"}},
+		{stats[2], []string{"Bytes", "Entry", "Generations"}},
+		{list[0], []string{"Entry", "Generations"}},
+		{www[1], []string{"Age", "Archive", "Meta", "Size", "Time"}},
+		{db[0], []string{"Archive", "Size", "Slot"}},
+	} {
+		var buf bytes.Buffer
+		if err := writeJSON(&buf, tc.v); err != nil {
+			t.Fatal(err)
+		}
+		if keys := jsonKeys(t, buf.Bytes()); !reflect.DeepEqual(keys, tc.keys) {
+			t.Errorf("%T has keys %q, want %q", tc.v, keys, tc.keys)
+		}
+	}
+
+	m.Objects[metaName("www.tar.gz.1700000100")] = []byte("{")
+	if _, err := config.list(nil); err == nil || !strings.Contains(err.Error(), "archive metadata is unreadable") {
+		t.Errorf("corrupt metadata listed, err=%v", err)
+	}
+}
+
+func TestLogging(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want logLevel
+		err  bool
+	}{
+		{"debug", levelDebug, false},
+		{"WARN", levelWarn, false},
+		{"error", levelError, false},
+		{"fatal", 0, true},
+	} {
+		l, err := parseLogLevel(tc.s)
+		if (err != nil) != tc.err || l != tc.want {
+			t.Errorf("parseLogLevel(%q) = %s, err=%v", tc.s, l, err)
+		}
+	}
+
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	fields := []interface{}{"entry", "www", "start", start, "duration", 1500 * time.Millisecond, "size", logSize(3 << 20), "err", errors.New("disk full")}
+	for _, tc := range []struct {
+		name string
+		l    *logger
+		want string
+	}{
+		{"text", &logger{level: levelInfo},
+			"Backup failed: entry=www start=2024-01-02T03:04:05Z duration=1.5s size=3.0MiB err=disk full\n"},
+		{"json", &logger{level: levelInfo, json: true},
+			`"level":"warn","msg":"Backup failed","entry":"www","start":"2024-01-02T03:04:05Z","duration":1.5,"size":3145728,"err":"disk full"}` + "\n"},
+		{"filtered", &logger{level: levelError}, ""},
+	} {
+		var buf bytes.Buffer
+		var reported []string
+		tc.l.w = &buf
+		tc.l.report = func(level logLevel, line string) { reported = append(reported, level.String()+" "+line) }
+		tc.l.event(levelWarn, "", "Backup failed", fields...)
+		if !strings.HasSuffix(buf.String(), tc.want) || tc.want == "" && buf.Len() > 0 {
+			t.Errorf("%s: logged %q, want %q", tc.name, buf.String(), tc.want)
+		}
+		if tc.want != "" && (len(reported) != 1 || reported[0] != "warn "+strings.TrimSuffix(buf.String(), "\n")) {
+			t.Errorf("%s: reported %q", tc.name, reported)
+		}
+		if tc.l.json && tc.want != "" {
+			var ev map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &ev); err != nil || ev["time"] == nil {
+				t.Errorf("%s: event %s isn't JSON with a time, err=%v", tc.name, buf.String(), err)
+			}
+		}
+	}
+
+	// setupLogging changes the global logger
+	w, level, asJSON, file, color := logs.w, logs.level, logs.json, logs.file, colored
+	defer func() { logs.w, logs.level, logs.json, logs.file, colored = w, level, asJSON, file, color }()
+	for _, tc := range []struct{ level, format, err string }{
+		{"verbose", "text", "unknown log level"},
+		{"info", "xml", "unknown log format"},
+	} {
+		if err := setupLogging(tc.level, tc.format, ""); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s %s: err=%v, want %s", tc.level, tc.format, err, tc.err)
+		}
+	}
+	path := filepath.Join(t.TempDir(), "tarbu.log")
+	if err := setupLogging("debug", "text", path); err != nil {
+		t.Fatal(err)
+	}
+	defer logs.file.Close()
+	logDebug("Backup started", "entry", "www")
+	data, err := os.ReadFile(path)
+	if err != nil || !regexp.MustCompile(`^\S+ DEBUG Backup started: entry=www\n$`).Match(data) {
+		t.Errorf("log file has %q, err=%v", data, err)
+	}
+}
+
+func TestHumanFormats(t *testing.T) {
+	for _, tc := range []struct {
+		n    int64
+		want string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{1536, "1.5KiB"},
+		{-2048, "-2.0KiB"},
+		{5 << 30, "5.0GiB"},
+		{3 << 40, "3.0TiB"},
+	} {
+		if got := formatSize(tc.n); got != tc.want {
+			t.Errorf("formatSize(%d) = %s, want %s", tc.n, got, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		s    string
+		want int64
+		err  bool
+	}{
+		{"512M", 512 << 20, false},
+		{"4GiB", 4 << 30, false},
+		{"1.5k", 1536, false},
+		{"100", 100, false},
+		{"-1K", 0, true},
+		{"lots", 0, true},
+	} {
+		n, err := parseSize(tc.s)
+		if (err != nil) != tc.err || n != tc.want {
+			t.Errorf("parseSize(%q) = %d, err=%v", tc.s, n, err)
+		}
+	}
+	for _, tc := range []struct {
+		d    time.Duration
+		want string
+	}{
+		{30 * time.Second, "0m"},
+		{90 * time.Minute, "1h30m"},
+		{76*time.Hour + 5*time.Minute, "3d4h"},
+		{48*time.Hour + 5*time.Minute, "2d"},
+	} {
+		if got := formatAge(tc.d); got != tc.want {
+			t.Errorf("formatAge(%s) = %s, want %s", tc.d, got, tc.want)
+		}
+	}
+	for _, tc := range []struct {
+		s    string
+		want time.Duration
+		err  bool
+	}{
+		{"30d", 30 * 24 * time.Hour, false},
+		{"2w", 14 * 24 * time.Hour, false},
+		{"90m", 90 * time.Minute, false},
+		{"soon", 0, true},
+	} {
+		d, err := parseDuration(tc.s)
+		if (err != nil) != tc.err || d != tc.want {
+			t.Errorf("parseDuration(%q) = %s, err=%v", tc.s, d, err)
+		}
+	}
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		zone string
+		want string
+		err  string
+	}{
+		{"UTC", "2024-01-02 03:04:05 UTC", ""},
+		{"Asia/Tokyo", "2024-01-02 12:04:05 JST", ""},
+		{"Mars/Olympus", "", "unknown time zone. zone=Mars/Olympus"},
+	} {
+		config := &Config{TimeZone: tc.zone}
+		err := config.loadTimeZone()
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%s: err=%v, want %s", tc.zone, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Skip(err)
+		}
+		if got := config.formatTime(at); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.zone, got, tc.want)
+		}
+	}
+	if got := (&Config{}).formatTime(at); got != at.In(time.Local).Format(_TimeLayout) {
+		t.Errorf("without TimeZone %s, want the local zone", got)
+	}
+}
+
+func TestListText(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	m := storage.NewMemory()
+	m.Objects["www.tar.gz.1699900000"] = make([]byte, 3<<20)
+	m.Objects["www.tar.gz.1699999000"] = []byte("data")
+	m.Objects["db.tar.gz.1"] = []byte("dump")
+	meta := &archiveMeta{Entry: "www", Hostname: "web1", Source: []string{"/srv/www", "/etc/nginx"}, Files: 12, Bytes: 5 << 20,
+		Version: "1.2.0", Start: now.Add(-1000 * time.Second), End: now.Add(-910 * time.Second)}
+	if err := writeMeta(m, "www.tar.gz.1699999000", meta); err != nil {
+		t.Fatal(err)
+	}
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip(err)
+	}
+	config := &Config{dst: m, Dst: "memory://", clock: fixedClock(now), location: tokyo,
+		Entries: []*Entry{{Name: "www"}, {Name: "db", Naming: "numbered"}}}
+	list, err := config.list(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	config.writeListText(&buf, list)
+	want := "www: 2 generations\n" +
+		"  2023-11-14 03:26:40 JST    3.0MiB     1d3h  memory://www.tar.gz.1699900000\n" +
+		"  2023-11-15 06:56:40 JST        4B      16m  memory://www.tar.gz.1699999000\n" +
+		"                          host=web1 source=/srv/www,/etc/nginx files=12 contents=5.0MiB took=1m30s version=1.2.0\n" +
+		"\n" +
+		"db: 1 generations\n" +
+		"  #1                             4B           memory://db.tar.gz.1\n"
+	if buf.String() != want {
+		t.Errorf("list is\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	config := &Config{StateDir: t.TempDir(), Entries: []*Entry{{Name: "www"}, {Name: `db"1`}, {Name: "new"}}}
+	if err := config.appendHistory([]result{
+		{name: "www", start: start, duration: 10 * time.Second, size: 100},
+		{name: `db"1`, start: start, duration: 3 * time.Second, size: 50},
+		{name: "old", start: start, duration: time.Second, size: 1},
+		{name: _SelfEntry, start: start, duration: time.Second, size: 7},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.appendHistory([]result{
+		{name: "www", start: start.Add(time.Hour), duration: 20 * time.Second, err: errors.New("disk full")},
+		{name: `db"1`, start: start.Add(time.Hour), skipped: "heavy entry on battery power"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := config.metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE tarbu_last_success_timestamp_seconds gauge\n",
+		`tarbu_last_success_timestamp_seconds{entry="www"} 1.70000001e+09` + "\n",
+		`tarbu_last_success_timestamp_seconds{entry="db\"1"} 1.700000003e+09` + "\n",
+		`tarbu_last_run_timestamp_seconds{entry="www"} 1.7000036e+09` + "\n",
+		`tarbu_last_duration_seconds{entry="www"} 20` + "\n",
+		`tarbu_last_archive_size_bytes{entry="www"} 100` + "\n",
+		`tarbu_last_archive_size_bytes{entry="` + _SelfEntry + `"} 7` + "\n",
+		"# TYPE tarbu_failures_total counter\n",
+		`tarbu_failures_total{entry="www"} 1` + "\n",
+		`tarbu_failures_total{entry="new"} 0` + "\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("metrics lack %q:\n%s", want, data)
+		}
+	}
+	for _, unwanted := range []string{`entry="old"`, `tarbu_last_run_timestamp_seconds{entry="new"}`} {
+		if strings.Contains(string(data), unwanted) {
+			t.Errorf("metrics have %s:\n%s", unwanted, data)
+		}
+	}
+
+	config.MetricsFile = filepath.Join(t.TempDir(), "tarbu.prom")
+	if err := config.writeMetricsFile(); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(config.MetricsFile)
+	if written, _ := os.ReadFile(config.MetricsFile); err != nil || fi.Mode().Perm() != 0644 || string(written) != string(data) {
+		t.Errorf("metrics file has mode %v, err=%v", fi.Mode(), err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(filepath.Dir(config.MetricsFile), ".tarbu-metrics-*")); len(left) > 0 {
+		t.Errorf("temporary files left %q", left)
+	}
+
+	// a failed refresh keeps serving the last metrics
+	h := &metricsHandler{}
+	h.refresh(config)
+	config.StateDir = config.MetricsFile
+	h.refresh(config)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Body.String() != string(data) || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("served %q as %s", rec.Body.String(), rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestReport(t *testing.T) {
+	now := time.Date(2024, 2, 27, 10, 30, 0, 0, time.UTC)
+	at := func(h int) time.Time { return now.Add(time.Duration(-h) * time.Hour) }
+	for _, tc := range []struct {
+		name    string
+		records []historyRecord
+		want    []entryReport
+		text    []string
+	}{
+		{"no runs", nil, nil, []string{"No runs recorded in this period."}},
+		{"growing", []historyRecord{
+			{Entry: "www", Start: at(3), Size: 1000},
+			{Entry: "www", Start: at(2), Size: 1500},
+			{Entry: "www", Start: at(1), Size: 3000},
+		}, []entryReport{{Entry: "www", Runs: 3, FirstSize: 1000, LastSize: 3000}}, []string{"100.0%", "+2.0K"}},
+		{"failures", []historyRecord{
+			{Entry: "db", Start: at(4), Error: "dump failed", RunID: "r1"},
+			{Entry: "db", Start: at(3), Size: 5000},
+			{Entry: "db", Start: at(2), Size: 4000},
+			{Entry: "db", Start: at(1), Error: "disk full", RunID: "r4"},
+		}, []entryReport{{Entry: "db", Runs: 4, Failures: 2, FirstSize: 5000, LastSize: 4000, LastError: "disk full", LastFailed: at(1), LastRunID: "r4"}},
+			[]string{"50.0%", "-1000B", "Last failure of db at 2024-02-27 09:30", "disk full", "run=r4"}},
+		{"skipped runs don't count", []historyRecord{
+			{Entry: "laptop", Start: at(2), Skipped: "heavy entry on battery power"},
+			{Entry: "www", Start: at(1), Size: 10},
+		}, []entryReport{{Entry: "www", Runs: 1, FirstSize: 10, LastSize: 10}}, []string{"www"}},
+		{"only failures", []historyRecord{
+			{Entry: "db", Start: at(1), Error: "dump failed"},
+		}, []entryReport{{Entry: "db", Runs: 1, Failures: 1, LastError: "dump failed", LastFailed: at(1)}}, []string{"0.0%"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rep := buildReport(tc.records, at(24), now)
+			if len(rep.Entries) != len(tc.want) {
+				t.Fatalf("report has %d entries, want %d", len(rep.Entries), len(tc.want))
+			}
+			for i, er := range rep.Entries {
+				if !reflect.DeepEqual(*er, tc.want[i]) {
+					t.Errorf("entry report %+v, want %+v", *er, tc.want[i])
+				}
+			}
+			config := &Config{location: time.UTC}
+			var buf bytes.Buffer
+			config.writeReportText(&buf, rep)
+			for _, w := range tc.text {
+				if !strings.Contains(buf.String(), w) {
+					t.Errorf("text report lacks %q:\n%s", w, buf.String())
+				}
+			}
+			buf.Reset()
+			if err := reportHTML.Execute(&buf, rep); err != nil {
+				t.Fatal(err)
+			}
+			if len(tc.want) > 0 && !strings.Contains(buf.String(), "<td>"+tc.want[0].Entry+"</td>") {
+				t.Errorf("HTML report lacks %s:\n%s", tc.want[0].Entry, buf.String())
+			}
+		})
+	}
+
+	data, err := json.Marshal(&entryReport{Entry: "db", Runs: 4, Failures: 1, FirstSize: 10, LastSize: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"SuccessRate":75,"Growth":-6`) {
+		t.Errorf("JSON report is %s", data)
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	for _, tc := range []struct {
+		name   string
+		ent    *Entry
+		names  []string
+		status string
+		age    int64
+		err    string
+	}{
+		{"fresh", &Entry{Name: "db"}, []string{"db.tar.gz.1699900000", "db.tar.gz.1699990000"}, "fresh", 10000, ""},
+		{"stale", &Entry{Name: "db"}, []string{"db.tar.gz.1699900000"}, "stale", 100000, ""},
+		{"missing", &Entry{Name: "db"}, []string{"www.tar.gz.1699990000"}, "missing", 0, ""},
+		{"numbered", &Entry{Name: "db", Naming: "numbered"}, []string{"db.tar.gz.0"}, "", 0, "numbered entries have no backup time"},
+	} {
+		config := &Config{dst: memoryBackend(tc.names...), clock: fixedClock(now)}
+		res, err := config.freshness(tc.ent, 26*time.Hour)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: err=%v, want %s", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || res.Status != tc.status || res.Age != tc.age || res.MaxAge != 26*3600 {
+			t.Errorf("%s: result %+v, err=%v", tc.name, res, err)
+		}
+		if tc.status == "missing" && (res.Archive != "" || res.Time != nil) {
+			t.Errorf("%s: missing backup has archive %s", tc.name, res.Archive)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-entry", "db", "-max-age", "soon"},
+		{"-entry", "db", "-max-age", "-1h"},
+	} {
+		if err := assertFreshCommand(args); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	now := time.Date(2024, 2, 27, 10, 30, 0, 0, time.UTC)
+	dst := storage.NewMemory()
+	config := &Config{dst: dst, StateDir: t.TempDir(), StaleAfter: "26h"}
+	for _, name := range []string{"ok", "failing", "stale", "missing"} {
+		config.Entries = append(config.Entries, &Entry{Name: name})
+	}
+	if err := config.isHistoryValid(); err != nil {
+		t.Fatal(err)
+	}
+	err := config.appendHistory([]result{
+		{name: "ok", start: now.Add(-3 * time.Hour), size: 10},
+		{name: "failing", start: now.Add(-2 * time.Hour), size: 20},
+		{name: "failing", start: now.Add(-time.Hour), err: fmt.Errorf("disk full")},
+		{name: "stale", start: now.Add(-48 * time.Hour), size: 30},
+		// skipped runs don't count
+		{name: "stale", start: now.Add(-time.Hour), skipped: "heavy entry on battery power"},
+		{name: "missing", start: now.Add(-time.Hour), err: fmt.Errorf("source vanished")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the journal is kept in StateDir
+	if objs, _ := dst.List(""); len(objs) != 0 {
+		t.Errorf("journal written to Dst: %v", objs)
+	}
+	records, err := config.readHistory(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := buildStatus(config.Entries, records, now, config.staleAfter)
+	for i, want := range []string{"ok", "failing", "stale", "missing"} {
+		if list[i].Status != want {
+			t.Errorf("%s is %s, want %s", list[i].Entry, list[i].Status, want)
+		}
+	}
+	if list[1].Size != 20 || list[1].Error != "disk full" {
+		t.Errorf("failing entry is %+v", list[1])
+	}
+	if list[2].Age == nil || *list[2].Age != 48*3600 {
+		t.Errorf("stale entry age is %v", list[2].Age)
+	}
+
+	config.StaleAfter = "0"
+	if err := config.isHistoryValid(); err == nil {
+		t.Error("zero StaleAfter is accepted")
+	}
+}
+
+func TestNameTemplate(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "file"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	// an archive named before the template was set
+	legacy := fmt.Sprintf("tpl.tar.gz.%d", now.Add(-time.Hour).Unix())
+	m := memoryBackend(legacy)
+	ent := &Entry{Name: "tpl", Path: src, NameTemplate: "{name}-{date:2006-01-02T150405}-{seq}.tar.gz"}
+	config := &Config{dst: m, KeepGen: 3, Entries: []*Entry{ent}, clock: fixedClock(now), location: time.UTC}
+	if err := config.isNamingValid(); err != nil {
+		t.Fatal(err)
+	}
+	// runs within the same second don't collide, nor reuse the number
+	// of a pruned archive
+	for i := 0; i < 4; i++ {
+		if err := backupEntryImpl(context.Background(), &result{name: ent.Name}, config, ent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gens, err := generations(m, ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, g := range gens {
+		got = append(got, g.Name)
+	}
+	want := []string{"tpl-2024-03-10T120000-1.tar.gz", "tpl-2024-03-10T120000-2.tar.gz", "tpl-2024-03-10T120000-3.tar.gz"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("generations are %v, want %v", got, want)
+	}
+	if _, ok := m.Objects[legacy]; ok {
+		t.Error("legacy archive isn't pruned")
+	}
+	if ts := archiveTime(ent, want[0]); ts != now.Unix() {
+		t.Errorf("archive time is %d", ts)
+	}
+
+	// legacy names take a sequence number instead of a later second, and
+	// so do their manifests
+	plain := &Entry{Name: "plain", Path: src, Index: true}
+	config.Entries = append(config.Entries, plain)
+	for i := 0; i < 3; i++ {
+		if err := backupEntryImpl(context.Background(), &result{name: plain.Name}, config, plain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gens, err = generations(m, plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = nil
+	for _, g := range gens {
+		got = append(got, g.Name)
+		if ts := archiveTime(plain, g.Name); ts != now.Unix() {
+			t.Errorf("archive time of %s is %d", g.Name, ts)
+		}
+		man, err := readManifest(m, plain, archiveKey(plain, g.Name))
+		if err != nil || man.key() != archiveKey(plain, g.Name) {
+			t.Errorf("manifest of %s is %v, err=%v", g.Name, man, err)
+		}
+	}
+	want = []string{fmt.Sprintf("plain.tar.gz.%d", now.Unix()), fmt.Sprintf("plain.tar.gz.%d-1", now.Unix()), fmt.Sprintf("plain.tar.gz.%d-2", now.Unix())}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("generations are %v, want %v", got, want)
+	}
+	for _, name := range []string{"plain.tar.gz.", "plain.tar.gz.x", "plain.tar.gz.1-", "plain.tar.gz.1-0", "plain.tar.gz.1-x", "other.tar.gz.1"} {
+		if _, err := generationKey(plain, name); err == nil {
+			t.Errorf("%s has a genKey", name)
+		}
+	}
+
+	// without {seq} a taken name fails
+	ent.NameTemplate = "{name}-{unix}.tar.gz"
+	if err := config.isNamingValid(); err != nil {
+		t.Fatal(err)
+	}
+	for i, wantErr := range []bool{false, true} {
+		err := backupEntryImpl(context.Background(), &result{name: ent.Name}, config, ent)
+		if (err != nil) != wantErr {
+			t.Errorf("run %d: err=%v", i, err)
+		}
+	}
+
+	for _, tmpl := range []string{"{date:2006}-{name}", "{name}-{seq}", "{name}-{unix}{seq}", "{name}-{date:Jan 2}", "{name}-{date:2006/01/02}", "{name}-{when}", "{name}-{unix"} {
+		if _, err := parseNameTemplate(ent, tmpl, time.UTC); err == nil {
+			t.Errorf("%s is accepted", tmpl)
+		}
+	}
+}
+
+func TestArchiveWorkers(t *testing.T) {
+	src := t.TempDir()
+	data := bytes.Repeat([]byte("many small files "), 200000)
+	if err := os.WriteFile(filepath.Join(src, "file"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := storage.NewMemory()
+	ent := &Entry{Name: "par", Path: src}
+	config := &Config{dst: m, KeepGen: 1, ArchiveWorkers: 4, Entries: []*Entry{ent}}
+	if err := config.isCompressionValid(); err != nil {
+		t.Fatal(err)
+	}
+	opts := config.archiveOptions(ent)
+	if opts.GzipWorkers != 4 || opts.ReadWorkers != 4 {
+		t.Errorf("archiver options are gzip=%d read=%d", opts.GzipWorkers, opts.ReadWorkers)
+	}
+	if err := backupEntryImpl(context.Background(), &result{name: ent.Name}, config, ent); err != nil {
+		t.Fatal(err)
+	}
+	gens, err := generations(m, ent)
+	if err != nil || len(gens) != 1 {
+		t.Fatalf("generations %v, err=%v", gens, err)
+	}
+	if err := config.verifyArchive(m, ent, gens[0].Name); err != nil {
+		t.Fatal(err)
+	}
+
+	// ReadWorkers wins where set
+	ent.ReadWorkers = 2
+	if opts := config.archiveOptions(ent); opts.ReadWorkers != 2 {
+		t.Errorf("read workers are %d", opts.ReadWorkers)
+	}
+	ent.ArchiveWorkers = -1
+	if err := config.isCompressionValid(); err == nil {
+		t.Error("negative ArchiveWorkers is accepted")
+	}
+}
+
+func TestStream(t *testing.T) {
+	src := t.TempDir()
+	for _, n := range []string{"keep", "skip.log"} {
+		if err := os.WriteFile(filepath.Join(src, n), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m := storage.NewMemory()
+	out := &bytes.Buffer{}
+	ent := &Entry{Name: "stream", Path: src, Exclude: []string{"*.log"}}
+	config := &Config{dst: m, KeepGen: 1, Entries: []*Entry{ent}, stream: out}
+	if err := config.isExcludeValid(); err != nil {
+		t.Fatal(err)
+	}
+	r := &result{name: ent.Name}
+	if err := backupEntryImpl(context.Background(), r, config, ent); err != nil {
+		t.Fatal(err)
+	}
+	// nothing goes to Dst
+	if len(m.Objects) != 0 {
+		t.Errorf("Dst holds %v", remaining(m))
+	}
+	sum := sha256.Sum256(out.Bytes())
+	if r.archive != _StreamLocation || r.size != int64(out.Len()) || r.sha256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("result is archive=%s size=%d sha256=%s", r.archive, r.size, r.sha256)
+	}
+	zr, err := gzip.NewReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(zr)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, filepath.Base(hdr.Name))
+	}
+	if strings.Join(names, " ") != filepath.Base(src)+" keep" {
+		t.Errorf("streamed %v", names)
+	}
+}
+
+func TestCompletionCommands(t *testing.T) {
+	listed := map[string]bool{}
+	for _, c := range completionCommands[1:] {
+		if _, ok := commands[c.name]; !ok {
+			t.Errorf("completion lists %s, which Main doesn't run", c.name)
+		}
+		listed[c.name] = true
+	}
+	for name := range commands {
+		if !listed[name] && name != "receive" {
+			t.Errorf("completion lacks the subcommand %s", name)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// catalogRecord describes one archive found in a destination. Time is
+// unknown for numbered entries. Verify is the outcome of the last
+// verification sample that picked the archive, at Verified.
+type catalogRecord struct {
+	Entry       string
+	Time        *time.Time `json:",omitempty"`
+	Size        int64
+	SHA256      string `json:",omitempty"`
+	Destination string
+	Path        string
+	Verified    *time.Time `json:",omitempty"`
+	Verify      string     `json:",omitempty"`
+}
+
+func catalogCommand(args []string) error {
+	if len(args) < 1 || args[0] != "export" {
+		return fmt.Errorf("usage: tarbu catalog export [-config path] [-format csv|json] [-json] [-no-checksum]")
+	}
+
+	fs := flag.NewFlagSet("catalog export", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	format := fs.String("format", "csv", "output format, csv or json")
+	noChecksum := fs.Bool("no-checksum", false, "don't hash archives")
+	asJSON := fs.Bool("json", false, "print JSON, the same as -format json")
+	fs.Parse(args[1:])
+	if *asJSON {
+		*format = "json"
+	}
+
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown format. format=%s", *format)
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	records, err := config.inventory(!*noChecksum)
+	if err != nil {
+		return err
+	}
+
+	if *format == "json" {
+		return writeJSON(os.Stdout, records)
+	}
+	return writeCatalogCSV(os.Stdout, records)
+}
+
+// inventory lists every generation of every entry, optionally hashing
+// the archives.
+func (config *Config) inventory(checksum bool) ([]catalogRecord, error) {
+	records := []catalogRecord{}
+	// the archives are listed without the verification results when the
+	// history can't be read
+	verifications, err := config.readVerifications()
+	if err != nil {
+		printWarning("Reading verification history failed: err=%s", err)
+	}
+	// later samples override earlier ones
+	verified := map[string]historyRecord{}
+	for _, v := range verifications {
+		verified[v.Archive] = v
+	}
+	entries := config.entriesWithSelf()
+	for _, e := range entries {
+		b, err := config.entryBackend(e)
+		if err != nil {
+			return nil, err
+		}
+		gens, err := generations(b, e)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range gens {
+			rec := catalogRecord{
+				Entry:       e.Name,
+				Size:        g.Size,
+				Destination: config.entryDst(e),
+				Path:        b.Location(g.Name),
+			}
+			if !e.numbered() {
+				at := time.Unix(archiveTime(e, g.Name), 0)
+				rec.Time = &at
+			}
+			if v, ok := verified[rec.Path]; ok {
+				at := v.Start
+				rec.Verified, rec.Verify = &at, v.Verify
+			}
+			if checksum {
+				sum, err := hashObject(b, g.Name)
+				if err != nil {
+					return nil, err
+				}
+				rec.SHA256 = hex.EncodeToString(sum)
+			}
+			records = append(records, rec)
+		}
+	}
+	return records, nil
+}
+
+func hashObject(b storage.Backend, name string) ([]byte, error) {
+	r, err := b.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func writeCatalogCSV(w io.Writer, records []catalogRecord) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"entry", "time", "size", "sha256", "destination", "path", "verified", "verify"})
+	for _, r := range records {
+		at, verified := "", ""
+		if r.Time != nil {
+			at = r.Time.UTC().Format(time.RFC3339)
+		}
+		if r.Verified != nil {
+			verified = r.Verified.UTC().Format(time.RFC3339)
+		}
+		cw.Write([]string{
+			r.Entry,
+			at,
+			strconv.FormatInt(r.Size, 10),
+			r.SHA256,
+			r.Destination,
+			r.Path,
+			verified,
+			r.Verify,
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,49 @@
+package backup
+
+import (
+	"os"
+
+	"github.com/k3nju/tarbu/internal/archiver"
+)
+
+// census is the number of files and bytes found under an entry's source.
+type census struct {
+	files int64
+	bytes int64
+}
+
+// scanSources counts the regular files the archive of ent would hold
+// from roots, leaving out what Exclude, ExcludeVCS and the filters
+// leave out. Special files never count, files vanishing meanwhile
+// don't, and unreadable directories fail the census as they fail the
+// archive.
+func (config *Config) scanSources(ent *Entry, roots []string) (census, error) {
+	var c census
+	opts := config.archiveOptions(ent)
+	opts.Special = func(string) error { return nil }
+	opts.Changed = func(*archiver.ChangeError) error { return nil }
+	err := archiver.List(roots, opts, func(_, _ string, fi os.FileInfo) error {
+		if fi.Mode().IsRegular() {
+			c.files++
+			c.bytes += fi.Size()
+		}
+		return nil
+	})
+	return c, err
+}
+
+// scanEntries takes a census of every entry, indexed like config.Entries.
+// Entries whose source can't be scanned get a nil census.
+func (config *Config) scanEntries() []*census {
+	cs := make([]*census, len(config.Entries))
+	for i, e := range config.Entries {
+		paths, err := e.sources()
+		if err != nil {
+			continue
+		}
+		if c, err := config.scanSources(e, paths); err == nil {
+			cs[i] = &c
+		}
+	}
+	return cs
+}
@@ -0,0 +1,104 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// cleanCommand deletes checksums and manifests whose archive is gone,
+// left by older versions or by archives deleted by hand.
+func cleanCommand(args []string) error {
+	fs := flag.NewFlagSet("clean", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	dryRun := fs.Bool("dry-run", false, "print what would be deleted")
+	yes := fs.Bool("yes", false, "delete without asking")
+	fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if config.isReadOnly() && !*dryRun {
+		return fmt.Errorf("clean is refused in read-only mode")
+	}
+	type orphan struct {
+		b    storage.Backend
+		name string
+	}
+	var orphans []orphan
+	var locs []string
+	entries := config.entriesWithSelf()
+	for _, ent := range entries {
+		b, err := config.entryBackend(ent)
+		if err != nil {
+			return err
+		}
+		names, err := orphanedSidecars(b, ent)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			orphans = append(orphans, orphan{b, n})
+			locs = append(locs, b.Location(n))
+		}
+	}
+	if *dryRun {
+		for _, l := range locs {
+			logs.event(levelInfo, "", "Would delete", "file", l)
+		}
+		return nil
+	}
+	if len(orphans) == 0 {
+		printSuccess("Nothing to clean: dst=%s", config.Dst)
+		return nil
+	}
+	if err := confirm("Cleaning "+config.Dst, locs, *yes); err != nil {
+		return err
+	}
+	for _, o := range orphans {
+		if err := o.b.Delete(o.name); err != nil {
+			return &RetentionError{o.b.Location(o.name), err}
+		}
+	}
+	printSuccess("Cleaned sidecars: dst=%s deleted=%d", config.Dst, len(orphans))
+	return nil
+}
+
+// orphanedSidecars returns the checksums, metadata and manifests of ent
+// in b whose archive is gone.
+func orphanedSidecars(b storage.Backend, ent *Entry) ([]string, error) {
+	objs, err := b.List(ent.Name)
+	if err != nil {
+		return nil, err
+	}
+	archives := map[string]bool{}
+	keys := map[genKey]bool{}
+	for _, o := range objs {
+		if isGeneration(ent, o.Name) {
+			archives[o.Name] = true
+			keys[archiveKey(ent, o.Name)] = true
+		}
+	}
+	var orphans []string
+	for _, o := range objs {
+		for _, suffix := range []string{_ChecksumSuffix, _MetaSuffix} {
+			archive := strings.TrimSuffix(o.Name, suffix)
+			if archive != o.Name && isGeneration(ent, archive) && !archives[archive] {
+				orphans = append(orphans, o.Name)
+			}
+		}
+	}
+	manifests, err := manifestKeys(b, ent)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range manifests {
+		if !keys[k] {
+			orphans = append(orphans, manifestName(ent, k))
+		}
+	}
+	return orphans, nil
+}
@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"os"
+)
+
+// commands are the subcommands of Main by name. completionCommands lists
+// them all but receive, which tarbu runs on the host of an ssh:// Dst.
+var commands = map[string]func(args []string) error{
+	"init":           initConfig,
+	"completion":     completion,
+	"catalog":        catalogCommand,
+	"report":         reportCommand,
+	"restore":        restoreCommand,
+	"launchd":        launchdCommand,
+	"seal":           sealCommand,
+	"recover":        recoverConfig,
+	"backup":         backupCommand,
+	"status":         statusCommand,
+	"assert-fresh":   assertFreshCommand,
+	"verify":         verifyCommand,
+	"drill":          drillCommand,
+	"stats":          statsCommand,
+	"daemon":         daemonCommand,
+	"service":        serviceCommand,
+	"list":           listCommand,
+	"flush":          flushCommand,
+	"clean":          cleanCommand,
+	"recompress":     recompressCommand,
+	"files":          filesCommand,
+	"repo":           repoCommand,
+	"prune":          pruneCommand,
+	"purge-versions": purgeVersionsCommand,
+	"attest":         attestCommand,
+	"diff":           diffCommand,
+	"find":           findCommand,
+	"sync":           syncCommand,
+	"receive":        receiveCommand,
+	"selftest":       selftestCommand,
+}
+
+// Main runs the tarbu command line: a backup run, or the subcommand
+// named by os.Args[1]. It exits the process.
+func Main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				fatal(err)
+			}
+			return
+		}
+	}
+
+	config, err := readConfig()
+	if err != nil {
+		fatalConfig(err)
+	}
+	if config.dryRun {
+		if err := config.isValid(); err != nil {
+			fatalConfig(err)
+		}
+		if err := config.plan(); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	if config.isReadOnly() {
+		fatalConfig("backup is refused in read-only mode")
+	}
+
+	var selfDir string
+	if config.SelfBackup {
+		if selfDir, err = config.addSelfEntry(); err != nil {
+			os.RemoveAll(selfDir)
+			fatal(err)
+		}
+	}
+
+	if err := config.isValid(); err != nil {
+		os.RemoveAll(selfDir)
+		fatalConfig(err)
+	}
+	lock, err := config.lockRun()
+	if err != nil {
+		os.RemoveAll(selfDir)
+		exit(classify(err).code, err)
+	}
+
+	if err := config.profiler.start(); err != nil {
+		os.RemoveAll(selfDir)
+		fatal(err)
+	}
+	defer config.recoverAndReport(nil)
+	stop := config.cancelOnSignal()
+	config.progress.start()
+	code := exitCode(backup(config))
+	config.progress.stop()
+	stop()
+	config.profiler.stop()
+	os.RemoveAll(selfDir)
+	lock.release()
+	os.Exit(code)
+}
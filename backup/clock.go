@@ -0,0 +1,71 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// clock is the time source for archive names and retention decisions.
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// offsetClock runs at wall clock speed from a shifted start, so durations
+// stay real under -fake-now.
+type offsetClock time.Duration
+
+func (c offsetClock) Now() time.Time { return time.Now().Add(time.Duration(c)) }
+
+// fixedClock always returns the same time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func (config *Config) now() time.Time {
+	if config.clock == nil {
+		return time.Now()
+	}
+	return config.clock.Now()
+}
+
+// _TimeLayout is how human output shows times, in config.location.
+const _TimeLayout = "2006-01-02 15:04:05 MST"
+
+// formatTime renders t for human output in the TimeZone of the config.
+func (config *Config) formatTime(t time.Time) string {
+	loc := config.location
+	if loc == nil {
+		loc = time.Local
+	}
+	return t.In(loc).Format(_TimeLayout)
+}
+
+// loadTimeZone resolves TimeZone, the local zone when it is empty.
+func (config *Config) loadTimeZone() error {
+	if config.TimeZone == "" {
+		return nil
+	}
+	loc, err := time.LoadLocation(config.TimeZone)
+	if err != nil {
+		return fmt.Errorf("unknown time zone. zone=%s", config.TimeZone)
+	}
+	config.location = loc
+	return nil
+}
+
+// parseFakeNow accepts unix seconds or RFC 3339.
+func parseFakeNow(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("fake now must be unix seconds or RFC 3339. now=%s", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,46 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+)
+
+const (
+	_ColorRed    = "\x1b[31m"
+	_ColorGreen  = "\x1b[32m"
+	_ColorYellow = "\x1b[33m"
+	_ColorReset  = "\x1b[0m"
+)
+
+// colored is true when console output uses ANSI colors.
+var colored bool
+
+// setupColor enables colors when stdout is a terminal, unless disabled
+// by flag or by the NO_COLOR convention (https://no-color.org).
+func setupColor(disable bool) {
+	colored = !disable && os.Getenv("NO_COLOR") == "" && isTerminal(os.Stdout)
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+func colorize(color, s string) string {
+	if !colored {
+		return s
+	}
+	return color + s + _ColorReset
+}
+
+func printError(format string, a ...interface{}) {
+	logs.event(levelError, _ColorRed, fmt.Sprintf(format, a...))
+}
+
+func printSuccess(format string, a ...interface{}) {
+	logs.event(levelInfo, _ColorGreen, fmt.Sprintf(format, a...))
+}
+
+func printWarning(format string, a ...interface{}) {
+	logs.event(levelWarn, _ColorYellow, fmt.Sprintf(format, a...))
+}
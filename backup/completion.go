@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type completionCommand struct {
+	name  string
+	flags []string
+	args  []string
+	// entries is true for subcommands taking entry names as arguments
+	entries bool
+}
+
+// completionCommands lists subcommands and their flags. The first
+// element describes the default backup command.
+var completionCommands = []completionCommand{
+	{"", []string{"-config", "-config-dir", "-no-color", "-dry-run", "-fake-now", "-summary-json", "-wait", "-log-level", "-log-format", "-log-file", "-cpuprofile", "-memprofile", "-trace", "-progress", "-progress-interval"}, nil, false},
+	{"init", []string{"-o", "-dst", "-keep-gen", "-entry", "-schedule", "-force"}, nil, false},
+	{"completion", []string{"-config"}, []string{"bash", "zsh", "fish"}, false},
+	{"recover", []string{"-from", "-o", "-force", "-identity", "-passphrase-env", "-passphrase-file"}, nil, false},
+	{"launchd", []string{"-config", "-label", "-hour", "-minute", "-log"}, nil, false},
+	{"seal", []string{"-keygen"}, nil, false},
+	{"restore", []string{"-config", "-ts", "-to", "-relabel", "-no-verify", "-in-place", "-yes", "-include"}, nil, true},
+	{"catalog", []string{"-config", "-format", "-json", "-no-checksum"}, []string{"export"}, false},
+	{"report", []string{"-config", "-since", "-format", "-json"}, nil, false},
+	{"backup", []string{"-config", "-entry", "-stdout", "-log-level", "-log-format", "-log-file", "-no-color"}, nil, false},
+	{"status", []string{"-config", "-stale", "-json"}, nil, true},
+	{"assert-fresh", []string{"-config", "-entry", "-max-age", "-json"}, nil, false},
+	{"verify", []string{"-config", "-json"}, nil, true},
+	{"drill", []string{"-config", "-ts", "-keep", "-json"}, nil, true},
+	{"stats", []string{"-config", "-json"}, nil, false},
+	{"list", []string{"-config", "-json"}, nil, true},
+	{"clean", []string{"-config", "-dry-run", "-yes"}, nil, false},
+	{"flush", []string{"-config"}, nil, false},
+	{"prune", []string{"-config", "-dry-run", "-yes"}, nil, true},
+	{"sync", []string{"-config", "-dry-run"}, nil, true},
+	{"purge-versions", []string{"-config", "-dry-run", "-yes"}, nil, false},
+	{"recompress", []string{"-config", "-entry", "-to", "-level", "-dry-run", "-yes"}, nil, false},
+	{"files", []string{"-config", "-long", "-json"}, nil, true},
+	{"find", []string{"-config", "-entry", "-json"}, nil, false},
+	{"diff", []string{"-config", "-json"}, nil, true},
+	{"selftest", []string{"-config", "-entry", "-full", "-keep"}, nil, false},
+	{"repo", []string{"-config", "-ts", "-to", "-json", "-dry-run", "-yes"}, []string{"snapshots", "restore", "prune"}, true},
+	{"attest", []string{"-o", "-pub", "-json"}, []string{"keygen", "verify"}, false},
+	{"daemon", []string{"-config", "-metrics-addr", "-wait", "-no-color", "-log-level", "-log-format", "-log-file"}, nil, false},
+	{"service", []string{"-name", "-config", "-metrics-addr", "-wait", "-log-level", "-log-format", "-log-file"}, []string{"install", "uninstall", "run"}, false},
+}
+
+var completionShells = map[string]func(io.Writer, []string){
+	"bash": writeBashCompletion,
+	"zsh":  writeZshCompletion,
+	"fish": writeFishCompletion,
+}
+
+func completion(args []string) error {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	configPath := fs.String("config", "", "config to read entry names from")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu completion [-config path] bash|zsh|fish")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("shell is required")
+	}
+	gen, ok := completionShells[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unsupported shell. shell=%s", fs.Arg(0))
+	}
+
+	var names []string
+	if *configPath != "" {
+		config, err := loadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		for _, e := range config.Entries {
+			names = append(names, e.Name)
+		}
+	}
+
+	gen(os.Stdout, names)
+	return nil
+}
+
+// completionWords returns the words offered after subcommand c.
+func (c completionCommand) completionWords(entries []string) []string {
+	var words []string
+	if c.name == "" {
+		words = append(words, subcommandNames()...)
+	}
+	words = append(words, c.flags...)
+	words = append(words, c.args...)
+	if c.entries {
+		words = append(words, entries...)
+	}
+	return words
+}
+
+// completionOrder returns subcommands with the default command last, as
+// shell case statements match the first pattern.
+func completionOrder() []completionCommand {
+	return append(completionCommands[1:len(completionCommands):len(completionCommands)], completionCommands[0])
+}
+
+func subcommandNames() []string {
+	var names []string
+	for _, c := range completionCommands[1:] {
+		names = append(names, c.name)
+	}
+	return names
+}
+
+func writeBashCompletion(w io.Writer, entries []string) {
+	fmt.Fprintln(w, "# bash completion for tarbu")
+	fmt.Fprintln(w, "_tarbu() {")
+	fmt.Fprintln(w, "\tlocal cur cmd w")
+	fmt.Fprintln(w, "\tcur=\"${COMP_WORDS[COMP_CWORD]}\"")
+	fmt.Fprintln(w, "\tcmd=\"\"")
+	fmt.Fprintln(w, "\tfor w in \"${COMP_WORDS[@]:1:COMP_CWORD-1}\"; do")
+	fmt.Fprintf(w, "\t\tcase \"$w\" in %s) cmd=\"$w\"; break;; esac\n", strings.Join(subcommandNames(), "|"))
+	fmt.Fprintln(w, "\tdone")
+	fmt.Fprintln(w, "\tcase \"$cmd\" in")
+	for _, c := range completionOrder() {
+		pattern := c.name
+		if pattern == "" {
+			pattern = "*"
+		}
+		fmt.Fprintf(w, "\t%s) COMPREPLY=($(compgen -W %q -- \"$cur\"));;\n", pattern, strings.Join(c.completionWords(entries), " "))
+	}
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -o default -F _tarbu tarbu")
+}
+
+func writeZshCompletion(w io.Writer, entries []string) {
+	fmt.Fprintln(w, "#compdef tarbu")
+	fmt.Fprintln(w, "_tarbu() {")
+	fmt.Fprintln(w, "\tlocal cmd w")
+	fmt.Fprintln(w, "\tfor w in ${words[2,CURRENT-1]}; do")
+	fmt.Fprintf(w, "\t\tcase $w in %s) cmd=$w; break;; esac\n", strings.Join(subcommandNames(), "|"))
+	fmt.Fprintln(w, "\tdone")
+	fmt.Fprintln(w, "\tcase $cmd in")
+	for _, c := range completionOrder() {
+		pattern := c.name
+		if pattern == "" {
+			pattern = "*"
+		}
+		fmt.Fprintf(w, "\t%s) compadd -- %s; _files;;\n", pattern, strings.Join(c.completionWords(entries), " "))
+	}
+	fmt.Fprintln(w, "\tesac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "compdef _tarbu tarbu")
+}
+
+func writeFishCompletion(w io.Writer, entries []string) {
+	fmt.Fprintln(w, "# fish completion for tarbu")
+	subs := strings.Join(subcommandNames(), " ")
+	for _, c := range completionCommands {
+		cond := "__fish_seen_subcommand_from " + c.name
+		if c.name == "" {
+			cond = "not __fish_seen_subcommand_from " + subs
+			for _, s := range subcommandNames() {
+				fmt.Fprintf(w, "complete -c tarbu -n '%s' -a %s\n", cond, s)
+			}
+		}
+		for _, f := range c.flags {
+			fmt.Fprintf(w, "complete -c tarbu -n '%s' -o %s\n", cond, strings.TrimPrefix(f, "-"))
+		}
+		args := c.args
+		if c.entries {
+			args = append(args[:len(args):len(args)], entries...)
+		}
+		if len(args) > 0 {
+			fmt.Fprintf(w, "complete -c tarbu -n '%s' -a '%s'\n", cond, strings.Join(args, " "))
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+)
+
+// codec describes a Entry.Compression. gzip is done in process,
+// the others by running their tool as a filter.
+type codec struct {
+	// suffix goes between the entry name and the timestamp
+	suffix string
+	// tool compresses, empty for gzip and none
+	tool string
+	// minLevel and maxLevel bound CompressionLevel
+	minLevel, maxLevel int
+}
+
+var codecs = map[string]codec{
+	"gzip":  {".tar.gz.", "", 1, 9},
+	"zstd":  {".tar.zst.", "zstd", 1, 19},
+	"xz":    {".tar.xz.", "xz", 0, 9},
+	"bzip2": {".tar.bz2.", "bzip2", 1, 9},
+	"none":  {".tar.", "", 0, 0},
+}
+
+// codecNames lists codecs in a fixed order, for suffix matching.
+var codecNames = []string{"gzip", "zstd", "xz", "bzip2", "none"}
+
+func (ent *Entry) codec() codec {
+	if ent.Compression == "" {
+		return codecs["gzip"]
+	}
+	return codecs[ent.Compression]
+}
+
+func (config *Config) isCompressionValid() error {
+	if config.ReadWorkers < 0 || config.CompressionWorkers < 0 || config.ArchiveWorkers < 0 {
+		return fmt.Errorf("config.ReadWorkers, config.CompressionWorkers and config.ArchiveWorkers must not be negative. read=%d compression=%d archive=%d", config.ReadWorkers, config.CompressionWorkers, config.ArchiveWorkers)
+	}
+	for _, e := range config.Entries {
+		c, ok := codecs[e.Compression]
+		if e.Compression != "" && !ok {
+			return fmt.Errorf("unknown entry compression. name=%s compression=%s", e.Name, e.Compression)
+		}
+		if e.Compression == "" {
+			c = codecs["gzip"]
+		}
+		if e.CompressionLevel != 0 && (e.CompressionLevel < c.minLevel || e.CompressionLevel > c.maxLevel) {
+			return fmt.Errorf("entry compression level is out of range. name=%s level=%d min=%d max=%d", e.Name, e.CompressionLevel, c.minLevel, c.maxLevel)
+		}
+		if e.CompressionWorkers < 0 || e.CompressionWorkers > 0 && c.tool != "zstd" && c.tool != "xz" {
+			return fmt.Errorf("entry compression workers need zstd or xz and must not be negative. name=%s compression=%s workers=%d", e.Name, e.Compression, e.CompressionWorkers)
+		}
+		if e.ArchiveWorkers < 0 {
+			return fmt.Errorf("entry archive workers must not be negative. name=%s workers=%d", e.Name, e.ArchiveWorkers)
+		}
+		e.archiveWorkers = e.ArchiveWorkers
+		if e.archiveWorkers == 0 {
+			e.archiveWorkers = config.ArchiveWorkers
+		}
+		e.compressionWorkers = e.CompressionWorkers
+		if e.compressionWorkers == 0 && (c.tool == "zstd" || c.tool == "xz") {
+			e.compressionWorkers = config.CompressionWorkers
+			if e.compressionWorkers == 0 {
+				e.compressionWorkers = e.archiveWorkers
+			}
+		}
+		if c.tool != "" {
+			if _, err := exec.LookPath(c.tool); err != nil {
+				return fmt.Errorf("entry compression tool not found. name=%s tool=%s", e.Name, c.tool)
+			}
+		}
+	}
+	return nil
+}
+
+// writeCompressed runs write through the compression tool of ent into w.
+// gzip and none are written by the archiver itself. Failures of the tool
+// are CompressionErrors.
+func writeCompressed(ent *Entry, w io.Writer, write func(io.Writer) error) error {
+	c := ent.codec()
+	if c.tool == "" {
+		return write(w)
+	}
+	args := []string{"-c"}
+	if ent.CompressionLevel != 0 {
+		args = append(args, "-"+strconv.Itoa(ent.CompressionLevel))
+	}
+	if c.tool == "zstd" {
+		args = append(args, "-q")
+	}
+	if ent.compressionWorkers > 0 {
+		args = append(args, "-T"+strconv.Itoa(ent.compressionWorkers))
+	}
+	f, err := startFilter(c.tool, args, "", nil, w)
+	if err != nil {
+		return &CompressionError{err}
+	}
+	werr := write(f)
+	if cerr := f.Close(); cerr != nil {
+		return &CompressionError{cerr}
+	}
+	return werr
+}
+
+// decompress returns the tar stream of a compressed archive, telling
+// the compression by its magic number rather than the name, so archives
+// keep restoring after an entry's Compression changed. Closing it
+// reports a failure of the tool.
+func decompress(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(6)
+	switch {
+	case len(magic) == 0:
+		return nil, fmt.Errorf("archive is empty")
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, fmt.Errorf("archive is not gzip. err=%s", err)
+		}
+		// gzip errors surface reading
+		return ioutil.NopCloser(zr), nil
+	case bytes.HasPrefix(magic, []byte("BZh")):
+		return ioutil.NopCloser(bzip2.NewReader(br)), nil
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return startFilter("zstd", []string{"-d", "-q", "-c"}, "", br, nil)
+	case bytes.HasPrefix(magic, []byte{0xfd, '7', 'z', 'X', 'Z', 0}):
+		return startFilter("xz", []string{"-d", "-c"}, "", br, nil)
+	}
+	return ioutil.NopCloser(br), nil
+}
@@ -0,0 +1,185 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configFragment is a config file decoded to JSON.
+type configFragment struct {
+	path string
+	data []byte
+}
+
+// readConfigData returns the config at path as JSON: a JSON, YAML or
+// TOML file, any of them on stdin for -, or a directory of fragments
+// merged by mergeConfigs.
+func readConfigData(path string) ([]byte, error) {
+	if path == "-" {
+		data, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, err
+		}
+		return decodeConfig(path, data)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		frags, err := readConfigDir(path)
+		if err != nil {
+			return nil, err
+		}
+		return mergeConfigs(frags)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// YAML and TOML configs become JSON, raw included
+	return decodeConfig(path, data)
+}
+
+// loadConfigDir loads the config at configPath, if any, with the
+// fragments of dir merged into it.
+func loadConfigDir(configPath, dir string) (*Config, error) {
+	frags, err := readConfigDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if configPath != "" {
+		data, err := readConfigData(configPath)
+		if err != nil {
+			return nil, err
+		}
+		frags = append([]configFragment{{configPath, data}}, frags...)
+	}
+	data, err := mergeConfigs(frags)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+// readConfigDir decodes the .json, .yaml, .yml and .toml files of dir in
+// name order, e.g. /etc/tarbu.d, where packages and config management
+// drop entries of their own.
+func readConfigDir(dir string) ([]configFragment, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var frags []configFragment
+	for _, fi := range infos {
+		switch strings.ToLower(filepath.Ext(fi.Name())) {
+		case ".json", ".yaml", ".yml", ".toml":
+		default:
+			continue
+		}
+		if fi.IsDir() {
+			continue
+		}
+		p := filepath.Join(dir, fi.Name())
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = decodeConfig(p, data); err != nil {
+			return nil, fmt.Errorf("config fragment is invalid. file=%s err=%s", p, err)
+		}
+		frags = append(frags, configFragment{p, data})
+	}
+	if len(frags) == 0 {
+		return nil, fmt.Errorf("no config file in directory. dir=%s", dir)
+	}
+	return frags, nil
+}
+
+// mergeConfigs merges config fragments into one. Entries and Templates
+// are appended, an entry name defined twice fails. Other keys may be set
+// by several fragments only to the same value.
+func mergeConfigs(frags []configFragment) ([]byte, error) {
+	if len(frags) == 1 {
+		return frags[0].data, nil
+	}
+	merged := map[string]json.RawMessage{}
+	setBy := map[string]string{}
+	var entries, templates []json.RawMessage
+	entryFile := map[string]string{}
+	for _, f := range frags {
+		var keys map[string]json.RawMessage
+		if err := json.Unmarshal(f.data, &keys); err != nil {
+			return nil, fmt.Errorf("config fragment is invalid. file=%s err=%s", f.path, err)
+		}
+		for k, v := range keys {
+			switch k {
+			case "Entries":
+				var es []json.RawMessage
+				if err := json.Unmarshal(v, &es); err != nil {
+					return nil, fmt.Errorf("config fragment is invalid. file=%s err=%s", f.path, err)
+				}
+				for _, e := range es {
+					var named struct{ Name string }
+					json.Unmarshal(e, &named)
+					if other, ok := entryFile[named.Name]; ok && named.Name != "" {
+						return nil, fmt.Errorf("entry defined in two config fragments. name=%s file=%s other=%s", named.Name, f.path, other)
+					}
+					entryFile[named.Name] = f.path
+				}
+				entries = append(entries, es...)
+			case "Templates":
+				var ts []json.RawMessage
+				if err := json.Unmarshal(v, &ts); err != nil {
+					return nil, fmt.Errorf("config fragment is invalid. file=%s err=%s", f.path, err)
+				}
+				templates = append(templates, ts...)
+			default:
+				if old, ok := merged[k]; ok && !sameJSON(old, v) {
+					return nil, fmt.Errorf("config fragments set a key differently. key=%s file=%s other=%s", k, f.path, setBy[k])
+				}
+				merged[k], setBy[k] = v, f.path
+			}
+		}
+	}
+	if entries != nil {
+		data, _ := json.Marshal(entries)
+		merged["Entries"] = data
+	}
+	if templates != nil {
+		data, _ := json.Marshal(templates)
+		merged["Templates"] = data
+	}
+	// sorted keys keep the merged config, which self backups store,
+	// stable
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(k)
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(merged[k])
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+func sameJSON(a, b json.RawMessage) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) != nil || json.Unmarshal(b, &vb) != nil {
+		return bytes.Equal(a, b)
+	}
+	ca, _ := json.Marshal(va)
+	cb, _ := json.Marshal(vb)
+	return bytes.Equal(ca, cb)
+}
@@ -0,0 +1,54 @@
+package backup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// _ConfirmPreview bounds the affected paths listed before asking.
+const _ConfirmPreview = 20
+
+// confirm lists what a destructive operation affects on stderr and asks
+// whether to go on. yes, from a -yes flag, skips the question, and is
+// required when stdin is no terminal to ask on.
+func confirm(what string, affected []string, yes bool) error {
+	listAffected(os.Stderr, what, affected)
+	if yes {
+		return nil
+	}
+	if !isTerminal(os.Stdin) {
+		return fmt.Errorf("%s needs confirmation, pass -yes", what)
+	}
+	p := &prompter{bufio.NewReader(os.Stdin), os.Stderr}
+	return p.confirm(what)
+}
+
+// listAffected writes the first _ConfirmPreview affected paths to w.
+func listAffected(w io.Writer, what string, affected []string) {
+	fmt.Fprintf(w, "%s affects %d paths:\n", what, len(affected))
+	for i, a := range affected {
+		if i == _ConfirmPreview {
+			fmt.Fprintf(w, "  ... and %d more\n", len(affected)-i)
+			break
+		}
+		fmt.Fprintf(w, "  %s\n", a)
+	}
+}
+
+// confirm asks whether to go on with what, anything but yes cancels.
+func (p *prompter) confirm(what string) error {
+	answer, err := p.ask("Continue? (yes/no)", "no")
+	if err == io.EOF {
+		return fmt.Errorf("%s needs confirmation, pass -yes", what)
+	}
+	if err != nil {
+		return err
+	}
+	if a := strings.ToLower(answer); a != "yes" && a != "y" {
+		return fmt.Errorf("%s cancelled", what)
+	}
+	return nil
+}
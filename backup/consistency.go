@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"fmt"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// quiesce freezes ent.Freeze and runs ent.Quiesce before the archive is
+// written. The returned function undoes both and must always be called.
+func quiesce(ent *Entry) (func() error, error) {
+	resume := func() error { return nil }
+	if len(ent.Quiesce) > 0 {
+		if err := runCommand(ent.Quiesce[0], ent.Quiesce[1:]...); err != nil {
+			return resume, err
+		}
+		resume = func() error {
+			if len(ent.Resume) == 0 {
+				return nil
+			}
+			return runCommand(ent.Resume[0], ent.Resume[1:]...)
+		}
+	}
+	if ent.Freeze != "" {
+		if err := runCommand("fsfreeze", "--freeze", ent.Freeze); err != nil {
+			resume()
+			return func() error { return nil }, err
+		}
+		appResume := resume
+		resume = func() error {
+			err := runCommand("fsfreeze", "--unfreeze", ent.Freeze)
+			if rerr := appResume(); err == nil {
+				err = rerr
+			}
+			return err
+		}
+	}
+	return resume, nil
+}
+
+// isFreezeValid rejects freezing the filesystem holding a destination,
+// as writing archives there would block until the freeze is lifted.
+func (config *Config) isFreezeValid() error {
+	for _, e := range config.Entries {
+		if e.Freeze == "" {
+			continue
+		}
+		for _, dst := range config.destinations() {
+			if storage.IsRemote(dst) {
+				continue
+			}
+			same, err := sameDevice(e.Freeze, dst)
+			if err != nil {
+				return err
+			}
+			if same {
+				return fmt.Errorf("entry freezes the filesystem of config.Dst. name=%s freeze=%s dst=%s", e.Name, e.Freeze, dst)
+			}
+		}
+		if tmp, err := sameDevice(e.Freeze, config.tmpDir()); err == nil && tmp {
+			return fmt.Errorf("entry freezes the filesystem of the temporary directory. name=%s freeze=%s", e.Name, e.Freeze)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	_ContainerLabel   = "tarbu.backup=true"
+	_ContainerPreExec = "tarbu.pre-exec"
+)
+
+// containerDiscovery synthesizes entries for labeled volumes and
+// containers. Volumes become one entry each, containers one entry per
+// mount. A container's tarbu.pre-exec label is run inside it with sh -c
+// before its first mount is archived, once per run, e.g. to dump a
+// database into that mount.
+type containerDiscovery struct {
+	// Runtime is the CLI to query, docker (default) or podman.
+	Runtime string `json:",omitempty"`
+	// Label selects volumes and containers, default tarbu.backup=true.
+	Label string `json:",omitempty"`
+}
+
+type containerMount struct {
+	Source      string
+	Destination string
+}
+
+type containerInspect struct {
+	Name   string
+	Mounts []containerMount
+	Config struct {
+		Labels map[string]string
+	}
+}
+
+func (d *containerDiscovery) runtime() string {
+	if d.Runtime == "" {
+		return "docker"
+	}
+	return d.Runtime
+}
+
+func (d *containerDiscovery) label() string {
+	if d.Label == "" {
+		return _ContainerLabel
+	}
+	return d.Label
+}
+
+func (d *containerDiscovery) run(args ...string) ([]string, error) {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(d.runtime(), args...)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s %s failed. err=%s", d.runtime(), args[0], commandError(err, stderr))
+	}
+	var lines []string
+	for _, l := range strings.Split(string(out), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines, nil
+}
+
+// discoverContainers appends entries for labeled volumes and containers.
+func (config *Config) discoverContainers() error {
+	d := config.ContainerDiscovery
+	if d == nil {
+		return nil
+	}
+
+	volumes, err := d.run("volume", "ls", "--filter", "label="+d.label(), "--format", "{{.Name}}")
+	if err != nil {
+		return err
+	}
+	for _, v := range volumes {
+		mp, err := d.run("volume", "inspect", "--format", "{{.Mountpoint}}", v)
+		if err != nil {
+			return err
+		}
+		if len(mp) == 0 {
+			continue
+		}
+		e, err := config.decodeEntry(json.RawMessage("{}"))
+		if err != nil {
+			return err
+		}
+		e.Name, e.Path = "volume-"+v, mp[0]
+		config.Entries = append(config.Entries, e)
+	}
+
+	ids, err := d.run("ps", "--filter", "label="+d.label(), "--format", "{{.ID}}")
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		out, err := d.run("inspect", id)
+		if err != nil {
+			return err
+		}
+		var cs []containerInspect
+		if err := json.Unmarshal([]byte(strings.Join(out, "\n")), &cs); err != nil {
+			return fmt.Errorf("%s inspect output is broken. id=%s err=%s", d.runtime(), id, err)
+		}
+		for _, c := range cs {
+			name := strings.TrimPrefix(c.Name, "/")
+			for i, m := range c.Mounts {
+				e, err := config.decodeEntry(json.RawMessage("{}"))
+				if err != nil {
+					return err
+				}
+				e.Name = name + strings.Replace(m.Destination, "/", "-", -1)
+				e.Path = m.Source
+				if pre := c.Config.Labels[_ContainerPreExec]; pre != "" && i == 0 {
+					e.PreCmd = []string{d.runtime(), "exec", name, "sh", "-c", pre}
+				}
+				config.Entries = append(config.Entries, e)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five field cron expression, minute hour
+// day-of-month month day-of-week, each field a bit set of the values it
+// matches.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set for *, cron matches either day field
+	// when both are restricted
+	domAny, dowAny bool
+}
+
+var cronAliases = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses expressions like "0 3 * * *", "*/15 8-18 * * 1-5" or
+// "@daily". Day-of-week 7 is Sunday like 0.
+func parseCron(s string) (*cronSchedule, error) {
+	expr := strings.TrimSpace(s)
+	if a, ok := cronAliases[expr]; ok {
+		expr = a
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression needs 5 fields. expr=%s", s)
+	}
+	c := &cronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{{&c.minute, 0, 59}, {&c.hour, 0, 23}, {&c.dom, 1, 31}, {&c.month, 1, 12}, {&c.dow, 0, 7}} {
+		bits, err := parseCronField(fields[i], f.min, f.max)
+		if err != nil {
+			return nil, fmt.Errorf("%s. expr=%s", err, s)
+		}
+		*f.bits = bits
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	return c, nil
+}
+
+// parseCronField parses a comma separated list of *, n, n-m, each
+// optionally with a /step.
+func parseCronField(f string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid cron step. field=%s", f)
+			}
+			rng, step = part[:i], n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			bounds := strings.SplitN(rng, "-", 2)
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, fmt.Errorf("invalid cron field. field=%s", f)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, fmt.Errorf("invalid cron field. field=%s", f)
+				}
+			} else if step > 1 {
+				// n/step runs from n to the end of the range
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("cron field out of range. field=%s min=%d max=%d", f, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (c *cronSchedule) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// next returns the first matching minute after t, in the location of t.
+// It returns the zero time for schedules never matching, like Feb 30.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	// Feb 29 comes within 8 years, anything else matches within a year
+	limit := t.AddDate(8, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// _CatchUpDelay is the default config.CatchUpDelay.
+const _CatchUpDelay = time.Minute
+
+func (config *Config) isScheduleValid() error {
+	config.catchUpDelay = _CatchUpDelay
+	if config.CatchUpDelay != "" {
+		d, err := parseDuration(config.CatchUpDelay)
+		if err != nil {
+			return fmt.Errorf("config.CatchUpDelay is invalid. err=%s", err)
+		}
+		config.catchUpDelay = d
+	}
+	if config.CatchUpJitter != "" {
+		d, err := parseDuration(config.CatchUpJitter)
+		if err != nil {
+			return fmt.Errorf("config.CatchUpJitter is invalid. err=%s", err)
+		}
+		config.catchUpJitter = d
+	}
+	for _, e := range config.Entries {
+		if err := e.parseSchedule(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseSchedule parses the Schedule of e, which must match some time.
+func (e *Entry) parseSchedule() error {
+	if e.Schedule == "" {
+		return nil
+	}
+	c, err := parseCron(e.Schedule)
+	if err != nil {
+		return fmt.Errorf("entry schedule is invalid. name=%s err=%s", e.Name, err)
+	}
+	if c.next(time.Now()).IsZero() {
+		return fmt.Errorf("entry schedule never matches. name=%s schedule=%s", e.Name, e.Schedule)
+	}
+	e.cron = c
+	return nil
+}
@@ -0,0 +1,243 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, 2, 27, 10, 30, 15, 0, time.UTC)
+	for _, tc := range []struct {
+		expr string
+		want time.Time
+	}{
+		{"0 3 * * *", time.Date(2024, 2, 28, 3, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 2, 27, 10, 45, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Sunday as 7
+		{"30 8 * * 7", time.Date(2024, 3, 3, 8, 30, 0, 0, time.UTC)},
+		// restricted day fields match either
+		{"0 12 1 * 3", time.Date(2024, 2, 28, 12, 0, 0, 0, time.UTC)},
+		{"5/20 9-17 * * 1-5", time.Date(2024, 2, 27, 10, 45, 0, 0, time.UTC)},
+	} {
+		c, err := parseCron(tc.expr)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.expr, err)
+		}
+		if got := c.next(from); !got.Equal(tc.want) {
+			t.Errorf("%s: next is %s, want %s", tc.expr, got, tc.want)
+		}
+	}
+
+	c, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.next(from); !got.IsZero() {
+		t.Errorf("Feb 30 matches at %s", got)
+	}
+	for _, expr := range []string{"0 3 * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("%s is accepted", expr)
+		}
+	}
+}
+
+func TestCatchUp(t *testing.T) {
+	now := time.Date(2024, 2, 27, 10, 30, 0, 0, time.UTC)
+	config := &Config{dst: storage.NewMemory(), CatchUp: true, location: time.UTC}
+	for _, name := range []string{"missed", "fresh", "new"} {
+		config.Entries = append(config.Entries, &Entry{Name: name, Schedule: "0 3 * * *"})
+	}
+	if err := config.isScheduleValid(); err != nil {
+		t.Fatal(err)
+	}
+	err := config.appendHistory([]result{
+		{name: "missed", start: now.AddDate(0, 0, -1).Add(-7 * time.Hour)},
+		// skipped runs don't count
+		{name: "missed", start: now.Add(-time.Hour), skipped: "heavy entry on battery power"},
+		{name: "fresh", start: now.Add(-7*time.Hour - 30*time.Minute)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := config.nextRuns(now)
+	config.catchUp(next, now)
+	tomorrow := time.Date(2024, 2, 28, 3, 0, 0, 0, time.UTC)
+	for i, want := range []time.Time{now.Add(_CatchUpDelay), tomorrow, now.Add(_CatchUpDelay)} {
+		if got := next[config.Entries[i]]; !got.Equal(want) {
+			t.Errorf("%s runs at %s, want %s", config.Entries[i].Name, got, want)
+		}
+	}
+}
+
+func TestDaemonSignals(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "tarbu.json")
+	write := func(schedule string) {
+		data := fmt.Sprintf(`{"Dst": %q, "KeepGen": 1, "Entries": [{"Name": "www", "Path": %q, "Schedule": %q}]}`, dir, dir, schedule)
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d := &daemon{configPath: path}
+
+	// the controls of the Windows service reach the daemon as signals
+	for _, tc := range []struct {
+		name     string
+		schedule string
+		sigs     []os.Signal
+	}{
+		{"stop", "0 3 * * *", []os.Signal{syscall.SIGTERM}},
+		{"reload then stop", "0 3 * * *", []os.Signal{syscall.SIGHUP, syscall.SIGINT}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			write(tc.schedule)
+			sig := make(chan os.Signal, len(tc.sigs))
+			for _, s := range tc.sigs {
+				sig <- s
+			}
+			if err := d.run(sig); err != nil {
+				t.Fatalf("run returned %v", err)
+			}
+		})
+	}
+
+	write("")
+	if err := d.run(make(chan os.Signal)); err == nil || !strings.Contains(err.Error(), "no entry has a schedule") {
+		t.Errorf("run without schedules returned %v", err)
+	}
+	if _, err := parseDaemon("daemon", nil); err == nil {
+		t.Error("daemon without a config is accepted")
+	}
+}
+
+func TestServiceArgs(t *testing.T) {
+	fs := flag.NewFlagSet("service install", flag.ContinueOnError)
+	fs.String("name", _ServiceName, "")
+	d := &daemon{}
+	d.register(fs)
+	if err := fs.Parse([]string{"-name", "nightly", "-config", "tarbu.json", "-wait", "5m", "-log-level", "warn"}); err != nil {
+		t.Fatal(err)
+	}
+	args, err := serviceArgs(fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs, _ := filepath.Abs("tarbu.json")
+	want := []string{"-config=" + abs, "-log-level=warn", "-name=nightly", "-wait=5m0s"}
+	if strings.Join(args, " ") != strings.Join(want, " ") {
+		t.Errorf("service runs with %q, want %q", args, want)
+	}
+
+	// the service command line takes back what install was given
+	run := flag.NewFlagSet("service run", flag.ContinueOnError)
+	name := run.String("name", _ServiceName, "")
+	got := &daemon{}
+	got.register(run)
+	if err := run.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if *name != "nightly" || got.configPath != abs || got.lockWait != 5*time.Minute || got.log.level != "warn" {
+		t.Errorf("service run parsed name=%s daemon=%+v", *name, got)
+	}
+}
+
+func TestLaunchdPlist(t *testing.T) {
+	job := &launchdJob{
+		Label:   "io.github.k3nju.tarbu.nightly",
+		Program: "/usr/local/bin/tarbu",
+		Config:  "/Users/a&b/Library/Application Support/tarbu/tarbu.json",
+		Log:     "/Users/a&b/Library/Logs/tarbu.log",
+		Hour:    4,
+		Minute:  30,
+	}
+	var buf bytes.Buffer
+	if err := job.writePlist(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>io.github.k3nju.tarbu.nightly</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>/usr/local/bin/tarbu</string>
+		<string>-config</string>
+		<string>/Users/a&amp;b/Library/Application Support/tarbu/tarbu.json</string>
+		<string>-no-color</string>
+	</array>
+	<key>StartCalendarInterval</key>
+	<dict>
+		<key>Hour</key>
+		<integer>4</integer>
+		<key>Minute</key>
+		<integer>30</integer>
+	</dict>
+	<key>LowPriorityIO</key>
+	<true/>
+	<key>ProcessType</key>
+	<string>Background</string>
+	<key>StandardOutPath</key>
+	<string>/Users/a&amp;b/Library/Logs/tarbu.log</string>
+	<key>StandardErrorPath</key>
+	<string>/Users/a&amp;b/Library/Logs/tarbu.log</string>
+</dict>
+</plist>
+`
+	if buf.String() != want {
+		t.Errorf("plist is\n%s\nwant\n%s", buf.String(), want)
+	}
+	for _, args := range [][]string{{"-hour", "24"}, {"-minute", "-1"}} {
+		if err := launchdCommand(args); err == nil || !strings.Contains(err.Error(), "invalid time") {
+			t.Errorf("%q: err=%v", args, err)
+		}
+	}
+}
+
+func TestAskSchedule(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		input   string
+		def     string
+		want    string
+		wantErr bool
+	}{
+		{"alias", "@daily\n", "", "@daily", false},
+		{"default", "\n", "30 2 * * *", "30 2 * * *", false},
+		{"none", "\n", "", "", false},
+		{"none over default", "-\n", "@daily", "", false},
+		{"asked again", "61 * * * *\n0 0 31 2 *\n0 3 * * 1\n", "", "0 3 * * 1", false},
+		{"no answer", "nightly\n", "", "", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			p := &prompter{bufio.NewReader(strings.NewReader(tc.input)), &out}
+			ent := &Entry{Name: "www"}
+			err := p.askSchedule(ent, tc.def)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("askSchedule returned %v", err)
+			}
+			if !tc.wantErr && (ent.Schedule != tc.want || (tc.want != "") != (ent.cron != nil)) {
+				t.Errorf("schedule is %q, want %q", ent.Schedule, tc.want)
+			}
+			if tc.name == "asked again" && strings.Count(out.String(), "Schedule for www") != 3 {
+				t.Errorf("asked %q", out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,273 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// daemonCommand keeps running and backs up each entry at the times of
+// its Schedule. SIGHUP reloads the config, keeping the old one when the
+// new one is invalid. SIGINT and SIGTERM stop the daemon once the
+// running backup finished. With -metrics-addr, Prometheus metrics are
+// served on /metrics. With config.CatchUp, runs missed while the daemon
+// was down are made up for after it starts. With config.VerifySample, a
+// sample of the stored generations is verified at its cadence.
+func daemonCommand(args []string) error {
+	d, err := parseDaemon("daemon", args)
+	if err != nil {
+		return err
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	return d.run(sig)
+}
+
+// daemon is the command line of a daemon, run by tarbu daemon or as a
+// Windows service.
+type daemon struct {
+	configPath  string
+	metricsAddr string
+	lockWait    time.Duration
+	log         logFlags
+}
+
+func (d *daemon) register(fs *flag.FlagSet) {
+	fs.StringVar(&d.configPath, "config", "", "path to JSON, YAML or TOML config file, reread on SIGHUP")
+	fs.StringVar(&d.metricsAddr, "metrics-addr", "", "serve Prometheus metrics on /metrics at this address, like :9469")
+	fs.DurationVar(&d.lockWait, "wait", 0, "wait this long for the lock of another run before a scheduled run fails")
+	d.log.register(fs)
+}
+
+// setup sets up the logging of the daemon and checks it has a config.
+func (d *daemon) setup() error {
+	if err := d.log.setup(); err != nil {
+		return err
+	}
+	if d.configPath == "" || d.configPath == "-" {
+		return fmt.Errorf("daemon needs a config file")
+	}
+	return nil
+}
+
+// parseDaemon parses the flags of the daemon and sets it up.
+func parseDaemon(name string, args []string) (*daemon, error) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	d := &daemon{}
+	d.register(fs)
+	fs.Parse(args)
+	if err := d.setup(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// run runs the scheduled backups until sig gets SIGINT or SIGTERM,
+// reloading the config on SIGHUP.
+func (d *daemon) run(sig <-chan os.Signal) error {
+	config, err := loadScheduled(d.configPath)
+	if err != nil {
+		return err
+	}
+	config.lockWait = d.lockWait
+	metrics := &metricsHandler{}
+	if d.metricsAddr != "" {
+		metrics.refresh(config)
+		ln, err := net.Listen("tcp", d.metricsAddr)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			if err := http.Serve(ln, mux); err != nil {
+				printError("Metrics server failed: addr=%s err=%s", d.metricsAddr, err)
+			}
+		}()
+	}
+
+	next := config.nextRuns(time.Now())
+	if config.CatchUp {
+		config.catchUp(next, time.Now())
+	}
+	verifyAt := config.nextVerify(time.Now())
+	for {
+		at := verifyAt
+		for _, t := range next {
+			if at.IsZero() || t.Before(at) {
+				at = t
+			}
+		}
+		logDebug("Daemon waiting", "next", at)
+		// wake up at least every minute, timers don't follow wall clock
+		// changes and suspend
+		wait := time.Until(at)
+		if wait > time.Minute {
+			wait = time.Minute
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case s := <-sig:
+			timer.Stop()
+			if s != syscall.SIGHUP {
+				printSuccess("Daemon stopped: signal=%s", s)
+				return nil
+			}
+			c, err := loadScheduled(d.configPath)
+			if err != nil {
+				printError("Reload failed: config=%s err=%s", d.configPath, err)
+				continue
+			}
+			c.lockWait = d.lockWait
+			config, next = c, c.nextRuns(time.Now())
+			verifyAt = config.nextVerify(time.Now())
+			if d.metricsAddr != "" {
+				metrics.refresh(config)
+			}
+			printSuccess("Reloaded config: config=%s", d.configPath)
+		case <-timer.C:
+			if !verifyAt.IsZero() && !verifyAt.After(time.Now()) {
+				config.runVerifySample()
+				verifyAt = config.nextVerify(time.Now())
+			}
+			var due []*Entry
+			for _, ent := range config.Entries {
+				if t, ok := next[ent]; ok && !t.After(time.Now()) {
+					due = append(due, ent)
+				}
+			}
+			if len(due) == 0 {
+				continue
+			}
+			config.runScheduled(due)
+			if d.metricsAddr != "" {
+				metrics.refresh(config)
+			}
+			// entries that came due during the run start right away
+			now := time.Now()
+			for _, ent := range due {
+				next[ent] = ent.cron.next(now.In(config.location))
+			}
+		}
+	}
+}
+
+// loadScheduled loads and validates the config of the daemon, which
+// must schedule at least one entry.
+func loadScheduled(path string) (*Config, error) {
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.discover(); err != nil {
+		return nil, err
+	}
+	if config.isReadOnly() {
+		return nil, fmt.Errorf("backup is refused in read-only mode")
+	}
+	if err := config.isValid(); err != nil {
+		return nil, err
+	}
+	if config.location == nil {
+		config.location = time.Local
+	}
+	scheduled := 0
+	for _, e := range config.Entries {
+		if e.cron == nil {
+			printWarning("Entry not scheduled: entry=%s", e.Name)
+			continue
+		}
+		scheduled++
+	}
+	if scheduled == 0 {
+		return nil, fmt.Errorf("no entry has a schedule")
+	}
+	return config, nil
+}
+
+// nextRuns returns the next run after now of every scheduled entry.
+func (config *Config) nextRuns(now time.Time) map[*Entry]time.Time {
+	next := map[*Entry]time.Time{}
+	for _, e := range config.Entries {
+		if e.cron != nil {
+			next[e] = e.cron.next(now.In(config.location))
+		}
+	}
+	return next
+}
+
+// catchUp moves the next run of entries that missed a scheduled run
+// since they last ran, or never ran, to shortly after now.
+func (config *Config) catchUp(next map[*Entry]time.Time, now time.Time) {
+	records, err := config.readHistory(time.Time{})
+	if err != nil {
+		printWarning("Catch-up skipped, reading run history failed: err=%s", err)
+		return
+	}
+	last := map[string]time.Time{}
+	for _, rec := range records {
+		if rec.Skipped == "" && rec.Start.After(last[rec.Entry]) {
+			last[rec.Entry] = rec.Start
+		}
+	}
+	for ent, t := range next {
+		lastRun := "never"
+		if l, ok := last[ent.Name]; ok {
+			missed := ent.cron.next(l.In(config.location))
+			if missed.IsZero() || !missed.Before(now) {
+				continue
+			}
+			lastRun = config.formatTime(l)
+		}
+		at := now.Add(config.catchUpDelay)
+		if config.catchUpJitter > 0 {
+			at = at.Add(time.Duration(rand.Int63n(int64(config.catchUpJitter))))
+		}
+		if at.Before(t) {
+			next[ent] = at
+			printSuccess("Catching up missed run: entry=%s last=%s at=%s", ent.Name, lastRun, config.formatTime(at))
+		}
+	}
+}
+
+// runScheduled backs up entries as one run with its own run ID, like a
+// run of tarbu without the daemon would.
+func (config *Config) runScheduled(entries []*Entry) {
+	run := *config
+	run.Entries = entries
+	run.aborted = 0
+	run.runID = newRunID()
+	os.Setenv(_RunIDEnv, run.runID)
+	// the destination may have gone away since the config was loaded
+	if err := run.isDstWritable(); err != nil {
+		printError("Scheduled run failed: run=%s err=%s", run.runID, err)
+		return
+	}
+	// tarbu may also be run by cron or by hand
+	lock, err := run.lockRun()
+	if err != nil {
+		printError("Scheduled run failed: run=%s err=%s", run.runID, err)
+		return
+	}
+	defer lock.release()
+	if run.SelfBackup {
+		dir, err := run.addSelfEntry()
+		defer os.RemoveAll(dir)
+		if err != nil {
+			printError("Backup failed: entry=%s run=%s err=%s", _SelfEntry, run.runID, err)
+			run.Entries = entries
+		}
+	}
+	defer run.recoverAndReport(nil)
+	// SIGINT and SIGTERM stop the run, then the daemon
+	stop := run.cancelOnSignal()
+	defer stop()
+	results := backup(&run)
+	printSuccess("Scheduled run finished: run=%s entries=%d exit=%d", run.runID, len(results), exitCode(results))
+}
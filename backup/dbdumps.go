@@ -0,0 +1,127 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	dumpers["mongodb"] = dumpMongoDB
+	dumpers["redis"] = dumpRedis
+	dumpers["ldap"] = dumpLDAP
+	dumpers["etcd"] = dumpEtcd
+	dumpers["consul"] = dumpConsul
+	dumpers["postgres"] = dumpPostgres
+	schemaTypes["postgres"] = true
+	schemaTypes["ldap"] = true
+}
+
+// uri returns the connection string of a typed entry, read from URIFile
+// when set so secrets can stay out of the config.
+func (ent *Entry) uri() (string, error) {
+	if ent.URIFile == "" {
+		return ent.URI, nil
+	}
+	data, err := ioutil.ReadFile(ent.URIFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func runCommand(name string, args ...string) error {
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(name, args...)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed. err=%s", name, commandError(err, stderr))
+	}
+	return nil
+}
+
+func dumpMongoDB(ent *Entry, dir string) error {
+	uri, err := ent.uri()
+	if err != nil {
+		return err
+	}
+	args := []string{"--archive=" + filepath.Join(dir, ent.Name+".archive")}
+	if uri != "" {
+		args = append(args, "--uri="+uri)
+	}
+	return runCommand("mongodump", append(args, ent.Args...)...)
+}
+
+// dumpRedis fetches an RDB over the replication protocol, which returns
+// once the server finished its background save.
+func dumpRedis(ent *Entry, dir string) error {
+	uri, err := ent.uri()
+	if err != nil {
+		return err
+	}
+	var args []string
+	if uri != "" {
+		args = append(args, "-u", uri)
+	}
+	args = append(args, ent.Args...)
+	return runCommand("redis-cli", append(args, "--rdb", filepath.Join(dir, ent.Name+".rdb"))...)
+}
+
+// dumpLDAP exports the directory as LDIF with slapcat. Args select the
+// database, e.g. ["-n", "1"]. A schema-only dump exports cn=schema of
+// the config database instead.
+func dumpLDAP(ent *Entry, dir string) error {
+	args := []string{"-l", filepath.Join(dir, ent.Name+".ldif")}
+	if ent.SchemaOnly {
+		args = append(args, "-n", "0", "-s", "cn=schema,cn=config")
+	}
+	return runCommand("slapcat", append(args, ent.Args...)...)
+}
+
+// dumpPostgres dumps a database as SQL with pg_dump, URI is the --dbname
+// value.
+func dumpPostgres(ent *Entry, dir string) error {
+	uri, err := ent.uri()
+	if err != nil {
+		return err
+	}
+	args := []string{"--file=" + filepath.Join(dir, ent.Name+".sql")}
+	if uri != "" {
+		args = append(args, "--dbname="+uri)
+	}
+	if ent.SchemaOnly {
+		args = append(args, "--schema-only")
+	}
+	return runCommand("pg_dump", append(args, ent.Args...)...)
+}
+
+// dumpEtcd saves a snapshot, URI is the --endpoints value.
+func dumpEtcd(ent *Entry, dir string) error {
+	uri, err := ent.uri()
+	if err != nil {
+		return err
+	}
+	var args []string
+	if uri != "" {
+		args = append(args, "--endpoints="+uri)
+	}
+	args = append(args, ent.Args...)
+	return runCommand("etcdctl", append(args, "snapshot", "save", filepath.Join(dir, ent.Name+".db"))...)
+}
+
+// dumpConsul saves a snapshot, URI is the -http-addr value.
+func dumpConsul(ent *Entry, dir string) error {
+	uri, err := ent.uri()
+	if err != nil {
+		return err
+	}
+	args := []string{"snapshot", "save"}
+	if uri != "" {
+		args = append(args, "-http-addr="+uri)
+	}
+	args = append(args, ent.Args...)
+	return runCommand("consul", append(args, filepath.Join(dir, ent.Name+".snap"))...)
+}
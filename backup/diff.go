@@ -0,0 +1,240 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/k3nju/tarbu/internal/archiver"
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// _DiffLive names the source tree instead of a generation in tarbu diff.
+const _DiffLive = "live"
+
+// diffFile is a regular file of a generation or of the source tree.
+type diffFile struct {
+	Size  int64
+	MTime int64
+	// SHA256 is empty when unknown, files of the source tree aren't read
+	SHA256 string
+}
+
+// diffRecord is a file added, removed or modified between two sides.
+type diffRecord struct {
+	Name string
+	// Change is added, removed or modified
+	Change  string
+	OldSize int64 `json:",omitempty"`
+	NewSize int64 `json:",omitempty"`
+}
+
+// diffCommand compares the regular files of two generations of an
+// entry, or of a generation and the source tree, by size, mtime and
+// SHA-256 where both sides know it. File lists are read from manifests,
+// archives without one are read through.
+func diffCommand(args []string) error {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu diff [-config path] [-json] <entry> <ts1> [<ts2>]")
+		fmt.Fprintln(fs.Output(), "ts is a unix timestamp or latest, ts2 is live for the source tree, the default")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 && fs.NArg() != 3 {
+		fs.Usage()
+		return fmt.Errorf("entry and timestamp are required")
+	}
+	from, to := fs.Arg(1), _DiffLive
+	if fs.NArg() == 3 {
+		to = fs.Arg(2)
+	}
+	if from == _DiffLive {
+		return fmt.Errorf("the first side must be a generation. ts=%s", from)
+	}
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	ent := config.findEntry(fs.Arg(0))
+	if ent == nil {
+		return fmt.Errorf("entry not found. name=%s", fs.Arg(0))
+	}
+	old, err := config.diffSide(ent, from)
+	if err != nil {
+		return err
+	}
+	cur, err := config.diffSide(ent, to)
+	if err != nil {
+		return err
+	}
+
+	records := diffFiles(old, cur)
+	if *asJSON {
+		return writeJSON(os.Stdout, records)
+	}
+	counts := map[string]int{}
+	for _, r := range records {
+		counts[r.Change]++
+		switch r.Change {
+		case "added":
+			fmt.Printf("+ %s (%s)\n", r.Name, formatSize(r.NewSize))
+		case "removed":
+			fmt.Printf("- %s (%s)\n", r.Name, formatSize(r.OldSize))
+		default:
+			fmt.Printf("M %s (%s -> %s)\n", r.Name, formatSize(r.OldSize), formatSize(r.NewSize))
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d added, %d removed, %d modified\n", counts["added"], counts["removed"], counts["modified"])
+	return nil
+}
+
+// diffSide returns the regular files of the generation of ent at ts,
+// or of its source tree for live.
+func (config *Config) diffSide(ent *Entry, ts string) (map[string]diffFile, error) {
+	if ts == _DiffLive {
+		return config.liveFiles(ent)
+	}
+	if ent.Repository {
+		return config.snapshotFiles(ent, ts)
+	}
+	b, err := config.entryBackend(ent)
+	if err != nil {
+		return nil, err
+	}
+	name, err := findGeneration(b, ent, ts)
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]diffFile{}
+	m, err := readManifest(b, ent, archiveKey(ent, name))
+	if err == nil {
+		for _, f := range m.Files {
+			files[memberPath(f.Name)] = diffFile{f.Size, f.MTime / 1e9, f.SHA256}
+		}
+		return files, nil
+	}
+	if !storage.IsNotExist(err) {
+		return nil, err
+	}
+
+	r, err := config.openArchive(b, ent, name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = scanArchive(bufio.NewReader(r), func(hdr *tar.Header, body io.Reader) error {
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			h := sha256.New()
+			if _, err := io.Copy(h, body); err != nil {
+				return err
+			}
+			// appended runs come later and win, as on extraction
+			files[memberPath(hdr.Name)] = diffFile{hdr.Size, hdr.ModTime.Unix(), hex.EncodeToString(h.Sum(nil))}
+		case tar.TypeLink:
+			files[memberPath(hdr.Name)] = files[memberPath(hdr.Linkname)]
+		}
+		return nil
+	})
+	if cerr := r.Close(); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s. archive=%s", err, b.Location(name))
+	}
+	return files, nil
+}
+
+// snapshotFiles returns the regular files of the snapshot of the
+// repository entry ent at ts, the chunks standing for the contents.
+func (config *Config) snapshotFiles(ent *Entry, ts string) (map[string]diffFile, error) {
+	rp, err := config.openRepo(ent)
+	if err != nil {
+		return nil, err
+	}
+	times, err := rp.snapshotTimes(ent.Name)
+	if err != nil {
+		return nil, err
+	}
+	if len(times) == 0 {
+		return nil, fmt.Errorf("no snapshot found. entry=%s", ent.Name)
+	}
+	at := times[len(times)-1]
+	if ts != "latest" {
+		if at, err = strconv.ParseInt(ts, 10, 64); err != nil {
+			return nil, fmt.Errorf("timestamp must be unix seconds or latest. ts=%s", ts)
+		}
+	}
+	s, err := rp.readSnapshot(snapshotName(ent.Name, at))
+	if err != nil {
+		return nil, err
+	}
+	files := map[string]diffFile{}
+	for _, f := range s.Files {
+		if f.Mode.IsRegular() {
+			files[memberPath(f.Name)] = diffFile{f.Size, f.MTime, strings.Join(f.Chunks, ",")}
+		}
+	}
+	return files, nil
+}
+
+// liveFiles returns the regular files the next backup of ent would
+// archive, without reading them.
+func (config *Config) liveFiles(ent *Entry) (map[string]diffFile, error) {
+	if ent.Type != "" {
+		return nil, fmt.Errorf("typed entries archive a dump, not files. name=%s type=%s", ent.Name, ent.Type)
+	}
+	if err := config.isExcludeValid(); err != nil {
+		return nil, err
+	}
+	if err := config.isFiltersValid(); err != nil {
+		return nil, err
+	}
+	roots, err := ent.sources()
+	if err != nil {
+		return nil, err
+	}
+	opts := config.archiveOptions(ent)
+	opts.Special = func(string) error { return nil }
+	files := map[string]diffFile{}
+	err = archiver.List(roots, opts, func(_, name string, fi os.FileInfo) error {
+		if fi.Mode().IsRegular() {
+			files[memberPath(name)] = diffFile{Size: fi.Size(), MTime: fi.ModTime().Unix()}
+		}
+		return nil
+	})
+	return files, err
+}
+
+// diffFiles returns the changes from old to cur by name. Files differ
+// by size or mtime, or by SHA-256 when both sides have one.
+func diffFiles(old, cur map[string]diffFile) []diffRecord {
+	records := []diffRecord{}
+	for name, o := range old {
+		c, ok := cur[name]
+		switch {
+		case !ok:
+			records = append(records, diffRecord{Name: name, Change: "removed", OldSize: o.Size})
+		case o.Size != c.Size || o.MTime != c.MTime || (o.SHA256 != "" && c.SHA256 != "" && o.SHA256 != c.SHA256):
+			records = append(records, diffRecord{Name: name, Change: "modified", OldSize: o.Size, NewSize: c.Size})
+		}
+	}
+	for name, c := range cur {
+		if _, ok := old[name]; !ok {
+			records = append(records, diffRecord{Name: name, Change: "added", NewSize: c.Size})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records
+}
@@ -0,0 +1,176 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// stubCommand puts an executable shell script named name first in PATH.
+// It logs its arguments, one call a line, to the returned file.
+func stubCommand(t *testing.T, name, script string) string {
+	t.Helper()
+	bin := t.TempDir()
+	log := filepath.Join(bin, name+".log")
+	script = "#!/bin/sh\nprintf '%s\\n' \"$*\" >> " + log + "\n" + script
+	if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	return log
+}
+
+// stubCalls returns the calls logged by a stubCommand.
+func stubCalls(t *testing.T, log string) []string {
+	t.Helper()
+	data, err := os.ReadFile(log)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+const dockerStub = `case "$*" in
+"volume ls "*) echo data;;
+"volume inspect "*) echo /var/lib/docker/volumes/data/_data;;
+"ps "*) echo abc;;
+"inspect abc") cat <<'EOF'
+[{"Name": "/db", "Config": {"Labels": {"tarbu.pre-exec": "pg_dumpall > /dump/all.sql"}},
+  "Mounts": [{"Source": "/srv/db/dump", "Destination": "/dump"},
+             {"Source": "/srv/db/data", "Destination": "/var/lib/postgresql/data"}]}]
+EOF
+;;
+esac
+`
+
+func TestDiscoverContainers(t *testing.T) {
+	log := stubCommand(t, "docker", dockerStub)
+	config, err := parseConfig([]byte(`{"Dst": "/backup", "ContainerDiscovery": {}, "Defaults": {"KeepGen": 3},
+		"Entries": [{"Name": "etc", "Path": "/etc"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := stubCalls(t, log); len(calls) != 0 {
+		t.Fatalf("loading the config ran docker %q", calls)
+	}
+	if err := config.discover(); err != nil {
+		t.Fatal(err)
+	}
+	// discovering again adds nothing
+	if err := config.discover(); err != nil {
+		t.Fatal(err)
+	}
+
+	type discovered struct {
+		Name, Path string
+		PreCmd     []string
+		KeepGen    int
+	}
+	var got []discovered
+	for _, e := range config.Entries {
+		got = append(got, discovered{e.Name, e.Path, e.PreCmd, e.KeepGen})
+	}
+	want := []discovered{
+		{"etc", "/etc", nil, 3},
+		{"volume-data", "/var/lib/docker/volumes/data/_data", nil, 3},
+		// the dump runs once, before the first mount
+		{"db-dump", "/srv/db/dump", []string{"docker", "exec", "db", "sh", "-c", "pg_dumpall > /dump/all.sql"}, 3},
+		{"db-var-lib-postgresql-data", "/srv/db/data", nil, 3},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries\n%+v\nwant\n%+v", got, want)
+	}
+	if calls := stubCalls(t, log); len(calls) != 4 || calls[0] != "volume ls --filter label=tarbu.backup=true --format {{.Name}}" {
+		t.Errorf("docker called with %q", calls)
+	}
+
+	podman := &Config{ContainerDiscovery: &containerDiscovery{Runtime: "podman", Label: "backup=yes"}}
+	if err := podman.discover(); err == nil || !strings.Contains(err.Error(), "podman volume failed") {
+		t.Errorf("missing podman: err=%v", err)
+	}
+}
+
+const kubectlStub = `case "$*" in
+*"get pvc -o "*) printf 'prod/data\nstaging/cache\n';;
+*"create -f -") cat >> "$(dirname "$0")/created";;
+*"wait --for=jsonpath"*) if [ -n "$KUBECTL_NOT_READY" ]; then echo "timed out waiting" >&2; exit 1; fi;;
+*"storage}") printf 1Gi;;
+*"storageClassName}") printf fast;;
+*" exec "*) printf 'tar stream';;
+*"get volumesnapshot "*) printf '2024-01-01T00:00:00Z tarbu-data-1\n2024-01-03T00:00:00Z tarbu-data-3\n2024-01-02T00:00:00Z tarbu-data-2\n';;
+esac
+`
+
+func TestKubernetes(t *testing.T) {
+	log := stubCommand(t, "kubectl", kubectlStub)
+	config, err := parseConfig([]byte(`{"Dst": "/backup", "Kubernetes": {"Kubeconfig": "/etc/kube", "Selector": "app=db"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls := stubCalls(t, log); len(calls) != 0 {
+		t.Fatalf("loading the config ran kubectl %q", calls)
+	}
+	if err := config.discover(); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range config.Entries {
+		names = append(names, e.Name+" "+e.Type+" "+e.pvc.namespace+"/"+e.pvc.pvc)
+	}
+	if want := []string{"pvc-prod-data k8s-pvc prod/data", "pvc-staging-cache k8s-pvc staging/cache"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("entries %q, want %q", names, want)
+	}
+	if calls := stubCalls(t, log); len(calls) != 1 || !strings.HasPrefix(calls[0], "--kubeconfig /etc/kube get pvc ") || !strings.HasSuffix(calls[0], " -l app=db --all-namespaces") {
+		t.Errorf("discovery called kubectl with %q", calls)
+	}
+
+	t.Run("dump", func(t *testing.T) {
+		os.Remove(log)
+		dir := t.TempDir()
+		if err := dumpPVC(config.Entries[0], dir); err != nil {
+			t.Fatal(err)
+		}
+		if data, err := os.ReadFile(filepath.Join(dir, "data.tar")); err != nil || string(data) != "tar stream" {
+			t.Errorf("dump is %q, err=%v", data, err)
+		}
+		created, _ := os.ReadFile(filepath.Join(filepath.Dir(log), "created"))
+		for _, kind := range []string{`"kind":"VolumeSnapshot"`, `"kind":"PersistentVolumeClaim"`, `"kind":"Pod"`, `"storageClassName":"fast"`, `"storage":"1Gi"`} {
+			if !strings.Contains(string(created), kind) {
+				t.Errorf("created objects lack %s:\n%s", kind, created)
+			}
+		}
+		// one snapshot is kept by default, the newest
+		var deleted []string
+		for _, c := range stubCalls(t, log) {
+			if i := strings.Index(c, "delete volumesnapshot "); i >= 0 {
+				deleted = append(deleted, c[i+len("delete volumesnapshot "):])
+			}
+		}
+		if want := []string{"tarbu-data-1", "tarbu-data-2"}; !reflect.DeepEqual(deleted, want) {
+			t.Errorf("deleted snapshots %q, want %q", deleted, want)
+		}
+	})
+
+	t.Run("not ready", func(t *testing.T) {
+		os.Remove(log)
+		t.Setenv("KUBECTL_NOT_READY", "1")
+		if err := dumpPVC(config.Entries[0], t.TempDir()); err == nil || !strings.Contains(err.Error(), "timed out waiting") {
+			t.Fatalf("err=%v, want the wait failing", err)
+		}
+		deleted := regexp.MustCompile(`^--kubeconfig /etc/kube -n prod delete volumesnapshot tarbu-data-[0-9]+ --wait=false$`)
+		calls := stubCalls(t, log)
+		if last := calls[len(calls)-1]; !deleted.MatchString(last) {
+			t.Errorf("last call %q, want the snapshot deleted", last)
+		}
+	})
+
+	if keep := (&kubernetesDiscovery{KeepSnapshots: 3}).keepSnapshots(); keep != 3 {
+		t.Errorf("keeps %d snapshots, want 3", keep)
+	}
+}
@@ -0,0 +1,184 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// drillCommand restores a generation of an entry into a temporary
+// directory and checks every file against what the backup recorded,
+// the manifest of incremental entries or the archive members otherwise.
+// Run periodically, it tests that backups can actually be restored.
+func drillCommand(args []string) error {
+	fs := flag.NewFlagSet("drill", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	ts := fs.String("ts", "latest", "unix timestamp of the generation to restore, ts-seq for a later one of the same second")
+	keep := fs.Bool("keep", false, "keep the restored files")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu drill [flags] <entry>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("entry is required")
+	}
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	ent := config.findEntry(fs.Arg(0))
+	if ent == nil {
+		return fmt.Errorf("entry not found. name=%s", fs.Arg(0))
+	}
+	b, err := config.entryBackend(ent)
+	if err != nil {
+		return err
+	}
+	name, err := findGeneration(b, ent, *ts)
+	if err != nil {
+		return err
+	}
+	archive := b.Location(name)
+
+	if want, err := readChecksum(b, name); err == nil {
+		sum, err := hashObject(b, name)
+		if err != nil {
+			return fmt.Errorf("reading archive failed. archive=%s err=%s", archive, err)
+		}
+		if got := hex.EncodeToString(sum); got != want {
+			return fmt.Errorf("archive checksum mismatch. archive=%s sha256=%s want=%s", archive, got, want)
+		}
+	} else if !storage.IsNotExist(err) {
+		return err
+	}
+
+	dir, err := ioutil.TempDir(config.TmpDir, "tarbu-drill-")
+	if err != nil {
+		return err
+	}
+	if *keep {
+		fmt.Printf("Restoring into %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	if err := config.restoreGeneration(b, ent, name, dir, nil, true, nil); err != nil {
+		return err
+	}
+	want, err := config.expectedFiles(b, ent, name)
+	if err != nil {
+		return err
+	}
+
+	res := drillResult{Entry: ent.Name, Archive: archive, Files: len(want), Mismatches: []drillMismatch{}}
+	for _, n := range sortedKeys(want) {
+		p := filepath.Join(dir, filepath.FromSlash(n))
+		sum, err := hashFile(p)
+		if err != nil {
+			res.Mismatches = append(res.Mismatches, drillMismatch{File: n, Want: want[n], Error: err.Error()})
+		} else if got := hex.EncodeToString(sum); got != want[n] {
+			res.Mismatches = append(res.Mismatches, drillMismatch{File: n, SHA256: got, Want: want[n]})
+		}
+	}
+	res.Passed = len(res.Mismatches) == 0
+	if *asJSON {
+		if err := writeJSON(os.Stdout, res); err != nil {
+			return err
+		}
+	} else {
+		for _, m := range res.Mismatches {
+			if m.Error != "" {
+				printError("Drill mismatch: entry=%s file=%s err=%s", ent.Name, m.File, m.Error)
+			} else {
+				printError("Drill mismatch: entry=%s file=%s sha256=%s want=%s", ent.Name, m.File, m.SHA256, m.Want)
+			}
+		}
+	}
+	if !res.Passed {
+		return fmt.Errorf("drill failed. entry=%s archive=%s files=%d mismatches=%d", ent.Name, archive, res.Files, len(res.Mismatches))
+	}
+	if !*asJSON {
+		printSuccess("Drill passed: entry=%s archive=%s files=%d", ent.Name, archive, res.Files)
+	}
+	return nil
+}
+
+// drillResult is the -json output of drill.
+type drillResult struct {
+	Entry      string
+	Archive    string
+	Files      int
+	Passed     bool
+	Mismatches []drillMismatch
+}
+
+type drillMismatch struct {
+	File   string
+	SHA256 string `json:",omitempty"`
+	Want   string
+	Error  string `json:",omitempty"`
+}
+
+// expectedFiles returns the SHA-256 of every regular file a restore of
+// name should produce, by member name.
+func (config *Config) expectedFiles(b storage.Backend, ent *Entry, name string) (map[string]string, error) {
+	want := map[string]string{}
+	m, err := readManifest(b, ent, archiveKey(ent, name))
+	if err == nil {
+		for _, f := range m.Files {
+			want[f.Name] = f.SHA256
+		}
+		return want, nil
+	}
+	if !storage.IsNotExist(err) {
+		return nil, err
+	}
+
+	r, err := config.openArchive(b, ent, name)
+	if err != nil {
+		return nil, err
+	}
+	_, err = scanArchive(bufio.NewReader(r), func(hdr *tar.Header, body io.Reader) error {
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			h := sha256.New()
+			if _, err := io.Copy(h, body); err != nil {
+				return err
+			}
+			want[hdr.Name] = hex.EncodeToString(h.Sum(nil))
+		case tar.TypeLink:
+			// links follow their target in the archive
+			want[hdr.Name] = want[hdr.Linkname]
+		}
+		return nil
+	})
+	if cerr := r.Close(); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s. archive=%s", err, b.Location(name))
+	}
+	return want, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
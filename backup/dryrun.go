@@ -0,0 +1,59 @@
+package backup
+
+// plan prints what a run would do: the archive each entry would create
+// with its estimated size, and the generations retention would delete
+// once it is written. Nothing is dumped, archived or deleted, and
+// PreCmd and PostCmd don't run.
+func (config *Config) plan() error {
+	entries := config.Entries
+	if config.SelfBackup {
+		entries = config.entriesWithSelf()
+	}
+	for _, ent := range entries {
+		b, err := config.entryBackend(ent)
+		if err != nil {
+			return err
+		}
+		name, err := config.archiveName(b, ent)
+		if err != nil {
+			return err
+		}
+		gens, err := generations(b, ent)
+		if err != nil {
+			return err
+		}
+		fields := []interface{}{"entry", ent.Name, "archive", b.Location(name)}
+		switch {
+		case ent.Name == _SelfEntry:
+			fields = append(fields, "data", logSize(len(config.raw)))
+		case ent.Type != "":
+			// the dump doesn't exist before the run
+		default:
+			paths, err := ent.sources()
+			if err != nil {
+				printError("Plan failed: entry=%s err=%s", ent.Name, err)
+				continue
+			}
+			c, err := config.scanSources(ent, paths)
+			if err != nil {
+				printError("Plan failed: entry=%s err=%s", ent.Name, err)
+				continue
+			}
+			fields = append(fields, "files", c.files, "data", logSize(c.bytes))
+		}
+		// the last archive is the best guess of the compressed size
+		if len(gens) > 0 {
+			fields = append(fields, "estimated_size", logSize(gens[len(gens)-1].Size))
+		}
+		logs.event(levelInfo, "", "Would create", fields...)
+
+		del, err := config.planPrune(b, ent, name)
+		if err != nil {
+			return err
+		}
+		for _, d := range del {
+			logs.event(levelInfo, "", "Would delete", "entry", ent.Name, "archive", b.Location(d))
+		}
+	}
+	return nil
+}
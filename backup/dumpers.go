@@ -0,0 +1,61 @@
+package backup
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// dumper writes the data of a typed entry as files into dir, which is
+// then archived like a relative entry.
+type dumper func(ent *Entry, dir string) error
+
+var dumpers = map[string]dumper{}
+
+// schemaTypes are the entry types whose dumpers honor SchemaOnly.
+var schemaTypes = map[string]bool{}
+
+// _SchemaName is appended to the names of SchemaOnly entries.
+const _SchemaName = ".schema"
+
+func (config *Config) isTypeValid() error {
+	for _, e := range config.Entries {
+		if _, ok := dumpers[e.Type]; e.Type != "" && !ok {
+			return fmt.Errorf("unknown entry type. name=%s type=%s", e.Name, e.Type)
+		}
+		if e.SchemaOnly && !schemaTypes[e.Type] {
+			return fmt.Errorf("entry type has no schema-only dump. name=%s type=%s", e.Name, e.Type)
+		}
+	}
+	return nil
+}
+
+// nameSchemaEntries moves SchemaOnly entries to their sub-name.
+func (config *Config) nameSchemaEntries() {
+	for _, e := range config.Entries {
+		if e.SchemaOnly && !strings.HasSuffix(e.Name, _SchemaName) {
+			e.Name += _SchemaName
+		}
+	}
+}
+
+// stage runs the dumper of a typed entry and returns an entry archiving
+// its output. The returned directory must be removed after archiving.
+func (config *Config) stage(ent *Entry) (*Entry, string, error) {
+	if err := config.checkTmpFree(); err != nil {
+		return nil, "", err
+	}
+	dir, err := ioutil.TempDir(config.tmpDir(), "tarbu-"+ent.Type+"-")
+	if err != nil {
+		return nil, "", err
+	}
+	if err := dumpers[ent.Type](ent, dir); err != nil {
+		os.RemoveAll(dir)
+		return nil, "", &SourceReadError{ent.Name, fmt.Errorf("%s dump failed. err=%s", ent.Type, err)}
+	}
+	staged := *ent
+	staged.Path = dir
+	staged.relative = true
+	return &staged, dir, nil
+}
@@ -0,0 +1,41 @@
+package backup
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseDuration is time.ParseDuration also accepting whole days and
+// weeks such as "30d" or "2w".
+func parseDuration(s string) (time.Duration, error) {
+	for unit, d := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if n := strings.TrimSuffix(s, unit); n != s {
+			if v, err := strconv.Atoi(n); err == nil {
+				return time.Duration(v) * d, nil
+			}
+		}
+	}
+	return time.ParseDuration(s)
+}
+
+// formatAge renders d in its two largest units down to minutes, e.g.
+// "3d4h" or "12m", for ages in human output.
+func formatAge(d time.Duration) string {
+	if d < time.Minute {
+		return "0m"
+	}
+	var parts []string
+	for _, u := range []struct {
+		suffix string
+		d      time.Duration
+	}{{"d", 24 * time.Hour}, {"h", time.Hour}, {"m", time.Minute}} {
+		if n := d / u.d; n > 0 && len(parts) < 2 {
+			parts = append(parts, strconv.FormatInt(int64(n), 10)+u.suffix)
+			d -= n * u.d
+		} else if len(parts) > 0 {
+			break
+		}
+	}
+	return strings.Join(parts, "")
+}
@@ -0,0 +1,314 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// _EncryptTools are the supported encryption tools. An encrypted
+// archive carries the tool name after the compression in its suffix,
+// e.g. .tar.gz.age.<timestamp>.
+var _EncryptTools = []string{"age", "gpg"}
+
+// encryptConfig encrypts archives with age or gpg before they are
+// written to Dst, self backups included: tarbu recover decrypts them
+// given the identity or passphrase.
+type encryptConfig struct {
+	// Tool is "age" or "gpg".
+	Tool string
+	// Recipients are the age public keys or gpg key IDs archives are
+	// encrypted to.
+	Recipients []string `json:",omitempty"`
+	// Identity is the age identity file decrypting archives on restore.
+	// gpg uses its keyring.
+	Identity string `json:",omitempty"`
+	// PassphraseEnv names an environment variable, PassphraseFile a file
+	// holding the passphrase of symmetric gpg encryption, used instead
+	// of Recipients.
+	PassphraseEnv  string `json:",omitempty"`
+	PassphraseFile string `json:",omitempty"`
+}
+
+func (config *Config) isEncryptValid() error {
+	enc := config.Encrypt
+	if enc == nil {
+		return nil
+	}
+	switch enc.Tool {
+	case "age":
+		// age reads passphrases from the terminal only
+		if enc.PassphraseEnv != "" || enc.PassphraseFile != "" {
+			return fmt.Errorf("config.Encrypt passphrases need gpg, age takes Recipients")
+		}
+	case "gpg":
+	default:
+		return fmt.Errorf("unknown config.Encrypt tool. tool=%s", enc.Tool)
+	}
+	passphrase := enc.PassphraseEnv != "" || enc.PassphraseFile != ""
+	if len(enc.Recipients) == 0 && !passphrase {
+		return fmt.Errorf("config.Encrypt needs Recipients or a passphrase")
+	}
+	if len(enc.Recipients) > 0 && passphrase {
+		return fmt.Errorf("config.Encrypt Recipients and passphrase are exclusive")
+	}
+	if _, err := exec.LookPath(enc.Tool); err != nil {
+		return fmt.Errorf("config.Encrypt tool not found. tool=%s", enc.Tool)
+	}
+	if enc.Tool == "age" && enc.Identity == "" {
+		for _, e := range config.Entries {
+			if e.VerifyAfterWrite {
+				return fmt.Errorf("entry.VerifyAfterWrite decrypts archives, config.Encrypt.Identity is needed. name=%s", e.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// encryptedSuffix is the archive suffix base encrypted with tool.
+func encryptedSuffix(base, tool string) string {
+	return strings.TrimSuffix(base, ".") + "." + tool + "."
+}
+
+// archiveSuffix is the suffix of the archives written for ent.
+func (config *Config) archiveSuffix(ent *Entry) string {
+	if config.Encrypt == nil {
+		return ent.suffix()
+	}
+	return encryptedSuffix(ent.suffix(), config.Encrypt.Tool)
+}
+
+// plainSuffixes are the suffixes of unencrypted archives of ent, one per
+// compression unless the entry has its own Suffix.
+func plainSuffixes(ent *Entry) []string {
+	if ent.Suffix != "" {
+		return []string{ent.Suffix}
+	}
+	var suffixes []string
+	for _, n := range codecNames {
+		suffixes = append(suffixes, codecs[n].suffix)
+	}
+	return suffixes
+}
+
+// archiveSuffixes are all suffixes archives of ent may have.
+func archiveSuffixes(ent *Entry) []string {
+	var suffixes []string
+	for _, s := range plainSuffixes(ent) {
+		suffixes = append(suffixes, s)
+		for _, t := range _EncryptTools {
+			suffixes = append(suffixes, encryptedSuffix(s, t))
+		}
+	}
+	return suffixes
+}
+
+// encryption returns the tool an archive of ent is encrypted with, ""
+// for plain archives.
+func encryption(ent *Entry, name string) string {
+	if t := ent.nameTemplate; t != nil {
+		if _, _, tool, ok := t.parse(name); ok {
+			return tool
+		}
+	}
+	rest := strings.TrimPrefix(name, ent.Name)
+	for _, s := range plainSuffixes(ent) {
+		for _, t := range _EncryptTools {
+			if strings.HasPrefix(rest, encryptedSuffix(s, t)) {
+				return t
+			}
+		}
+	}
+	return ""
+}
+
+func (enc *encryptConfig) passphrase() (string, error) {
+	if enc.PassphraseEnv != "" {
+		p := os.Getenv(enc.PassphraseEnv)
+		if p == "" {
+			return "", fmt.Errorf("passphrase variable is empty. env=%s", enc.PassphraseEnv)
+		}
+		return p, nil
+	}
+	data, err := ioutil.ReadFile(enc.PassphraseFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// filterCmd is an encryption tool run as a filter. Close waits for it
+// and reports its failure.
+type filterCmd struct {
+	cmd    *exec.Cmd
+	tool   string
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr *bytes.Buffer
+}
+
+// startFilter runs tool with args. With w, the filter is written to and
+// its output goes to w. Otherwise it reads r and the filter is read from.
+// A passphrase is handed over on fd 3.
+func startFilter(tool string, args []string, passphrase string, r io.Reader, w io.Writer) (*filterCmd, error) {
+	f := &filterCmd{cmd: exec.Command(tool, args...), tool: tool, stderr: &bytes.Buffer{}}
+	f.cmd.Stderr = f.stderr
+	var err error
+	if w != nil {
+		f.cmd.Stdout = w
+		if f.stdin, err = f.cmd.StdinPipe(); err != nil {
+			return nil, err
+		}
+	} else {
+		f.cmd.Stdin = r
+		if f.stdout, err = f.cmd.StdoutPipe(); err != nil {
+			return nil, err
+		}
+	}
+	var pw *os.File
+	if passphrase != "" {
+		pr, w, err := os.Pipe()
+		if err != nil {
+			return nil, err
+		}
+		defer pr.Close()
+		pw = w
+		f.cmd.ExtraFiles = []*os.File{pr}
+	}
+	if err := f.cmd.Start(); err != nil {
+		if pw != nil {
+			pw.Close()
+		}
+		return nil, fmt.Errorf("%s failed to start. err=%s", tool, err)
+	}
+	if pw != nil {
+		go func() {
+			io.WriteString(pw, passphrase+"\n")
+			pw.Close()
+		}()
+	}
+	return f, nil
+}
+
+func (f *filterCmd) Write(p []byte) (int, error) { return f.stdin.Write(p) }
+
+func (f *filterCmd) Read(p []byte) (int, error) { return f.stdout.Read(p) }
+
+func (f *filterCmd) Close() error {
+	if f.stdin != nil {
+		f.stdin.Close()
+	}
+	if f.stdout != nil {
+		// let the tool end when the reader stops early
+		io.Copy(ioutil.Discard, f.stdout)
+	}
+	if err := f.cmd.Wait(); err != nil {
+		return fmt.Errorf("%s failed. err=%s", f.tool, commandError(err, f.stderr))
+	}
+	return nil
+}
+
+// encrypter returns a writer encrypting into w.
+func (config *Config) encrypter(w io.Writer) (*filterCmd, error) {
+	enc := config.Encrypt
+	var args []string
+	passphrase := ""
+	switch enc.Tool {
+	case "age":
+		for _, r := range enc.Recipients {
+			args = append(args, "-r", r)
+		}
+	case "gpg":
+		args = []string{"--batch", "--quiet", "--no-tty"}
+		if len(enc.Recipients) > 0 {
+			args = append(args, "--trust-model", "always", "--encrypt")
+			for _, r := range enc.Recipients {
+				args = append(args, "-r", r)
+			}
+		} else {
+			var err error
+			if passphrase, err = enc.passphrase(); err != nil {
+				return nil, err
+			}
+			args = append(args, "--symmetric", "--cipher-algo", "AES256",
+				"--pinentry-mode", "loopback", "--passphrase-fd", "3")
+		}
+	}
+	return startFilter(enc.Tool, args, passphrase, nil, w)
+}
+
+// writeEncrypted runs write through the encrypter into w. Failures of
+// the tool are EncryptionErrors.
+func (config *Config) writeEncrypted(w io.Writer, write func(io.Writer) error) error {
+	ew, err := config.encrypter(w)
+	if err != nil {
+		return &EncryptionError{config.Encrypt.Tool, err}
+	}
+	werr := write(ew)
+	if cerr := ew.Close(); cerr != nil {
+		// a dead tool fails writes, its own error tells why
+		return &EncryptionError{config.Encrypt.Tool, cerr}
+	}
+	return werr
+}
+
+// openArchive opens name of ent in b, decrypting it when it is
+// encrypted.
+func (config *Config) openArchive(b storage.Backend, ent *Entry, name string) (io.ReadCloser, error) {
+	r, err := b.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	tool := encryption(ent, name)
+	if tool == "" {
+		return r, nil
+	}
+
+	enc := config.Encrypt
+	if enc == nil {
+		enc = &encryptConfig{Tool: tool}
+	}
+	var args []string
+	passphrase := ""
+	switch tool {
+	case "age":
+		if enc.Identity == "" {
+			r.Close()
+			return nil, fmt.Errorf("archive is encrypted with age, config.Encrypt.Identity is needed. archive=%s", b.Location(name))
+		}
+		args = []string{"-d", "-i", enc.Identity}
+	case "gpg":
+		args = []string{"--batch", "--quiet", "--no-tty", "--decrypt"}
+		if enc.PassphraseEnv != "" || enc.PassphraseFile != "" {
+			if passphrase, err = enc.passphrase(); err != nil {
+				r.Close()
+				return nil, err
+			}
+			args = append(args, "--pinentry-mode", "loopback", "--passphrase-fd", "3")
+		}
+	}
+	f, err := startFilter(tool, args, passphrase, r, nil)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	return &decrypted{f, r}, nil
+}
+
+type decrypted struct {
+	*filterCmd
+	src io.Closer
+}
+
+// Close waits for the tool before closing the archive it reads.
+func (d *decrypted) Close() error {
+	err := d.filterCmd.Close()
+	d.src.Close()
+	return err
+}
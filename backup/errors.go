@@ -0,0 +1,230 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	_ExitOK = 0
+	// _ExitFailure is used for runs whose failures are of mixed or
+	// unknown kinds and for failing subcommands.
+	_ExitFailure = 1
+	// _ExitConfig is used when the config is unreadable or invalid, no
+	// entry was attempted.
+	_ExitConfig = 2
+	// _ExitPartial is used when some entries failed and others were
+	// backed up. When none was, the code tells the kind of failure.
+	_ExitPartial = 3
+	// _ExitLocked is used when another run holds the lock, see Lock.
+	_ExitLocked           = 4
+	_ExitSourceRead       = 10
+	_ExitDestinationWrite = 11
+	_ExitCompression      = 12
+	_ExitRetention        = 13
+	_ExitUpload           = 14
+	_ExitInterrupted      = 15
+	_ExitTimeout          = 16
+	_ExitEncryption       = 17
+)
+
+// SourceReadError is returned when an entry's source can't be read.
+type SourceReadError struct {
+	Path string
+	Err  error
+}
+
+func (e *SourceReadError) Error() string {
+	return fmt.Sprintf("source read failed. path=%s err=%s", e.Path, e.Err)
+}
+
+func (e *SourceReadError) Unwrap() error { return e.Err }
+
+// DestinationWriteError is returned when an archive can't be written.
+type DestinationWriteError struct {
+	Path string
+	Err  error
+}
+
+func (e *DestinationWriteError) Error() string {
+	return fmt.Sprintf("destination write failed. path=%s err=%s", e.Path, e.Err)
+}
+
+func (e *DestinationWriteError) Unwrap() error { return e.Err }
+
+// CompressionError is returned when producing the archive stream fails.
+type CompressionError struct {
+	Err error
+}
+
+func (e *CompressionError) Error() string {
+	return fmt.Sprintf("compression failed. err=%s", e.Err)
+}
+
+func (e *CompressionError) Unwrap() error { return e.Err }
+
+// EncryptionError is returned when the encryption tool fails to start
+// or exits with an error.
+type EncryptionError struct {
+	Tool string
+	Err  error
+}
+
+func (e *EncryptionError) Error() string {
+	return fmt.Sprintf("encryption failed. tool=%s err=%s", e.Tool, e.Err)
+}
+
+func (e *EncryptionError) Unwrap() error { return e.Err }
+
+// RetentionError is returned when old generations can't be pruned.
+type RetentionError struct {
+	Path string
+	Err  error
+}
+
+func (e *RetentionError) Error() string {
+	return fmt.Sprintf("retention failed. path=%s err=%s", e.Path, e.Err)
+}
+
+func (e *RetentionError) Unwrap() error { return e.Err }
+
+// UploadError is returned when an archive can't be sent to a remote
+// destination.
+type UploadError struct {
+	Dst string
+	Err error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("upload failed. dst=%s err=%s", e.Dst, e.Err)
+}
+
+func (e *UploadError) Unwrap() error { return e.Err }
+
+// LockError is returned when another tarbu run holds a lock for longer
+// than -wait.
+type LockError struct {
+	What string
+	Path string
+	// Holder is the pid of the run holding it, with the host for
+	// leases, if known
+	Holder string
+	Wait   time.Duration
+}
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("another tarbu run holds the lock of %s. lock=%s holder=%s wait=%s", e.What, e.Path, e.Holder, e.Wait)
+}
+
+// InterruptedError is returned for entries stopped by a signal or their
+// Timeout, and for entries a signal kept from starting.
+type InterruptedError struct {
+	Entry string
+	// Signal is set when the run was interrupted, Timeout otherwise
+	Signal  os.Signal
+	Timeout time.Duration
+	Started bool
+}
+
+func (e *InterruptedError) Error() string {
+	switch {
+	case e.Signal == nil:
+		return fmt.Sprintf("backup timed out. entry=%s timeout=%s", e.Entry, e.Timeout)
+	case e.Started:
+		return fmt.Sprintf("backup interrupted. entry=%s signal=%s", e.Entry, e.Signal)
+	}
+	return fmt.Sprintf("backup not started, the run was interrupted. entry=%s signal=%s", e.Entry, e.Signal)
+}
+
+// panicError is a recovered panic of an entry's backup.
+type panicError struct {
+	value interface{}
+}
+
+func (e *panicError) Error() string {
+	return fmt.Sprintf("panic: %v", e.value)
+}
+
+type errorClass struct {
+	kind string
+	code int
+}
+
+func classify(err error) errorClass {
+	var (
+		sre *SourceReadError
+		dwe *DestinationWriteError
+		ce  *CompressionError
+		ee  *EncryptionError
+		re  *RetentionError
+		ue  *UploadError
+		le  *LockError
+		ie  *InterruptedError
+		pe  *panicError
+	)
+	switch {
+	case errors.As(err, &sre):
+		return errorClass{"source-read", _ExitSourceRead}
+	case errors.As(err, &dwe):
+		return errorClass{"destination-write", _ExitDestinationWrite}
+	case errors.As(err, &ce):
+		return errorClass{"compression", _ExitCompression}
+	case errors.As(err, &ee):
+		return errorClass{"encryption", _ExitEncryption}
+	case errors.As(err, &re):
+		return errorClass{"retention", _ExitRetention}
+	case errors.As(err, &ue):
+		return errorClass{"upload", _ExitUpload}
+	case errors.As(err, &le):
+		return errorClass{"locked", _ExitLocked}
+	case errors.As(err, &ie) && ie.Signal != nil:
+		return errorClass{"interrupted", _ExitInterrupted}
+	case errors.As(err, &ie):
+		return errorClass{"timeout", _ExitTimeout}
+	case errors.As(err, &pe):
+		return errorClass{"panic", _ExitFailure}
+	}
+	return errorClass{"unknown", _ExitFailure}
+}
+
+func errorKind(err error) string {
+	return classify(err).kind
+}
+
+// exitCode returns _ExitOK without failures and _ExitPartial when some
+// entries were backed up nonetheless. When none was, it is the kind
+// specific code if all failures share a kind, _ExitFailure otherwise.
+func exitCode(results []result) int {
+	code, succeeded := _ExitOK, false
+	for _, r := range results {
+		if r.err == nil {
+			succeeded = succeeded || r.skipped == ""
+		}
+	}
+	for _, r := range results {
+		if r.err == nil {
+			continue
+		}
+		if succeeded {
+			return _ExitPartial
+		}
+		c := classify(r.err).code
+		if code != _ExitOK && code != c {
+			return _ExitFailure
+		}
+		code = c
+	}
+	return code
+}
+
+// commandError appends the trimmed stderr of a failed command to err.
+func commandError(err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%s: %s", err, msg)
+	}
+	return err
+}
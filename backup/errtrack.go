@@ -0,0 +1,161 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// errorReporting sends panics and internal errors to Sentry and/or a
+// generic webhook receiving the same context as JSON.
+type errorReporting struct {
+	SentryDSN string `json:",omitempty"`
+	Webhook   string `json:",omitempty"`
+}
+
+type errorEvent struct {
+	Message string
+	Stack   string `json:",omitempty"`
+	Context map[string]string
+	Time    time.Time
+}
+
+var errorReportClient = &http.Client{Timeout: 10 * time.Second}
+
+func (config *Config) isErrorReportingValid() error {
+	if config.ErrorReporting == nil || config.ErrorReporting.SentryDSN == "" {
+		return nil
+	}
+	if _, _, err := sentryEndpoint(config.ErrorReporting.SentryDSN); err != nil {
+		return fmt.Errorf("config.ErrorReporting.SentryDSN is invalid. err=%s", err)
+	}
+	return nil
+}
+
+// recoverAndReport reports a panic of the calling goroutine and panics
+// again. It must be deferred.
+func (config *Config) recoverAndReport(ctx map[string]string) {
+	if v := recover(); v != nil {
+		config.reportError(fmt.Sprintf("panic: %v", v), debug.Stack(), ctx)
+		panic(v)
+	}
+}
+
+// recoverEntry turns a panic while backing up r.name into its error. It
+// must be deferred.
+func (config *Config) recoverEntry(r *result) {
+	if v := recover(); v != nil {
+		stack := debug.Stack()
+		r.err = &panicError{v}
+		config.reportError(fmt.Sprintf("panic: %v", v), stack, map[string]string{"entry": r.name})
+	}
+}
+
+// reportError sends an event to the configured trackers. Delivery
+// failures are printed, they never fail the run.
+func (config *Config) reportError(msg string, stack []byte, ctx map[string]string) {
+	er := config.ErrorReporting
+	if er == nil {
+		return
+	}
+	if ctx == nil {
+		ctx = map[string]string{}
+	}
+	host, _ := os.Hostname()
+	ctx["hostname"] = host
+	if config.runID != "" {
+		ctx["run_id"] = config.runID
+	}
+	ev := errorEvent{Message: msg, Stack: string(stack), Context: ctx, Time: time.Now()}
+
+	if er.Webhook != "" {
+		if err := postJSON(er.Webhook, nil, ev); err != nil {
+			printWarning("Error report failed: tracker=webhook err=%s", err)
+		}
+	}
+	if er.SentryDSN != "" {
+		if err := sendSentry(er.SentryDSN, ev); err != nil {
+			printWarning("Error report failed: tracker=sentry err=%s", err)
+		}
+	}
+}
+
+// sentryEndpoint converts https://<key>@<host>/<project> into the store
+// API URL and the auth header.
+func sentryEndpoint(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return "", "", fmt.Errorf("public key is missing")
+	}
+	project := strings.Trim(u.Path, "/")
+	if project == "" {
+		return "", "", fmt.Errorf("project id is missing")
+	}
+	prefix := ""
+	if i := strings.LastIndexByte(project, '/'); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	endpoint := fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project)
+	auth := fmt.Sprintf("Sentry sentry_version=7, sentry_client=tarbu, sentry_key=%s", u.User.Username())
+	return endpoint, auth, nil
+}
+
+func sendSentry(dsn string, ev errorEvent) error {
+	endpoint, auth, err := sentryEndpoint(dsn)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	body := map[string]interface{}{
+		"event_id":  hex.EncodeToString(id),
+		"timestamp": ev.Time.UTC().Format(time.RFC3339),
+		"level":     "error",
+		"platform":  "go",
+		"logger":    "tarbu",
+		"message":   ev.Message,
+		"tags":      ev.Context,
+		"extra":     map[string]string{"stack": ev.Stack},
+	}
+	return postJSON(endpoint, map[string]string{"X-Sentry-Auth": auth}, body)
+}
+
+func postJSON(endpoint string, header map[string]string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return post(endpoint, header, data)
+}
+
+// post sends data as JSON.
+func post(endpoint string, header map[string]string, data []byte) error {
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	resp, err := errorReportClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status. url=%s status=%s", endpoint, resp.Status)
+	}
+	return nil
+}
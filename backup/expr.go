@@ -0,0 +1,351 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// retentionExpr is a compiled RetentionExpr such as
+//
+//	age < 7d || (weekday == "Sun" && age < 8w) || index < 3
+//
+// Values are numbers, strings and booleans. Durations (s, m, h, d, w)
+// are numbers of seconds so they compare with age.
+type retentionExpr struct {
+	src  string
+	root exprNode
+}
+
+type exprNode interface {
+	eval(env map[string]interface{}) (interface{}, error)
+}
+
+type exprToken struct {
+	kind string // "num", "str", "ident", "op", "eof"
+	text string
+	num  float64
+	pos  int
+}
+
+func compileRetentionExpr(src string) (*retentionExpr, error) {
+	toks, err := lexExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{toks: toks}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+	}
+	return &retentionExpr{src, root}, nil
+}
+
+// keep evaluates the expression for a generation created at ts. index
+// is 0 for the newest generation.
+func (e *retentionExpr) keep(ts, now time.Time, index int) (bool, error) {
+	env := map[string]interface{}{
+		"age":     now.Sub(ts).Seconds(),
+		"index":   float64(index),
+		"weekday": ts.Weekday().String()[:3],
+		"day":     float64(ts.Day()),
+		"month":   float64(ts.Month()),
+		"year":    float64(ts.Year()),
+		"hour":    float64(ts.Hour()),
+	}
+	v, err := e.root.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression is not boolean. expr=%s", e.src)
+	}
+	return b, nil
+}
+
+var exprUnits = map[byte]float64{
+	's': 1,
+	'm': 60,
+	'h': 60 * 60,
+	'd': 24 * 60 * 60,
+	'w': 7 * 24 * 60 * 60,
+}
+
+func lexExpr(src string) ([]exprToken, error) {
+	var toks []exprToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(src) && (src[j] >= '0' && src[j] <= '9' || src[j] == '.') {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad number %q at %d", src[i:j], i)
+			}
+			if j < len(src) {
+				if u, ok := exprUnits[src[j]]; ok {
+					n *= u
+					j++
+				}
+			}
+			toks = append(toks, exprToken{"num", src[i:j], n, i})
+			i = j
+		case c == '"':
+			j := strings.IndexByte(src[i+1:], '"')
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			toks = append(toks, exprToken{"str", src[i+1 : i+1+j], 0, i})
+			i += j + 2
+		case unicode.IsLetter(rune(c)) || c == '_':
+			j := i
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_') {
+				j++
+			}
+			toks = append(toks, exprToken{"ident", src[i:j], 0, i})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")"} {
+				if strings.HasPrefix(src[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected %q at %d", c, i)
+			}
+			toks = append(toks, exprToken{"op", op, 0, i})
+			i += len(op)
+		}
+	}
+	return append(toks, exprToken{"eof", "end of expression", 0, len(src)}), nil
+}
+
+type exprParser struct {
+	toks []exprToken
+	i    int
+}
+
+func (p *exprParser) peek() exprToken { return p.toks[p.i] }
+
+func (p *exprParser) next() exprToken {
+	t := p.toks[p.i]
+	if t.kind != "eof" {
+		p.i++
+	}
+	return t
+}
+
+func (p *exprParser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != "op" {
+		return false
+	}
+	for _, o := range ops {
+		if t.text == o {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	l, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		r, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l = &logicalNode{"||", l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	l, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		r, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		l = &logicalNode{"&&", l, r}
+	}
+	return l, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.isOp("!") {
+		p.next()
+		n, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{n}, nil
+	}
+	return p.parseCmp()
+}
+
+func (p *exprParser) parseCmp() (exprNode, error) {
+	l, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if p.isOp("==", "!=", "<", "<=", ">", ">=") {
+		op := p.next().text
+		r, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &cmpNode{op, l, r}, nil
+	}
+	return l, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case "num":
+		return &litNode{t.num}, nil
+	case "str":
+		return &litNode{t.text}, nil
+	case "ident":
+		switch t.text {
+		case "true":
+			return &litNode{true}, nil
+		case "false":
+			return &litNode{false}, nil
+		}
+		switch t.text {
+		case "age", "index", "weekday", "day", "month", "year", "hour":
+			return &varNode{t.text}, nil
+		}
+		return nil, fmt.Errorf("unknown variable %q at %d", t.text, t.pos)
+	case "op":
+		if t.text == "(" {
+			n, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if !p.isOp(")") {
+				return nil, fmt.Errorf("missing ) at %d", p.peek().pos)
+			}
+			p.next()
+			return n, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at %d", t.text, t.pos)
+}
+
+type litNode struct{ v interface{} }
+
+func (n *litNode) eval(map[string]interface{}) (interface{}, error) { return n.v, nil }
+
+type varNode struct{ name string }
+
+func (n *varNode) eval(env map[string]interface{}) (interface{}, error) { return env[n.name], nil }
+
+type notNode struct{ n exprNode }
+
+func (n *notNode) eval(env map[string]interface{}) (interface{}, error) {
+	v, err := n.n.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return nil, fmt.Errorf("! needs a boolean, got %v", v)
+	}
+	return !b, nil
+}
+
+type logicalNode struct {
+	op   string
+	l, r exprNode
+}
+
+func (n *logicalNode) eval(env map[string]interface{}) (interface{}, error) {
+	lv, err := n.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	l, ok := lv.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s needs booleans, got %v", n.op, lv)
+	}
+	if n.op == "||" && l || n.op == "&&" && !l {
+		return l, nil
+	}
+	rv, err := n.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	r, ok := rv.(bool)
+	if !ok {
+		return nil, fmt.Errorf("%s needs booleans, got %v", n.op, rv)
+	}
+	return r, nil
+}
+
+type cmpNode struct {
+	op   string
+	l, r exprNode
+}
+
+func (n *cmpNode) eval(env map[string]interface{}) (interface{}, error) {
+	lv, err := n.l.eval(env)
+	if err != nil {
+		return nil, err
+	}
+	rv, err := n.r.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch l := lv.(type) {
+	case float64:
+		r, ok := rv.(float64)
+		if !ok {
+			break
+		}
+		switch n.op {
+		case "==":
+			return l == r, nil
+		case "!=":
+			return l != r, nil
+		case "<":
+			return l < r, nil
+		case "<=":
+			return l <= r, nil
+		case ">":
+			return l > r, nil
+		case ">=":
+			return l >= r, nil
+		}
+	case string, bool:
+		if n.op != "==" && n.op != "!=" {
+			return nil, fmt.Errorf("%s can't compare %v", n.op, lv)
+		}
+		return (lv == rv) == (n.op == "=="), nil
+	}
+	return nil, fmt.Errorf("can't compare %v %s %v", lv, n.op, rv)
+}
@@ -0,0 +1,236 @@
+package backup
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tarMissing warns once per run that restores go without the tar binary.
+var tarMissing sync.Once
+
+// memberFilter selects the members a restore extracts by -include
+// paths, which are member names without leading ./ and / or a trailing
+// slash. A path takes a file or directory and everything under it.
+type memberFilter struct {
+	paths []string
+	// extracted counts the members extracted
+	extracted int
+}
+
+func (f *memberFilter) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(f.paths, ",")
+}
+
+func (f *memberFilter) Set(v string) error {
+	p := memberPath(v)
+	if p == "" {
+		return fmt.Errorf("include must name a file or directory. include=%s", v)
+	}
+	for i, q := range f.paths {
+		switch {
+		case p == q || strings.HasPrefix(p, q+"/"):
+			return nil
+		case strings.HasPrefix(q, p+"/"):
+			// a path under another would end its run early
+			f.paths[i] = p
+			return nil
+		}
+	}
+	f.paths = append(f.paths, p)
+	return nil
+}
+
+// match returns the index of the path name is or is under, -1 for none.
+func (f *memberFilter) match(name string) int {
+	name = memberPath(name)
+	for i, p := range f.paths {
+		if name == p || strings.HasPrefix(name, p+"/") {
+			return i
+		}
+	}
+	return -1
+}
+
+func memberPath(name string) string {
+	return strings.Trim(strings.TrimPrefix(name, "./"), "/")
+}
+
+// extractNative extracts the tar stream r into to without the tar
+// binary. It restores directories, regular files, symlinks and hard
+// links with their modes and mtimes, and owners when running as root.
+// Extended attributes, ACLs and special files are left out.
+//
+// With a filter only the members it matches are extracted. Archives keep
+// the files under a directory together, so with stopEarly reading ends
+// once every path of the filter was passed, which it reports.
+func extractNative(r io.Reader, to string, f *memberFilter, stopEarly bool) (bool, error) {
+	root := os.Geteuid() == 0
+	var dirs []*tar.Header
+	extracted := map[string]bool{}
+	running, left := -1, 0
+	if f != nil {
+		left = len(f.paths)
+	}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+		if f != nil {
+			i := f.match(hdr.Name)
+			if i != running && running >= 0 {
+				left--
+				if left == 0 && stopEarly {
+					return true, finishDirs(to, dirs, root)
+				}
+			}
+			running = i
+			if i < 0 {
+				continue
+			}
+			f.extracted++
+		}
+		p, err := extractPath(to, hdr.Name)
+		if err != nil {
+			return false, err
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return false, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			// a symlink in its place would take the mode and mtime
+			if fi, err := os.Lstat(p); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				if err := os.Remove(p); err != nil {
+					return false, err
+				}
+			}
+			if err := os.MkdirAll(p, 0700); err != nil {
+				return false, err
+			}
+			dirs = append(dirs, hdr)
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+			extracted[memberPath(hdr.Name)] = true
+			os.Remove(p)
+			out, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if err != nil {
+				return false, err
+			}
+			_, err = io.Copy(out, tr)
+			if cerr := out.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return false, err
+			}
+			if err := os.Chmod(p, os.FileMode(hdr.Mode).Perm()); err != nil {
+				return false, err
+			}
+			if err := os.Chtimes(p, hdr.ModTime, hdr.ModTime); err != nil {
+				return false, err
+			}
+		case tar.TypeSymlink:
+			os.Remove(p)
+			if err := os.Symlink(hdr.Linkname, p); err != nil {
+				return false, err
+			}
+		case tar.TypeLink:
+			target, err := extractPath(to, hdr.Linkname)
+			if err != nil {
+				return false, err
+			}
+			if f != nil && !extracted[memberPath(hdr.Linkname)] {
+				printWarning("Hard link left out, its target isn't included: name=%s target=%s", hdr.Name, hdr.Linkname)
+				continue
+			}
+			os.Remove(p)
+			if err := os.Link(target, p); err != nil {
+				return false, err
+			}
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			printWarning("Member left out without tar: name=%s type=%c", hdr.Name, hdr.Typeflag)
+			continue
+		}
+		if root {
+			if err := os.Lchown(p, hdr.Uid, hdr.Gid); err != nil {
+				return false, err
+			}
+		}
+	}
+	return false, finishDirs(to, dirs, root)
+}
+
+// finishDirs sets the owners, modes and mtimes of the directories
+// extracted once their contents are.
+func finishDirs(to string, dirs []*tar.Header, root bool) error {
+	// deepest first, so restoring a directory doesn't touch its parent
+	for i := len(dirs) - 1; i >= 0; i-- {
+		hdr := dirs[i]
+		p, err := extractPath(to, hdr.Name)
+		if err != nil {
+			return err
+		}
+		// a later member may have replaced it with a symlink
+		if fi, err := os.Lstat(p); err != nil || !fi.IsDir() {
+			continue
+		}
+		if root {
+			if err := os.Lchown(p, hdr.Uid, hdr.Gid); err != nil {
+				return err
+			}
+		}
+		if err := os.Chmod(p, os.FileMode(hdr.Mode).Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(p, time.Now(), hdr.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractPath is where member name goes under to. Leading slashes are
+// dropped as tar does. Names leaving to are refused, with .. or through
+// a symlink below to, which an earlier member may have made point
+// anywhere.
+func extractPath(to, name string) (string, error) {
+	name = strings.TrimLeft(name, "/")
+	segs := strings.Split(name, "/")
+	for _, seg := range segs {
+		if seg == ".." {
+			return "", fmt.Errorf("invalid member name in archive. name=%s", name)
+		}
+	}
+	dir := to
+	for _, seg := range segs[:len(segs)-1] {
+		if seg == "" || seg == "." {
+			continue
+		}
+		dir = filepath.Join(dir, seg)
+		fi, err := os.Lstat(dir)
+		if err != nil {
+			// the rest is created
+			break
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("member path goes through a symlink. name=%s symlink=%s", name, dir)
+		}
+	}
+	return filepath.Join(to, filepath.FromSlash(name)), nil
+}
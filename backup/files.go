@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/k3nju/tarbu/internal/archiver"
+)
+
+// fileRecord is a member the next archive of an entry would hold.
+type fileRecord struct {
+	Name string
+	Mode string
+	Size int64
+}
+
+// filesCommand prints the members the next backup of an entry would
+// archive, after Exclude, ExcludeVCS and the special file policy, so
+// patterns can be checked without a run. Incremental entries archive
+// only the changed files among them.
+func filesCommand(args []string) error {
+	fs := flag.NewFlagSet("files", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	long := fs.Bool("long", false, "print the mode and size of members")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu files [-config path] [-long] [-json] <entry>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("entry is required")
+	}
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	ent := config.findEntry(fs.Arg(0))
+	if ent == nil {
+		return fmt.Errorf("entry not found. name=%s", fs.Arg(0))
+	}
+	if ent.Type != "" {
+		return fmt.Errorf("typed entries archive a dump, not files. name=%s type=%s", ent.Name, ent.Type)
+	}
+	if err := config.isExcludeValid(); err != nil {
+		return err
+	}
+	if err := config.isFiltersValid(); err != nil {
+		return err
+	}
+	roots, err := ent.sources()
+	if err != nil {
+		return err
+	}
+
+	opts := config.archiveOptions(ent)
+	if ent.SpecialFiles != "" {
+		// fail would abort the run at the first one, list them all
+		opts.Special = func(p string) error {
+			if ent.SpecialFiles != "skip" {
+				printWarning("Special file left out: path=%s policy=%s", p, ent.SpecialFiles)
+			}
+			return nil
+		}
+	}
+	records := []fileRecord{}
+	var n, size int64
+	err = archiver.List(roots, opts, func(_, name string, fi os.FileInfo) error {
+		n++
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		if *asJSON {
+			records = append(records, fileRecord{name, fi.Mode().String(), fi.Size()})
+		} else if *long {
+			fmt.Printf("%s %10d %s\n", fi.Mode(), fi.Size(), name)
+		} else {
+			fmt.Println(name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(os.Stdout, records)
+	}
+	fmt.Fprintf(os.Stderr, "%d members, %s of file data\n", n, formatSize(size))
+	return nil
+}
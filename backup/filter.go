@@ -0,0 +1,56 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+)
+
+// _FilteredPaths is the number of paths left out by filters the summary
+// lists for each entry, on top of their count.
+const _FilteredPaths = 20
+
+func (config *Config) isFiltersValid() error {
+	for _, e := range config.Entries {
+		if e.MaxFileSize != "" {
+			n, err := parseSize(e.MaxFileSize)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("entry max file size must be a positive size. name=%s max_file_size=%s", e.Name, e.MaxFileSize)
+			}
+			e.maxFileSize = n
+		}
+		if e.SkipOlderThan != "" {
+			d, err := parseDuration(e.SkipOlderThan)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("entry skip older than is invalid. name=%s skip_older_than=%s", e.Name, e.SkipOlderThan)
+			}
+			e.skipOlderThan = d
+		}
+		filtered := e.maxFileSize > 0 || e.skipOlderThan > 0 || e.SkipSockets || e.SkipDevices || e.FollowSymlinks
+		// filters would drop the dump
+		if filtered && e.Type != "" {
+			return fmt.Errorf("typed entries archive a dump and can't be filtered. name=%s type=%s", e.Name, e.Type)
+		}
+	}
+	return nil
+}
+
+// skipper returns the archiver.Options Skip of the filters of ent, nil
+// without filters.
+func (config *Config) skipper(ent *Entry) func(string, os.FileInfo) bool {
+	if ent.maxFileSize == 0 && ent.skipOlderThan == 0 && !ent.SkipSockets && !ent.SkipDevices {
+		return nil
+	}
+	cutoff := config.now().Add(-ent.skipOlderThan)
+	return func(_ string, fi os.FileInfo) bool {
+		mode := fi.Mode()
+		switch {
+		case ent.maxFileSize > 0 && mode.IsRegular() && fi.Size() > ent.maxFileSize:
+		case ent.skipOlderThan > 0 && fi.ModTime().Before(cutoff):
+		case ent.SkipSockets && mode&os.ModeSocket != 0:
+		case ent.SkipDevices && mode&os.ModeDevice != 0:
+		default:
+			return false
+		}
+		return true
+	}
+}
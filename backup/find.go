@@ -0,0 +1,211 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// findRecord is a file found in a generation.
+type findRecord struct {
+	Entry   string
+	Name    string
+	Archive string
+	Time    time.Time
+	Size    int64
+	MTime   time.Time
+	SHA256  string `json:",omitempty"`
+	// Changed is set when the file differs from the generation before,
+	// or isn't in it
+	Changed bool
+}
+
+// findCommand searches the file lists of indexed and incremental
+// entries and the snapshots of repository entries for the files
+// matching pattern, and prints the generations holding them, oldest
+// first, without reading any archive.
+func findCommand(args []string) error {
+	fs := flag.NewFlagSet("find", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	entry := fs.String("entry", "", "search this entry only")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu find [-config path] [-entry name] [-json] <pattern>")
+		fmt.Fprintln(fs.Output(), "pattern is a path or glob, matched against base names too when it has no slash")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("pattern is required")
+	}
+	pattern := fs.Arg(0)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("pattern is invalid. pattern=%s", pattern)
+	}
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	entries := config.Entries
+	if *entry != "" {
+		ent := config.findEntry(*entry)
+		if ent == nil {
+			return fmt.Errorf("entry not found. name=%s", *entry)
+		}
+		entries = []*Entry{ent}
+	}
+
+	records := []findRecord{}
+	for _, ent := range entries {
+		var found []findRecord
+		if ent.Repository {
+			found, err = config.findSnapshots(ent, pattern)
+		} else {
+			found, err = config.findGenerations(ent, pattern)
+		}
+		if err != nil {
+			return err
+		}
+		records = append(records, found...)
+	}
+
+	if *asJSON {
+		return writeJSON(os.Stdout, records)
+	}
+	last := ""
+	for _, r := range records {
+		if key := r.Entry + "\x00" + r.Name; key != last {
+			if last != "" {
+				fmt.Println()
+			}
+			fmt.Printf("%s (entry=%s)\n", r.Name, r.Entry)
+			last = key
+		}
+		mark := " "
+		if r.Changed {
+			mark = "*"
+		}
+		fmt.Printf("%s %-23s %9s  modified %-23s  %s\n", mark, config.formatTime(r.Time), formatSize(r.Size), config.formatTime(r.MTime), r.Archive)
+	}
+	fmt.Fprintf(os.Stderr, "%d matches, * marks generations where the file changed\n", len(records))
+	return nil
+}
+
+// findGenerations searches the manifests of the generations of ent.
+// Generations without one are skipped with a warning.
+func (config *Config) findGenerations(ent *Entry, pattern string) ([]findRecord, error) {
+	b, err := config.entryBackend(ent)
+	if err != nil {
+		return nil, err
+	}
+	gens, err := generations(b, ent)
+	if err != nil {
+		return nil, err
+	}
+	var found []findRecord
+	seen := map[string]string{}
+	unindexed := 0
+	for _, g := range gens {
+		ts := archiveTime(ent, g.Name)
+		m, err := readManifest(b, ent, archiveKey(ent, g.Name))
+		if storage.IsNotExist(err) {
+			unindexed++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range m.Files {
+			if !matchFile(pattern, f.Name) {
+				continue
+			}
+			prev, ok := seen[f.Name]
+			seen[f.Name] = f.SHA256
+			found = append(found, findRecord{
+				Entry:   ent.Name,
+				Name:    f.Name,
+				Archive: b.Location(g.Name),
+				Time:    time.Unix(ts, 0),
+				Size:    f.Size,
+				MTime:   time.Unix(0, f.MTime),
+				SHA256:  f.SHA256,
+				Changed: !ok || prev != f.SHA256,
+			})
+		}
+	}
+	if unindexed > 0 {
+		printWarning("Generations without a file list skipped, set Index to list them: entry=%s generations=%d", ent.Name, unindexed)
+	}
+	return sortFound(found), nil
+}
+
+// findSnapshots searches the snapshots of the repository entry ent.
+func (config *Config) findSnapshots(ent *Entry, pattern string) ([]findRecord, error) {
+	rp, err := config.openRepo(ent)
+	if err != nil {
+		return nil, err
+	}
+	times, err := rp.snapshotTimes(ent.Name)
+	if err != nil {
+		return nil, err
+	}
+	var found []findRecord
+	seen := map[string]string{}
+	for _, ts := range times {
+		name := snapshotName(ent.Name, ts)
+		s, err := rp.readSnapshot(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range s.Files {
+			if !f.Mode.IsRegular() || !matchFile(pattern, f.Name) {
+				continue
+			}
+			// the chunks name the contents
+			sum := strings.Join(f.Chunks, ",")
+			prev, ok := seen[f.Name]
+			seen[f.Name] = sum
+			found = append(found, findRecord{
+				Entry:   ent.Name,
+				Name:    f.Name,
+				Archive: rp.snapshots.Location(name),
+				Time:    time.Unix(ts, 0),
+				Size:    f.Size,
+				MTime:   time.Unix(f.MTime, 0),
+				Changed: !ok || prev != sum,
+			})
+		}
+	}
+	return sortFound(found), nil
+}
+
+// sortFound orders records by file, keeping the generation order they
+// come in.
+func sortFound(found []findRecord) []findRecord {
+	sort.SliceStable(found, func(i, j int) bool { return found[i].Name < found[j].Name })
+	return found
+}
+
+// matchFile tells whether the member name matches pattern, a path or a
+// glob. Leading ./ and / don't count, patterns without a slash match
+// base names too.
+func matchFile(pattern, name string) bool {
+	name = strings.TrimLeft(strings.TrimPrefix(name, "./"), "/")
+	pattern = strings.TrimLeft(strings.TrimPrefix(pattern, "./"), "/")
+	if ok, _ := path.Match(pattern, name); ok {
+		return true
+	}
+	if strings.Contains(pattern, "/") {
+		return false
+	}
+	ok, _ := path.Match(pattern, path.Base(name))
+	return ok
+}
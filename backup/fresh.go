@@ -0,0 +1,101 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// assertFreshCommand fails unless the newest archive of an entry is
+// younger than -max-age, so pipelines can refuse risky steps without a
+// recent backup. Only successful runs leave archives in Dst.
+func assertFreshCommand(args []string) error {
+	fs := flag.NewFlagSet("assert-fresh", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	entry := fs.String("entry", "", "entry whose newest generation is checked")
+	maxAge := fs.String("max-age", "", "oldest acceptable age of the newest generation, e.g. 26h or 2d")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu assert-fresh [-config path] [-json] -entry name -max-age duration")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *entry == "" || *maxAge == "" {
+		fs.Usage()
+		return fmt.Errorf("-entry and -max-age are required")
+	}
+	limit, err := parseDuration(*maxAge)
+	if err != nil || limit <= 0 {
+		return fmt.Errorf("max age is invalid. max_age=%s", *maxAge)
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	ent := config.findEntry(*entry)
+	if ent == nil {
+		return fmt.Errorf("entry not found. name=%s", *entry)
+	}
+	res, err := config.freshness(ent, limit)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		if err := writeJSON(os.Stdout, res); err != nil {
+			return err
+		}
+	}
+
+	age := time.Duration(res.Age) * time.Second
+	switch res.Status {
+	case "missing":
+		return fmt.Errorf("backup is missing. entry=%s dst=%s", ent.Name, config.entryDst(ent))
+	case "stale":
+		return fmt.Errorf("backup is stale. entry=%s age=%s max_age=%s archive=%s", ent.Name, age, limit, res.Archive)
+	}
+	if !*asJSON {
+		printSuccess("Backup is fresh: entry=%s age=%s archive=%s", ent.Name, age, res.Archive)
+	}
+	return nil
+}
+
+// freshness returns the age of the newest generation of ent, stale when
+// older than limit.
+func (config *Config) freshness(ent *Entry, limit time.Duration) (freshResult, error) {
+	res := freshResult{Entry: ent.Name, MaxAge: int64(limit / time.Second), Status: "missing"}
+	b, err := config.entryBackend(ent)
+	if err != nil {
+		return res, err
+	}
+	if ent.numbered() {
+		return res, fmt.Errorf("numbered entries have no backup time. entry=%s", ent.Name)
+	}
+	gens, err := generations(b, ent)
+	if err != nil {
+		return res, err
+	}
+	if len(gens) > 0 {
+		newest := gens[len(gens)-1]
+		at := time.Unix(archiveTime(ent, newest.Name), 0)
+		age := config.now().Sub(at).Round(time.Second)
+		res.Archive, res.Time, res.Age, res.Status = b.Location(newest.Name), &at, int64(age/time.Second), "fresh"
+		if age > limit {
+			res.Status = "stale"
+		}
+	}
+	return res, nil
+}
+
+// freshResult is the -json output of assert-fresh. Status is "fresh",
+// "stale" or "missing", Age and MaxAge are seconds.
+type freshResult struct {
+	Entry   string
+	Status  string
+	Archive string     `json:",omitempty"`
+	Time    *time.Time `json:",omitempty"`
+	Age     int64
+	MaxAge  int64
+}
@@ -0,0 +1,171 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// _HistoryFile is the run journal kept in config.Dst, or in
+// config.StateDir when set.
+const _HistoryFile = ".tarbu-history.jsonl"
+
+// _HistoryLease is the lease taken while a journal that can't be
+// appended to is rewritten.
+const _HistoryLease = ".tarbu-history.lease"
+
+// _HistoryMaxLine bounds a journal record when reading.
+const _HistoryMaxLine = 16 << 20
+
+// historyRecord is one entry's outcome in one run.
+type historyRecord struct {
+	RunID    string `json:",omitempty"`
+	Entry    string
+	Start    time.Time
+	Duration time.Duration
+	Archive  string `json:",omitempty"`
+	Size     int64  `json:",omitempty"`
+	SHA256   string `json:",omitempty"`
+	Skipped  string `json:",omitempty"`
+	Changed  int    `json:",omitempty"`
+	Vanished int    `json:",omitempty"`
+	Error    string `json:",omitempty"`
+	Kind     string `json:",omitempty"`
+	// Verify is set on records of a verification sample instead of a
+	// backup, "ok" or "corrupt"
+	Verify string `json:",omitempty"`
+}
+
+func (config *Config) isHistoryValid() error {
+	if config.StateDir != "" {
+		if err := isDirWritable("config.StateDir", config.StateDir); err != nil {
+			return err
+		}
+	}
+	if config.StaleAfter != "" {
+		d, err := parseDuration(config.StaleAfter)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("config.StaleAfter is invalid. stale_after=%s", config.StaleAfter)
+		}
+		config.staleAfter = d
+	}
+	return nil
+}
+
+// historyBackend returns where the journal is kept.
+func (config *Config) historyBackend() (storage.Backend, error) {
+	if config.StateDir != "" {
+		return &storage.Local{Dir: config.StateDir}, nil
+	}
+	return config.backend()
+}
+
+// appendHistory adds the results of a run to the journal. The records
+// are written with a single append, so runs sharing a destination don't
+// interleave and readers see a run's records all or nothing, apart from
+// a torn last line. Remote destinations can't append, there the journal
+// is rewritten holding _HistoryLease so concurrent runs keep each
+// other's records.
+func (config *Config) appendHistory(results []result) error {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, r := range results {
+		rec := historyRecord{
+			RunID:    config.runID,
+			Entry:    r.name,
+			Start:    r.start,
+			Duration: r.duration,
+			Archive:  r.archive,
+			Size:     r.size,
+			SHA256:   r.sha256,
+			Skipped:  r.skipped,
+			Changed:  r.changed,
+			Vanished: r.vanished,
+			Verify:   r.verified,
+		}
+		if r.err != nil {
+			rec.Error = r.err.Error()
+			rec.Kind = errorKind(r.err)
+		}
+		if err := enc.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	b, err := config.historyBackend()
+	if err != nil {
+		return err
+	}
+	if a, ok := b.(storage.Appender); ok {
+		return a.Append(_HistoryFile, buf.Bytes())
+	}
+	// a run holds the lease for a rewrite only, waiting for its TTL
+	// outlasts a run that crashed holding it
+	wait := config.leaseTTL
+	if wait == 0 {
+		wait = _LeaseTTL
+	}
+	l, err := config.takeLease(b, _HistoryLease, "the history", wait)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	old, err := b.Open(_HistoryFile)
+	if err != nil && !storage.IsNotExist(err) {
+		return err
+	}
+	r := io.Reader(buf)
+	if err == nil {
+		defer old.Close()
+		r = io.MultiReader(old, buf)
+	}
+	return b.Put(_HistoryFile, r)
+}
+
+// readHistory returns the backup records started at or after since.
+func (config *Config) readHistory(since time.Time) ([]historyRecord, error) {
+	return config.readJournal(since, false)
+}
+
+// readVerifications returns the records of verification samples.
+func (config *Config) readVerifications() ([]historyRecord, error) {
+	return config.readJournal(time.Time{}, true)
+}
+
+// readJournal returns the journal records started at or after since,
+// those of verification samples or those of backups.
+func (config *Config) readJournal(since time.Time, verify bool) ([]historyRecord, error) {
+	b, err := config.historyBackend()
+	if err != nil {
+		return nil, err
+	}
+	f, err := b.Open(_HistoryFile)
+	if storage.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []historyRecord
+	sc := bufio.NewScanner(f)
+	// errors carry command stderr and can exceed the default line limit
+	sc.Buffer(nil, _HistoryMaxLine)
+	for sc.Scan() {
+		var rec historyRecord
+		// a torn last line from a crashed run is skipped
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			continue
+		}
+		if !rec.Start.Before(since) && (rec.Verify != "") == verify {
+			records = append(records, rec)
+		}
+	}
+	return records, sc.Err()
+}
@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync/atomic"
+)
+
+func (config *Config) isCmdValid() error {
+	for _, e := range config.Entries {
+		switch e.PreCmdFailure {
+		case "", "fail", "skip", "abort":
+		default:
+			return fmt.Errorf("unknown entry pre command failure policy. name=%s policy=%s", e.Name, e.PreCmdFailure)
+		}
+		if e.CmdTimeout == "" {
+			continue
+		}
+		d, err := parseDuration(e.CmdTimeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("entry command timeout is invalid. name=%s timeout=%s", e.Name, e.CmdTimeout)
+		}
+		e.cmdTimeout = d
+	}
+	return nil
+}
+
+// runCmd runs a PreCmd or PostCmd of ent within its CmdTimeout. The
+// command gets TARBU_ENTRY and the variables in env.
+func (ent *Entry) runCmd(args []string, env ...string) error {
+	ctx := context.Background()
+	if ent.cmdTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ent.cmdTimeout)
+		defer cancel()
+	}
+	stderr := &bytes.Buffer{}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), append([]string{"TARBU_ENTRY=" + ent.Name}, env...)...)
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out. timeout=%s", ent.CmdTimeout)
+	}
+	if err != nil {
+		return commandError(err, stderr)
+	}
+	return nil
+}
+
+// preCmd runs ent.PreCmd and applies PreCmdFailure when it fails. It
+// returns false when the entry must not be archived.
+func (config *Config) preCmd(r *result, ent *Entry) bool {
+	if len(ent.PreCmd) == 0 {
+		return true
+	}
+	err := ent.runCmd(ent.PreCmd)
+	if err == nil {
+		return true
+	}
+	switch ent.PreCmdFailure {
+	case "skip":
+		r.skipped = fmt.Sprintf("pre command failed. err=%s", err)
+		return false
+	case "abort":
+		atomic.StoreInt32(&config.aborted, 1)
+	}
+	r.err = &SourceReadError{ent.Path, fmt.Errorf("pre command failed. err=%s", err)}
+	return false
+}
+
+// postCmd runs ent.PostCmd after the entry was archived or failed to,
+// telling it which in TARBU_STATUS. A failing PostCmd is a warning.
+func (config *Config) postCmd(r *result, ent *Entry) {
+	if len(ent.PostCmd) == 0 {
+		return
+	}
+	status := "succeeded"
+	if r.err != nil {
+		status = "failed"
+	}
+	if err := ent.runCmd(ent.PostCmd, "TARBU_STATUS="+status, "TARBU_ARCHIVE="+r.archive); err != nil {
+		r.warnings = append(r.warnings, fmt.Sprintf("post command failed. err=%s", err))
+	}
+}
+
+// isAborted is true once an entry's PreCmd aborted the run.
+func (config *Config) isAborted() bool {
+	return atomic.LoadInt32(&config.aborted) != 0
+}
@@ -0,0 +1,260 @@
+package backup
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/k3nju/tarbu/internal/archiver"
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// _ManifestPrefix starts the names of the manifests of incremental
+// entries, .tarbu-manifest.<entry>.<genKey>.json. Like the history
+// they are hidden next to the archives.
+const _ManifestPrefix = ".tarbu-manifest."
+
+// _FullEvery is the default of Entry.FullEvery.
+const _FullEvery = 7
+
+type manifestFile struct {
+	Name   string
+	Size   int64
+	MTime  int64
+	SHA256 string `json:",omitempty"`
+}
+
+// manifest lists every regular file of a generation of an incremental
+// or indexed entry, by member name.
+type manifest struct {
+	RunID string `json:",omitempty"`
+	Entry string
+	Time  int64
+	// Seq orders the generations started in the same second
+	Seq int `json:",omitempty"`
+	// Base and BaseSeq are the genKey of the full backup whose changes
+	// the archive holds, zero when the archive is a full backup.
+	Base    int64 `json:",omitempty"`
+	BaseSeq int   `json:",omitempty"`
+	Files   []manifestFile
+
+	mu    sync.Mutex
+	files map[string]*manifestFile
+}
+
+func manifestName(ent *Entry, k genKey) string {
+	return fmt.Sprintf("%s%s.%s.json", _ManifestPrefix, ent.Name, k)
+}
+
+func (m *manifest) key() genKey     { return genKey{m.Time, m.Seq} }
+func (m *manifest) baseKey() genKey { return genKey{m.Base, m.BaseSeq} }
+
+// archiveKey returns the genKey of an archive name of ent, one that
+// generations listed.
+func archiveKey(ent *Entry, name string) genKey {
+	k, _ := generationKey(ent, name)
+	return k
+}
+
+// archiveTime returns the timestamp of an archive name of ent.
+func archiveTime(ent *Entry, name string) int64 {
+	return archiveKey(ent, name).ts
+}
+
+func readManifest(b storage.Backend, ent *Entry, k genKey) (*manifest, error) {
+	r, err := b.Open(manifestName(ent, k))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	m := &manifest{}
+	if err := json.NewDecoder(r).Decode(m); err != nil {
+		return nil, fmt.Errorf("manifest is broken. manifest=%s err=%s", b.Location(manifestName(ent, k)), err)
+	}
+	m.files = map[string]*manifestFile{}
+	for i := range m.Files {
+		m.files[m.Files[i].Name] = &m.Files[i]
+	}
+	return m, nil
+}
+
+func writeManifest(b storage.Backend, ent *Entry, m *manifest) error {
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Name < m.Files[j].Name })
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	name := manifestName(ent, m.key())
+	if err := b.Put(name, strings.NewReader(string(data))); err != nil {
+		return putError(b, b.Location(name), err)
+	}
+	return nil
+}
+
+// manifestKeys returns the genKeys of the manifests of ent, oldest
+// first.
+func manifestKeys(b storage.Backend, ent *Entry) ([]genKey, error) {
+	prefix := _ManifestPrefix + ent.Name + "."
+	objs, err := b.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var keys []genKey
+	for _, o := range objs {
+		// entry names may share a prefix, so anything but a bare
+		// genKey belongs to another entry
+		if k, ok := parseGenKey(strings.TrimSuffix(strings.TrimPrefix(o.Name, prefix), ".json")); ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].before(keys[j]) })
+	return keys, nil
+}
+
+// incrementalBase returns the manifest of the full backup the next
+// archive of ent is taken against, or nil when it has to be a full
+// backup: there is none yet, its archive is gone, or FullEvery runs
+// have passed since.
+func (config *Config) incrementalBase(b storage.Backend, ent *Entry) (*manifest, error) {
+	keys, err := manifestKeys(b, ent)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	last, err := readManifest(b, ent, keys[len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	base := last
+	if last.Base != 0 {
+		if base, err = readManifest(b, ent, last.baseKey()); storage.IsNotExist(err) {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	gens, err := generations(b, ent)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, g := range gens {
+		found = found || archiveKey(ent, g.Name) == base.key()
+	}
+	if !found {
+		return nil, nil
+	}
+
+	runs := 0
+	for _, k := range keys {
+		if !k.before(base.key()) {
+			runs++
+		}
+	}
+	every := ent.FullEvery
+	if every == 0 {
+		every = _FullEvery
+	}
+	if runs >= every {
+		return nil, nil
+	}
+	return base, nil
+}
+
+// track makes opts leave out the files unchanged since base, a nil base
+// archiving everything, and fills m as the archive is written.
+func (m *manifest) track(opts *archiver.Options, base *manifest) {
+	add := func(f manifestFile) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.Files = append(m.Files, f)
+	}
+	if base != nil {
+		m.Base, m.BaseSeq = base.Time, base.Seq
+		opts.Unchanged = func(name string, fi os.FileInfo) bool {
+			f, ok := base.files[name]
+			if !ok || f.Size != fi.Size() || f.MTime != fi.ModTime().UnixNano() {
+				return false
+			}
+			add(*f)
+			return true
+		}
+	}
+	opts.Record = func(name string, fi os.FileInfo, sum []byte) {
+		add(manifestFile{name, fi.Size(), fi.ModTime().UnixNano(), hex.EncodeToString(sum)})
+	}
+}
+
+// keepBases drops from expired the full backups that kept incremental
+// archives of ent depend on.
+func keepBases(b storage.Backend, ent *Entry, gens, expired []string) ([]string, error) {
+	dropped := map[string]bool{}
+	for _, g := range expired {
+		dropped[g] = true
+	}
+	needed := map[genKey]bool{}
+	for _, g := range gens {
+		if dropped[g] {
+			continue
+		}
+		m, err := readManifest(b, ent, archiveKey(ent, g))
+		if storage.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m.Base != 0 {
+			needed[m.baseKey()] = true
+		}
+	}
+	var del []string
+	for _, g := range expired {
+		if !needed[archiveKey(ent, g)] {
+			del = append(del, g)
+		}
+	}
+	return del, nil
+}
+
+// restoreIncremental extracts the full backup an incremental archive is
+// based on, then the archive, and removes the files deleted in between.
+func (config *Config) restoreIncremental(b storage.Backend, ent *Entry, m *manifest, to string, opts []string, verify bool, include *memberFilter) error {
+	full, err := generationAt(b, ent, m.baseKey())
+	if err != nil {
+		return fmt.Errorf("full backup of incremental archive is missing. err=%s", err)
+	}
+	base, err := readManifest(b, ent, m.baseKey())
+	if err != nil {
+		return fmt.Errorf("full backup manifest of incremental archive is unreadable. archive=%s err=%s", b.Location(full), err)
+	}
+	if verify {
+		if err := config.verifyArchive(b, ent, full); err != nil {
+			return err
+		}
+	}
+	if err := config.extractArchive(b, ent, full, to, opts, include); err != nil {
+		return err
+	}
+	fmt.Printf("Restored full backup %s into %s\n", b.Location(full), to)
+	name, err := generationAt(b, ent, m.key())
+	if err != nil {
+		return err
+	}
+	if err := config.extractArchive(b, ent, name, to, opts, include); err != nil {
+		return err
+	}
+	for _, f := range base.Files {
+		if _, ok := m.files[f.Name]; ok || include != nil && include.match(f.Name) < 0 {
+			continue
+		}
+		if err := os.Remove(filepath.Join(to, filepath.FromSlash(f.Name))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package backup
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// entryFlags collects repeated -entry name=path flags.
+type entryFlags []*Entry
+
+func (f *entryFlags) String() string {
+	var s []string
+	for _, e := range *f {
+		s = append(s, e.Name+"="+e.Path)
+	}
+	return strings.Join(s, ",")
+}
+
+func (f *entryFlags) Set(v string) error {
+	i := strings.IndexByte(v, '=')
+	if i <= 0 || i == len(v)-1 {
+		return fmt.Errorf("entry must be name=path. entry=%s", v)
+	}
+	*f = append(*f, &Entry{Name: v[:i], Path: v[i+1:]})
+	return nil
+}
+
+// prompter reads answers for values not given by flags.
+type prompter struct {
+	r *bufio.Reader
+	w io.Writer
+}
+
+func (p *prompter) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.w, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.w, "%s: ", question)
+	}
+	line, err := p.r.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return def, nil
+	}
+	return line, nil
+}
+
+// askSchedule asks for the Schedule of ent until the daemon can run it,
+// empty leaving ent to cron or a timer.
+func (p *prompter) askSchedule(ent *Entry, def string) error {
+	for {
+		v, err := p.ask("Schedule for "+ent.Name+" (cron like @daily or \"30 2 * * *\", - for none)", def)
+		if err != nil {
+			return err
+		}
+		if ent.Schedule = v; v == "-" {
+			ent.Schedule = ""
+		}
+		err = ent.parseSchedule()
+		if err == nil {
+			return nil
+		}
+		fmt.Fprintln(p.w, err)
+	}
+}
+
+func initConfig(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	out := fs.String("o", "tarbu.json", "path to write the config to, or - for stdout")
+	dst := fs.String("dst", "", "backup destination directory")
+	keepGen := fs.Int("keep-gen", 0, "number of generations to keep")
+	schedule := fs.String("schedule", "", "cron schedule of the entries for tarbu daemon, like @daily or \"30 2 * * *\"")
+	force := fs.Bool("force", false, "overwrite an existing config file")
+	var entries entryFlags
+	fs.Var(&entries, "entry", "entry as name=path, may be repeated")
+	fs.Parse(args)
+
+	if *out != "-" && !*force {
+		if _, err := os.Stat(*out); err == nil {
+			return fmt.Errorf("config already exists, use -force to overwrite. path=%s", *out)
+		}
+	}
+
+	// prompts go to stderr so -o - can be redirected
+	p := &prompter{bufio.NewReader(os.Stdin), os.Stderr}
+	config := &Config{Dst: *dst, KeepGen: *keepGen, Entries: entries}
+	for _, e := range entries {
+		e.Schedule = *schedule
+		if err := e.parseSchedule(); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	for config.Dst == "" {
+		if config.Dst, err = p.ask("Destination directory", ""); err != nil {
+			return err
+		}
+	}
+	for config.KeepGen < 1 {
+		v, err := p.ask("Generations to keep", "3")
+		if err != nil {
+			return err
+		}
+		if config.KeepGen, err = strconv.Atoi(v); err != nil || config.KeepGen < 1 {
+			fmt.Fprintln(p.w, "must be a positive number")
+			config.KeepGen = 0
+		}
+	}
+	for len(entries) == 0 {
+		name, err := p.ask("Entry name (empty to finish)", "")
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			if len(config.Entries) > 0 {
+				break
+			}
+			continue
+		}
+		path := ""
+		for path == "" {
+			if path, err = p.ask("Path to back up for "+name, ""); err != nil {
+				return err
+			}
+		}
+		ent := &Entry{Name: name, Path: path}
+		if err := p.askSchedule(ent, *schedule); err != nil {
+			return err
+		}
+		config.Entries = append(config.Entries, ent)
+	}
+
+	if err := config.isNameDuplicated(); err != nil {
+		return err
+	}
+	if err := config.isDstWritable(); err != nil {
+		// the config may be generated for another host
+		fmt.Fprintf(os.Stderr, "warning: %s\n", err)
+	}
+
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if *out == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return ioutil.WriteFile(*out, data, 0644)
+}
@@ -0,0 +1,145 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// _InterruptGrace is how long an interrupted entry gets to delete its
+// partial archive before the run goes on without it.
+const _InterruptGrace = 10 * time.Second
+
+func (config *Config) isTimeoutValid() error {
+	for _, e := range config.Entries {
+		if e.Timeout == "" {
+			continue
+		}
+		d, err := parseDuration(e.Timeout)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("entry timeout is invalid. name=%s timeout=%s", e.Name, e.Timeout)
+		}
+		e.timeout = d
+	}
+	return nil
+}
+
+// runContext is the context of the run, done when it is interrupted.
+func (config *Config) runContext() context.Context {
+	if config.ctx == nil {
+		return context.Background()
+	}
+	return config.ctx
+}
+
+// cancelOnSignal interrupts the run on SIGINT or SIGTERM. Only the first
+// signal is caught, another one kills tarbu as usual. The returned func
+// stops catching them.
+func (config *Config) cancelOnSignal() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	config.ctx = ctx
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case s := <-sig:
+			signal.Stop(sig)
+			config.signal = s
+			printWarning("Interrupted, stopping the run: signal=%s run=%s", s, config.runID)
+			cancel()
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(sig)
+		close(done)
+		cancel()
+	}
+}
+
+// archiveEntry runs backupEntryImpl on ent until its Timeout or the run
+// is interrupted. The archive then stops at the next file or write and
+// deletes what was stored of it. A backup blocked in the kernel, e.g. on
+// a hung NFS mount, is left behind after _InterruptGrace, the next run
+// removes its partial archive.
+func (config *Config) archiveEntry(r *result, ent *Entry) error {
+	ctx, cancel := config.runContext(), context.CancelFunc(func() {})
+	if ent.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, ent.timeout)
+	}
+	defer cancel()
+
+	// the result is copied back only once the backup returned
+	res := *r
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer config.recoverEntry(&res)
+		res.err = backupEntryImpl(ctx, &res, config, ent)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		select {
+		case <-done:
+		case <-time.After(_InterruptGrace):
+			r.warnings = append(r.warnings, fmt.Sprintf("backup still blocked, left behind. grace=%s", _InterruptGrace))
+			return config.interruptedError(ent)
+		}
+	}
+	*r = res
+	if r.err != nil && ctx.Err() != nil {
+		return config.interruptedError(ent)
+	}
+	return r.err
+}
+
+func (config *Config) interruptedError(ent *Entry) error {
+	if config.runContext().Err() != nil {
+		return &InterruptedError{Entry: ent.Name, Signal: config.signal, Started: true}
+	}
+	return &InterruptedError{Entry: ent.Name, Timeout: ent.timeout, Started: true}
+}
+
+// reportInterrupted prints the entries an interrupted run stopped or
+// didn't start.
+func (config *Config) reportInterrupted(results []result) {
+	if config.runContext().Err() == nil || config.signal == nil {
+		return
+	}
+	var stopped, skipped []string
+	for _, r := range results {
+		var ie *InterruptedError
+		if !errors.As(r.err, &ie) || ie.Signal == nil {
+			continue
+		}
+		if ie.Started {
+			stopped = append(stopped, r.name)
+		} else {
+			skipped = append(skipped, r.name)
+		}
+	}
+	printWarning("Run interrupted: signal=%s run=%s stopped=%s not_started=%s", config.signal, config.runID,
+		strings.Join(stopped, ","), strings.Join(skipped, ","))
+}
+
+// ctxWriter fails writes once ctx is done, which stops the compressor
+// and encryption pipeline in front of the destination.
+type ctxWriter struct {
+	ctx context.Context
+	w   io.Writer
+}
+
+func (cw *ctxWriter) Write(p []byte) (int, error) {
+	if err := cw.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cw.w.Write(p)
+}
@@ -0,0 +1,270 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+func init() {
+	dumpers["k8s-pvc"] = dumpPVC
+}
+
+// kubernetesDiscovery adds a k8s-pvc entry for every PVC matching
+// Selector. Each run snapshots the PVC through CSI, mounts a volume
+// restored from the snapshot in a helper pod and archives its contents.
+// Old snapshots are pruned to KeepSnapshots per PVC, and the snapshot of
+// a run that failed is deleted.
+type kubernetesDiscovery struct {
+	Kubeconfig    string `json:",omitempty"`
+	Namespace     string `json:",omitempty"`
+	Selector      string `json:",omitempty"`
+	SnapshotClass string `json:",omitempty"`
+	// HelperImage must provide tar, default busybox.
+	HelperImage string `json:",omitempty"`
+	// KeepSnapshots is the number of snapshots kept per PVC, default 1.
+	KeepSnapshots int `json:",omitempty"`
+	// Timeout bounds waiting for snapshots and the helper pod.
+	Timeout string `json:",omitempty"`
+}
+
+// pvcSource is what a k8s-pvc entry needs to reach its PVC.
+type pvcSource struct {
+	k8s       *kubernetesDiscovery
+	namespace string
+	pvc       string
+}
+
+func (k *kubernetesDiscovery) kubectl(ns string, stdin []byte, args ...string) ([]byte, error) {
+	var base []string
+	if k.Kubeconfig != "" {
+		base = append(base, "--kubeconfig", k.Kubeconfig)
+	}
+	if ns != "" {
+		base = append(base, "-n", ns)
+	}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("kubectl", append(base, args...)...)
+	cmd.Stderr = stderr
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("kubectl %s failed. err=%s", args[0], commandError(err, stderr))
+	}
+	return out, nil
+}
+
+func (k *kubernetesDiscovery) timeout() string {
+	if k.Timeout == "" {
+		return "10m"
+	}
+	return k.Timeout
+}
+
+func (k *kubernetesDiscovery) keepSnapshots() int {
+	if k.KeepSnapshots < 1 {
+		return 1
+	}
+	return k.KeepSnapshots
+}
+
+func (k *kubernetesDiscovery) helperImage() string {
+	if k.HelperImage == "" {
+		return "busybox"
+	}
+	return k.HelperImage
+}
+
+// discoverPVCs appends an entry for every selected PVC.
+func (config *Config) discoverPVCs() error {
+	k := config.Kubernetes
+	if k == nil {
+		return nil
+	}
+	args := []string{"get", "pvc", "-o", "jsonpath={range .items[*]}{.metadata.namespace}/{.metadata.name}{\"\\n\"}{end}"}
+	if k.Selector != "" {
+		args = append(args, "-l", k.Selector)
+	}
+	if k.Namespace == "" {
+		args = append(args, "--all-namespaces")
+	}
+	out, err := k.kubectl(k.Namespace, nil, args...)
+	if err != nil {
+		return err
+	}
+	for _, l := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		i := strings.IndexByte(l, '/')
+		if i < 0 {
+			continue
+		}
+		e, err := config.decodeEntry(json.RawMessage("{}"))
+		if err != nil {
+			return err
+		}
+		e.Name = "pvc-" + l[:i] + "-" + l[i+1:]
+		e.Type = "k8s-pvc"
+		e.pvc = &pvcSource{k, l[:i], l[i+1:]}
+		config.Entries = append(config.Entries, e)
+	}
+	return nil
+}
+
+func dumpPVC(ent *Entry, dir string) error {
+	src := ent.pvc
+	if src == nil {
+		return fmt.Errorf("k8s-pvc entries are discovered through config.Kubernetes")
+	}
+	k, ns := src.k8s, src.namespace
+	name := fmt.Sprintf("tarbu-%s-%d", src.pvc, time.Now().Unix())
+	labels := map[string]string{"app.kubernetes.io/managed-by": "tarbu", "tarbu/pvc": src.pvc}
+
+	// snapshot the PVC
+	snap := map[string]interface{}{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshot",
+		"metadata":   map[string]interface{}{"name": name, "labels": labels},
+		"spec": map[string]interface{}{
+			"source": map[string]string{"persistentVolumeClaimName": src.pvc},
+		},
+	}
+	if k.SnapshotClass != "" {
+		snap["spec"].(map[string]interface{})["volumeSnapshotClassName"] = k.SnapshotClass
+	}
+	if err := k.apply(ns, snap); err != nil {
+		return err
+	}
+	// a snapshot no archive was made of, not ready say, is no use
+	dumped := false
+	defer func() {
+		if !dumped {
+			k.kubectl(ns, nil, "delete", "volumesnapshot", name, "--wait=false")
+		}
+	}()
+	if _, err := k.kubectl(ns, nil, "wait", "--for=jsonpath={.status.readyToUse}=true", "volumesnapshot/"+name, "--timeout="+k.timeout()); err != nil {
+		return err
+	}
+
+	// restore it into a temporary PVC mounted by a helper pod
+	size, err := k.kubectl(ns, nil, "get", "pvc", src.pvc, "-o", "jsonpath={.spec.resources.requests.storage}")
+	if err != nil {
+		return err
+	}
+	class, err := k.kubectl(ns, nil, "get", "pvc", src.pvc, "-o", "jsonpath={.spec.storageClassName}")
+	if err != nil {
+		return err
+	}
+	pvcSpec := map[string]interface{}{
+		"accessModes": []string{"ReadWriteOnce"},
+		"resources":   map[string]interface{}{"requests": map[string]string{"storage": string(size)}},
+		"dataSource": map[string]string{
+			"apiGroup": "snapshot.storage.k8s.io",
+			"kind":     "VolumeSnapshot",
+			"name":     name,
+		},
+	}
+	if len(class) > 0 {
+		pvcSpec["storageClassName"] = string(class)
+	}
+	pvc := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "PersistentVolumeClaim",
+		"metadata":   map[string]interface{}{"name": name, "labels": labels},
+		"spec":       pvcSpec,
+	}
+	pod := map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": name, "labels": labels},
+		"spec": map[string]interface{}{
+			"restartPolicy": "Never",
+			"containers": []map[string]interface{}{{
+				"name":         "tarbu",
+				"image":        k.helperImage(),
+				"command":      []string{"sleep", "86400"},
+				"volumeMounts": []map[string]interface{}{{"name": "snapshot", "mountPath": "/snapshot", "readOnly": true}},
+			}},
+			"volumes": []map[string]interface{}{{
+				"name":                  "snapshot",
+				"persistentVolumeClaim": map[string]interface{}{"claimName": name, "readOnly": true},
+			}},
+		},
+	}
+	if err := k.apply(ns, pvc); err != nil {
+		return err
+	}
+	defer k.kubectl(ns, nil, "delete", "pvc", name, "--wait=false")
+	if err := k.apply(ns, pod); err != nil {
+		return err
+	}
+	defer k.kubectl(ns, nil, "delete", "pod", name, "--wait=false")
+	if _, err := k.kubectl(ns, nil, "wait", "--for=condition=Ready", "pod/"+name, "--timeout="+k.timeout()); err != nil {
+		return err
+	}
+
+	// stream the snapshot contents out of the pod
+	f, err := os.Create(filepath.Join(dir, src.pvc+".tar"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	args := []string{"exec", name, "--", "tar", "cf", "-", "-C", "/snapshot", "."}
+	if k.Kubeconfig != "" {
+		args = append([]string{"--kubeconfig", k.Kubeconfig}, args...)
+	}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command("kubectl", append([]string{"-n", ns}, args...)...)
+	cmd.Stdout = f
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("kubectl exec tar failed. err=%s", commandError(err, stderr))
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	dumped = true
+
+	return k.pruneSnapshots(ns, src.pvc)
+}
+
+func (k *kubernetesDiscovery) apply(ns string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	_, err = k.kubectl(ns, data, "create", "-f", "-")
+	return err
+}
+
+// pruneSnapshots deletes the oldest tarbu snapshots of pvc beyond
+// KeepSnapshots.
+func (k *kubernetesDiscovery) pruneSnapshots(ns, pvc string) error {
+	out, err := k.kubectl(ns, nil, "get", "volumesnapshot", "-l", "tarbu/pvc="+pvc,
+		"-o", "jsonpath={range .items[*]}{.metadata.creationTimestamp} {.metadata.name}{\"\\n\"}{end}")
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return nil
+	}
+	// RFC 3339 timestamps sort chronologically
+	sort.Strings(lines)
+	for len(lines) > k.keepSnapshots() {
+		f := strings.Fields(lines[0])
+		if len(f) == 2 {
+			if _, err := k.kubectl(ns, nil, "delete", "volumesnapshot", f[1]); err != nil {
+				return &RetentionError{"volumesnapshot/" + f[1], err}
+			}
+		}
+		lines = lines[1:]
+	}
+	return nil
+}
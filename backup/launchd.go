@@ -0,0 +1,119 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// expandHome replaces a leading ~/ with the user's home directory, so
+// per-user configs can point at ~/Library or ~/.local paths.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
+
+func (config *Config) expandHomes() {
+	config.Dst = expandHome(config.Dst)
+	config.TmpDir = expandHome(config.TmpDir)
+	for _, e := range config.Entries {
+		e.Path = expandHome(e.Path)
+	}
+}
+
+var launchdPlist = template.Must(template.New("plist").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{.Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>{{.Program}}</string>
+		<string>-config</string>
+		<string>{{.Config}}</string>
+		<string>-no-color</string>
+	</array>
+	<key>StartCalendarInterval</key>
+	<dict>
+		<key>Hour</key>
+		<integer>{{.Hour}}</integer>
+		<key>Minute</key>
+		<integer>{{.Minute}}</integer>
+	</dict>
+	<key>LowPriorityIO</key>
+	<true/>
+	<key>ProcessType</key>
+	<string>Background</string>
+	<key>StandardOutPath</key>
+	<string>{{.Log}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{.Log}}</string>
+</dict>
+</plist>
+`))
+
+// launchdCommand prints a LaunchAgent plist running tarbu in the
+// foreground at a daily time. launchd does the scheduling, so tarbu
+// neither forks nor keeps running between runs.
+func launchdCommand(args []string) error {
+	fs := flag.NewFlagSet("launchd", flag.ExitOnError)
+	configPath := fs.String("config", "~/Library/Application Support/tarbu/tarbu.json", "config the agent runs with")
+	label := fs.String("label", "io.github.k3nju.tarbu", "launchd job label")
+	hour := fs.Int("hour", 3, "hour of the daily run")
+	minute := fs.Int("minute", 0, "minute of the daily run")
+	logPath := fs.String("log", "~/Library/Logs/tarbu.log", "file receiving output")
+	fs.Parse(args)
+
+	if *hour < 0 || *hour > 23 || *minute < 0 || *minute > 59 {
+		return fmt.Errorf("invalid time. hour=%d minute=%d", *hour, *minute)
+	}
+	program, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	job := &launchdJob{
+		Label:   *label,
+		Program: program,
+		Config:  expandHome(*configPath),
+		Log:     expandHome(*logPath),
+		Hour:    *hour,
+		Minute:  *minute,
+	}
+	return job.writePlist(os.Stdout)
+}
+
+// launchdJob is the tarbu run a LaunchAgent plist starts.
+type launchdJob struct {
+	Label, Program, Config, Log string
+	Hour, Minute                int
+}
+
+func (j *launchdJob) writePlist(w io.Writer) error {
+	return launchdPlist.Execute(w, map[string]interface{}{
+		"Label":   xmlEscape(j.Label),
+		"Program": xmlEscape(j.Program),
+		"Config":  xmlEscape(j.Config),
+		"Hour":    j.Hour,
+		"Minute":  j.Minute,
+		"Log":     xmlEscape(j.Log),
+	})
+}
+
+func xmlEscape(s string) string {
+	b := &bytes.Buffer{}
+	xml.EscapeText(b, []byte(s))
+	return b.String()
+}
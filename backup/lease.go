@@ -0,0 +1,190 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+const (
+	// _LeasePrefix starts the names of lease objects, followed by the
+	// entry name.
+	_LeasePrefix = ".tarbu-lease."
+	// _LeaseTTL is the default config.LeaseTTL.
+	_LeaseTTL = 10 * time.Minute
+	// _LeaseSettle is how long a written lease is left before it is read
+	// back to see which of racing hosts won it.
+	_LeaseSettle = time.Second
+)
+
+// lease is the object claiming an entry of Dst, or the history, for a
+// run.
+type lease struct {
+	Host  string
+	PID   int
+	RunID string
+	// Expires is renewed while the run goes on, a lease of a host that
+	// went away is taken over after it
+	Expires time.Time
+}
+
+// entryLease is a lease held by this run, renewed until released.
+type entryLease struct {
+	b    storage.Backend
+	name string
+	held lease
+	ttl  time.Duration
+	stop chan struct{}
+	done chan struct{}
+}
+
+func leaseName(ent *Entry) string {
+	return _LeasePrefix + ent.Name
+}
+
+func readLease(b storage.Backend, name string) (*lease, error) {
+	rc, err := b.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	l := &lease{}
+	if err := json.Unmarshal(data, l); err != nil {
+		// a broken lease holds nothing
+		return &lease{}, nil
+	}
+	return l, nil
+}
+
+// leaseEntry claims ent on Dst for config.Lease, returning a nil lease
+// otherwise.
+func (config *Config) leaseEntry(ent *Entry) (*entryLease, error) {
+	if !config.Lease {
+		return nil, nil
+	}
+	b, err := config.entryBackend(ent)
+	if err != nil {
+		return nil, &DestinationWriteError{config.entryDst(ent), err}
+	}
+	l, err := config.takeLease(b, leaseName(ent), "entry "+ent.Name, config.lockWait)
+	if _, ok := err.(*LockError); err != nil && !ok {
+		return nil, &DestinationWriteError{config.entryDst(ent), err}
+	}
+	return l, err
+}
+
+// takeLease claims the lease name in b for what, waiting for wait while
+// another run holds it. Object stores have no compare and swap, so the
+// lease is written, left to settle and read back: of hosts racing for
+// it, the one whose write was kept wins and the others wait like for a
+// lease they found held.
+func (config *Config) takeLease(b storage.Backend, name, what string, wait time.Duration) (*entryLease, error) {
+	host, _ := os.Hostname()
+	l := &entryLease{
+		b:    b,
+		name: name,
+		held: lease{Host: host, PID: os.Getpid(), RunID: config.runID},
+		ttl:  config.leaseTTL,
+	}
+	if l.ttl == 0 {
+		l.ttl = _LeaseTTL
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		cur, err := readLease(b, l.name)
+		if err != nil && !storage.IsNotExist(err) {
+			return nil, err
+		}
+		if err != nil || !time.Now().Before(cur.Expires) || cur.RunID == l.held.RunID {
+			if err := l.write(); err != nil {
+				return nil, err
+			}
+			time.Sleep(_LeaseSettle)
+			if cur, err = readLease(b, l.name); err != nil && !storage.IsNotExist(err) {
+				return nil, err
+			}
+			if err == nil && cur.RunID == l.held.RunID {
+				l.stop, l.done = make(chan struct{}), make(chan struct{})
+				go l.renew()
+				return l, nil
+			}
+			if cur == nil {
+				cur = &lease{}
+			}
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return nil, &LockError{what, b.Location(l.name), cur.Host + ":" + strconv.Itoa(cur.PID), wait}
+		}
+		if left > 5*time.Second {
+			left = 5 * time.Second
+		}
+		time.Sleep(left)
+	}
+}
+
+func (l *entryLease) write() error {
+	l.held.Expires = time.Now().Add(l.ttl)
+	data, err := json.Marshal(l.held)
+	if err != nil {
+		return err
+	}
+	return l.b.Put(l.name, bytes.NewReader(data))
+}
+
+// renew extends the lease every third of its TTL.
+func (l *entryLease) renew() {
+	defer close(l.done)
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+			if err := l.write(); err != nil {
+				printWarning("Renewing lease failed: lease=%s err=%s", l.b.Location(l.name), err)
+			}
+		}
+	}
+}
+
+// release stops renewing l and deletes it unless another run took it
+// over meanwhile. A nil l is fine.
+func (l *entryLease) release() {
+	if l == nil {
+		return
+	}
+	close(l.stop)
+	<-l.done
+	cur, err := readLease(l.b, l.name)
+	if err != nil || cur.RunID != l.held.RunID {
+		return
+	}
+	if err := l.b.Delete(l.name); err != nil {
+		printWarning("Releasing lease failed: lease=%s err=%s", l.b.Location(l.name), err)
+	}
+}
+
+func (config *Config) isLeaseValid() error {
+	config.leaseTTL = _LeaseTTL
+	if config.LeaseTTL == "" {
+		return nil
+	}
+	d, err := parseDuration(config.LeaseTTL)
+	if err != nil || d < 3*time.Second {
+		return fmt.Errorf("config.LeaseTTL is invalid, it takes a duration of 3s or more. ttl=%s", config.LeaseTTL)
+	}
+	config.leaseTTL = d
+	return nil
+}
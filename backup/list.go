@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// listEntry is an entry with its generations in Dst, oldest first.
+type listEntry struct {
+	Entry       string
+	Generations []listGeneration
+}
+
+type listGeneration struct {
+	Archive string
+	// Time and Age are unknown for numbered entries, which have Slot
+	Time *time.Time `json:",omitempty"`
+	Slot int64      `json:",omitempty"`
+	Size int64
+	// Age is in seconds
+	Age *int64 `json:",omitempty"`
+	// Meta is unknown for archives written before tarbu recorded it
+	Meta *archiveMeta `json:",omitempty"`
+}
+
+// listCommand shows the generations of the given entries, every entry
+// and the self backup without arguments.
+func listCommand(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu list [-config path] [-json] [entry...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	list, err := config.list(fs.Args())
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(os.Stdout, list)
+	}
+	config.writeListText(os.Stdout, list)
+	return nil
+}
+
+// writeListText writes list as the text output of tarbu list.
+func (config *Config) writeListText(w io.Writer, list []listEntry) {
+	for i, le := range list {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "%s: %d generations\n", le.Entry, len(le.Generations))
+		for _, g := range le.Generations {
+			at, age := fmt.Sprintf("#%d", g.Slot), ""
+			if g.Time != nil {
+				at, age = config.formatTime(*g.Time), formatAge(time.Duration(*g.Age)*time.Second)
+			}
+			fmt.Fprintf(w, "  %-23s %9s %8s  %s\n", at, formatSize(g.Size), age, g.Archive)
+			if m := g.Meta; m != nil {
+				source := m.Type
+				if source == "" {
+					source = strings.Join(m.Source, ",")
+				}
+				fmt.Fprintf(w, "  %-23s host=%s source=%s files=%d contents=%s took=%s version=%s\n", "", m.Hostname, source, m.Files, formatSize(m.Bytes), m.End.Sub(m.Start).Round(time.Second), m.Version)
+			}
+		}
+	}
+}
+
+// list returns the generations of the named entries, of every entry and
+// the self backup, if there is one, without names.
+func (config *Config) list(names []string) ([]listEntry, error) {
+	entries := config.entriesWithSelf()
+	if len(names) > 0 {
+		entries = nil
+		for _, n := range names {
+			ent := config.findEntry(n)
+			if ent == nil {
+				return nil, fmt.Errorf("entry not found. name=%s", n)
+			}
+			entries = append(entries, ent)
+		}
+	}
+	now := config.now()
+	list := []listEntry{}
+	for _, ent := range entries {
+		b, err := config.entryBackend(ent)
+		if err != nil {
+			return nil, err
+		}
+		gens, err := generations(b, ent)
+		if err != nil {
+			return nil, err
+		}
+		if ent.Name == _SelfEntry && len(gens) == 0 && len(names) == 0 {
+			continue
+		}
+		objs, err := b.List(ent.Name)
+		if err != nil {
+			return nil, err
+		}
+		metas := map[string]bool{}
+		for _, o := range objs {
+			metas[o.Name] = true
+		}
+		le := listEntry{Entry: ent.Name, Generations: []listGeneration{}}
+		for _, g := range gens {
+			lg := listGeneration{Archive: b.Location(g.Name), Size: g.Size}
+			if metas[metaName(g.Name)] {
+				if lg.Meta, err = readMeta(b, g.Name); err != nil {
+					return nil, fmt.Errorf("archive metadata is unreadable. file=%s err=%s", b.Location(metaName(g.Name)), err)
+				}
+			}
+			if ent.numbered() {
+				lg.Slot = archiveTime(ent, g.Name)
+			} else {
+				at := time.Unix(archiveTime(ent, g.Name), 0)
+				age := int64(now.Sub(at) / time.Second)
+				lg.Time, lg.Age = &at, &age
+			}
+			le.Generations = append(le.Generations, lg)
+		}
+		list = append(list, le)
+	}
+	return list, nil
+}
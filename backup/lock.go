@@ -0,0 +1,125 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runLock holds exclusive flocks on files of config.LockDir. The kernel
+// drops them when the process dies, so a killed run never leaves them
+// held.
+type runLock struct {
+	files []*os.File
+}
+
+func (config *Config) isLockValid() error {
+	switch config.Lock {
+	case "", "dst", "entry", "none":
+	default:
+		return fmt.Errorf("unknown config.Lock. lock=%s", config.Lock)
+	}
+	if config.LockDir != "" {
+		return isDirWritable("config.LockDir", config.LockDir)
+	}
+	return nil
+}
+
+// lockPath names the lock of dst, or of ent in dst when ent is set.
+// dst is hashed, remote destinations are locked on this host only.
+func (config *Config) lockPath(dst string, ent *Entry) string {
+	key := dst
+	if ent != nil {
+		key += "\x00" + ent.Name
+	}
+	sum := sha256.Sum256([]byte(key))
+	dir := config.LockDir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "tarbu-"+hex.EncodeToString(sum[:8])+".lock")
+}
+
+// lockRun takes the locks of every destination for config.Lock "dst",
+// the default, in sorted order so runs sharing some don't deadlock. It
+// returns a nil lock when the run isn't locked as a whole.
+func (config *Config) lockRun() (*runLock, error) {
+	if config.Lock != "" && config.Lock != "dst" {
+		return nil, nil
+	}
+	l := &runLock{}
+	for _, dst := range config.destinations() {
+		f, err := acquireLock(config.lockPath(dst, nil), "config.Dst "+dst, config.lockWait)
+		if err != nil {
+			l.release()
+			return nil, err
+		}
+		l.files = append(l.files, f)
+	}
+	return l, nil
+}
+
+// lockEntry takes the lock of ent for config.Lock "entry", returning a
+// nil lock otherwise.
+func (config *Config) lockEntry(ent *Entry) (*runLock, error) {
+	if config.Lock != "entry" {
+		return nil, nil
+	}
+	f, err := acquireLock(config.lockPath(config.entryDst(ent), ent), "entry "+ent.Name, config.lockWait)
+	if err != nil {
+		return nil, err
+	}
+	return &runLock{[]*os.File{f}}, nil
+}
+
+// acquireLock locks path, polling for up to wait while another process
+// holds it. The holder's pid is written to the file for the error of the
+// next one.
+func acquireLock(path, what string, wait time.Duration) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		held, err := tryLock(f)
+		if err == nil {
+			break
+		}
+		if !held {
+			f.Close()
+			return nil, fmt.Errorf("locking failed. lock=%s err=%s", path, err)
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			holder, _ := ioutil.ReadAll(f)
+			f.Close()
+			return nil, &LockError{what, path, strings.TrimSpace(string(holder)), wait}
+		}
+		if left > time.Second {
+			left = time.Second
+		}
+		time.Sleep(left)
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return f, nil
+}
+
+// release unlocks l, a nil l is fine. The files stay, removing them
+// would race with a process about to lock them.
+func (l *runLock) release() {
+	if l == nil {
+		return
+	}
+	for _, f := range l.files {
+		f.Close()
+	}
+}
@@ -0,0 +1,219 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel orders log events, events below the -log-level are dropped.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(s, n) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level. level=%s", s)
+}
+
+// logSize is a byte count field, human readable in text and a number
+// in JSON.
+type logSize int64
+
+// logRate is a bytes per second field, like logSize.
+type logRate float64
+
+func (r logRate) String() string {
+	return formatSize(int64(r)) + "/s"
+}
+
+// logger writes the events of a run. Text lines are the message
+// followed by key=value fields, JSON lines are objects with time, level,
+// msg and the fields, for log aggregators.
+type logger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level logLevel
+	json  bool
+	// file is set when logs go to -log-file instead of stdout
+	file *os.File
+	// bars are the progress bars drawn below the events
+	bars *progress
+	// report gets every event logged too, the Windows event log of a
+	// service
+	report func(level logLevel, line string)
+}
+
+var logs = &logger{w: os.Stdout, level: levelInfo}
+
+// logFlags are the flags of the output of runs, shared by the backup
+// command and the daemon.
+type logFlags struct {
+	level, format, file string
+	noColor             bool
+}
+
+func (f *logFlags) register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.noColor, "no-color", false, "disable colored output")
+	fs.StringVar(&f.level, "log-level", "info", "least severe messages logged, debug, info, warn or error")
+	fs.StringVar(&f.format, "log-format", "text", "log format, text or json")
+	fs.StringVar(&f.file, "log-file", "", "append logs to this file instead of stdout")
+}
+
+func (f *logFlags) setup() error {
+	setupColor(f.noColor)
+	return setupLogging(f.level, f.format, f.file)
+}
+
+// setupLogging configures logs from the -log-level, -log-format and
+// -log-file flags. Log files are appended to and never colored.
+func setupLogging(level, format, file string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown log format. format=%s", format)
+	}
+	logs.level, logs.json = l, format == "json"
+	if file != "" {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		logs.w, logs.file, colored = f, f, false
+	}
+	if logs.json {
+		colored = false
+	}
+	return nil
+}
+
+// event logs msg with fields given as key, value pairs.
+func (l *logger) event(level logLevel, color, msg string, fields ...interface{}) {
+	if level < l.level {
+		return
+	}
+	var buf bytes.Buffer
+	if l.json {
+		l.writeJSON(&buf, level, msg, fields)
+	} else {
+		l.writeText(&buf, level, color, msg, fields)
+	}
+	if l.report != nil {
+		l.report(level, strings.TrimSuffix(buf.String(), "\n"))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.bars != nil {
+		l.bars.erase(l.w)
+	}
+	l.w.Write(buf.Bytes())
+	if l.bars != nil {
+		l.bars.draw(l.w)
+	}
+}
+
+func (l *logger) writeText(buf *bytes.Buffer, level logLevel, color, msg string, fields []interface{}) {
+	if l.file != nil {
+		fmt.Fprintf(buf, "%s %-5s ", time.Now().Format(time.RFC3339), strings.ToUpper(level.String()))
+	}
+	line := msg
+	if len(fields) > 0 {
+		line += ":"
+	}
+	for i := 0; i+1 < len(fields); i += 2 {
+		var v string
+		switch f := fields[i+1].(type) {
+		case logSize:
+			v = formatSize(int64(f))
+		case time.Duration:
+			v = f.Round(time.Millisecond).String()
+		case time.Time:
+			v = f.Format(time.RFC3339)
+		default:
+			v = fmt.Sprint(f)
+		}
+		line += fmt.Sprintf(" %s=%s", fields[i], v)
+	}
+	buf.WriteString(colorize(color, line))
+	buf.WriteByte('\n')
+}
+
+func (l *logger) writeJSON(buf *bytes.Buffer, level logLevel, msg string, fields []interface{}) {
+	fmt.Fprintf(buf, `{"time":%q,"level":%q,"msg":`, time.Now().Format(time.RFC3339Nano), level)
+	writeJSONValue(buf, msg)
+	for i := 0; i+1 < len(fields); i += 2 {
+		buf.WriteByte(',')
+		writeJSONValue(buf, fmt.Sprint(fields[i]))
+		buf.WriteByte(':')
+		switch f := fields[i+1].(type) {
+		case logSize:
+			writeJSONValue(buf, int64(f))
+		case logRate:
+			writeJSONValue(buf, int64(f))
+		case time.Duration:
+			// seconds, as aggregators sum and average them
+			writeJSONValue(buf, f.Seconds())
+		case error:
+			writeJSONValue(buf, f.Error())
+		default:
+			writeJSONValue(buf, f)
+		}
+	}
+	buf.WriteString("}\n")
+}
+
+func writeJSONValue(buf *bytes.Buffer, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(data)
+}
+
+// logDebug logs the progress of a run, only shown with -log-level debug.
+func logDebug(msg string, fields ...interface{}) {
+	logs.event(levelDebug, "", msg, fields...)
+}
+
+// fatal writes err to stderr, where cron mail and wrappers expect it,
+// and exits with 1. JSON logs and log files get it as an event too.
+func fatal(err interface{}) {
+	exit(_ExitFailure, err)
+}
+
+// fatalConfig is fatal for configs the run can't start with.
+func fatalConfig(err interface{}) {
+	exit(_ExitConfig, err)
+}
+
+func exit(code int, err interface{}) {
+	if logs.json || logs.file != nil {
+		logs.event(levelError, "", "Run failed", "err", err)
+	}
+	log.Println(err)
+	os.Exit(code)
+}
@@ -0,0 +1,78 @@
+package backup
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/k3nju/tarbu/internal/archiver"
+)
+
+// _DefaultBufferSize is the read and write buffer size of an entry.
+const _DefaultBufferSize = 64 << 10
+
+// _CompressorMemory approximates what a gzip writer allocates.
+const _CompressorMemory = 1 << 20
+
+func (config *Config) isMemoryValid() error {
+	config.bufferSize = _DefaultBufferSize
+	if config.BufferSize != "" {
+		n, err := parseSize(config.BufferSize)
+		if err != nil || n < 512 {
+			return fmt.Errorf("config.BufferSize must be a size of at least 512 bytes. size=%s", config.BufferSize)
+		}
+		config.bufferSize = int(n)
+	}
+	if config.MaxMemory != "" {
+		n, err := parseSize(config.MaxMemory)
+		if err != nil {
+			return fmt.Errorf("config.MaxMemory is invalid. err=%s", err)
+		}
+		config.memory = newMemoryBudget(n)
+	}
+	return nil
+}
+
+// entryMemory is the buffer memory ent holds while archiving.
+func (config *Config) entryMemory(ent *Entry) int64 {
+	// gzip is compressed in process, the other tools allocate their own
+	if ent.archiveWorkers > 1 && ent.codec().tool == "" && ent.Compression != "none" {
+		return int64(2*config.bufferSize) + archiver.GzipMemory(ent.archiveWorkers)
+	}
+	return int64(2*config.bufferSize) + _CompressorMemory
+}
+
+// memoryBudget bounds the buffer memory of concurrently archived
+// entries. An entry needing more than the whole budget runs alone.
+type memoryBudget struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	max   int64
+	inUse int64
+}
+
+func newMemoryBudget(max int64) *memoryBudget {
+	b := &memoryBudget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+// acquire blocks until n bytes fit and returns the amount to release.
+func (b *memoryBudget) acquire(n int64) int64 {
+	if n > b.max {
+		n = b.max
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.inUse+n > b.max {
+		b.cond.Wait()
+	}
+	b.inUse += n
+	return n
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mu.Lock()
+	b.inUse -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
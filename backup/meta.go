@@ -0,0 +1,96 @@
+package backup
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// Version is the version of tarbu recorded in archive metadata, set at
+// build time with -ldflags "-X github.com/k3nju/tarbu/backup.Version=v1.2.3".
+var Version = "dev"
+
+// _MetaSuffix is appended to an archive name for the file describing
+// it, so an archive copied to another machine with it still tells where
+// it came from.
+const _MetaSuffix = ".meta.json"
+
+func metaName(name string) string {
+	return name + _MetaSuffix
+}
+
+// archiveMeta describes an archive and the run that wrote it.
+type archiveMeta struct {
+	Entry    string
+	RunID    string `json:",omitempty"`
+	Hostname string
+	// Source is the archived paths, Type the dump for typed entries
+	Source  []string `json:",omitempty"`
+	Type    string   `json:",omitempty"`
+	Version string
+	Start   time.Time
+	End     time.Time
+	// Files and Bytes are the regular files archived and their size
+	// uncompressed, for Append entries those of the last run
+	Files int
+	Bytes int64
+}
+
+// newArchiveMeta returns the metadata of an archive of ent, as much as
+// is known before archiving.
+func (config *Config) newArchiveMeta(ent *Entry, start time.Time) *archiveMeta {
+	host, _ := os.Hostname()
+	m := &archiveMeta{Entry: ent.Name, RunID: config.runID, Hostname: host, Type: ent.Type, Version: Version, Start: start}
+	if ent.Type == "" {
+		m.Source = ent.Paths
+		if len(m.Source) == 0 {
+			m.Source = []string{ent.Path}
+		}
+	}
+	return m
+}
+
+// writeMeta stores m next to the archive name.
+func writeMeta(b storage.Backend, name string, m *archiveMeta) error {
+	data, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := b.Put(metaName(name), strings.NewReader(string(data)+"\n")); err != nil {
+		return putError(b, b.Location(metaName(name)), err)
+	}
+	return nil
+}
+
+// readMeta returns the metadata of the archive name. A missing file is
+// an error satisfying storage.IsNotExist.
+func readMeta(b storage.Backend, name string) (*archiveMeta, error) {
+	r, err := b.Open(metaName(name))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	m := &archiveMeta{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// moveMeta renames the metadata of the archive from with it, if it has
+// any.
+func moveMeta(b storage.Backend, from, to string) error {
+	err := storage.Move(b, metaName(from), b, metaName(to))
+	if storage.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
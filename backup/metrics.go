@@ -0,0 +1,149 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// entryMetrics is what the run history tells about an entry.
+type entryMetrics struct {
+	lastRun     time.Time
+	lastSuccess time.Time
+	duration    time.Duration
+	size        int64
+	failures    int
+}
+
+// metrics renders the metrics of every entry in the run history in the
+// Prometheus text format.
+func (config *Config) metrics() ([]byte, error) {
+	records, err := config.readHistory(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	entries := map[string]*entryMetrics{}
+	for _, e := range config.Entries {
+		entries[e.Name] = &entryMetrics{}
+	}
+	for _, rec := range records {
+		if rec.Skipped != "" {
+			continue
+		}
+		m := entries[rec.Entry]
+		if m == nil {
+			// entries removed from the config are left out
+			if rec.Entry != _SelfEntry {
+				continue
+			}
+			m = &entryMetrics{}
+			entries[rec.Entry] = m
+		}
+		m.lastRun, m.duration = rec.Start, rec.Duration
+		if rec.Error != "" {
+			m.failures++
+			continue
+		}
+		m.lastSuccess, m.size = rec.Start.Add(rec.Duration), rec.Size
+	}
+	names := make([]string, 0, len(entries))
+	for n := range entries {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	buf := &bytes.Buffer{}
+	for _, metric := range []struct {
+		name, typ, help string
+		value           func(m *entryMetrics) (float64, bool)
+	}{
+		{"tarbu_last_success_timestamp_seconds", "gauge", "Time the last successful backup of the entry finished.", func(m *entryMetrics) (float64, bool) {
+			return float64(m.lastSuccess.UnixNano()) / 1e9, !m.lastSuccess.IsZero()
+		}},
+		{"tarbu_last_run_timestamp_seconds", "gauge", "Time the last backup of the entry started.", func(m *entryMetrics) (float64, bool) {
+			return float64(m.lastRun.UnixNano()) / 1e9, !m.lastRun.IsZero()
+		}},
+		{"tarbu_last_duration_seconds", "gauge", "Duration of the last backup of the entry.", func(m *entryMetrics) (float64, bool) {
+			return m.duration.Seconds(), !m.lastRun.IsZero()
+		}},
+		{"tarbu_last_archive_size_bytes", "gauge", "Size of the archive of the last successful backup of the entry.", func(m *entryMetrics) (float64, bool) {
+			return float64(m.size), !m.lastSuccess.IsZero()
+		}},
+		{"tarbu_failures_total", "counter", "Failed backups of the entry in the run history.", func(m *entryMetrics) (float64, bool) {
+			return float64(m.failures), true
+		}},
+	} {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", metric.name, metric.help, metric.name, metric.typ)
+		for _, n := range names {
+			if v, ok := metric.value(entries[n]); ok {
+				fmt.Fprintf(buf, "%s{entry=\"%s\"} %g\n", metric.name, escapeLabel(n), v)
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+
+// writeMetricsFile replaces config.MetricsFile with the current metrics.
+// It is renamed into place so the textfile collector never reads half
+// of it.
+func (config *Config) writeMetricsFile() error {
+	data, err := config.metrics()
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(config.MetricsFile), ".tarbu-metrics-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// the collector runs as another user
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), config.MetricsFile)
+}
+
+// metricsHandler serves the metrics of the daemon, refreshed after every
+// run rather than on every scrape so remote histories aren't fetched
+// over and over.
+type metricsHandler struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+func (h *metricsHandler) refresh(config *Config) {
+	data, err := config.metrics()
+	if err != nil {
+		printWarning("Reading metrics failed: err=%s", err)
+		return
+	}
+	h.mu.Lock()
+	h.data = data
+	h.mu.Unlock()
+}
+
+func (h *metricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	data := h.data
+	h.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(data)
+}
@@ -0,0 +1,306 @@
+package backup
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// nameTemplate is a parsed NameTemplate of an entry. Its placeholders
+// are {name}, the entry name, {date:layout}, the run's start formatted
+// with the Go time layout in config.TimeZone, {unix}, the start in Unix
+// seconds, and {seq}, 0 or one more than the highest of the archives of
+// the entry dated the same, so they sort in the order they were written.
+type nameTemplate struct {
+	parts []namePart
+	loc   *time.Location
+	// re matches the archive names, encrypted ones too
+	re *regexp.Regexp
+	// groups are the kinds of the submatches of re, before the tool
+	groups []string
+}
+
+// namePart is literal text, or a placeholder when kind is set.
+type namePart struct {
+	kind string
+	text string
+}
+
+func parseNameTemplate(ent *Entry, tmpl string, loc *time.Location) (*nameTemplate, error) {
+	if loc == nil {
+		loc = time.Local
+	}
+	t := &nameTemplate{loc: loc}
+	for rest := tmpl; rest != ""; {
+		i := strings.IndexAny(rest, "{}")
+		if i < 0 {
+			t.parts = append(t.parts, namePart{text: rest})
+			break
+		}
+		if i > 0 {
+			t.parts = append(t.parts, namePart{text: rest[:i]})
+		}
+		end := strings.IndexByte(rest, '}')
+		if rest[i] == '}' || end < 0 {
+			return nil, fmt.Errorf("unbalanced brace in name template. template=%s", tmpl)
+		}
+		ph := rest[i+1 : end]
+		rest = rest[end+1:]
+		switch {
+		case ph == "name" || ph == "unix" || ph == "seq":
+			t.parts = append(t.parts, namePart{kind: ph})
+		case strings.HasPrefix(ph, "date:") && len(ph) > len("date:"):
+			t.parts = append(t.parts, namePart{kind: "date", text: ph[len("date:"):]})
+		default:
+			return nil, fmt.Errorf("unknown placeholder in name template. template=%s placeholder={%s}", tmpl, ph)
+		}
+	}
+
+	// generations are listed by the entry name
+	if len(t.parts) == 0 || t.parts[0].kind != "name" {
+		return nil, fmt.Errorf("name template must start with {name}. template=%s", tmpl)
+	}
+	count := map[string]int{}
+	for i, p := range t.parts {
+		count[p.kind]++
+		// digits of adjacent placeholders can't be told apart
+		if i > 0 && p.kind != "" && t.parts[i-1].kind != "" {
+			return nil, fmt.Errorf("name template placeholders must be separated. template=%s", tmpl)
+		}
+	}
+	if count["date"]+count["unix"] != 1 {
+		return nil, fmt.Errorf("name template needs one {date:layout} or {unix}. template=%s", tmpl)
+	}
+	if count["seq"] > 1 {
+		return nil, fmt.Errorf("name template has more than one {seq}. template=%s", tmpl)
+	}
+	sample := t.render(ent, time.Date(2006, 1, 2, 15, 4, 5, 0, loc), 0)
+	if strings.ContainsAny(sample, `/\`) {
+		return nil, fmt.Errorf("name template makes names with path separators. template=%s", tmpl)
+	}
+
+	expr := "^"
+	for _, p := range t.parts {
+		switch p.kind {
+		case "":
+			expr += regexp.QuoteMeta(p.text)
+		case "name":
+			expr += regexp.QuoteMeta(ent.Name)
+		case "date":
+			expr += "(.+?)"
+		case "unix", "seq":
+			expr += `(\d+)`
+		}
+		if p.kind != "" && p.kind != "name" {
+			t.groups = append(t.groups, p.kind)
+		}
+	}
+	t.re = regexp.MustCompile(expr + `(?:\.(` + strings.Join(_EncryptTools, "|") + `))?$`)
+	if _, _, _, ok := t.parse(sample); !ok {
+		return nil, fmt.Errorf("name template makes names it can't read back, the date layout needs a year. template=%s", tmpl)
+	}
+	return t, nil
+}
+
+// render returns the unencrypted archive name started at start.
+func (t *nameTemplate) render(ent *Entry, start time.Time, seq int) string {
+	var b strings.Builder
+	for _, p := range t.parts {
+		switch p.kind {
+		case "":
+			b.WriteString(p.text)
+		case "name":
+			b.WriteString(ent.Name)
+		case "date":
+			b.WriteString(start.In(t.loc).Format(p.text))
+		case "unix":
+			b.WriteString(strconv.FormatInt(start.Unix(), 10))
+		case "seq":
+			b.WriteString(strconv.Itoa(seq))
+		}
+	}
+	return b.String()
+}
+
+func (t *nameTemplate) hasSeq() bool {
+	for _, p := range t.parts {
+		if p.kind == "seq" {
+			return true
+		}
+	}
+	return false
+}
+
+// parse returns the start time, sequence number and encryption tool of
+// an archive name, ok false when the template didn't make name.
+func (t *nameTemplate) parse(name string) (ts int64, seq int, tool string, ok bool) {
+	m := t.re.FindStringSubmatch(name)
+	if m == nil {
+		return 0, 0, "", false
+	}
+	for i, kind := range t.groups {
+		s := m[i+1]
+		switch kind {
+		case "date":
+			var layout string
+			for _, p := range t.parts {
+				if p.kind == "date" {
+					layout = p.text
+				}
+			}
+			at, err := time.ParseInLocation(layout, s, t.loc)
+			if err != nil || at.Year() == 0 {
+				return 0, 0, "", false
+			}
+			ts = at.Unix()
+		case "unix":
+			n, err := strconv.ParseInt(s, 10, 64)
+			if err != nil {
+				return 0, 0, "", false
+			}
+			ts = n
+		case "seq":
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return 0, 0, "", false
+			}
+			seq = n
+		}
+	}
+	return ts, seq, m[len(m)-1], true
+}
+
+// parseNameTemplates parses the NameTemplate of every entry, so commands
+// reading Dst recognize templated names without validating the config.
+func (config *Config) parseNameTemplates() error {
+	for _, e := range config.Entries {
+		if e.NameTemplate == "" {
+			continue
+		}
+		t, err := parseNameTemplate(e, e.NameTemplate, config.location)
+		if err != nil {
+			return fmt.Errorf("entry NameTemplate is invalid. name=%s err=%s", e.Name, err)
+		}
+		e.nameTemplate = t
+	}
+	return nil
+}
+
+// genKey identifies a generation of an entry: the Unix time it started
+// and a sequence number ordering the archives started in the same
+// second. Legacy archive names and manifest names end with its String.
+type genKey struct {
+	ts  int64
+	seq int
+}
+
+func (k genKey) String() string {
+	if k.seq == 0 {
+		return strconv.FormatInt(k.ts, 10)
+	}
+	return fmt.Sprintf("%d-%d", k.ts, k.seq)
+}
+
+func (k genKey) before(o genKey) bool {
+	if k.ts != o.ts {
+		return k.ts < o.ts
+	}
+	return k.seq < o.seq
+}
+
+// parseGenKey parses a genKey String, a Unix time followed by -seq when
+// earlier archives started in the same second.
+func parseGenKey(s string) (genKey, bool) {
+	stamp, seq := s, ""
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		stamp, seq = s[:i], s[i+1:]
+		if seq == "" || strings.IndexFunc(seq, notDigit) >= 0 {
+			return genKey{}, false
+		}
+	}
+	if stamp == "" || strings.IndexFunc(stamp, notDigit) >= 0 {
+		return genKey{}, false
+	}
+	ts, err := strconv.ParseInt(stamp, 10, 64)
+	if err != nil {
+		return genKey{}, false
+	}
+	k := genKey{ts: ts}
+	if seq != "" {
+		if k.seq, err = strconv.Atoi(seq); err != nil || k.seq == 0 {
+			return genKey{}, false
+		}
+	}
+	return k, true
+}
+
+// generationKey returns the genKey of the archive name of ent. Names
+// written before NameTemplate was set keep the legacy form
+// <name><suffix><genKey>.
+func generationKey(ent *Entry, name string) (genKey, error) {
+	name = filepath.Base(name)
+	if t := ent.nameTemplate; t != nil {
+		if ts, seq, _, ok := t.parse(name); ok {
+			return genKey{ts, seq}, nil
+		}
+	}
+	for _, s := range archiveSuffixes(ent) {
+		if rest := strings.TrimPrefix(name, ent.Name+s); rest != name {
+			if k, ok := parseGenKey(rest); ok {
+				return k, nil
+			}
+		}
+	}
+	return genKey{}, fmt.Errorf("archive name has no timestamp. entry=%s name=%s", ent.Name, name)
+}
+
+// archiveName returns the name of the archive of ent written to b now.
+// It is unique without changing the time: a legacy name taken in the
+// same second gets the next sequence number, a templated one the next
+// {seq}. A template without {seq} fails rather than replace an archive.
+func (config *Config) archiveName(b storage.Backend, ent *Entry) (string, error) {
+	suffix := config.archiveSuffix(ent)
+	if ent.numbered() {
+		return ent.Name + suffix + "1", nil
+	}
+	gens, err := generations(b, ent)
+	if err != nil {
+		return "", err
+	}
+	now := config.now()
+	t := ent.nameTemplate
+	if t == nil {
+		k := genKey{ts: now.Unix()}
+		for _, g := range gens {
+			if gk, err := generationKey(ent, g.Name); err == nil && gk.ts == k.ts && gk.seq >= k.seq {
+				k.seq = gk.seq + 1
+			}
+		}
+		return ent.Name + suffix + k.String(), nil
+	}
+
+	name := t.render(ent, now, 0)
+	ts, seq, _, _ := t.parse(name)
+	for _, g := range gens {
+		gts, gseq, _, ok := t.parse(g.Name)
+		if !ok || gts != ts {
+			continue
+		}
+		if !t.hasSeq() {
+			return "", fmt.Errorf("archive name is taken, the entry NameTemplate needs {seq}. entry=%s archive=%s", ent.Name, b.Location(g.Name))
+		}
+		if gseq >= seq {
+			seq = gseq + 1
+		}
+	}
+	name = t.render(ent, now, seq)
+	if config.Encrypt != nil {
+		name += "." + config.Encrypt.Tool
+	}
+	return name, nil
+}
@@ -0,0 +1,266 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// notifyConfig sends the summary of a run when it ends.
+type notifyConfig struct {
+	// Type is "email", "webhook", "slack" or a transport registered with
+	// registerNotifier.
+	Type string
+	// On is "failure", the default, to notify runs where an entry
+	// failed, or "always".
+	On string `json:",omitempty"`
+	// URL is the webhook, or the Slack incoming webhook.
+	URL string `json:",omitempty"`
+	// Template renders the webhook body from the Report, which is
+	// sent as JSON by default.
+	Template string `json:",omitempty"`
+	// SMTP is the host:port email is sent through, authenticating with
+	// User and Password when set.
+	SMTP     string   `json:",omitempty"`
+	User     string   `json:",omitempty"`
+	Password string   `json:",omitempty"`
+	From     string   `json:",omitempty"`
+	To       []string `json:",omitempty"`
+	// Options configure registered transports.
+	Options map[string]string `json:",omitempty"`
+
+	// template is Template parsed by isValid
+	template *template.Template
+}
+
+// Report is what notifiers and -summary-json get about a run.
+type Report struct {
+	RunID string
+	Host  string
+	Start time.Time
+	// ExitCode is the exit status of the run, see exitCode
+	ExitCode int
+	// Duration is in seconds
+	Duration  float64
+	Succeeded int
+	Failed    int
+	Skipped   int
+	// Bytes is the size of the archives written
+	Bytes int64
+	// Pruned counts the generations deleted by retention
+	Pruned  int
+	Entries []ReportEntry
+}
+
+// ReportEntry is the outcome of an entry in Report.Entries.
+type ReportEntry struct {
+	Entry string
+	// Status is succeeded, failed or skipped
+	Status   string
+	Archive  string `json:",omitempty"`
+	Size     int64  `json:",omitempty"`
+	Duration float64
+	Error    string `json:",omitempty"`
+	// Filtered counts the files filters left out, FilteredPaths lists
+	// the first of them
+	Filtered      int      `json:",omitempty"`
+	FilteredPaths []string `json:",omitempty"`
+}
+
+// Notifier is a transport of run summaries. Transports built into tarbu
+// register themselves from init with registerNotifier, so an internal
+// chat or ticketing system only takes a file added to the build.
+type Notifier interface {
+	// Validate checks the config of a notify entry when the config is
+	// loaded. Transports read their settings from n.Options.
+	Validate(n *notifyConfig) error
+	// Send delivers the summary of a run.
+	Send(n *notifyConfig, s *Report) error
+}
+
+var notifiers = map[string]Notifier{}
+
+func init() {
+	registerNotifier("webhook", webhookNotifier{})
+	registerNotifier("slack", slackNotifier{})
+	registerNotifier("email", emailNotifier{})
+}
+
+// registerNotifier makes t the transport of notify entries of type typ.
+// Registering a type twice is a programming error.
+func registerNotifier(typ string, t Notifier) {
+	if _, ok := notifiers[typ]; ok {
+		panic("notifier registered twice: " + typ)
+	}
+	notifiers[typ] = t
+}
+
+func (config *Config) isNotifyValid() error {
+	for i, n := range config.Notify {
+		switch n.On {
+		case "", "failure", "always":
+		default:
+			return fmt.Errorf("unknown notify condition. index=%d on=%s", i, n.On)
+		}
+		t, ok := notifiers[n.Type]
+		if !ok {
+			return fmt.Errorf("unknown notify type. index=%d type=%s", i, n.Type)
+		}
+		if err := t.Validate(n); err != nil {
+			return fmt.Errorf("notify config is invalid. index=%d type=%s err=%s", i, n.Type, err)
+		}
+		if n.Template != "" {
+			t, err := template.New("notify").Parse(n.Template)
+			if err != nil {
+				return fmt.Errorf("notify template is invalid. index=%d err=%s", i, err)
+			}
+			n.template = t
+		}
+	}
+	return nil
+}
+
+// summarize returns the Report of results, the run started at start.
+func (config *Config) summarize(results []result, start time.Time) *Report {
+	host, _ := os.Hostname()
+	s := &Report{
+		RunID:    config.runID,
+		Host:     host,
+		Start:    start,
+		Duration: time.Since(start).Seconds(),
+		ExitCode: exitCode(results),
+		Entries:  []ReportEntry{},
+	}
+	for _, r := range results {
+		e := ReportEntry{Entry: r.name, Duration: r.duration.Seconds()}
+		switch {
+		case r.skipped != "":
+			e.Status, e.Error = "skipped", r.skipped
+			s.Skipped++
+		case r.err != nil:
+			e.Status, e.Error = "failed", r.err.Error()
+			s.Failed++
+		default:
+			e.Status, e.Archive, e.Size = "succeeded", r.archive, r.size
+			e.Filtered, e.FilteredPaths = r.filtered, r.filteredPaths
+			s.Succeeded++
+			s.Bytes += r.size
+		}
+		s.Pruned += r.pruned
+		s.Entries = append(s.Entries, e)
+	}
+	return s
+}
+
+// writeSummary writes s as JSON to path, - for stdout.
+func writeSummary(path string, s *Report) error {
+	if path == "-" {
+		return writeJSON(os.Stdout, s)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(f, s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// text is the summary for people, the first line a subject.
+func (s *Report) text() string {
+	status := "succeeded"
+	if s.Failed > 0 {
+		status = "failed"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "tarbu backup %s on %s\n\n", status, s.Host)
+	fmt.Fprintf(&b, "%d succeeded, %d failed, %d skipped, %s written, %d archives pruned in %s.\n",
+		s.Succeeded, s.Failed, s.Skipped, formatSize(s.Bytes), s.Pruned, time.Duration(s.Duration*float64(time.Second)).Round(time.Second))
+	for _, e := range s.Entries {
+		if e.Status != "succeeded" {
+			fmt.Fprintf(&b, "%s %s: %s\n", e.Entry, e.Status, e.Error)
+		}
+	}
+	fmt.Fprintf(&b, "run=%s\n", s.RunID)
+	return b.String()
+}
+
+// notify sends s to every notifier it concerns. Failures are warnings,
+// they don't fail the run.
+func (config *Config) notify(s *Report) {
+	for _, n := range config.Notify {
+		if n.On != "always" && s.Failed == 0 {
+			continue
+		}
+		if err := notifiers[n.Type].Send(n, s); err != nil {
+			printWarning("Notify failed: type=%s err=%s", n.Type, err)
+		}
+	}
+}
+
+// webhookNotifier posts the summary as JSON, or rendered by Template.
+type webhookNotifier struct{}
+
+func (webhookNotifier) Validate(n *notifyConfig) error {
+	if n.URL == "" {
+		return fmt.Errorf("URL is required")
+	}
+	return nil
+}
+
+func (webhookNotifier) Send(n *notifyConfig, s *Report) error {
+	if n.template == nil {
+		return postJSON(n.URL, nil, s)
+	}
+	var body bytes.Buffer
+	if err := n.template.Execute(&body, s); err != nil {
+		return err
+	}
+	return post(n.URL, nil, body.Bytes())
+}
+
+// slackNotifier posts the text summary to a Slack incoming webhook.
+type slackNotifier struct{}
+
+func (slackNotifier) Validate(n *notifyConfig) error {
+	return webhookNotifier{}.Validate(n)
+}
+
+func (slackNotifier) Send(n *notifyConfig, s *Report) error {
+	return postJSON(n.URL, nil, map[string]string{"text": s.text()})
+}
+
+// emailNotifier mails the text summary through SMTP.
+type emailNotifier struct{}
+
+func (emailNotifier) Validate(n *notifyConfig) error {
+	if _, _, err := net.SplitHostPort(n.SMTP); err != nil {
+		return fmt.Errorf("SMTP must be host:port. smtp=%s", n.SMTP)
+	}
+	if n.From == "" || len(n.To) == 0 {
+		return fmt.Errorf("From and To are required")
+	}
+	return nil
+}
+
+func (emailNotifier) Send(n *notifyConfig, s *Report) error {
+	text := s.text()
+	subject := text[:strings.IndexByte(text, '\n')]
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\n", n.From, strings.Join(n.To, ", "), subject, time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(text, "\n", "\r\n", -1))
+	var auth smtp.Auth
+	if n.User != "" {
+		host, _, _ := net.SplitHostPort(n.SMTP)
+		auth = smtp.PlainAuth("", n.User, n.Password, host)
+	}
+	return smtp.SendMail(n.SMTP, auth, n.From, n.To, msg.Bytes())
+}
@@ -0,0 +1,77 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// onBattery reports whether the host runs on battery. Hosts without
+// power supply information are assumed to be on AC power.
+func onBattery() bool {
+	switch runtime.GOOS {
+	case "linux":
+		return linuxOnBattery("/sys/class/power_supply")
+	case "darwin":
+		out, err := exec.Command("pmset", "-g", "batt").Output()
+		return err == nil && strings.Contains(string(out), "'Battery Power'")
+	}
+	return false
+}
+
+func linuxOnBattery(dir string) bool {
+	supplies, _ := filepath.Glob(filepath.Join(dir, "*"))
+	battery := false
+	for _, s := range supplies {
+		typ := readSysfs(filepath.Join(s, "type"))
+		switch typ {
+		case "Mains", "USB":
+			if readSysfs(filepath.Join(s, "online")) == "1" {
+				return false
+			}
+		case "Battery":
+			if readSysfs(filepath.Join(s, "status")) == "Discharging" {
+				battery = true
+			}
+		}
+	}
+	return battery
+}
+
+func readSysfs(path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func (config *Config) hasHeavyEntries() bool {
+	for _, e := range config.Entries {
+		if e.Heavy {
+			return true
+		}
+	}
+	return false
+}
+
+// powerCheck decides whether heavy entries are skipped in this run. With
+// OnBattery "wait" it polls for AC power up to BatteryWait first.
+func (config *Config) powerCheck() bool {
+	if config.OnBattery == "" || !config.hasHeavyEntries() || !onBattery() {
+		return false
+	}
+	if config.OnBattery == "wait" {
+		deadline := time.Now().Add(config.batteryWait)
+		for time.Now().Before(deadline) {
+			time.Sleep(30 * time.Second)
+			if !onBattery() {
+				return false
+			}
+		}
+	}
+	return true
+}
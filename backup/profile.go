@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// profiler writes the profiles asked for by -cpuprofile, -memprofile and
+// -trace, so slow runs can be reported with something actionable.
+type profiler struct {
+	cpu, mem, trace string
+	files           []*os.File
+}
+
+func (p *profiler) register(fs *flag.FlagSet) {
+	fs.StringVar(&p.cpu, "cpuprofile", "", "write a CPU profile to this file")
+	fs.StringVar(&p.mem, "memprofile", "", "write a heap profile to this file when the run ends")
+	fs.StringVar(&p.trace, "trace", "", "write an execution trace to this file")
+}
+
+func (p *profiler) start() error {
+	if p.cpu != "" {
+		f, err := os.Create(p.cpu)
+		if err != nil {
+			return err
+		}
+		p.files = append(p.files, f)
+		if err := pprof.StartCPUProfile(f); err != nil {
+			return fmt.Errorf("starting CPU profile failed. err=%s", err)
+		}
+	}
+	if p.trace != "" {
+		f, err := os.Create(p.trace)
+		if err != nil {
+			return err
+		}
+		p.files = append(p.files, f)
+		if err := trace.Start(f); err != nil {
+			return fmt.Errorf("starting trace failed. err=%s", err)
+		}
+	}
+	return nil
+}
+
+// stop flushes the profiles. It must run before os.Exit.
+func (p *profiler) stop() {
+	if p.cpu != "" {
+		pprof.StopCPUProfile()
+	}
+	if p.trace != "" {
+		trace.Stop()
+	}
+	if p.mem != "" {
+		if err := p.writeHeap(); err != nil {
+			printWarning("Writing heap profile failed: err=%s", err)
+		}
+	}
+	for _, f := range p.files {
+		if err := f.Close(); err != nil {
+			printWarning("Writing profile failed: err=%s", err)
+		}
+	}
+	p.files = nil
+}
+
+func (p *profiler) writeHeap() error {
+	f, err := os.Create(p.mem)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// report live objects as of the end of the run
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,297 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/archiver"
+)
+
+// _BarRedraw is how often progress bars are redrawn.
+const _BarRedraw = time.Second
+
+// progress reports how far the entries being archived are, as asked
+// for by -progress: a log line per entry every -progress-interval, or a
+// bar per entry redrawn below the logs when stdout is a terminal.
+type progress struct {
+	mode     string
+	interval time.Duration
+
+	mu      sync.Mutex
+	entries []*entryProgress
+	// drawn is the number of bar lines on the terminal
+	drawn int
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func (p *progress) register(fs *flag.FlagSet) {
+	fs.StringVar(&p.mode, "progress", "off", "report the progress of entries, off, log, bars, or auto for bars on a terminal and log lines otherwise. Sources are scanned first for the percentages")
+	fs.DurationVar(&p.interval, "progress-interval", time.Minute, "how often -progress log writes a line per entry")
+}
+
+// setup checks the flags once logging is set up, as bars are drawn
+// where text logs go.
+func (p *progress) setup() error {
+	tty := isTerminal(os.Stdout) && logs.file == nil && !logs.json
+	switch p.mode {
+	case "off", "log":
+	case "bars":
+		if !tty {
+			return fmt.Errorf("progress bars need text logs on a terminal. progress=%s", p.mode)
+		}
+	case "auto":
+		p.mode = "log"
+		if tty {
+			p.mode = "bars"
+		}
+	default:
+		return fmt.Errorf("unknown progress mode. progress=%s", p.mode)
+	}
+	if p.interval <= 0 {
+		return fmt.Errorf("progress interval must be positive. interval=%s", p.interval)
+	}
+	return nil
+}
+
+func (p *progress) enabled() bool {
+	return p != nil && p.mode != "off"
+}
+
+// start reports until stop is called.
+func (p *progress) start() {
+	if !p.enabled() {
+		return
+	}
+	every := p.interval
+	if p.mode == "bars" {
+		every = _BarRedraw
+		logs.mu.Lock()
+		logs.bars = p
+		logs.mu.Unlock()
+	}
+	p.done = make(chan struct{})
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		t := time.NewTicker(every)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-t.C:
+				p.report()
+			}
+		}
+	}()
+}
+
+// stop ends reporting and takes the bars off the terminal.
+func (p *progress) stop() {
+	if !p.enabled() || p.done == nil {
+		return
+	}
+	close(p.done)
+	p.wg.Wait()
+	if p.mode == "bars" {
+		logs.mu.Lock()
+		p.erase(logs.w)
+		logs.bars = nil
+		logs.mu.Unlock()
+	}
+}
+
+func (p *progress) report() {
+	if p.mode == "bars" {
+		logs.mu.Lock()
+		p.erase(logs.w)
+		p.draw(logs.w)
+		logs.mu.Unlock()
+		return
+	}
+	p.mu.Lock()
+	entries := append([]*entryProgress(nil), p.entries...)
+	p.mu.Unlock()
+	for _, e := range entries {
+		logs.event(levelInfo, "", "Backup progress", e.fields()...)
+	}
+}
+
+// erase and draw run under logs.mu, so log events go above the bars.
+func (p *progress) erase(w io.Writer) {
+	if p.drawn > 0 {
+		fmt.Fprintf(w, "\r\x1b[%dA\x1b[J", p.drawn)
+		p.drawn = 0
+	}
+}
+
+func (p *progress) draw(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	width, _ := strconv.Atoi(os.Getenv("COLUMNS"))
+	if width <= 0 {
+		width = 80
+	}
+	var buf strings.Builder
+	for _, e := range p.entries {
+		line := []rune(e.bar())
+		// a wrapped line would throw off erase
+		if len(line) >= width {
+			line = line[:width-1]
+		}
+		buf.WriteString(string(line))
+		buf.WriteByte('\n')
+	}
+	io.WriteString(w, buf.String())
+	p.drawn = len(p.entries)
+}
+
+// track starts reporting an entry, c is its census when taken. It
+// returns nil when progress isn't reported.
+func (p *progress) track(name string, c *census) *entryProgress {
+	if !p.enabled() {
+		return nil
+	}
+	e := &entryProgress{name: name, start: time.Now()}
+	if c != nil {
+		e.total = c.bytes
+	}
+	p.mu.Lock()
+	p.entries = append(p.entries, e)
+	p.mu.Unlock()
+	return e
+}
+
+func (p *progress) untrack(e *entryProgress) {
+	if e == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, o := range p.entries {
+		if o == e {
+			p.entries = append(p.entries[:i], p.entries[i+1:]...)
+			break
+		}
+	}
+}
+
+// entryProgress counts what an entry archived so far. The methods do
+// nothing on nil.
+type entryProgress struct {
+	// updated atomically, first for their alignment
+	files, read, written int64
+
+	name  string
+	start time.Time
+	// total is the source bytes found by the census, 0 when unknown
+	total int64
+}
+
+// hook counts the files archived and source bytes read with opts.
+func (e *entryProgress) hook(opts *archiver.Options) {
+	if e == nil {
+		return
+	}
+	read := opts.Read
+	opts.Read = func(n int) {
+		atomic.AddInt64(&e.read, int64(n))
+		if read != nil {
+			read(n)
+		}
+	}
+	archived := opts.Archived
+	opts.Archived = func(name string, fi os.FileInfo) {
+		if fi.Mode().IsRegular() {
+			atomic.AddInt64(&e.files, 1)
+		}
+		if archived != nil {
+			archived(name, fi)
+		}
+	}
+}
+
+// wrote counts n bytes written to the destination.
+func (e *entryProgress) wrote(n int64) {
+	if e != nil {
+		atomic.AddInt64(&e.written, n)
+	}
+}
+
+// writer counts what goes through w as written.
+func (e *entryProgress) writer(w io.Writer) io.Writer {
+	if e == nil {
+		return w
+	}
+	return &progressWriter{w, e}
+}
+
+type progressWriter struct {
+	w io.Writer
+	e *entryProgress
+}
+
+func (pw *progressWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.e.wrote(int64(n))
+	return n, err
+}
+
+// percent is how much of the census was read, -1 without one. Sources
+// grow and incremental archives read less, so it is an estimate held
+// below 100 until the entry is done.
+func (e *entryProgress) percent() int {
+	if e.total <= 0 {
+		return -1
+	}
+	pct := int(atomic.LoadInt64(&e.read) * 100 / e.total)
+	if pct > 99 {
+		pct = 99
+	}
+	return pct
+}
+
+// rate is the bytes read per second since the entry started.
+func (e *entryProgress) rate() logRate {
+	secs := time.Since(e.start).Seconds()
+	if secs <= 0 {
+		return 0
+	}
+	return logRate(float64(atomic.LoadInt64(&e.read)) / secs)
+}
+
+func (e *entryProgress) fields() []interface{} {
+	fields := []interface{}{"entry", e.name, "files", atomic.LoadInt64(&e.files),
+		"read", logSize(atomic.LoadInt64(&e.read)), "written", logSize(atomic.LoadInt64(&e.written))}
+	if pct := e.percent(); pct >= 0 {
+		fields = append(fields, "percent", pct)
+	}
+	return append(fields, "rate", e.rate())
+}
+
+// bar is the terminal line of the entry, source bytes read in and
+// archive bytes out.
+func (e *entryProgress) bar() string {
+	const width = 12
+	gauge := strings.Repeat(" ", width+2)
+	pct := "  ?%"
+	if p := e.percent(); p >= 0 {
+		gauge = "[" + strings.Repeat("#", p*width/100) + strings.Repeat(".", width-p*width/100) + "]"
+		pct = fmt.Sprintf("%3d%%", p)
+	}
+	name := e.name
+	if len(name) > 14 {
+		name = name[:13] + "~"
+	}
+	return fmt.Sprintf("%-14s %s %s %d files %s in %s out %s",
+		name, gauge, pct, atomic.LoadInt64(&e.files), formatSize(atomic.LoadInt64(&e.read)),
+		formatSize(atomic.LoadInt64(&e.written)), e.rate())
+}
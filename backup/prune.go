@@ -0,0 +1,232 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// pruneCommand applies retention to the generations in the destinations
+// without archiving anything, e.g. right after lowering KeepGen. The
+// newest generation counts as the one just written. Repository entries
+// forget their snapshots, tarbu repo prune then frees their chunks.
+func pruneCommand(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	dryRun := fs.Bool("dry-run", false, "print what would be deleted")
+	yes := fs.Bool("yes", false, "delete without asking")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu prune [-config path] [-dry-run] [-yes] [entry...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if config.isReadOnly() && !*dryRun {
+		return fmt.Errorf("prune is refused in read-only mode")
+	}
+	if err := config.isRetentionValid(); err != nil {
+		return err
+	}
+	if err := config.isNamingValid(); err != nil {
+		return err
+	}
+	entries := config.Entries
+	if config.SelfBackup {
+		entries = config.entriesWithSelf()
+	}
+	if fs.NArg() > 0 {
+		entries = nil
+		for _, n := range fs.Args() {
+			ent := config.findEntry(n)
+			if ent == nil {
+				return fmt.Errorf("entry not found. name=%s", n)
+			}
+			entries = append(entries, ent)
+		}
+	}
+
+	type expiredGen struct {
+		ent  *Entry
+		b    storage.Backend
+		name string
+	}
+	var expired []expiredGen
+	var locs []string
+	var snapshots int
+	for _, ent := range entries {
+		if ent.Repository {
+			rp, err := config.openRepo(ent)
+			if err != nil {
+				return err
+			}
+			names, err := rp.forget(ent, config.keepGen(ent), true)
+			if err != nil {
+				return &RetentionError{config.entryDst(ent), err}
+			}
+			for _, n := range names {
+				expired = append(expired, expiredGen{ent, rp.snapshots, n})
+				locs = append(locs, rp.snapshots.Location(n))
+			}
+			snapshots += len(names)
+			continue
+		}
+		b, err := config.entryBackend(ent)
+		if err != nil {
+			return err
+		}
+		names, err := config.pruneOnly(b, ent)
+		if err != nil {
+			return err
+		}
+		for _, n := range names {
+			expired = append(expired, expiredGen{ent, b, n})
+			locs = append(locs, b.Location(n))
+		}
+	}
+	if len(expired) == 0 {
+		printSuccess("Nothing to prune: dst=%s", config.Dst)
+		return nil
+	}
+	if *dryRun {
+		for _, e := range expired {
+			logs.event(levelInfo, "", "Would delete", "entry", e.ent.Name, "archive", e.b.Location(e.name))
+		}
+		return nil
+	}
+	if err := confirm("Pruning "+config.Dst, locs, *yes); err != nil {
+		return err
+	}
+	lock, err := config.lockRun()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	for _, e := range expired {
+		// snapshots go for good, tarbu repo prune frees their chunks
+		if e.ent.Repository {
+			if err := e.b.Delete(e.name); err != nil {
+				return &RetentionError{e.b.Location(e.name), err}
+			}
+			printSuccess("Deleted generation: entry=%s archive=%s", e.ent.Name, e.b.Location(e.name))
+			continue
+		}
+		if err := config.discard(e.b, append([]string{e.name}, sidecars(e.ent, e.name)...)...); err != nil {
+			return &RetentionError{e.b.Location(e.name), err}
+		}
+		if config.trashRetention > 0 {
+			printSuccess("Moved generation to the trash: entry=%s archive=%s", e.ent.Name, e.b.Location(e.name))
+		} else {
+			printSuccess("Deleted generation: entry=%s archive=%s", e.ent.Name, e.b.Location(e.name))
+		}
+	}
+	if snapshots > 0 {
+		printWarning("Forgot snapshots, tarbu repo prune frees their chunks: snapshots=%d", snapshots)
+	}
+	return nil
+}
+
+// pruneOnly returns the generations of ent retention deletes when no
+// archive is written. Numbered entries keep their slot numbers.
+func (config *Config) pruneOnly(b storage.Backend, ent *Entry) ([]string, error) {
+	if !ent.numbered() {
+		return config.planPrune(b, ent)
+	}
+	objs, err := generations(b, ent)
+	if err != nil {
+		return nil, &RetentionError{config.entryDst(ent), err}
+	}
+	names := make([]string, len(objs))
+	for i, o := range objs {
+		names[i] = o.Name
+	}
+	expired, err := config.expired(ent, names)
+	if err != nil {
+		return nil, &RetentionError{config.entryDst(ent), err}
+	}
+	return expired, nil
+}
+
+// purgeVersionsCommand deletes for good the old versions and delete
+// markers that deletes and retention left in versioned destinations,
+// under which previously pruned archives stay billed and restorable.
+// Current objects are kept.
+func purgeVersionsCommand(args []string) error {
+	fs := flag.NewFlagSet("purge-versions", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	dryRun := fs.Bool("dry-run", false, "print what would be deleted")
+	yes := fs.Bool("yes", false, "delete without asking")
+	fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if config.isReadOnly() {
+		return fmt.Errorf("purge-versions is refused in read-only mode")
+	}
+	type purge struct {
+		dst string
+		v   storage.Versioner
+		vs  []storage.Version
+	}
+	var purges []purge
+	var locs []string
+	for _, dst := range config.destinations() {
+		b, err := config.dstBackend(dst)
+		if err != nil {
+			return err
+		}
+		v, ok := storage.AsVersioner(b)
+		if !ok {
+			logDebug("Destination keeps no versions", "dst", dst)
+			continue
+		}
+		vs, err := v.Versions("")
+		if err != nil {
+			return &RetentionError{dst, err}
+		}
+		if len(vs) == 0 {
+			continue
+		}
+		purges = append(purges, purge{dst, v, vs})
+		for _, ver := range vs {
+			locs = append(locs, b.Location(ver.Name)+"?versionId="+ver.ID)
+		}
+	}
+	if len(locs) == 0 {
+		printSuccess("Nothing to purge: dst=%s", config.Dst)
+		return nil
+	}
+	if *dryRun {
+		for _, l := range locs {
+			logs.event(levelInfo, "", "Would delete version", "object", l)
+		}
+		return nil
+	}
+	if err := confirm("Purging old versions", locs, *yes); err != nil {
+		return err
+	}
+	lock, err := config.lockRun()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	for _, p := range purges {
+		if err := p.v.DeleteVersions(p.vs...); err != nil {
+			return &RetentionError{p.dst, err}
+		}
+		var size int64
+		for _, ver := range p.vs {
+			size += ver.Size
+		}
+		printSuccess("Purged versions: dst=%s versions=%d size=%s", p.dst, len(p.vs), formatSize(size))
+	}
+	return nil
+}
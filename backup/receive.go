@@ -0,0 +1,19 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// receiveCommand is the remote end of ssh:// destinations, which run it
+// over ssh on the host storing the archives. It's not meant to be run
+// by hand.
+func receiveCommand(args []string) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" {
+		fmt.Fprintln(os.Stderr, "usage: tarbu receive [-sub] put|get|list|delete|rename|free <dir> [<name>...]")
+		return fmt.Errorf("operation is required")
+	}
+	return storage.Receive(args, os.Stdin, os.Stdout)
+}
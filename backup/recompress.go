@@ -0,0 +1,226 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os/exec"
+	"strings"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// recompressCommand converts the generations of an entry to another
+// compression. Each one is streamed into a new archive of the same time,
+// whose tar stream is read back and compared before the original is
+// deleted. Encrypted archives stay encrypted with the same tool.
+func recompressCommand(args []string) error {
+	fs := flag.NewFlagSet("recompress", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	name := fs.String("entry", "", "entry whose generations are converted")
+	to := fs.String("to", "", "compression to convert to: gzip, zstd, xz, bzip2 or none")
+	level := fs.Int("level", 0, "compression level, the default of the compression when zero")
+	dryRun := fs.Bool("dry-run", false, "print what would be converted")
+	yes := fs.Bool("yes", false, "convert without asking")
+	fs.Parse(args)
+
+	if *name == "" || *to == "" {
+		fs.Usage()
+		return fmt.Errorf("-entry and -to are required")
+	}
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if config.isReadOnly() && !*dryRun {
+		return fmt.Errorf("recompress is refused in read-only mode")
+	}
+	ent := config.findEntry(*name)
+	if ent == nil {
+		return fmt.Errorf("entry not found. name=%s", *name)
+	}
+	if ent.Suffix != "" || ent.NameTemplate != "" {
+		return fmt.Errorf("entries with their own Suffix or NameTemplate can't be recompressed. name=%s", ent.Name)
+	}
+	target := *ent
+	target.Compression, target.CompressionLevel, target.compressionWorkers = *to, *level, 0
+	c, ok := codecs[*to]
+	if !ok {
+		return fmt.Errorf("unknown compression. compression=%s", *to)
+	}
+	if *level != 0 && (*level < c.minLevel || *level > c.maxLevel) {
+		return fmt.Errorf("compression level is out of range. level=%d min=%d max=%d", *level, c.minLevel, c.maxLevel)
+	}
+	if c.tool != "" {
+		if _, err := exec.LookPath(c.tool); err != nil {
+			return fmt.Errorf("compression tool not found. tool=%s", c.tool)
+		}
+	}
+
+	b, err := config.entryBackend(ent)
+	if err != nil {
+		return err
+	}
+	gens, err := generations(b, ent)
+	if err != nil {
+		return err
+	}
+	var todo []string
+	var locs []string
+	for _, g := range gens {
+		if archiveCodec(ent, g.Name) != *to {
+			todo = append(todo, g.Name)
+			locs = append(locs, b.Location(g.Name))
+		}
+	}
+	if len(todo) == 0 {
+		printSuccess("Nothing to recompress: entry=%s compression=%s", ent.Name, *to)
+		return nil
+	}
+	if *dryRun {
+		for _, n := range todo {
+			logs.event(levelInfo, "", "Would recompress", "archive", b.Location(n), "to", recompressedName(ent, n, c.suffix))
+		}
+		return nil
+	}
+	if err := confirm("Recompressing "+ent.Name+" to "+*to, locs, *yes); err != nil {
+		return err
+	}
+	lock, err := config.lockRun()
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	for _, n := range todo {
+		newName, err := config.recompress(b, ent, &target, n)
+		if err != nil {
+			return err
+		}
+		printSuccess("Recompressed archive: entry=%s from=%s to=%s", ent.Name, b.Location(n), b.Location(newName))
+	}
+	if current := ent.codec(); current.suffix != c.suffix {
+		printWarning("Entry still writes its old compression, set its Compression for new archives: entry=%s compression=%s", ent.Name, *to)
+	}
+	return nil
+}
+
+// archiveCodec returns the compression an archive of ent was written
+// with, by its suffix.
+func archiveCodec(ent *Entry, name string) string {
+	rest := strings.TrimPrefix(name, ent.Name)
+	// gzip comes before none, whose .tar. prefixes the others
+	for _, n := range codecNames {
+		if strings.HasPrefix(rest, codecs[n].suffix) {
+			return n
+		}
+	}
+	return ""
+}
+
+// recompressedName is name with its compression suffix replaced by
+// suffix, keeping the encryption and the timestamp or slot.
+func recompressedName(ent *Entry, name, suffix string) string {
+	var stamp string
+	if k, err := generationKey(ent, name); err == nil {
+		stamp = k.String()
+	}
+	if tool := encryption(ent, name); tool != "" {
+		suffix = encryptedSuffix(suffix, tool)
+	}
+	return ent.Name + suffix + stamp
+}
+
+// recompress writes archive name of ent again compressed as target, and
+// deletes it once the new archive reads back the same tar stream.
+func (config *Config) recompress(b storage.Backend, ent, target *Entry, name string) (string, error) {
+	tool := encryption(ent, name)
+	if tool != "" && (config.Encrypt == nil || config.Encrypt.Tool != tool) {
+		return "", fmt.Errorf("archive is encrypted with %s, config.Encrypt must use it too. archive=%s", tool, b.Location(name))
+	}
+	newName := recompressedName(ent, name, target.codec().suffix)
+
+	tr, err := config.openTar(b, ent, name)
+	if err != nil {
+		return "", err
+	}
+	want := sha256.New()
+	size, sum, err := putArchive(b, newName, func(w io.Writer) error {
+		write := func(w io.Writer) error {
+			return writeCompressed(target, w, func(w io.Writer) error {
+				return copyTar(w, io.TeeReader(tr, want), target)
+			})
+		}
+		if tool != "" {
+			return config.writeEncrypted(w, write)
+		}
+		return write(w)
+	})
+	if cerr := tr.Close(); err == nil && cerr != nil {
+		err = &SourceReadError{b.Location(name), cerr}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// read the new archive back before letting go of the old one
+	got := sha256.New()
+	if err := config.hashTar(b, ent, newName, got); err != nil {
+		b.Delete(newName)
+		return "", fmt.Errorf("recompressed archive doesn't read back. archive=%s err=%s", b.Location(newName), err)
+	}
+	if !bytes.Equal(got.Sum(nil), want.Sum(nil)) {
+		b.Delete(newName)
+		return "", fmt.Errorf("recompressed archive differs from the original. archive=%s", b.Location(newName))
+	}
+	if err := writeChecksum(b, newName, sum); err != nil {
+		b.Delete(newName)
+		return "", err
+	}
+	if err := moveMeta(b, name, newName); err != nil {
+		return "", &RetentionError{b.Location(name), err}
+	}
+	if err := b.Delete(name, checksumName(name)); err != nil {
+		return "", &RetentionError{b.Location(name), err}
+	}
+	logDebug("Recompressed", "archive", b.Location(newName), "size", logSize(size))
+	return newName, nil
+}
+
+// copyTar copies a plain tar stream to w, compressing it with gzip for
+// gzip targets, which the archiver does for backups.
+func copyTar(w io.Writer, r io.Reader, target *Entry) error {
+	if target.codec().tool != "" || target.Compression == "none" {
+		_, err := io.Copy(w, r)
+		return err
+	}
+	level := target.CompressionLevel
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	zw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(zw, r); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// hashTar hashes the tar stream of archive name into h.
+func (config *Config) hashTar(b storage.Backend, ent *Entry, name string, h hash.Hash) error {
+	tr, err := config.openTar(b, ent, name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(h, tr); err != nil {
+		tr.Close()
+		return err
+	}
+	return tr.Close()
+}
@@ -0,0 +1,146 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+func recoverConfig(args []string) error {
+	fs := flag.NewFlagSet("recover", flag.ExitOnError)
+	from := fs.String("from", "", "destination directory or URL holding a self backup")
+	out := fs.String("o", "tarbu.json", "path to write the recovered config to, or - for stdout")
+	force := fs.Bool("force", false, "overwrite an existing config file")
+	// an encrypted self backup is read without the config it holds
+	dec := &encryptConfig{}
+	fs.StringVar(&dec.Identity, "identity", "", "age identity file decrypting an encrypted self backup")
+	fs.StringVar(&dec.PassphraseEnv, "passphrase-env", "", "environment variable holding the gpg passphrase of an encrypted self backup")
+	fs.StringVar(&dec.PassphraseFile, "passphrase-file", "", "file holding the gpg passphrase of an encrypted self backup")
+	fs.Parse(args)
+
+	if *from == "" {
+		return fmt.Errorf("-from is required")
+	}
+	if *out != "-" && !*force {
+		if _, err := os.Stat(*out); err == nil {
+			return fmt.Errorf("config already exists, use -force to overwrite. path=%s", *out)
+		}
+	}
+
+	// without a config, remote credentials come from the environment
+	b, err := storage.Open(*from, nil)
+	if err != nil {
+		return err
+	}
+	self := &Entry{Name: _SelfEntry}
+	sb := b
+	gens, err := generations(sb, self)
+	if err != nil {
+		return err
+	}
+	if len(gens) == 0 {
+		// written with PerEntrySubdir
+		sb = storage.Sub(b, _SelfEntry)
+		if gens, err = generations(sb, self); err != nil {
+			return err
+		}
+	}
+	if len(gens) == 0 {
+		return fmt.Errorf("no self backup found. from=%s", *from)
+	}
+	latest := sb.Location(gens[len(gens)-1].Name)
+	data, err := (&Config{Encrypt: dec}).readSelfConfig(sb, gens[len(gens)-1].Name)
+	if err != nil {
+		return fmt.Errorf("extracting config failed. archive=%s err=%s", latest, err)
+	}
+
+	config := &Config{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return fmt.Errorf("recovered config is broken. archive=%s err=%s", latest, err)
+	}
+
+	if *out == "-" {
+		if _, err := os.Stdout.Write(data); err != nil {
+			return err
+		}
+	} else if err := ioutil.WriteFile(*out, data, 0600); err != nil {
+		return err
+	}
+
+	// the plan goes to stderr so -o - stays a clean config
+	w := os.Stderr
+	fmt.Fprintf(w, "Recovered config from %s\n", latest)
+	if config.Dst != *from && filepath.Clean(config.Dst) != filepath.Clean(*from) {
+		fmt.Fprintf(w, "Note: config.Dst is %s, archives below are read from %s\n", config.Dst, *from)
+	}
+	fmt.Fprintln(w, "Restore plan:")
+	for _, e := range config.Entries {
+		b := config.entryDir(b, e)
+		gens, err := generations(b, e)
+		if err != nil {
+			return err
+		}
+		if len(gens) == 0 {
+			fmt.Fprintf(w, "  # entry=%s: no archive found\n", e.Name)
+			continue
+		}
+		fmt.Fprintf(w, "  # entry=%s path=%s generations=%d\n", e.Name, e.Path, len(gens))
+		// incremental archives need their full backup and deletions
+		// applied, encrypted ones decrypting, which tarbu restore does
+		last := gens[len(gens)-1].Name
+		if storage.IsRemote(*from) || e.Incremental || encryption(e, last) != "" {
+			fmt.Fprintf(w, "  tarbu restore -config %s -to / %s\n", *out, e.Name)
+			continue
+		}
+		opts := ""
+		switch {
+		case e.PreserveExtended:
+			// quoted against the shell globbing the include pattern
+			opts = "'" + strings.Join(_ExtendedAttrOpts, "' '") + "' "
+		case e.SecurityAttrs:
+			opts = strings.Join(_SecurityAttrOpts, " ") + " "
+		}
+		if _, err := os.Stat(b.Location(last)); os.IsNotExist(err) {
+			// split in parts
+			fmt.Fprintf(w, "  cat %s.part* | tar %s-xf - -C /\n", b.Location(last), opts)
+			continue
+		}
+		fmt.Fprintf(w, "  tar %s-xf %s -C /\n", opts, b.Location(last))
+	}
+	return nil
+}
+
+// readSelfConfig returns the config stored in a self backup archive,
+// decrypting it with config.Encrypt.
+func (config *Config) readSelfConfig(b storage.Backend, name string) ([]byte, error) {
+	r, err := config.openArchive(b, &Entry{Name: _SelfEntry}, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var data []byte
+	_, err = scanArchive(bufio.NewReader(r), func(hdr *tar.Header, body io.Reader) error {
+		if hdr.Name != "./"+_SelfConfig || data != nil {
+			return nil
+		}
+		var rerr error
+		data, rerr = ioutil.ReadAll(io.LimitReader(body, _SelfConfigMax))
+		return rerr
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("%s is missing from the archive", _SelfConfig)
+	}
+	return data, nil
+}
@@ -0,0 +1,243 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// replicaConfig is a secondary destination every new archive is copied
+// to once written, e.g. an NFS mount or a bucket. Replicas are pruned on
+// their own and tarbu sync copies the generations they miss.
+type replicaConfig struct {
+	// Dst is a directory or URL, as config.Dst
+	Dst string
+	// KeepGen is the number of generations the replica keeps instead of
+	// the retention of each entry
+	KeepGen int `json:",omitempty"`
+
+	// backend is Dst opened by isValid
+	backend storage.Backend
+}
+
+func (config *Config) isReplicasValid() error {
+	for _, rep := range config.Replicas {
+		if rep.Dst == "" {
+			return fmt.Errorf("config.Replicas.Dst is required")
+		}
+		if rep.Dst == config.Dst {
+			return fmt.Errorf("config.Replicas.Dst must differ from config.Dst. dst=%s", rep.Dst)
+		}
+		if rep.KeepGen < 0 {
+			return fmt.Errorf("config.Replicas.KeepGen must not be negative. dst=%s keep_gen=%d", rep.Dst, rep.KeepGen)
+		}
+		b, err := config.openDst(rep.Dst)
+		if err != nil {
+			return fmt.Errorf("config.Replicas.Dst can't be opened. dst=%s err=%s", rep.Dst, err)
+		}
+		rep.backend = b
+	}
+	return nil
+}
+
+// replicated is false for the entries replicas skip: repository
+// snapshots share chunks, and numbered slots are renamed every run.
+func (ent *Entry) replicated() bool {
+	return !ent.Repository && !ent.numbered()
+}
+
+// replicaEntry is ent as the replica rep keeps it.
+func (rep *replicaConfig) replicaEntry(ent *Entry) *Entry {
+	if rep.KeepGen == 0 {
+		return ent
+	}
+	e := *ent
+	e.KeepGen = rep.KeepGen
+	e.KeepDaily, e.KeepWeekly, e.KeepMonthly, e.maxAge = 0, 0, 0, 0
+	return &e
+}
+
+// replicate copies the archive name of ent just written to b to every
+// replica and prunes them. Failures are warnings, the archive is safe in
+// the primary destination.
+func (config *Config) replicate(r *result, b storage.Backend, ent *Entry, name string) {
+	if !ent.replicated() {
+		return
+	}
+	if ent.Name == _SelfEntry {
+		config.copySelf(r, b, ent, name)
+	}
+	for _, rep := range config.Replicas {
+		rb := config.entryDir(rep.backend, ent)
+		if err := copyGeneration(b, rb, ent, name); err != nil {
+			r.warnings = append(r.warnings, fmt.Sprintf("copying to replica failed. replica=%s err=%s", rep.Dst, err))
+			continue
+		}
+		if _, err := config.prune(rb, rep.replicaEntry(ent)); err != nil {
+			r.warnings = append(r.warnings, fmt.Sprintf("pruning replica failed. replica=%s err=%s", rep.Dst, err))
+		}
+	}
+}
+
+// copyGeneration copies the archive name of ent and its sidecars from b
+// to rb, the archive last so a copy cut short has none.
+func copyGeneration(b, rb storage.Backend, ent *Entry, name string) error {
+	for _, n := range append(sidecars(ent, name), name) {
+		r, err := b.Open(n)
+		if storage.IsNotExist(err) && n != name {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = rb.Put(n, r)
+		r.Close()
+		if err != nil {
+			return putError(rb, rb.Location(n), err)
+		}
+	}
+	return nil
+}
+
+// missingGenerations returns the generations of ent in b that the
+// replica rb lacks and would keep, oldest first.
+func (config *Config) missingGenerations(b, rb storage.Backend, ent *Entry) ([]string, error) {
+	gens, err := generations(b, ent)
+	if err != nil {
+		return nil, err
+	}
+	have, err := generations(rb, ent)
+	if err != nil {
+		return nil, err
+	}
+	had := map[string]bool{}
+	all := []string{}
+	for _, g := range have {
+		had[g.Name] = true
+		all = append(all, g.Name)
+	}
+	var missing []string
+	for _, g := range gens {
+		if !had[g.Name] {
+			missing = append(missing, g.Name)
+			all = append(all, g.Name)
+		}
+	}
+	// incremental chains need their bases, which pruning keeps
+	if len(missing) == 0 || ent.Incremental {
+		return missing, nil
+	}
+	sort.Slice(all, func(i, j int) bool { return archiveTime(ent, all[i]) < archiveTime(ent, all[j]) })
+	locs := make([]string, len(all))
+	for i, n := range all {
+		locs[i] = rb.Location(n)
+	}
+	expired, err := config.expired(ent, locs)
+	if err != nil {
+		return nil, err
+	}
+	dropped := map[string]bool{}
+	for _, l := range expired {
+		dropped[l] = true
+	}
+	var wanted []string
+	for _, n := range missing {
+		if !dropped[rb.Location(n)] {
+			wanted = append(wanted, n)
+		}
+	}
+	return wanted, nil
+}
+
+// syncCommand copies to every replica the generations it misses, those
+// written while it was unreachable or before it was added, then prunes
+// it.
+func syncCommand(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	dryRun := fs.Bool("dry-run", false, "print what would be copied")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu sync [-config path] [-dry-run] [entry...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if config.isReadOnly() && !*dryRun {
+		return fmt.Errorf("sync is refused in read-only mode")
+	}
+	for _, check := range []func() error{config.isRetentionValid, config.isNamingValid, config.isSplitValid, config.isReplicasValid} {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	if len(config.Replicas) == 0 {
+		return fmt.Errorf("config.Replicas is empty")
+	}
+	entries := config.Entries
+	if config.SelfBackup {
+		entries = config.entriesWithSelf()
+	}
+	if fs.NArg() > 0 {
+		entries = nil
+		for _, n := range fs.Args() {
+			ent := config.findEntry(n)
+			if ent == nil {
+				return fmt.Errorf("entry not found. name=%s", n)
+			}
+			entries = append(entries, ent)
+		}
+	}
+	if !*dryRun {
+		lock, err := config.lockRun()
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	copied := 0
+	for _, ent := range entries {
+		if !ent.replicated() {
+			continue
+		}
+		b, err := config.entryBackend(ent)
+		if err != nil {
+			return err
+		}
+		for _, rep := range config.Replicas {
+			rb := config.entryDir(rep.backend, ent)
+			rent := rep.replicaEntry(ent)
+			missing, err := config.missingGenerations(b, rb, rent)
+			if err != nil {
+				return err
+			}
+			for _, n := range missing {
+				if *dryRun {
+					logs.event(levelInfo, "", "Would copy", "entry", ent.Name, "archive", b.Location(n), "replica", rb.Location(n))
+					continue
+				}
+				if err := copyGeneration(b, rb, ent, n); err != nil {
+					return err
+				}
+				copied++
+				printSuccess("Copied generation: entry=%s archive=%s replica=%s", ent.Name, b.Location(n), rb.Location(n))
+			}
+			if *dryRun {
+				continue
+			}
+			if _, err := config.prune(rb, rent); err != nil {
+				return err
+			}
+		}
+	}
+	if !*dryRun {
+		printSuccess("Synced replicas: replicas=%d copied=%d", len(config.Replicas), copied)
+	}
+	return nil
+}
@@ -0,0 +1,758 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/archiver"
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// _RepoDir is the directory of the repository under Dst, shared by the
+// repository entries of the destination so their chunks dedupe too.
+const _RepoDir = ".tarbu-repo"
+
+// chunks are cut where the high bits of the gear hash of the last 64
+// bytes are clear, between _ChunkMin and _ChunkMax long. Inserting or
+// deleting bytes only changes the chunks around the edit.
+const (
+	_ChunkMin  = 512 << 10
+	_ChunkMax  = 8 << 20
+	_ChunkMask = (1<<20 - 1) << 44
+)
+
+// gear maps bytes to random values for the rolling hash. It must never
+// change, or the chunks of a tree no longer match the stored ones.
+var gear = func() (t [256]uint64) {
+	// splitmix64
+	x := uint64(0x7461726275)
+	for i := range t {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		t[i] = z ^ z>>31
+	}
+	return t
+}()
+
+func (config *Config) isRepositoryValid() error {
+	for _, e := range config.Entries {
+		if !e.Repository {
+			continue
+		}
+		if e.Incremental || e.Append || e.Type != "" || e.numbered() {
+			return fmt.Errorf("repository entries can't be incremental, appended, typed or numbered. name=%s", e.Name)
+		}
+		// snapshots only keep mode, owner and mtime
+		if e.SecurityAttrs || e.PreserveExtended {
+			return fmt.Errorf("repository entries can't record extended attributes. name=%s", e.Name)
+		}
+		if e.VerifyAfterWrite {
+			return fmt.Errorf("repository entries write no archive to verify. name=%s", e.Name)
+		}
+		// chunks are stored as they are
+		if config.Encrypt != nil {
+			return fmt.Errorf("repository entries can't be encrypted. name=%s", e.Name)
+		}
+	}
+	return nil
+}
+
+// repoSnapshot lists the files of one run of an entry and their chunks.
+type repoSnapshot struct {
+	Entry string
+	Time  int64
+	RunID string `json:",omitempty"`
+	Host  string `json:",omitempty"`
+	Files []repoFile
+}
+
+// repoFile is a member of a snapshot, named as in archives of the entry.
+// Hard links are separate files sharing their chunks.
+type repoFile struct {
+	Name  string
+	Mode  os.FileMode
+	Size  int64  `json:",omitempty"`
+	MTime int64  `json:",omitempty"`
+	UID   int    `json:",omitempty"`
+	GID   int    `json:",omitempty"`
+	Link  string `json:",omitempty"`
+	// Chunks are the sha256 of the plain chunks of regular files
+	Chunks []string `json:",omitempty"`
+}
+
+// repo is a content-addressed store of chunks, gzipped under
+// chunks/<first two hex digits>/<sha256>, and of the snapshots naming
+// them under snapshots/<entry>.<unix>.json.
+type repo struct {
+	b         storage.Backend
+	snapshots storage.Backend
+	// known holds the chunks listed so far by directory, listed on the
+	// first lookup in it
+	known map[string]map[string]bool
+}
+
+// openRepo opens the repository of the destination of ent.
+func (config *Config) openRepo(ent *Entry) (*repo, error) {
+	b, err := config.dstBackend(ent.Dst)
+	if err != nil {
+		return nil, err
+	}
+	b = storage.Sub(b, _RepoDir)
+	return &repo{b: b, snapshots: storage.Sub(b, "snapshots"), known: map[string]map[string]bool{}}, nil
+}
+
+func (rp *repo) chunkDir(id string) storage.Backend {
+	return storage.Sub(storage.Sub(rp.b, "chunks"), id[:2])
+}
+
+// dir returns the chunks stored in the directory of id.
+func (rp *repo) dir(id string) (map[string]bool, error) {
+	if ids, ok := rp.known[id[:2]]; ok {
+		return ids, nil
+	}
+	objs, err := rp.chunkDir(id).List("")
+	if err != nil {
+		return nil, err
+	}
+	ids := map[string]bool{}
+	for _, o := range objs {
+		if !strings.HasSuffix(o.Name, storage.TmpSuffix) {
+			ids[o.Name] = true
+		}
+	}
+	rp.known[id[:2]] = ids
+	return ids, nil
+}
+
+// put stores data unless the repository has it, returning its id and
+// the bytes stored.
+func (rp *repo) put(data []byte) (string, int64, error) {
+	sum := sha256.Sum256(data)
+	id := hex.EncodeToString(sum[:])
+	ids, err := rp.dir(id)
+	if err != nil || ids[id] {
+		return id, 0, err
+	}
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return "", 0, err
+	}
+	n := int64(buf.Len())
+	if err := rp.chunkDir(id).Put(id, buf); err != nil {
+		return "", 0, err
+	}
+	ids[id] = true
+	return id, n, nil
+}
+
+// get reads chunk id, failing when it doesn't hash to its id.
+func (rp *repo) get(id string) ([]byte, error) {
+	if len(id) != sha256.Size*2 {
+		return nil, fmt.Errorf("invalid chunk id. id=%s", id)
+	}
+	rc, err := rp.chunkDir(id).Open(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, fmt.Errorf("chunk is corrupt. chunk=%s err=%s", rp.chunkDir(id).Location(id), err)
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("chunk is corrupt. chunk=%s err=%s", rp.chunkDir(id).Location(id), err)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != id {
+		return nil, fmt.Errorf("chunk doesn't match its hash. chunk=%s", rp.chunkDir(id).Location(id))
+	}
+	return data, nil
+}
+
+func snapshotName(entry string, ts int64) string {
+	return fmt.Sprintf("%s.%d.json", entry, ts)
+}
+
+// snapshotTimes returns the times of the snapshots of entry, oldest
+// first.
+func (rp *repo) snapshotTimes(entry string) ([]int64, error) {
+	objs, err := rp.snapshots.List(entry + ".")
+	if err != nil {
+		return nil, err
+	}
+	var ts []int64
+	for _, o := range objs {
+		s := strings.TrimSuffix(strings.TrimPrefix(o.Name, entry+"."), ".json")
+		// entry.sub.<unix>.json belongs to another entry
+		if t, err := strconv.ParseInt(s, 10, 64); err == nil && o.Name == snapshotName(entry, t) {
+			ts = append(ts, t)
+		}
+	}
+	sort.Slice(ts, func(i, j int) bool { return ts[i] < ts[j] })
+	return ts, nil
+}
+
+func (rp *repo) readSnapshot(name string) (*repoSnapshot, error) {
+	rc, err := rp.snapshots.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	s := &repoSnapshot{}
+	if err := json.NewDecoder(rc).Decode(s); err != nil {
+		return nil, fmt.Errorf("snapshot is corrupt. snapshot=%s err=%s", rp.snapshots.Location(name), err)
+	}
+	return s, nil
+}
+
+func (rp *repo) writeSnapshot(s *repoSnapshot) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return rp.snapshots.Put(snapshotName(s.Entry, s.Time), bytes.NewReader(data))
+}
+
+// forget deletes the snapshots of ent beyond keep, returning their names.
+// Their chunks stay until repo prune collects them.
+func (rp *repo) forget(ent *Entry, keep int, dryRun bool) ([]string, error) {
+	ts, err := rp.snapshotTimes(ent.Name)
+	if err != nil || keep <= 0 || len(ts) <= keep {
+		return nil, err
+	}
+	var names []string
+	for _, t := range ts[:len(ts)-keep] {
+		names = append(names, snapshotName(ent.Name, t))
+	}
+	if dryRun {
+		return names, nil
+	}
+	return names, rp.snapshots.Delete(names...)
+}
+
+// splitChunks cuts r into content-defined chunks, passing each to fn.
+// The chunk is reused after fn returns.
+func splitChunks(r io.Reader, fn func([]byte) error) error {
+	br := bufio.NewReaderSize(r, 1<<20)
+	chunk := make([]byte, 0, _ChunkMax)
+	var h uint64
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		chunk = append(chunk, c)
+		h = h<<1 + gear[c]
+		if len(chunk) >= _ChunkMax || len(chunk) >= _ChunkMin && h&_ChunkMask == 0 {
+			if err := fn(chunk); err != nil {
+				return err
+			}
+			chunk, h = chunk[:0], 0
+		}
+	}
+	if len(chunk) == 0 {
+		return nil
+	}
+	return fn(chunk)
+}
+
+// snapshot backs ent up into the repository of its destination: the
+// chunks of its files not stored yet, then a snapshot naming them. The
+// same walk as archives is taken, with Exclude and the special file
+// policy applied by opts.
+func (config *Config) snapshot(ctx context.Context, r *result, ent *Entry, roots []string, opts *archiver.Options) error {
+	rp, err := config.openRepo(ent)
+	if err != nil {
+		return &DestinationWriteError{config.entryDst(ent), err}
+	}
+	host, _ := os.Hostname()
+	s := &repoSnapshot{Entry: ent.Name, Time: config.now().Unix(), RunID: config.runID, Host: host, Files: []repoFile{}}
+	// counted by -progress on top of the throttle
+	read := opts.Read
+	var stored int64
+	err = archiver.List(roots, opts, func(path, name string, fi os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f := repoFile{Name: name, Mode: fi.Mode(), MTime: fi.ModTime().Unix()}
+		f.UID, f.GID = fileOwner(fi)
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			if f.Link, err = os.Readlink(path); err != nil {
+				return &SourceReadError{path, err}
+			}
+		case fi.Mode().IsRegular():
+			src, err := os.Open(path)
+			if os.IsNotExist(err) && opts.Changed != nil {
+				return opts.Changed(&archiver.ChangeError{Path: path, Vanished: true, Err: err})
+			}
+			if err != nil {
+				return &SourceReadError{path, err}
+			}
+			defer src.Close()
+			err = splitChunks(src, func(chunk []byte) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if read != nil {
+					read(len(chunk))
+				}
+				id, n, err := rp.put(chunk)
+				if err != nil {
+					return putError(rp.b, rp.b.Location("chunks"), err)
+				}
+				f.Chunks = append(f.Chunks, id)
+				f.Size += int64(len(chunk))
+				stored += n
+				r.progress.wrote(n)
+				return nil
+			})
+			switch err.(type) {
+			case nil:
+			case *DestinationWriteError:
+				return err
+			default:
+				if ctx.Err() != nil {
+					return err
+				}
+				return &SourceReadError{path, err}
+			}
+		}
+		s.Files = append(s.Files, f)
+		if opts.Archived != nil {
+			opts.Archived(name, fi)
+		}
+		return nil
+	})
+	switch e := err.(type) {
+	case nil:
+	case *archiver.SourceError:
+		return &SourceReadError{e.Path, e.Err}
+	default:
+		// stored chunks are kept, the next run or repo prune deals
+		// with them
+		return err
+	}
+	if err := rp.writeSnapshot(s); err != nil {
+		return putError(rp.snapshots, rp.snapshots.Location(snapshotName(s.Entry, s.Time)), err)
+	}
+	r.archive = rp.snapshots.Location(snapshotName(s.Entry, s.Time))
+	r.size = stored
+	forgot, err := rp.forget(ent, config.keepGen(ent), false)
+	if err != nil {
+		return &RetentionError{rp.snapshots.Location(""), err}
+	}
+	r.pruned = len(forgot)
+	return nil
+}
+
+// repoCommand runs the repo subcommands on repository entries. Backup
+// runs take their snapshots.
+func repoCommand(args []string) error {
+	const usage = "usage: tarbu repo snapshots|restore|prune [flags]"
+	if len(args) < 1 {
+		return fmt.Errorf(usage)
+	}
+	switch args[0] {
+	case "snapshots":
+		return repoSnapshotsCommand(args[1:])
+	case "restore":
+		return repoRestoreCommand(args[1:])
+	case "prune":
+		return repoPruneCommand(args[1:])
+	}
+	return fmt.Errorf(usage)
+}
+
+// repoEntry returns the repository entry name of config.
+func repoEntry(config *Config, name string) (*Entry, error) {
+	ent := config.findEntry(name)
+	if ent == nil {
+		return nil, fmt.Errorf("entry not found. name=%s", name)
+	}
+	if !ent.Repository {
+		return nil, fmt.Errorf("entry isn't a repository entry. name=%s", name)
+	}
+	return ent, nil
+}
+
+// snapshotRecord is a snapshot as printed by repo snapshots.
+type snapshotRecord struct {
+	Entry string
+	Time  int64
+	RunID string `json:",omitempty"`
+	Files int
+	Size  int64
+}
+
+func repoSnapshotsCommand(args []string) error {
+	fs := flag.NewFlagSet("repo snapshots", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu repo snapshots [-config path] [-json] <entry>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("entry is required")
+	}
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	ent, err := repoEntry(config, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	rp, err := config.openRepo(ent)
+	if err != nil {
+		return err
+	}
+	ts, err := rp.snapshotTimes(ent.Name)
+	if err != nil {
+		return err
+	}
+	records := []snapshotRecord{}
+	for _, t := range ts {
+		s, err := rp.readSnapshot(snapshotName(ent.Name, t))
+		if err != nil {
+			return err
+		}
+		rec := snapshotRecord{Entry: s.Entry, Time: s.Time, RunID: s.RunID, Files: len(s.Files)}
+		for _, f := range s.Files {
+			rec.Size += f.Size
+		}
+		records = append(records, rec)
+	}
+	if *asJSON {
+		return writeJSON(os.Stdout, records)
+	}
+	for _, rec := range records {
+		fmt.Printf("%d %s %8d files %10s %s\n", rec.Time, config.formatTime(time.Unix(rec.Time, 0)), rec.Files, formatSize(rec.Size), rec.RunID)
+	}
+	return nil
+}
+
+func repoRestoreCommand(args []string) error {
+	fs := flag.NewFlagSet("repo restore", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	ts := fs.String("ts", "latest", "unix timestamp of the snapshot to restore")
+	to := fs.String("to", "/", "directory to restore into")
+	yes := fs.Bool("yes", false, "overwrite existing files without asking")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu repo restore [-config path] [-ts unix] [-to dir] [-yes] <entry>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("entry is required")
+	}
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if config.isReadOnly() {
+		return fmt.Errorf("restore is refused in read-only mode")
+	}
+	ent, err := repoEntry(config, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	rp, err := config.openRepo(ent)
+	if err != nil {
+		return err
+	}
+	times, err := rp.snapshotTimes(ent.Name)
+	if err != nil {
+		return err
+	}
+	if len(times) == 0 {
+		return fmt.Errorf("no snapshot found. entry=%s", ent.Name)
+	}
+	t := times[len(times)-1]
+	if *ts != "latest" {
+		if t, err = strconv.ParseInt(*ts, 10, 64); err != nil {
+			return fmt.Errorf("invalid timestamp. ts=%s", *ts)
+		}
+	}
+	s, err := rp.readSnapshot(snapshotName(ent.Name, t))
+	if storage.IsNotExist(err) {
+		return fmt.Errorf("snapshot not found. entry=%s ts=%s", ent.Name, *ts)
+	}
+	if err != nil {
+		return err
+	}
+
+	var overwritten []string
+	for _, f := range s.Files {
+		p, err := restorePath(*to, f.Name)
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(p); err == nil && !fi.IsDir() {
+			overwritten = append(overwritten, p)
+		}
+	}
+	if len(overwritten) > 0 {
+		if err := confirm("Restoring "+rp.snapshots.Location(snapshotName(ent.Name, t))+" into "+*to, overwritten, *yes); err != nil {
+			return err
+		}
+	}
+	if err := rp.restore(s, *to); err != nil {
+		return err
+	}
+	printSuccess("Restored snapshot: entry=%s ts=%d files=%d to=%s", ent.Name, t, len(s.Files), *to)
+	return nil
+}
+
+// restorePath is where member name goes under dir, refusing names that
+// would leave it.
+func restorePath(dir, name string) (string, error) {
+	for _, seg := range strings.Split(name, "/") {
+		if seg == ".." {
+			return "", fmt.Errorf("invalid member name in snapshot. name=%s", name)
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// restore writes the files of s under dir. Directories get their mtime
+// once their contents are written, and owners are restored when running
+// as root.
+func (rp *repo) restore(s *repoSnapshot, dir string) error {
+	root := os.Geteuid() == 0
+	var dirs []repoFile
+	for _, f := range s.Files {
+		p, err := restorePath(dir, f.Name)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		switch {
+		case f.Mode.IsDir():
+			if err := os.MkdirAll(p, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, f)
+			continue
+		case f.Mode&os.ModeSymlink != 0:
+			os.Remove(p)
+			if err := os.Symlink(f.Link, p); err != nil {
+				return err
+			}
+		case f.Mode.IsRegular():
+			if err := rp.restoreFile(f, p); err != nil {
+				return err
+			}
+		default:
+			// special files are never stored
+			continue
+		}
+		if root {
+			if err := os.Lchown(p, f.UID, f.GID); err != nil {
+				return err
+			}
+		}
+	}
+	// deepest first, so restoring a directory doesn't touch its parent
+	for i := len(dirs) - 1; i >= 0; i-- {
+		f := dirs[i]
+		p, _ := restorePath(dir, f.Name)
+		if root {
+			if err := os.Lchown(p, f.UID, f.GID); err != nil {
+				return err
+			}
+		}
+		if err := os.Chmod(p, f.Mode.Perm()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(p, time.Unix(f.MTime, 0), time.Unix(f.MTime, 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rp *repo) restoreFile(f repoFile, p string) error {
+	os.Remove(p)
+	out, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	for _, id := range f.Chunks {
+		data, err := rp.get(id)
+		if err == nil {
+			_, err = out.Write(data)
+		}
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(p, f.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(p, time.Unix(f.MTime, 0), time.Unix(f.MTime, 0))
+}
+
+func repoPruneCommand(args []string) error {
+	fs := flag.NewFlagSet("repo prune", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	dryRun := fs.Bool("dry-run", false, "print what would be deleted")
+	yes := fs.Bool("yes", false, "delete without asking")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu repo prune [-config path] [-dry-run] [-yes]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if config.isReadOnly() && !*dryRun {
+		return fmt.Errorf("prune is refused in read-only mode")
+	}
+	if !*dryRun {
+		lock, err := config.lockRun()
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	// entries sharing a destination share its repository
+	repos := map[string]*repo{}
+	var order []string
+	for _, ent := range config.Entries {
+		if !ent.Repository {
+			continue
+		}
+		dst := config.entryDst(ent)
+		if repos[dst] == nil {
+			rp, err := config.openRepo(ent)
+			if err != nil {
+				return err
+			}
+			repos[dst] = rp
+			order = append(order, dst)
+		}
+		names, err := repos[dst].forget(ent, config.keepGen(ent), *dryRun)
+		if err != nil {
+			return &RetentionError{dst, err}
+		}
+		for _, n := range names {
+			if *dryRun {
+				logs.event(levelInfo, "", "Would forget", "snapshot", repos[dst].snapshots.Location(n))
+			} else {
+				printSuccess("Forgot snapshot: entry=%s snapshot=%s", ent.Name, repos[dst].snapshots.Location(n))
+			}
+		}
+	}
+	if len(order) == 0 {
+		return fmt.Errorf("no repository entry in config")
+	}
+	for _, dst := range order {
+		if err := repos[dst].collect(*dryRun, *yes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// collect deletes the chunks no snapshot of the repository names, those
+// of forgotten snapshots and of runs that failed.
+func (rp *repo) collect(dryRun, yes bool) error {
+	objs, err := rp.snapshots.List("")
+	if err != nil {
+		return err
+	}
+	used := map[string]bool{}
+	for _, o := range objs {
+		if !strings.HasSuffix(o.Name, ".json") {
+			continue
+		}
+		s, err := rp.readSnapshot(o.Name)
+		if err != nil {
+			// guessing would delete chunks it still needs
+			return err
+		}
+		for _, f := range s.Files {
+			for _, id := range f.Chunks {
+				used[id] = true
+			}
+		}
+	}
+
+	type chunk struct {
+		dir  storage.Backend
+		name string
+	}
+	var unused []chunk
+	var locs []string
+	var size int64
+	for i := 0; i < 256; i++ {
+		dir := storage.Sub(storage.Sub(rp.b, "chunks"), fmt.Sprintf("%02x", i))
+		objs, err := dir.List("")
+		if err != nil {
+			return err
+		}
+		for _, o := range objs {
+			if !used[o.Name] {
+				unused = append(unused, chunk{dir, o.Name})
+				locs = append(locs, dir.Location(o.Name))
+				size += o.Size
+			}
+		}
+	}
+	if len(unused) == 0 {
+		printSuccess("Nothing to prune: repository=%s", rp.b.Location(""))
+		return nil
+	}
+	if dryRun {
+		logs.event(levelInfo, "", "Would delete unused chunks", "repository", rp.b.Location(""), "chunks", len(unused), "size", formatSize(size))
+		return nil
+	}
+	if err := confirm("Pruning "+rp.b.Location(""), locs, yes); err != nil {
+		return err
+	}
+	for _, c := range unused {
+		if err := c.dir.Delete(c.name); err != nil {
+			return &RetentionError{c.dir.Location(c.name), err}
+		}
+	}
+	printSuccess("Pruned repository: repository=%s chunks=%d size=%s", rp.b.Location(""), len(unused), formatSize(size))
+	return nil
+}
@@ -0,0 +1,163 @@
+package backup
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// entryReport summarizes the history of one entry.
+type entryReport struct {
+	Entry      string
+	Runs       int
+	Failures   int
+	FirstSize  int64
+	LastSize   int64
+	LastError  string
+	LastFailed time.Time
+	// LastRunID is the run of the last failure
+	LastRunID string
+}
+
+func (r *entryReport) SuccessRate() float64 {
+	if r.Runs == 0 {
+		return 0
+	}
+	return float64(r.Runs-r.Failures) / float64(r.Runs) * 100
+}
+
+func (r *entryReport) Growth() int64 {
+	return r.LastSize - r.FirstSize
+}
+
+// MarshalJSON adds SuccessRate and Growth to the fields.
+func (r *entryReport) MarshalJSON() ([]byte, error) {
+	type fields entryReport
+	return json.Marshal(struct {
+		*fields
+		SuccessRate float64
+		Growth      int64
+	}{(*fields)(r), r.SuccessRate(), r.Growth()})
+}
+
+type runReport struct {
+	Since   time.Time
+	Until   time.Time
+	Entries []*entryReport
+}
+
+func reportCommand(args []string) error {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	sinceFlag := fs.String("since", "30d", "report period, e.g. 30d or 12h")
+	format := fs.String("format", "text", "output format, text, html or json")
+	asJSON := fs.Bool("json", false, "print JSON, the same as -format json")
+	fs.Parse(args)
+	if *asJSON {
+		*format = "json"
+	}
+
+	since, err := parseDuration(*sinceFlag)
+	if err != nil {
+		return err
+	}
+	if *format != "text" && *format != "html" && *format != "json" {
+		return fmt.Errorf("unknown format. format=%s", *format)
+	}
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	records, err := config.readHistory(now.Add(-since))
+	if err != nil {
+		return err
+	}
+	rep := buildReport(records, now.Add(-since), now)
+
+	switch *format {
+	case "html":
+		return reportHTML.Execute(os.Stdout, rep)
+	case "json":
+		return writeJSON(os.Stdout, rep)
+	}
+	config.writeReportText(os.Stdout, rep)
+	return nil
+}
+
+func buildReport(records []historyRecord, since, until time.Time) *runReport {
+	byEntry := map[string]*entryReport{}
+	for _, rec := range records {
+		if rec.Skipped != "" {
+			continue
+		}
+		er, ok := byEntry[rec.Entry]
+		if !ok {
+			er = &entryReport{Entry: rec.Entry}
+			byEntry[rec.Entry] = er
+		}
+		er.Runs++
+		if rec.Error != "" {
+			er.Failures++
+			er.LastError = rec.Error
+			er.LastFailed = rec.Start
+			er.LastRunID = rec.RunID
+			continue
+		}
+		if er.Runs-er.Failures == 1 {
+			er.FirstSize = rec.Size
+		}
+		er.LastSize = rec.Size
+	}
+
+	rep := &runReport{Since: since, Until: until, Entries: []*entryReport{}}
+	for _, er := range byEntry {
+		rep.Entries = append(rep.Entries, er)
+	}
+	sort.Slice(rep.Entries, func(i, j int) bool { return rep.Entries[i].Entry < rep.Entries[j].Entry })
+	return rep
+}
+
+func (config *Config) writeReportText(w io.Writer, rep *runReport) {
+	fmt.Fprintf(w, "tarbu report %s - %s\n\n", config.formatTime(rep.Since), config.formatTime(rep.Until))
+	if len(rep.Entries) == 0 {
+		fmt.Fprintln(w, "No runs recorded in this period.")
+		return
+	}
+	fmt.Fprintf(w, "%-24s %6s %8s %9s %9s %10s\n", "ENTRY", "RUNS", "FAILED", "SUCCESS", "SIZE", "GROWTH")
+	for _, er := range rep.Entries {
+		growth := formatSize(er.Growth())
+		if er.Growth() >= 0 {
+			growth = "+" + growth
+		}
+		fmt.Fprintf(w, "%-24s %6d %8d %8.1f%% %9s %10s\n", er.Entry, er.Runs, er.Failures, er.SuccessRate(), formatSize(er.LastSize), growth)
+	}
+	for _, er := range rep.Entries {
+		if er.Failures > 0 {
+			fmt.Fprintf(w, "\nLast failure of %s at %s:\n  %s\n", er.Entry, config.formatTime(er.LastFailed), er.LastError)
+			if er.LastRunID != "" {
+				fmt.Fprintf(w, "  run=%s\n", er.LastRunID)
+			}
+		}
+	}
+}
+
+var reportHTML = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>tarbu report</title></head>
+<body>
+<h1>tarbu report</h1>
+<p>{{.Since.Format "2006-01-02 15:04"}} - {{.Until.Format "2006-01-02 15:04"}}</p>
+{{if .Entries}}<table border="1" cellpadding="4">
+<tr><th>Entry</th><th>Runs</th><th>Failed</th><th>Success</th><th>Size</th><th>Growth</th><th>Last error</th></tr>
+{{range .Entries}}<tr><td>{{.Entry}}</td><td>{{.Runs}}</td><td>{{.Failures}}</td><td>{{printf "%.1f" .SuccessRate}}%</td><td>{{.LastSize}}</td><td>{{.Growth}}</td><td>{{.LastError}}{{if .LastRunID}} (run {{.LastRunID}}){{end}}</td></tr>
+{{end}}</table>{{else}}<p>No runs recorded in this period.</p>{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,331 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+func restoreCommand(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	ts := fs.String("ts", "latest", "unix timestamp of the generation to restore, ts-seq for a later one of the same second")
+	to := fs.String("to", "", "directory to extract into")
+	relabel := fs.String("relabel", "", "SELinux relabeling after extraction: restorecon or recorded")
+	noVerify := fs.Bool("no-verify", false, "extract without reading the archive through first")
+	inPlace := fs.Bool("in-place", false, "restore to the original paths, replacing the live files, the same as -to /")
+	yes := fs.Bool("yes", false, "overwrite existing files without asking")
+	includes := &memberFilter{}
+	fs.Var(includes, "include", "restore only this file or directory, as archived, e.g. etc/ssh, may be repeated. The archive is read only as far as needed and not verified first")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu restore (-to dir | -in-place) [flags] <entry>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("entry is required")
+	}
+	switch *relabel {
+	case "", "restorecon", "recorded":
+	default:
+		return fmt.Errorf("unknown relabel mode. relabel=%s", *relabel)
+	}
+	// the live tree is replaced only when asked for
+	switch {
+	case *inPlace && *to != "":
+		return fmt.Errorf("-in-place and -to are exclusive")
+	case *inPlace:
+		*to = "/"
+	case *to == "":
+		fs.Usage()
+		return fmt.Errorf("-to or -in-place is required")
+	}
+
+	var include *memberFilter
+	if len(includes.paths) > 0 {
+		include = includes
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if config.isReadOnly() {
+		return fmt.Errorf("restore is refused in read-only mode")
+	}
+	ent := config.findEntry(fs.Arg(0))
+	if ent == nil {
+		return fmt.Errorf("entry not found. name=%s", fs.Arg(0))
+	}
+	b, err := config.entryBackend(ent)
+	if err != nil {
+		return err
+	}
+	name, err := findGeneration(b, ent, *ts)
+	if err != nil {
+		return err
+	}
+	archive := b.Location(name)
+
+	opts := ent.restoreOpts(*relabel == "recorded")
+	if include != nil && len(opts) > 0 {
+		printWarning("Extended attributes aren't restored with -include: dropped=%s", strings.Join(opts, ","))
+	}
+	if err := config.restoreConfirmed(b, ent, name, *to, opts, !*noVerify && include == nil, include, *yes); err != nil {
+		return err
+	}
+	if include != nil {
+		if include.extracted == 0 {
+			return fmt.Errorf("no member matches -include. archive=%s include=%s", archive, include)
+		}
+		fmt.Printf("Restored %d members of %s into %s\n", include.extracted, archive, *to)
+	} else {
+		fmt.Printf("Restored %s into %s\n", archive, *to)
+	}
+
+	if *relabel == "restorecon" {
+		roots, err := ent.sources()
+		if err != nil {
+			return err
+		}
+		for _, root := range roots {
+			target := filepath.Join(*to, strings.TrimPrefix(root, "/"))
+			stderr := &bytes.Buffer{}
+			cmd := exec.Command("restorecon", "-R", target)
+			cmd.Stderr = stderr
+			if err := cmd.Run(); err != nil {
+				return fmt.Errorf("restorecon failed. path=%s err=%s", target, commandError(err, stderr))
+			}
+			fmt.Printf("Relabeled %s\n", target)
+		}
+	}
+	return nil
+}
+
+// restoreOpts are the tar options restoring the attributes ent records,
+// the SELinux labels with recorded.
+func (ent *Entry) restoreOpts(recorded bool) []string {
+	switch {
+	case ent.PreserveExtended:
+		return _ExtendedAttrOpts
+	case ent.SecurityAttrs || recorded:
+		return _SecurityAttrOpts
+	}
+	return nil
+}
+
+// restoreGeneration extracts name of ent into to, an incremental archive
+// after the full backup it is based on. With verify, a corrupt archive
+// fails before anything is extracted. A non-nil include restores only
+// the members it selects.
+func (config *Config) restoreGeneration(b storage.Backend, ent *Entry, name, to string, opts []string, verify bool, include *memberFilter) error {
+	if verify {
+		if err := config.verifyArchive(b, ent, name); err != nil {
+			return err
+		}
+	}
+	m, err := readManifest(b, ent, archiveKey(ent, name))
+	switch {
+	case err == nil && m.Base != 0:
+		err = config.restoreIncremental(b, ent, m, to, opts, verify, include)
+	case err == nil || storage.IsNotExist(err):
+		err = config.extractArchive(b, ent, name, to, opts, include)
+	}
+	return err
+}
+
+// restoreConfirmed is restoreGeneration confirming first when existing
+// files are replaced, unless yes.
+func (config *Config) restoreConfirmed(b storage.Backend, ent *Entry, name, to string, opts []string, verify bool, include *memberFilter, yes bool) error {
+	overwritten, verified, err := config.overwritten(b, ent, name, to, verify, include)
+	if err != nil {
+		return err
+	}
+	if len(overwritten) > 0 {
+		if err := confirm("Restoring "+b.Location(name)+" into "+to, overwritten, yes); err != nil {
+			return err
+		}
+	}
+	return config.restoreGeneration(b, ent, name, to, opts, verify && !verified, include)
+}
+
+// overwritten returns the existing files a restore of name into to
+// replaces, without reading the archive just for that: the manifest
+// lists them, or the verify pass, which it reports as run. Otherwise
+// they are the paths included or the roots of ent.
+func (config *Config) overwritten(b storage.Backend, ent *Entry, name, to string, verify bool, include *memberFilter) ([]string, bool, error) {
+	var names []string
+	verified := false
+	m, err := readManifest(b, ent, archiveKey(ent, name))
+	switch {
+	case include != nil:
+		names = include.paths
+	case err == nil:
+		for _, f := range m.Files {
+			names = append(names, f.Name)
+		}
+	case !storage.IsNotExist(err):
+		return nil, false, err
+	case verify:
+		if names, err = config.verifyMembers(b, ent, name); err != nil {
+			return nil, false, err
+		}
+		verified = true
+	default:
+		roots, err := ent.sources()
+		if err != nil {
+			return nil, false, err
+		}
+		for _, r := range roots {
+			names = append(names, memberPath(r))
+		}
+	}
+	sort.Strings(names)
+	var paths []string
+	for i, n := range names {
+		// appended archives repeat names
+		if i > 0 && n == names[i-1] {
+			continue
+		}
+		p := filepath.Join(to, filepath.FromSlash(n))
+		if _, err := os.Lstat(p); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths, verified, nil
+}
+
+func (config *Config) findEntry(name string) *Entry {
+	for _, e := range config.Entries {
+		if e.Name == name {
+			return e
+		}
+	}
+	return nil
+}
+
+// findGeneration returns the archive name of ent created at ts, which
+// is a unix timestamp or "latest".
+func findGeneration(b storage.Backend, ent *Entry, ts string) (string, error) {
+	gens, err := generations(b, ent)
+	if err != nil {
+		return "", err
+	}
+	if len(gens) == 0 {
+		return "", fmt.Errorf("no generation found. entry=%s dst=%s", ent.Name, b.Location(""))
+	}
+	if ts == "latest" {
+		return gens[len(gens)-1].Name, nil
+	}
+	want, ok := parseGenKey(ts)
+	if !ok {
+		return "", fmt.Errorf("timestamp must be unix seconds, unix seconds-seq or latest. ts=%s", ts)
+	}
+	return generationAt(b, ent, want)
+}
+
+func (config *Config) verifyArchive(b storage.Backend, ent *Entry, name string) error {
+	_, err := config.scanVerified(b, ent, name, false)
+	return err
+}
+
+// verifyMembers verifies name and returns the names of the members that
+// aren't directories.
+func (config *Config) verifyMembers(b storage.Backend, ent *Entry, name string) ([]string, error) {
+	return config.scanVerified(b, ent, name, true)
+}
+
+func (config *Config) scanVerified(b storage.Backend, ent *Entry, name string, list bool) ([]string, error) {
+	r, err := config.openArchive(b, ent, name)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	var fn func(*tar.Header, io.Reader) error
+	if list {
+		fn = func(hdr *tar.Header, _ io.Reader) error {
+			if hdr.Typeflag != tar.TypeDir {
+				names = append(names, hdr.Name)
+			}
+			return nil
+		}
+	}
+	_, err = scanArchive(bufio.NewReader(r), fn)
+	// a failed decryption explains the broken stream
+	if cerr := r.Close(); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s. archive=%s", err, b.Location(name))
+	}
+	return names, nil
+}
+
+// extractArchive streams name of ent from b into tar, or only the
+// members include selects when it isn't nil.
+func (config *Config) extractArchive(b storage.Backend, ent *Entry, name, to string, opts []string, include *memberFilter) error {
+	if err := os.MkdirAll(to, 0755); err != nil {
+		return err
+	}
+	r, err := config.openArchive(b, ent, name)
+	if err != nil {
+		return err
+	}
+	tr, err := decompress(r)
+	if err != nil {
+		if cerr := r.Close(); cerr != nil {
+			return cerr
+		}
+		return fmt.Errorf("%s. archive=%s", err, b.Location(name))
+	}
+	stopped := false
+	// the tar of Windows drops modes and links of unix archives
+	if _, lerr := exec.LookPath("tar"); lerr != nil || include != nil || runtime.GOOS == "windows" {
+		if lerr != nil {
+			// a missing tar shouldn't leave the backups unrestorable
+			tarMissing.Do(func() {
+				printWarning("tar not found, extracting without it: dropped=%s", strings.Join(append(opts[:len(opts):len(opts)], "special files"), ","))
+			})
+		}
+		// appended archives repeat paths further on
+		stopped, err = extractNative(tr, to, include, !ent.Append)
+	} else {
+		args := append(opts, "-xf", "-", "-C", to)
+		stderr := &bytes.Buffer{}
+		cmd := exec.Command("tar", args...)
+		cmd.Stdin = tr
+		cmd.Stderr = stderr
+		if err = cmd.Run(); err != nil {
+			err = commandError(err, stderr)
+		}
+	}
+	terr := tr.Close()
+	cerr := r.Close()
+	if stopped {
+		// tools reading the rest of the archive were cut off
+		terr, cerr = nil, nil
+	}
+	if cerr != nil {
+		return cerr
+	}
+	if terr != nil {
+		return terr
+	}
+	if err != nil {
+		return fmt.Errorf("extract failed. archive=%s err=%s", b.Location(name), err)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+type hookGeneration struct {
+	Path string
+	Time time.Time
+}
+
+type hookInput struct {
+	Entry       string
+	KeepGen     int
+	Generations []hookGeneration
+}
+
+// _FutureSkew is how far ahead of now archive dates may be before they
+// are taken for clock mishaps.
+const _FutureSkew = 5 * time.Minute
+
+// expired returns the generations of ent to delete. gens is sorted
+// oldest first as returned by generations.
+func (config *Config) expired(ent *Entry, gens []string) ([]string, error) {
+	if !ent.numbered() {
+		gens = config.orderFuture(ent, gens)
+	}
+	if ent.hasRetentionPolicy() {
+		return config.expiredByPolicy(ent, gens), nil
+	}
+	// an entry's own KeepGen overrides hooks and expressions too
+	if len(config.RetentionHook) > 0 && ent.KeepGen == 0 {
+		return config.expiredByHook(ent, gens)
+	}
+	if config.retentionExpr != nil && ent.KeepGen == 0 {
+		return config.expiredByExpr(ent, gens)
+	}
+
+	keep := config.keepGen(ent)
+	if len(gens) <= keep {
+		return nil, nil
+	}
+	return gens[:len(gens)-keep], nil
+}
+
+// orderFuture warns about the generations dated in the future and
+// reorders gens for config.FutureArchives.
+func (config *Config) orderFuture(ent *Entry, gens []string) []string {
+	limit := config.now().Add(_FutureSkew)
+	var past, future []string
+	for i, g := range gens {
+		ts := time.Unix(archiveTime(ent, gens[i]), 0)
+		if ts.After(limit) {
+			printWarning("Archive dated in the future, check the clock: entry=%s archive=%s time=%s", ent.Name, g, config.formatTime(ts))
+			future = append(future, g)
+		} else {
+			past = append(past, g)
+		}
+	}
+	switch {
+	case len(future) == 0 || config.FutureArchives == "newest":
+		return gens
+	case config.FutureArchives == "oldest":
+		return append(future, past...)
+	}
+	return past
+}
+
+// keepGen is the number of generations the KeepGen of ent, or else of
+// the config, keeps, the archive just written included. gens passed to
+// expired always contain it.
+func (config *Config) keepGen(ent *Entry) int {
+	n := config.KeepGen
+	if ent.KeepGen > 0 {
+		n = ent.KeepGen
+	}
+	if config.KeepGenIncludesCurrent != nil && !*config.KeepGenIncludesCurrent {
+		return n + 1
+	}
+	return n
+}
+
+// sidecars are the files next to the archive name of ent that go with
+// it. They may not exist.
+func sidecars(ent *Entry, name string) []string {
+	// the manifest stays behind after Incremental is turned off
+	return []string{checksumName(name), metaName(name), manifestName(ent, archiveKey(ent, name))}
+}
+
+// prune deletes the expired generations of ent from b and returns how
+// many it deleted.
+func (config *Config) prune(b storage.Backend, ent *Entry) (int, error) {
+	expired, err := config.planPrune(b, ent)
+	if err != nil {
+		return 0, err
+	}
+	var del []string
+	for _, n := range expired {
+		del = append(append(del, n), sidecars(ent, n)...)
+	}
+	if err := config.discard(b, del...); err != nil {
+		return 0, &RetentionError{config.entryDst(ent), err}
+	}
+	return len(expired), nil
+}
+
+// planPrune returns the names of the expired archives of ent. pending
+// names archives not written yet, which count as the newest
+// generations.
+func (config *Config) planPrune(b storage.Backend, ent *Entry, pending ...string) ([]string, error) {
+	objs, err := generations(b, ent)
+	if err != nil {
+		return nil, &RetentionError{config.entryDst(ent), err}
+	}
+	for _, p := range pending {
+		objs = append(objs, storage.Object{Name: p})
+	}
+	// policies see locations, so hooks get usable paths or URLs
+	gens := make([]string, len(objs))
+	names := map[string]string{}
+	for i, o := range objs {
+		gens[i] = b.Location(o.Name)
+		names[gens[i]] = o.Name
+	}
+	expired, err := config.expired(ent, gens)
+	if err != nil {
+		return nil, &RetentionError{config.entryDst(ent), err}
+	}
+	if ent.Incremental {
+		if expired, err = keepBases(b, ent, gens, expired); err != nil {
+			return nil, &RetentionError{config.entryDst(ent), err}
+		}
+	}
+	del := make([]string, len(expired))
+	for i, g := range expired {
+		del[i] = names[g]
+	}
+	return del, nil
+}
+
+// expiredByHook runs config.RetentionHook with the generations as JSON on
+// stdin. The hook prints a JSON array of the paths to keep, every
+// other generation is deleted. Any hook failure keeps everything.
+func (config *Config) expiredByHook(ent *Entry, gens []string) ([]string, error) {
+	in := hookInput{Entry: ent.Name, KeepGen: config.keepGen(ent), Generations: []hookGeneration{}}
+	for i := range gens {
+		ts := archiveTime(ent, gens[i])
+		in.Generations = append(in.Generations, hookGeneration{gens[i], time.Unix(ts, 0)})
+	}
+	data, err := json.Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(config.RetentionHook[0], config.RetentionHook[1:]...)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("retention hook failed. err=%s", commandError(err, stderr))
+	}
+
+	var keep []string
+	if err := json.Unmarshal(out, &keep); err != nil {
+		return nil, fmt.Errorf("retention hook output is not a JSON array of paths. err=%s", err)
+	}
+	kept := map[string]struct{}{}
+	for _, k := range keep {
+		kept[k] = struct{}{}
+	}
+
+	var expired []string
+	for _, g := range gens {
+		if _, ok := kept[g]; !ok {
+			expired = append(expired, g)
+		}
+	}
+	return expired, nil
+}
+
+// expiredByExpr deletes the generations for which config.RetentionExpr
+// is false. An evaluation error keeps everything.
+func (config *Config) expiredByExpr(ent *Entry, gens []string) ([]string, error) {
+	now := config.now()
+	var expired []string
+	for i := range gens {
+		ts := time.Unix(archiveTime(ent, gens[i]), 0)
+		keep, err := config.retentionExpr.keep(ts, now, len(gens)-1-i)
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			expired = append(expired, gens[i])
+		}
+	}
+	return expired, nil
+}
+
+func (ent *Entry) hasRetentionPolicy() bool {
+	return ent.KeepDaily > 0 || ent.KeepWeekly > 0 || ent.KeepMonthly > 0 || ent.maxAge > 0
+}
+
+// expiredByPolicy applies the KeepDaily, KeepWeekly, KeepMonthly and
+// MaxAge rules of ent. Days, weeks and months are those of the clock's
+// time zone.
+func (config *Config) expiredByPolicy(ent *Entry, gens []string) []string {
+	now := config.now()
+	times := make([]time.Time, len(gens))
+	for i := range gens {
+		times[i] = time.Unix(archiveTime(ent, gens[i]), 0).In(now.Location())
+	}
+
+	keep := make([]bool, len(gens))
+	for i := len(gens) - 1; i >= 0 && i >= len(gens)-config.keepGen(ent); i-- {
+		keep[i] = true
+	}
+	// keep the newest generation of each of the last n periods
+	periods := func(n int, period func(time.Time) string) {
+		seen := map[string]bool{}
+		for i := len(gens) - 1; i >= 0 && len(seen) < n; i-- {
+			if p := period(times[i]); !seen[p] {
+				seen[p] = true
+				keep[i] = true
+			}
+		}
+	}
+	periods(ent.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") })
+	periods(ent.KeepWeekly, func(t time.Time) string {
+		y, w := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", y, w)
+	})
+	periods(ent.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") })
+
+	var expired []string
+	for i := range gens {
+		if i == len(gens)-1 {
+			break
+		}
+		if !keep[i] || (ent.maxAge > 0 && now.Sub(times[i]) > ent.maxAge) {
+			expired = append(expired, gens[i])
+		}
+	}
+	return expired
+}
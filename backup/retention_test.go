@@ -0,0 +1,563 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+func memoryBackend(names ...string) *storage.Memory {
+	m := storage.NewMemory()
+	for _, n := range names {
+		m.Objects[n] = nil
+	}
+	return m
+}
+
+// remaining returns the sorted names left in m.
+func remaining(m *storage.Memory) []string {
+	var names []string
+	for n := range m.Objects {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRotate(t *testing.T) {
+	m := memoryBackend("www.tar.gz.0", "www.tar.gz.1", "www.tar.gz.2", "www.tar.gz.10", "www.tar.gz.9", "other.tar.gz.1")
+	m.Objects["www.tar.gz.1.sha256"] = []byte("00ff  www.tar.gz.1\n")
+	config := &Config{KeepGen: 3}
+	pruned, err := config.rotate(m, &Entry{Name: "www", Naming: "numbered"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pruned != 2 {
+		t.Fatalf("pruned %d, want 2", pruned)
+	}
+	want := []string{"other.tar.gz.1", "www.tar.gz.1", "www.tar.gz.2", "www.tar.gz.2.sha256", "www.tar.gz.3"}
+	if got := remaining(m); !reflect.DeepEqual(got, want) {
+		t.Fatalf("remaining %v, want %v", got, want)
+	}
+	if got := string(m.Objects["www.tar.gz.2.sha256"]); got != "00ff  www.tar.gz.2\n" {
+		t.Fatalf("checksum %q", got)
+	}
+}
+
+func TestPruneKeepGen(t *testing.T) {
+	m := memoryBackend(
+		"www.tar.gz.9",
+		"www.tar.gz.10",
+		"www.tar.gz.200",
+		"www.tar.gz.1000",
+		".tarbu-history.jsonl",
+		"www-old.tar.gz.1",
+		"other.tar.gz.5",
+		"www.tar.gz.3",
+		"www[1].tar.gz.7",
+		"www[1].tar.gz.8",
+	)
+
+	config := &Config{KeepGen: 2}
+	if _, err := config.prune(m, &Entry{Name: "www"}); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		".tarbu-history.jsonl", "other.tar.gz.5", "www-old.tar.gz.1",
+		"www.tar.gz.1000", "www.tar.gz.200", "www[1].tar.gz.7", "www[1].tar.gz.8",
+	}
+	if got := remaining(m); !reflect.DeepEqual(got, want) {
+		t.Fatalf("remaining %v, want %v", got, want)
+	}
+
+	// glob metacharacters in names match literally
+	config.KeepGen = 1
+	if _, err := config.prune(m, &Entry{Name: "www[1]"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Objects["www[1].tar.gz.7"]; ok {
+		t.Fatal("www[1].tar.gz.7 is not removed")
+	}
+	if _, ok := m.Objects["www[1].tar.gz.8"]; !ok {
+		t.Fatal("www[1].tar.gz.8 is removed")
+	}
+
+	// the archive just written doesn't count
+	m = memoryBackend("www.tar.gz.1", "www.tar.gz.2", "www.tar.gz.3")
+	excluded := false
+	config.KeepGenIncludesCurrent = &excluded
+	if _, err := config.prune(m, &Entry{Name: "www"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := remaining(m), []string{"www.tar.gz.2", "www.tar.gz.3"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("remaining %v, want %v", got, want)
+	}
+}
+
+func TestSidecars(t *testing.T) {
+	ent := &Entry{Name: "www"}
+	key := func(ts int64) string { return manifestName(ent, genKey{ts, 0}) }
+	m := memoryBackend(
+		"www.tar.gz.100", "www.tar.gz.100.sha256", "www.tar.gz.100.meta.json", key(100),
+		"www.tar.gz.200", "www.tar.gz.200.sha256", "www.tar.gz.200.meta.json", key(200),
+		"www2.tar.gz.100.sha256",
+	)
+	// expired generations take their sidecars along
+	if _, err := (&Config{KeepGen: 1}).prune(m, ent); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{key(200), "www.tar.gz.200", "www.tar.gz.200.meta.json", "www.tar.gz.200.sha256", "www2.tar.gz.100.sha256"}
+	if got := remaining(m); !reflect.DeepEqual(got, want) {
+		t.Fatalf("remaining %v, want %v", got, want)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		objects []string
+		want    []string
+	}{
+		{"none", []string{"www.tar.gz.100", "www.tar.gz.100.sha256", "www.tar.gz.100.meta.json", key(100)}, nil},
+		{"archive gone", []string{"www.tar.gz.100.sha256", "www.tar.gz.100.meta.json", key(100), "www.tar.gz.200"},
+			[]string{key(100), "www.tar.gz.100.meta.json", "www.tar.gz.100.sha256"}},
+		{"other entries", []string{"www2.tar.gz.100.sha256", "www-old.tar.gz.1.meta.json"}, nil},
+		{"not a sidecar", []string{"www.tar.gz.100.bak", "www.notes.sha256"}, nil},
+	} {
+		got, err := orphanedSidecars(memoryBackend(tc.objects...), ent)
+		sort.Strings(got)
+		if err != nil || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: orphans %q, err=%v, want %q", tc.name, got, err, tc.want)
+		}
+	}
+}
+
+func TestPruneRetentionExprFixedClock(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	day := int64(24 * 60 * 60)
+	m := storage.NewMemory()
+	// one generation a day for 20 days, at noon
+	for i := int64(0); i < 20; i++ {
+		m.Objects[fmt.Sprintf("www.tar.gz.%d", now.Unix()-i*day)] = nil
+	}
+
+	expr, err := compileRetentionExpr(`age < 7d || weekday == "Sun"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{retentionExpr: expr, clock: fixedClock(now)}
+	if _, err := config.prune(m, &Entry{Name: "www"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2024-03-10 is a Sunday: the last 7 days and the Sundays 7 and 14
+	// days ago are kept
+	var want []string
+	for i := int64(0); i < 20; i++ {
+		if i < 7 || i == 7 || i == 14 {
+			want = append(want, fmt.Sprintf("www.tar.gz.%d", now.Unix()-i*day))
+		}
+	}
+	sort.Strings(want)
+	if got := remaining(m); !reflect.DeepEqual(got, want) {
+		t.Fatalf("remaining %v, want %v", got, want)
+	}
+}
+
+func TestRetentionHook(t *testing.T) {
+	gens := []string{"www.tar.gz.1700000000", "www.tar.gz.1700000100", "www.tar.gz.1700000200"}
+	loc := func(i int) string { return "memory://" + gens[i] }
+	for _, tc := range []struct {
+		name    string
+		script  string
+		keepGen int
+		want    []string
+		wantErr string
+	}{
+		{"keeps listed", fmt.Sprintf(`echo '[%q, %q]'`, loc(0), loc(2)), 0, []string{gens[0], gens[2]}, ""},
+		{"keeps nothing", `echo '[]'`, 0, nil, ""},
+		{"unknown paths ignored", fmt.Sprintf(`echo '["memory://other", %q]'`, loc(1)), 0, []string{gens[1]}, ""},
+		{"fails", `echo broken policy >&2; exit 3`, 0, gens, "retention hook failed. err=exit status 3: broken policy"},
+		{"not JSON", `echo keep all`, 0, gens, "not a JSON array of paths"},
+		{"not paths", `echo '{"keep": 1}'`, 0, gens, "not a JSON array of paths"},
+		{"entry KeepGen wins", `exit 1`, 1, gens[2:], ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			in := filepath.Join(dir, "in.json")
+			m := memoryBackend(gens...)
+			config := &Config{KeepGen: 2, RetentionHook: []string{"sh", "-c", "cat > " + in + "; " + tc.script}}
+			ent := &Entry{Name: "www", KeepGen: tc.keepGen}
+			_, err := config.prune(m, ent)
+			var re *RetentionError
+			if tc.wantErr != "" && (!errors.As(err, &re) || !strings.Contains(err.Error(), tc.wantErr)) || tc.wantErr == "" && err != nil {
+				t.Fatalf("prune returned %v, want %q", err, tc.wantErr)
+			}
+			if got := remaining(m); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("remaining %v, want %v", got, tc.want)
+			}
+			if tc.keepGen > 0 {
+				return
+			}
+			data, err := os.ReadFile(in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got hookInput
+			if err := json.Unmarshal(data, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Entry != "www" || got.KeepGen != 2 || len(got.Generations) != 3 || got.Generations[0].Path != loc(0) || got.Generations[2].Time.Unix() != 1700000200 {
+				t.Errorf("hook got %+v", got)
+			}
+		})
+	}
+
+	config := &Config{RetentionHook: []string{"keep"}, RetentionExpr: "age < 7d"}
+	if err := config.isRetentionValid(); err == nil {
+		t.Error("RetentionHook with RetentionExpr is accepted")
+	}
+	config = &Config{RetentionHook: []string{"keep"}, Entries: []*Entry{{Name: "www", Naming: "numbered"}}}
+	if err := config.isNamingValid(); err == nil || !strings.Contains(err.Error(), "KeepGen only") {
+		t.Errorf("numbered entry kept by the hook: err=%v", err)
+	}
+}
+
+func TestRetentionExpr(t *testing.T) {
+	// a Sunday generation 3 days old, the second newest
+	now := time.Date(2024, 3, 13, 12, 0, 0, 0, time.UTC)
+	ts := time.Date(2024, 3, 10, 2, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		expr       string
+		want       bool
+		compileErr string
+		evalErr    string
+	}{
+		{expr: `age < 7d`, want: true},
+		{expr: `age >= 3d && age <= 3.5d`, want: true},
+		{expr: `weekday == "Sun" && hour == 2`, want: true},
+		{expr: `weekday != "Sun" || index > 1`, want: false},
+		{expr: `!(day == 10 && month == 3 && year == 2024)`, want: false},
+		{expr: `index == 1 && age > 60m && age < 4w`, want: true},
+		{expr: `age > 1s || false`, want: true},
+		{expr: `weekday == "Sun`, compileErr: "unterminated string at 11"},
+		{expr: `size < 10`, compileErr: `unknown variable "size" at 0`},
+		{expr: `(age < 7d`, compileErr: "missing ) at 9"},
+		{expr: `age < 7d age`, compileErr: `unexpected "age" at 9`},
+		{expr: `age < 7d; true`, compileErr: "unexpected ';' at 8"},
+		{expr: `age < 1.2.3`, compileErr: `bad number "1.2.3" at 6`},
+		{expr: `age <`, compileErr: `unexpected "end of expression" at 5`},
+		{expr: `age`, evalErr: "expression is not boolean"},
+		{expr: `!age`, evalErr: "! needs a boolean"},
+		{expr: `age && true`, evalErr: "&& needs booleans"},
+		{expr: `false || index`, evalErr: "|| needs booleans"},
+		{expr: `weekday < "Sun"`, evalErr: "< can't compare Sun"},
+		{expr: `age == "old"`, evalErr: "can't compare"},
+	} {
+		t.Run(tc.expr, func(t *testing.T) {
+			e, err := compileRetentionExpr(tc.expr)
+			if tc.compileErr != "" {
+				if err == nil || err.Error() != tc.compileErr {
+					t.Fatalf("compiling returned %v, want %q", err, tc.compileErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			keep, err := e.keep(ts, now, 1)
+			if tc.evalErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.evalErr) {
+					t.Fatalf("keep returned %v, want %q", err, tc.evalErr)
+				}
+				return
+			}
+			if err != nil || keep != tc.want {
+				t.Errorf("keep returned %v, err=%v, want %v", keep, err, tc.want)
+			}
+		})
+	}
+
+	// an evaluation error keeps everything
+	expr, err := compileRetentionExpr(`age`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := memoryBackend("www.tar.gz.1700000000", "www.tar.gz.1700000100")
+	config := &Config{retentionExpr: expr, clock: fixedClock(now)}
+	var re *RetentionError
+	if _, err := config.prune(m, &Entry{Name: "www"}); !errors.As(err, &re) || len(m.Objects) != 2 {
+		t.Errorf("prune returned %v, left %v", err, remaining(m))
+	}
+	config = &Config{RetentionExpr: "age <"}
+	if err := config.isRetentionValid(); err == nil {
+		t.Error("invalid RetentionExpr is accepted")
+	}
+}
+
+func TestPruneKeepsIncrementalBase(t *testing.T) {
+	ent := &Entry{Name: "www", Incremental: true}
+	m := memoryBackend("www.tar.gz.1", "www.tar.gz.2", "www.tar.gz.3")
+	for ts, base := range map[int64]int64{1: 0, 2: 1, 3: 1} {
+		if err := writeManifest(m, ent, &manifest{Entry: "www", Time: ts, Base: base}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := &Config{KeepGen: 1}
+	if _, err := config.prune(m, ent); err != nil {
+		t.Fatal(err)
+	}
+	// the full backup stays for the kept incremental archive
+	want := []string{
+		".tarbu-manifest.www.1.json", ".tarbu-manifest.www.3.json",
+		"www.tar.gz.1", "www.tar.gz.3",
+	}
+	if got := remaining(m); !reflect.DeepEqual(got, want) {
+		t.Fatalf("remaining %v, want %v", got, want)
+	}
+}
+
+func TestPruneTimePolicy(t *testing.T) {
+	now := time.Date(2024, 3, 31, 12, 0, 0, 0, time.UTC)
+	hour := int64(60 * 60)
+	m := storage.NewMemory()
+	// one generation every 12 hours for 60 days
+	for i := int64(0); i < 120; i++ {
+		m.Objects[fmt.Sprintf("www.tar.gz.%d", now.Unix()-i*12*hour)] = nil
+	}
+	gen := func(hoursAgo int64) string { return fmt.Sprintf("www.tar.gz.%d", now.Unix()-hoursAgo*hour) }
+
+	ent := &Entry{Name: "www", KeepDaily: 3, KeepWeekly: 2, KeepMonthly: 2, maxAge: 40 * 24 * time.Hour}
+	config := &Config{KeepGen: 1, clock: fixedClock(now)}
+	if _, err := config.prune(m, ent); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		gen(0),       // newest, also of 2024-03-31, ISO week 13 and March
+		gen(24),      // 2024-03-30
+		gen(48),      // 2024-03-29
+		gen(7 * 24),  // Sunday 2024-03-24, the newest of week 12
+		gen(31 * 24), // 2024-02-29 12:00, the newest of February
+	}
+	sort.Strings(want)
+	if got := remaining(m); !reflect.DeepEqual(got, want) {
+		t.Fatalf("remaining %v, want %v", got, want)
+	}
+
+	// MaxAge overrides the monthly rule
+	ent.maxAge = 30 * 24 * time.Hour
+	if _, err := config.prune(m, ent); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Objects[gen(31*24)]; ok {
+		t.Fatal("generation older than MaxAge is kept")
+	}
+}
+
+func TestGenerationsEncrypted(t *testing.T) {
+	m := memoryBackend("www.tar.gz.age.30", "www.tar.gz.10", "www.tar.gz.gpg.20", "www.tar.gz.zst.5", "www2.tar.gz.1")
+	ent := &Entry{Name: "www"}
+	gens, err := generations(m, ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, g := range gens {
+		names = append(names, g.Name)
+	}
+	want := []string{"www.tar.gz.10", "www.tar.gz.gpg.20", "www.tar.gz.age.30"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("generations %v, want %v", names, want)
+	}
+	for name, tool := range map[string]string{"www.tar.gz.10": "", "www.tar.gz.gpg.20": "gpg", "www.tar.gz.age.30": "age"} {
+		if got := encryption(ent, name); got != tool {
+			t.Errorf("encryption(%s) is %q, want %q", name, got, tool)
+		}
+	}
+}
+
+func TestGenerationsCompression(t *testing.T) {
+	// archives written before the compression changed stay generations
+	m := memoryBackend("www.tar.gz.10", "www.tar.zst.20", "www.tar.xz.age.30", "www.tar.40", "www.tarball.50")
+	ent := &Entry{Name: "www", Compression: "zstd"}
+	gens, err := generations(m, ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, g := range gens {
+		names = append(names, g.Name)
+	}
+	want := []string{"www.tar.gz.10", "www.tar.zst.20", "www.tar.xz.age.30", "www.tar.40"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("generations %v, want %v", names, want)
+	}
+	if got := encryption(ent, "www.tar.xz.age.30"); got != "age" {
+		t.Fatalf("encryption is %q, want age", got)
+	}
+}
+
+func TestSuffix(t *testing.T) {
+	m := memoryBackend("www.tgz-100", "www.tgz-200", "www.tgz-200-1", "www.tgz-300", "www.tgz-.gpg.400",
+		"www.tar.gz.50", "www.tgz-old", "www.tgz-100.sha256")
+	ent := &Entry{Name: "www", Suffix: ".tgz-"}
+	for _, tc := range []struct {
+		ts, want string
+	}{
+		{"latest", "www.tgz-.gpg.400"},
+		{"200", "www.tgz-200"},
+		{"200-1", "www.tgz-200-1"},
+		// archives of the compression suffix aren't the entry's
+		{"50", ""},
+	} {
+		name, err := findGeneration(m, ent, tc.ts)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("ts=%s found %s", tc.ts, name)
+			}
+			continue
+		}
+		if err != nil || name != tc.want {
+			t.Errorf("ts=%s found %s, err=%v, want %s", tc.ts, name, err, tc.want)
+		}
+	}
+
+	config := &Config{KeepGen: 2}
+	if _, err := config.prune(m, ent); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"www.tar.gz.50", "www.tgz-.gpg.400", "www.tgz-300", "www.tgz-old"}
+	if got := remaining(m); !reflect.DeepEqual(got, want) {
+		t.Fatalf("remaining %v, want %v", got, want)
+	}
+}
+
+func TestPlanPrunePending(t *testing.T) {
+	m := memoryBackend("www.tar.gz.10", "www.tar.gz.10.sha256", "www.tar.gz.20")
+	config := &Config{KeepGen: 2}
+	del, err := config.planPrune(m, &Entry{Name: "www"}, "www.tar.gz.30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"www.tar.gz.10"}; !reflect.DeepEqual(del, want) {
+		t.Fatalf("planPrune returned %v, want %v", del, want)
+	}
+	if len(m.Objects) != 3 {
+		t.Fatalf("planning deleted objects: %v", remaining(m))
+	}
+
+	// checksums go with their archives
+	config.KeepGen = 1
+	if _, err := config.prune(m, &Entry{Name: "www"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := remaining(m), []string{"www.tar.gz.20"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("remaining %v, want %v", got, want)
+	}
+}
+
+func TestPruneFutureArchives(t *testing.T) {
+	for policy, want := range map[string][]string{
+		"":       {"www.tar.gz.200", "www.tar.gz.99999"},
+		"oldest": {"www.tar.gz.200"},
+		"newest": {"www.tar.gz.99999"},
+	} {
+		m := memoryBackend("www.tar.gz.100", "www.tar.gz.200", "www.tar.gz.99999")
+		config := &Config{KeepGen: 1, FutureArchives: policy, clock: fixedClock(time.Unix(300, 0))}
+		if _, err := config.prune(m, &Entry{Name: "www"}); err != nil {
+			t.Fatal(err)
+		}
+		if got := remaining(m); !reflect.DeepEqual(got, want) {
+			t.Errorf("policy %q left %v, want %v", policy, got, want)
+		}
+	}
+}
+
+func TestEntryOverrides(t *testing.T) {
+	m := memoryBackend("www.tar.gz.100", "www.tar.gz.200", "www.tar.gz.300")
+	config := &Config{KeepGen: 3, clock: fixedClock(time.Unix(400, 0))}
+	if _, err := config.prune(m, &Entry{Name: "www", KeepGen: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := remaining(m), []string{"www.tar.gz.300"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entry KeepGen left %v, want %v", got, want)
+	}
+
+	// every destination is checked
+	dst, other := t.TempDir(), t.TempDir()
+	missing := filepath.Join(other, "missing")
+	config = &Config{Dst: dst, Entries: []*Entry{{Name: "www"}, {Name: "db", Dst: other}}}
+	if err := config.isDstWritable(); err != nil {
+		t.Fatal(err)
+	}
+	config.Entries = append(config.Entries, &Entry{Name: "media", Dst: missing})
+	if err := config.isDstWritable(); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("missing entry Dst passed: err=%v", err)
+	}
+	b, err := config.entryBackend(config.Entries[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc := b.Location("x"); loc != filepath.Join(other, "x") {
+		t.Errorf("entry archives go to %s", loc)
+	}
+}
+
+func TestPruneOnly(t *testing.T) {
+	m := memoryBackend("www.tar.gz.10", "www.tar.gz.20", "www.tar.gz.30", "www.tar.gz.40")
+	config := &Config{KeepGen: 2}
+	got, err := config.pruneOnly(m, &Entry{Name: "www"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"www.tar.gz.10", "www.tar.gz.20"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expired %v, want %v", got, want)
+	}
+
+	// slots beyond KeepGen go, the others keep their numbers
+	m = memoryBackend("log.tar.gz.1", "log.tar.gz.2", "log.tar.gz.3")
+	got, err = config.pruneOnly(m, &Entry{Name: "log", Naming: "numbered"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"log.tar.gz.3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expired %v, want %v", got, want)
+	}
+}
+
+func TestPruneTrash(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	m := memoryBackend("www.tar.gz.1", "www.tar.gz.1.sha256", "www.tar.gz.2", "www.tar.gz.3")
+	config := &Config{KeepGen: 1, trashRetention: 7 * 24 * time.Hour, clock: fixedClock(now)}
+	if _, err := config.prune(m, &Entry{Name: "www"}); err != nil {
+		t.Fatal(err)
+	}
+	stamp := fmt.Sprint(now.Unix())
+	want := []string{
+		".trash/" + stamp + "-www.tar.gz.1", ".trash/" + stamp + "-www.tar.gz.1.sha256",
+		".trash/" + stamp + "-www.tar.gz.2", "www.tar.gz.3",
+	}
+	if got := remaining(m); !reflect.DeepEqual(got, want) {
+		t.Fatalf("remaining %v, want %v", got, want)
+	}
+
+	// trashed for more than TrashRetention, gone
+	m.Objects["www.tar.gz.4"] = nil
+	later := now.Add(8 * 24 * time.Hour)
+	config.clock = fixedClock(later)
+	if _, err := config.prune(m, &Entry{Name: "www"}); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{".trash/" + fmt.Sprint(later.Unix()) + "-www.tar.gz.3", "www.tar.gz.4"}
+	if got := remaining(m); !reflect.DeepEqual(got, want) {
+		t.Fatalf("remaining %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// _RetryDelay is the wait before the first retry, doubled for each
+// one after it up to _RetryMaxDelay.
+const (
+	_RetryDelay    = 30 * time.Second
+	_RetryMaxDelay = time.Hour
+)
+
+func (config *Config) isRetryValid() error {
+	for _, e := range config.Entries {
+		if e.Retries < 0 {
+			return fmt.Errorf("entry retries must not be negative. name=%s retries=%d", e.Name, e.Retries)
+		}
+		e.retryDelay = _RetryDelay
+		if e.RetryDelay == "" {
+			continue
+		}
+		d, err := parseDuration(e.RetryDelay)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("entry retry delay is invalid. name=%s retry_delay=%s", e.Name, e.RetryDelay)
+		}
+		e.retryDelay = d
+	}
+	return nil
+}
+
+// retryable tells whether another attempt may succeed where err failed.
+// Interrupted runs, locks held elsewhere and panics fail for good, and
+// retention failed after the archive was stored.
+func retryable(err error) bool {
+	var ie *InterruptedError
+	if errors.As(err, &ie) && ie.Signal != nil {
+		return false
+	}
+	switch errorKind(err) {
+	case "locked", "panic", "retention":
+		return false
+	}
+	return true
+}
+
+// archiveRetrying archives ent, trying again up to Retries times after
+// failures that may be transient, such as NFS blips or a remote mount
+// momentarily full. Waits start at RetryDelay and double every attempt.
+// Failed uploads count as transient unless UploadRetries retried them.
+func (config *Config) archiveRetrying(r *result, ent *Entry) error {
+	base := *r
+	delay := ent.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := config.archiveEntry(r, ent)
+		if err == nil || attempt > ent.Retries || !retryable(err) {
+			return err
+		}
+		if config.UploadRetries > 0 && errorKind(err) == "upload" {
+			// the upload was retried without archiving again already
+			return err
+		}
+		logs.event(levelWarn, _ColorYellow, "Backup attempt failed", "entry", ent.Name, "run", config.runID,
+			"attempt", attempt, "retry_in", delay, "err", err)
+		// counts and warnings of the failed attempt don't carry over
+		base.warnings = append(base.warnings, fmt.Sprintf("attempt %d failed. err=%s", attempt, err))
+		*r = base
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-config.runContext().Done():
+			timer.Stop()
+			return &InterruptedError{Entry: ent.Name, Signal: config.signal, Started: true}
+		}
+		if delay *= 2; delay > _RetryMaxDelay {
+			delay = _RetryMaxDelay
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package backup
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// numbered is true for entries named like logrotate, <name><suffix>1 the
+// newest archive up to <suffix>N, instead of by timestamp.
+func (ent *Entry) numbered() bool {
+	return ent.Naming == "numbered"
+}
+
+// slotName replaces the number ending an archive name with n.
+func slotName(name string, n int64) string {
+	return name[:strings.LastIndexFunc(name, notDigit)+1] + strconv.FormatInt(n, 10)
+}
+
+func (config *Config) isNamingValid() error {
+	if err := config.parseNameTemplates(); err != nil {
+		return err
+	}
+	for _, e := range config.Entries {
+		// incremental manifests are keyed by the second, which templated
+		// names may share
+		if e.NameTemplate != "" && (e.numbered() || e.Incremental || e.Repository) {
+			return fmt.Errorf("entry NameTemplate applies to timestamped entries, not numbered, incremental or repository ones. name=%s", e.Name)
+		}
+		switch e.Naming {
+		case "", "timestamp":
+			continue
+		case "numbered":
+		default:
+			return fmt.Errorf("unknown entry naming. name=%s naming=%s", e.Name, e.Naming)
+		}
+		// numbers say nothing about the age of an archive
+		if e.Incremental || e.KeepDaily > 0 || e.KeepWeekly > 0 || e.KeepMonthly > 0 || e.MaxAge != "" {
+			return fmt.Errorf("numbered entries are kept by KeepGen only and can't be incremental. name=%s", e.Name)
+		}
+		if e.KeepGen == 0 && (len(config.RetentionHook) > 0 || config.RetentionExpr != "") {
+			return fmt.Errorf("numbered entries are kept by KeepGen only, not config.RetentionHook or config.RetentionExpr. name=%s", e.Name)
+		}
+		b, err := config.dstBackend(e.Dst)
+		if err != nil {
+			return err
+		}
+		if !storage.CanRename(b) {
+			return fmt.Errorf("config.Dst can't rename archives, numbered naming needs a local, sftp, ssh or webdav destination. name=%s dst=%s", e.Name, config.entryDst(e))
+		}
+	}
+	return nil
+}
+
+// rotate makes the archive just written to slot 0 of ent the newest,
+// numbered 1, renumbering the older ones and deleting those beyond
+// KeepGen. It returns how many it deleted.
+func (config *Config) rotate(b storage.Backend, ent *Entry) (int, error) {
+	rn, ok := b.(storage.Renamer)
+	if !ok {
+		return 0, &RetentionError{config.entryDst(ent), fmt.Errorf("destination can't rename")}
+	}
+	objs, err := generations(b, ent)
+	if err != nil {
+		return 0, &RetentionError{config.entryDst(ent), err}
+	}
+	names := make([]string, len(objs))
+	for i, o := range objs {
+		names[i] = o.Name
+	}
+	expired, err := config.expired(ent, names)
+	if err != nil {
+		return 0, err
+	}
+	var del []string
+	for _, n := range expired {
+		del = append(append(del, n), sidecars(ent, n)...)
+	}
+	if err := config.discard(b, del...); err != nil {
+		return 0, &RetentionError{config.entryDst(ent), err}
+	}
+
+	// the highest numbers go first, so nothing is replaced
+	for _, n := range names[len(expired):] {
+		to := slotName(n, archiveTime(ent, n)+1)
+		if err := rn.Rename(n, to); err != nil {
+			return 0, &RetentionError{config.entryDst(ent), err}
+		}
+		if err := moveMeta(b, n, to); err != nil {
+			return 0, &RetentionError{config.entryDst(ent), err}
+		}
+		// the checksum line names the archive, so it is written anew
+		want, err := readChecksum(b, n)
+		if storage.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return 0, &RetentionError{config.entryDst(ent), err}
+		}
+		sum, err := hex.DecodeString(want)
+		if err != nil {
+			return 0, &RetentionError{config.entryDst(ent), fmt.Errorf("checksum is broken. file=%s", b.Location(checksumName(n)))}
+		}
+		if err := writeChecksum(b, to, sum); err != nil {
+			return 0, err
+		}
+		if err := b.Delete(checksumName(n)); err != nil {
+			return 0, &RetentionError{config.entryDst(ent), err}
+		}
+	}
+	return len(expired), nil
+}
@@ -0,0 +1,136 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// LoadConfig reads a JSON, YAML or TOML config file, or JSON from stdin
+// for path -, and prepares it.
+func LoadConfig(path string) (*Config, error) {
+	return loadConfig(path)
+}
+
+// Prepare expands cfg as the tarbu command does the config file it
+// reads: it applies Defaults to Entries and generates the entries of
+// Templates, loads TimeZone, expands ${VAR} and ~ and parses
+// NameTemplate. Entry fields left zero take their Defaults, so a Config
+// built in code can't set one back to zero. Run and Restore prepare cfg
+// unless it already is, fields changed afterwards aren't expanded.
+func (config *Config) Prepare() error {
+	if config.prepared {
+		return nil
+	}
+	return config.prepare(nil)
+}
+
+// Run backs up the entries of cfg like a run of the tarbu command,
+// applying retention and sending notifications. It fails without
+// backing up anything when cfg is invalid or another run holds the
+// lock. Otherwise the outcome of each entry is in the report, whose
+// ExitCode is what tarbu would exit with. Cancelling ctx interrupts the
+// entries still running. Events are logged as the command logs them.
+// The entries of ContainerDiscovery and Kubernetes are added by Run.
+//
+// Validating cfg fills it in, so a Config is good for one run.
+func Run(ctx context.Context, cfg *Config) (Report, error) {
+	if err := cfg.Prepare(); err != nil {
+		return Report{}, err
+	}
+	if cfg.isReadOnly() {
+		return Report{}, fmt.Errorf("backup is refused in read-only mode")
+	}
+	if err := cfg.discover(); err != nil {
+		return Report{}, err
+	}
+	if cfg.SelfBackup {
+		dir, err := cfg.addSelfEntry()
+		defer os.RemoveAll(dir)
+		if err != nil {
+			return Report{}, err
+		}
+	}
+	if err := cfg.isValid(); err != nil {
+		return Report{}, err
+	}
+	if cfg.runID == "" {
+		cfg.runID = runID()
+	}
+	lock, err := cfg.lockRun()
+	if err != nil {
+		return Report{}, err
+	}
+	defer lock.release()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	cfg.ctx = ctx
+	start := time.Now()
+	results := backup(cfg)
+	return *cfg.summarize(results, start), nil
+}
+
+// RestoreOptions select the generation Restore extracts and where to.
+type RestoreOptions struct {
+	// TS selects the generation as tarbu restore -ts does: its Unix
+	// time, seconds-seq for later runs of the same second, or latest,
+	// the default when empty.
+	TS string
+	// To is the directory to extract into, / for the original paths.
+	To string
+	// Include restores only these files and directories as archived,
+	// e.g. etc/ssh, reading the archive only as far as needed.
+	Include []string
+	// NoVerify extracts without reading the archive through first.
+	NoVerify bool
+}
+
+// Restore extracts a generation of the entry named entry into opts.To
+// like tarbu restore -yes, replacing the files there, and returns the
+// location of the archive.
+func Restore(cfg *Config, entry string, opts RestoreOptions) (string, error) {
+	if err := cfg.Prepare(); err != nil {
+		return "", err
+	}
+	if cfg.isReadOnly() {
+		return "", fmt.Errorf("restore is refused in read-only mode")
+	}
+	if opts.To == "" {
+		return "", fmt.Errorf("restore directory is required")
+	}
+	ent := cfg.findEntry(entry)
+	if ent == nil {
+		return "", fmt.Errorf("entry not found. name=%s", entry)
+	}
+	var include *memberFilter
+	for _, p := range opts.Include {
+		if include == nil {
+			include = &memberFilter{}
+		}
+		if err := include.Set(p); err != nil {
+			return "", err
+		}
+	}
+	b, err := cfg.entryBackend(ent)
+	if err != nil {
+		return "", err
+	}
+	ts := opts.TS
+	if ts == "" {
+		ts = "latest"
+	}
+	name, err := findGeneration(b, ent, ts)
+	if err != nil {
+		return "", err
+	}
+	verify := !opts.NoVerify && include == nil
+	if err := cfg.restoreGeneration(b, ent, name, opts.To, ent.restoreOpts(false), verify, include); err != nil {
+		return "", err
+	}
+	if include != nil && include.extracted == 0 {
+		return "", fmt.Errorf("no member matches the include paths. archive=%s include=%s", b.Location(name), include)
+	}
+	return b.Location(name), nil
+}
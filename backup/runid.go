@@ -0,0 +1,34 @@
+package backup
+
+import (
+	"crypto/rand"
+	"fmt"
+	"os"
+)
+
+// _RunIDEnv passes the run ID to hooks, dump tools and pre commands, and
+// lets a scheduler hand in its own ID.
+const _RunIDEnv = "TARBU_RUN_ID"
+
+// newRunID returns a random UUID identifying a backup run in the output,
+// the history, error reports and manifests it produces.
+func newRunID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// runID returns the ID of this run, taken from $TARBU_RUN_ID when set
+// and exported there for the commands the run starts.
+func runID() string {
+	id := os.Getenv(_RunIDEnv)
+	if id == "" {
+		id = newRunID()
+		os.Setenv(_RunIDEnv, id)
+	}
+	return id
+}
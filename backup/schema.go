@@ -0,0 +1,404 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// cfgValue is a config value as parsed from JSON, YAML or TOML, with
+// the line it is on for error messages.
+type cfgValue struct {
+	line int
+	// v is nil, bool, string, json.Number, []*cfgValue or *cfgObject
+	v interface{}
+	// plain is set for unquoted YAML scalars, typed by the field they
+	// are decoded into
+	plain bool
+}
+
+// cfgObject keeps keys in the order they were written.
+type cfgObject struct {
+	keys  []string
+	lines []int
+	vals  []*cfgValue
+}
+
+func (o *cfgObject) get(key string) *cfgValue {
+	for i, k := range o.keys {
+		if k == key {
+			return o.vals[i]
+		}
+	}
+	return nil
+}
+
+func (o *cfgObject) set(key string, line int, v *cfgValue) error {
+	if o.get(key) != nil {
+		return fmt.Errorf("config key is duplicated. key=%s line=%d", key, line)
+	}
+	o.keys, o.lines, o.vals = append(o.keys, key), append(o.lines, line), append(o.vals, v)
+	return nil
+}
+
+// decodeConfig checks the config in data against Config and
+// returns it as JSON. YAML and TOML are told by the extension of path,
+// or by the content for stdin, anything else is JSON, which is returned
+// as is.
+func decodeConfig(path string, data []byte) ([]byte, error) {
+	var root *cfgValue
+	var err error
+	ext := strings.ToLower(filepath.Ext(path))
+	if path == "-" {
+		ext = sniffConfig(data)
+	}
+	switch ext {
+	case ".yaml", ".yml":
+		root, err = parseYAML(data)
+	case ".toml":
+		root, err = parseTOML(data)
+	default:
+		root, err = parseJSON(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkValue(root, reflect.TypeOf(Config{}), "config"); err != nil {
+		return nil, err
+	}
+	switch ext {
+	case ".yaml", ".yml", ".toml":
+		var b bytes.Buffer
+		root.encode(&b)
+		return b.Bytes(), nil
+	}
+	return data, nil
+}
+
+// sniffConfig returns the extension of the format of the config in
+// data, which has no name: JSON is an object, TOML starts with a table
+// or a key = value line, and anything else is YAML.
+func sniffConfig(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+			continue
+		case strings.HasPrefix(line, "{"):
+			return ".json"
+		case strings.HasPrefix(line, "["), tomlKeyLine.MatchString(line):
+			return ".toml"
+		}
+		return ".yaml"
+	}
+	return ".json"
+}
+
+// tomlKeyLine matches a TOML key = value line, bare or quoted keys
+// dotted or not.
+var tomlKeyLine = regexp.MustCompile(`^("[^"]*"|'[^']*'|[A-Za-z0-9_.-]+)\s*=`)
+
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// checkValue checks v decodes into a t, reporting unknown keys and
+// values of the wrong type with the field and line. Plain YAML scalars
+// get their type from t.
+func checkValue(v *cfgValue, t reflect.Type, field string) error {
+	if v.plain {
+		v.v, v.plain = resolvePlain(v.v.(string), t.Kind() == reflect.String), false
+	}
+	if v.v == nil {
+		return nil
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	// Defaults and template entries hold entry fields decoded later
+	if t == rawMessageType {
+		t = reflect.TypeOf(Entry{})
+	}
+	want := ""
+	switch t.Kind() {
+	case reflect.Interface:
+		resolveAll(v)
+		return nil
+	case reflect.String:
+		if _, ok := v.v.(string); !ok {
+			want = "a string"
+		}
+	case reflect.Bool:
+		if _, ok := v.v.(bool); !ok {
+			want = "true or false"
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, ok := v.v.(json.Number); !ok {
+			want = "an integer"
+		} else if _, err := strconv.ParseInt(string(n), 10, 64); err != nil {
+			want = "an integer"
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := v.v.(json.Number); !ok {
+			want = "a number"
+		}
+	case reflect.Slice, reflect.Array:
+		a, ok := v.v.([]*cfgValue)
+		if !ok {
+			want = "a list"
+			break
+		}
+		for i, e := range a {
+			if err := checkValue(e, t.Elem(), fmt.Sprintf("%s[%d]", field, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		o, ok := v.v.(*cfgObject)
+		if !ok {
+			want = "an object"
+			break
+		}
+		for i, k := range o.keys {
+			if err := checkValue(o.vals[i], t.Elem(), field+"."+k); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		o, ok := v.v.(*cfgObject)
+		if !ok {
+			want = "an object"
+			break
+		}
+		fields := jsonFields(t)
+		for i, k := range o.keys {
+			ft, ok := fields[k]
+			if !ok {
+				// encoding/json matches names case insensitively
+				for name, f := range fields {
+					if strings.EqualFold(name, k) {
+						ft, ok = f, true
+						break
+					}
+				}
+			}
+			if !ok {
+				return fmt.Errorf("unknown config key. field=%s.%s line=%d", field, k, o.lines[i])
+			}
+			if err := checkValue(o.vals[i], ft, field+"."+k); err != nil {
+				return err
+			}
+		}
+	}
+	if want != "" {
+		return fmt.Errorf("config value must be %s. field=%s line=%d", want, field, v.line)
+	}
+	return nil
+}
+
+// jsonFields returns the types of the fields of t by JSON name.
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := map[string]reflect.Type{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" || (f.PkgPath != "" && !f.Anonymous) {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for n, ft := range jsonFields(f.Type) {
+				fields[n] = ft
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = f.Type
+	}
+	return fields
+}
+
+// resolvePlain types a plain YAML scalar, its text for string fields and
+// otherwise by the YAML core schema.
+func resolvePlain(s string, text bool) interface{} {
+	if text {
+		return s
+	}
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return nil
+	case "true", "True", "TRUE":
+		return true
+	case "false", "False", "FALSE":
+		return false
+	}
+	if n, ok := parseNumber(s); ok {
+		return n
+	}
+	return s
+}
+
+// resolveAll types the plain scalars below values of no fixed type.
+func resolveAll(v *cfgValue) {
+	if v.plain {
+		v.v, v.plain = resolvePlain(v.v.(string), false), false
+	}
+	switch t := v.v.(type) {
+	case []*cfgValue:
+		for _, e := range t {
+			resolveAll(e)
+		}
+	case *cfgObject:
+		for _, e := range t.vals {
+			resolveAll(e)
+		}
+	}
+}
+
+// parseNumber parses decimal, 0x, 0o and 0b integers and decimal floats,
+// with _ separators, as JSON numbers.
+func parseNumber(s string) (json.Number, bool) {
+	s = strings.Replace(s, "_", "", -1)
+	if n, err := strconv.ParseInt(s, 0, 64); err == nil {
+		if u := strings.TrimLeft(s, "+-"); len(u) > 1 && u[0] == '0' && isDigit(u[1]) {
+			// 0755 is octal for strconv, not for YAML 1.2 or TOML
+			return "", false
+		}
+		return json.Number(strconv.FormatInt(n, 10)), true
+	}
+	if strings.ContainsAny(s, "xXoObB") {
+		return "", false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || strings.ContainsAny(s, "iInN") {
+		// inf and nan have no JSON form
+		return "", false
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), true
+}
+
+func (v *cfgValue) encode(b *bytes.Buffer) {
+	if v.plain {
+		resolveAll(v)
+	}
+	switch t := v.v.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool:
+		b.WriteString(strconv.FormatBool(t))
+	case json.Number:
+		b.WriteString(string(t))
+	case string:
+		s, _ := json.Marshal(t)
+		b.Write(s)
+	case []*cfgValue:
+		b.WriteByte('[')
+		for i, e := range t {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			e.encode(b)
+		}
+		b.WriteByte(']')
+	case *cfgObject:
+		b.WriteByte('{')
+		for i, k := range t.keys {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			s, _ := json.Marshal(k)
+			b.Write(s)
+			b.WriteByte(':')
+			t.vals[i].encode(b)
+		}
+		b.WriteByte('}')
+	}
+}
+
+// lineAt returns the line of data offset off is on.
+func lineAt(data []byte, off int64) int {
+	return bytes.Count(data[:off], []byte("\n")) + 1
+}
+
+// parseJSON parses a JSON config keeping the lines of values.
+func parseJSON(data []byte) (*cfgValue, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	// the decoder offset is at the end of the previous token
+	next := func() int {
+		off := dec.InputOffset()
+		for off < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[off]) >= 0 {
+			off++
+		}
+		return lineAt(data, off)
+	}
+	syntax := func(err error) error {
+		if se, ok := err.(*json.SyntaxError); ok {
+			return fmt.Errorf("config is invalid JSON. line=%d err=%s", lineAt(data, se.Offset), err)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("config is invalid JSON. line=%d err=unexpected end", lineAt(data, int64(len(data))))
+		}
+		return err
+	}
+	var value func() (*cfgValue, error)
+	value = func() (*cfgValue, error) {
+		line := next()
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, syntax(err)
+		}
+		v := &cfgValue{line: line}
+		switch tok {
+		case json.Delim('['):
+			a := []*cfgValue{}
+			for dec.More() {
+				e, err := value()
+				if err != nil {
+					return nil, err
+				}
+				a = append(a, e)
+			}
+			v.v = a
+		case json.Delim('{'):
+			o := &cfgObject{}
+			for dec.More() {
+				kline := next()
+				k, err := dec.Token()
+				if err != nil {
+					return nil, syntax(err)
+				}
+				e, err := value()
+				if err != nil {
+					return nil, err
+				}
+				if err := o.set(k.(string), kline, e); err != nil {
+					return nil, err
+				}
+			}
+			v.v = o
+		default:
+			v.v = tok
+			return v, nil
+		}
+		// the closing delimiter
+		if _, err := dec.Token(); err != nil {
+			return nil, syntax(err)
+		}
+		return v, nil
+	}
+	root, err := value()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("config has data after the top level object. line=%d", next())
+	}
+	return root, nil
+}
@@ -0,0 +1,262 @@
+package backup
+
+import (
+	"crypto/cipher"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const schemaJSON = `{"Dst":"/backup","KeepGen":3,"TmpMinFree":"1024","Defaults":{"Compression":"zstd"},` +
+	`"Notify":[{"Type":"webhook","URL":"http://hooks/x#y","Template":"run {{.RunID}}\ndone\n"}],` +
+	`"Entries":[{"Name":"www","Path":"/var/www","Exclude":["*.log","tmp/"],"Quiesce":["sh","-c","echo 'it''s' \"ok\""]},` +
+	`{"Name":"etc","Paths":["/etc"],"ExcludeVCS":true,"Args":[]}]}`
+
+const schemaYAML = `# tarbu
+Dst: /backup
+KeepGen: 3
+TmpMinFree: 1024
+Defaults: {Compression: zstd}
+Notify:
+  - Type: webhook
+    URL: http://hooks/x#y  # a comment
+    Template: |
+      run {{.RunID}}
+      done
+Entries:
+- Name: www
+  Path: '/var/www'
+  Exclude: [ "*.log",
+    tmp/ ]
+  Quiesce:
+    - sh
+    - -c
+    - "echo 'it''s' \"ok\""
+- Name: etc
+  Paths:
+  - /etc
+  ExcludeVCS: true
+  Args: []
+`
+
+const schemaTOML = `Dst = "/backup" # where
+KeepGen = 3
+TmpMinFree = "1024"
+
+[Defaults]
+Compression = "zstd"
+
+[[Notify]]
+Type = "webhook"
+URL = 'http://hooks/x#y'
+Template = """
+run {{.RunID}}
+done
+"""
+
+[[Entries]]
+Name = "www"
+Path = "/var/www"
+Exclude = [
+  "*.log", # logs
+  "tmp/",
+]
+Quiesce = ["sh", "-c", "echo 'it''s' \"ok\""]
+
+[[Entries]]
+Name = "etc"
+Paths = ["/etc"]
+ExcludeVCS = true
+Args = []
+`
+
+func TestDecodeConfigFormats(t *testing.T) {
+	for _, tc := range []struct {
+		path, text string
+	}{
+		{"c.yaml", schemaYAML},
+		{"c.toml", schemaTOML},
+		{"c.json", schemaJSON},
+		// stdin is told by its content
+		{"-", schemaYAML},
+		{"-", "Dst: /backup\n" + strings.SplitN(schemaYAML, "Dst: /backup\n", 2)[1]},
+		{"-", schemaTOML},
+		{"-", schemaJSON},
+	} {
+		got, err := decodeConfig(tc.path, []byte(tc.text))
+		if err != nil {
+			t.Errorf("%s: %s", tc.path, err)
+			continue
+		}
+		if string(got) != schemaJSON {
+			t.Errorf("%s decoded to\n%s\nwant\n%s", tc.path, got, schemaJSON)
+		}
+	}
+}
+
+func TestDecodeConfigErrors(t *testing.T) {
+	for _, c := range []struct {
+		path, text, err string
+	}{
+		{"c.json", "{\n\"Dst\": \"/backup\",\n\"KeepGenn\": 3\n}", "field=config.KeepGenn line=3"},
+		{"c.json", "{\"Entries\": [\n{\"Name\": \"www\"},\n{\"Name\": \"etc\", \"Pth\": \"/etc\"}]}", "field=config.Entries[1].Pth line=3"},
+		{"c.json", "{\"Defaults\": {\"Exlude\": []}}", "field=config.Defaults.Exlude line=1"},
+		{"c.json", "{\n\"KeepGen\": \"3\"}", "must be an integer. field=config.KeepGen line=2"},
+		{"c.json", "{\n\"Dst\": \"/a\",\n\"Dst\": \"/b\"}", "duplicated. key=Dst line=3"},
+		{"c.json", "{\n\"Dst\": \"/a\",\n}", "invalid JSON. line=2"},
+		{"c.yaml", "Dst: /backup\nEntries:\n  - Name: www\n    Pth: /etc\n", "field=config.Entries[0].Pth line=4"},
+		{"c.yaml", "KeepGen: three\n", "must be an integer. field=config.KeepGen line=1"},
+		{"c.yaml", "Dst: &d /backup\n", "anchors"},
+		{"c.yaml", "Entries:\n  - Name: www\n     Path: /etc\n", "indentation is off. line=3"},
+		{"c.toml", "Dst = \"/backup\"\n\n[[Entries]]\nName = \"www\"\nPth = \"/etc\"\n", "field=config.Entries[0].Pth line=5"},
+		{"c.toml", "KeepGen = 3\nKeepGen = 4\n", "duplicated. key=KeepGen line=2"},
+		{"c.toml", "Dst = /backup\n", "unknown value. value=/backup line=1"},
+	} {
+		_, err := decodeConfig(c.path, []byte(c.text))
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s %q: got err=%v, want %s", c.path, c.text, err, c.err)
+		}
+	}
+}
+
+func TestConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("00-base.json", `{"Dst":"/backup","KeepGen":3,"Entries":[{"Name":"etc","Path":"/etc"}]}`)
+	write("10-www.yaml", "KeepGen: 3\nEntries:\n- Name: www\n  Path: /var/www\n")
+	write("README", "not a config")
+	config, err := loadConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Dst != "/backup" || len(config.Entries) != 2 || config.Entries[1].Name != "www" {
+		t.Fatalf("merged config is %+v", config)
+	}
+
+	write("20-dup.json", `{"Entries":[{"Name":"etc","Path":"/srv/etc"}]}`)
+	if _, err := loadConfig(dir); err == nil || !strings.Contains(err.Error(), "name=etc") {
+		t.Errorf("duplicate entry loaded, err=%v", err)
+	}
+	os.Remove(filepath.Join(dir, "20-dup.json"))
+	write("20-dst.json", `{"Dst":"/other"}`)
+	if _, err := loadConfig(dir); err == nil || !strings.Contains(err.Error(), "key=Dst") {
+		t.Errorf("conflicting Dst loaded, err=%v", err)
+	}
+	os.Remove(filepath.Join(dir, "20-dst.json"))
+
+	main := filepath.Join(t.TempDir(), "tarbu.json")
+	if err := os.WriteFile(main, []byte(`{"Dst":"/backup","Entries":[{"Name":"home","Path":"/home"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if config, err := loadConfigDir(main, dir); err != nil || len(config.Entries) != 3 || config.Entries[0].Name != "home" {
+		t.Errorf("config with fragments is %+v, err=%v", config, err)
+	}
+}
+
+// writeSealKey writes a seal key of bytes b and makes it the local key.
+func writeSealKey(t *testing.T, b byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(strings.Repeat(fmt.Sprintf("%02x", b), 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TARBU_KEY_FILE", path)
+	return path
+}
+
+func TestSeal(t *testing.T) {
+	aead, err := readSealKey(writeSealKey(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := seal(aead, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := seal(aead, "s3cret")
+	if !strings.HasPrefix(sealed, _SealedPrefix) || sealed == again {
+		t.Errorf("sealed to %q and %q, want prefixed values with their own nonce", sealed, again)
+	}
+	if plain, err := unseal(aead, sealed); err != nil || plain != "s3cret" {
+		t.Errorf("unsealed %q, err=%v", plain, err)
+	}
+
+	data, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(sealed, _SealedPrefix))
+	data[len(data)-1] ^= 1
+	tampered := _SealedPrefix + base64.StdEncoding.EncodeToString(data)
+	other, err := readSealKey(writeSealKey(t, 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		aead   cipher.AEAD
+		sealed string
+		err    string
+	}{
+		{"tampered", aead, tampered, "can't be opened with the local key"},
+		{"wrong key", other, sealed, "can't be opened with the local key"},
+		{"not base64", aead, _SealedPrefix + "!!", "sealed value is broken"},
+		{"short", aead, _SealedPrefix + "AAAA", "sealed value is broken"},
+	} {
+		if plain, err := unseal(tc.aead, tc.sealed); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: unsealed %q, err=%v, want %q", tc.name, plain, err, tc.err)
+		}
+	}
+
+	bad := filepath.Join(t.TempDir(), "key")
+	os.WriteFile(bad, []byte("abcd\n"), 0600)
+	if _, err := readSealKey(bad); err == nil {
+		t.Error("short seal key read")
+	}
+}
+
+func TestUnsealConfig(t *testing.T) {
+	// configs without sealed values need no key
+	t.Setenv("TARBU_KEY_FILE", filepath.Join(t.TempDir(), "missing"))
+	plain := []byte(`{"Dst":"/backup","Entries":[]}`)
+	if got, err := unsealConfig(plain); err != nil || string(got) != string(plain) {
+		t.Errorf("unsealed %s, err=%v", got, err)
+	}
+
+	aead, err := readSealKey(writeSealKey(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, _ := seal(aead, "hunter2")
+	secret, _ := seal(aead, "AKIA/secret")
+	data := []byte(`{"Dst":"s3://bucket/tarbu","KeepGen":3,` +
+		`"Credentials":{"s3":{"SecretAccessKey":"` + secret + `"}},` +
+		`"Notify":[{"Type":"email","SMTP":"mail:25","User":"tarbu","Password":"` + password + `","From":"a@b","To":["c@d"]}],` +
+		`"Entries":[{"Name":"db","Type":"postgres","URI":"postgres://db/app","Args":["--password","` + password + `"]}]}`)
+	config, err := parseConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Notify[0].Password != "hunter2" || config.Entries[0].Args[1] != "hunter2" || config.Credentials["s3"].SecretAccessKey != "AKIA/secret" {
+		t.Errorf("unsealed to notify=%+v entry=%+v credentials=%+v", config.Notify[0], config.Entries[0], config.Credentials["s3"])
+	}
+	if config.KeepGen != 3 {
+		t.Errorf("numbers changed: KeepGen=%d", config.KeepGen)
+	}
+	// self backups keep them sealed
+	if string(config.raw) != string(data) {
+		t.Errorf("raw config is %s", config.raw)
+	}
+
+	writeSealKey(t, 2)
+	if _, err := unsealConfig(data); err == nil || !strings.Contains(err.Error(), "key=.") {
+		t.Errorf("unsealed with the wrong key, err=%v", err)
+	}
+	broken := []byte(`{"Notify":[{"Password":"` + _SealedPrefix + `!!"}]}`)
+	if _, err := unsealConfig(broken); err == nil || !strings.Contains(err.Error(), "key=.Notify[0].Password") {
+		t.Errorf("broken value unsealed, err=%v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// _SealedPrefix marks a config string sealed with the local key. The rest
+// is base64 of an AES-256-GCM nonce followed by the ciphertext.
+const _SealedPrefix = "sealed:"
+
+// sealKeyPath returns the key file, $TARBU_KEY_FILE or tarbu/key under
+// the user config directory.
+func sealKeyPath() (string, error) {
+	if p := os.Getenv("TARBU_KEY_FILE"); p != "" {
+		return p, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "tarbu", "key"), nil
+}
+
+func readSealKey(path string) (cipher.AEAD, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading seal key failed. path=%s err=%s", path, err)
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("seal key must be 32 hex encoded bytes. path=%s", path)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plain string) (string, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), nil)
+	return _SealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func unseal(aead cipher.AEAD, s string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, _SealedPrefix))
+	if err != nil || len(data) < aead.NonceSize() {
+		return "", fmt.Errorf("sealed value is broken")
+	}
+	n := aead.NonceSize()
+	plain, err := aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		return "", fmt.Errorf("sealed value can't be opened with the local key")
+	}
+	return string(plain), nil
+}
+
+// unsealConfig replaces every sealed string in data with its plaintext.
+// Configs without sealed values are returned as is and need no key.
+func unsealConfig(data []byte) ([]byte, error) {
+	if !bytes.Contains(data, []byte(`"`+_SealedPrefix)) {
+		return data, nil
+	}
+	path, err := sealKeyPath()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := readSealKey(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	var walk func(v interface{}, at string) (interface{}, error)
+	walk = func(v interface{}, at string) (interface{}, error) {
+		switch t := v.(type) {
+		case string:
+			if !strings.HasPrefix(t, _SealedPrefix) {
+				return t, nil
+			}
+			s, err := unseal(aead, t)
+			if err != nil {
+				return nil, fmt.Errorf("%s. key=%s", err, at)
+			}
+			return s, nil
+		case map[string]interface{}:
+			for k, e := range t {
+				var err error
+				if t[k], err = walk(e, at+"."+k); err != nil {
+					return nil, err
+				}
+			}
+		case []interface{}:
+			for i, e := range t {
+				var err error
+				if t[i], err = walk(e, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+					return nil, err
+				}
+			}
+		}
+		return v, nil
+	}
+	if v, err = walk(v, ""); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// sealCommand prints the sealed form of a value read from stdin, to be
+// pasted into a config in place of the plaintext.
+func sealCommand(args []string) error {
+	fs := flag.NewFlagSet("seal", flag.ExitOnError)
+	keygen := fs.Bool("keygen", false, "generate a new key instead of sealing")
+	fs.Parse(args)
+
+	path, err := sealKeyPath()
+	if err != nil {
+		return err
+	}
+
+	if *keygen {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("seal key already exists. path=%s", path)
+		}
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote seal key to %s\n", path)
+		return nil
+	}
+
+	aead, err := readSealKey(path)
+	if err != nil {
+		return err
+	}
+	plain, err := ioutil.ReadAll(os.Stdin)
+	if err != nil {
+		return err
+	}
+	s, err := seal(aead, strings.TrimRight(string(plain), "\r\n"))
+	if err != nil {
+		return err
+	}
+	fmt.Println(s)
+	return nil
+}
@@ -0,0 +1,167 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// _SelfEntry is the reserved entry name of the self backup.
+const _SelfEntry = "tarbu-self"
+
+// _SelfConfig is the config file name inside a self backup archive.
+const _SelfConfig = "config.json"
+
+// _SelfCatalog and _SelfKeys are the catalog and key metadata inside a
+// self backup archive.
+const (
+	_SelfCatalog = "catalog.csv"
+	_SelfKeys    = "keys.json"
+)
+
+// _SelfConfigMax bounds the config read back from a self backup.
+const _SelfConfigMax = 16 << 20
+
+// selfKeys describes the keys a recovered setup needs. Secret keys are
+// never stored, only where they live and their public halves.
+type selfKeys struct {
+	// SealKey is the key file of the sealed values in the config
+	SealKey string `json:",omitempty"`
+	// Encrypt is the tool and keys archives are encrypted with
+	Encrypt *encryptConfig `json:",omitempty"`
+	// Attestation is the key run records are signed with
+	Attestation *selfAttestationKey `json:",omitempty"`
+}
+
+type selfAttestationKey struct {
+	Key       string
+	PublicKey string `json:",omitempty"`
+	KeyID     string `json:",omitempty"`
+}
+
+// entriesWithSelf returns Entries followed by the self backup entry, so
+// commands looking at Dst see the self archives too.
+func (config *Config) entriesWithSelf() []*Entry {
+	n := len(config.Entries)
+	if n > 0 && config.Entries[n-1].Name == _SelfEntry {
+		return config.Entries
+	}
+	return append(config.Entries[:n:n], &Entry{Name: _SelfEntry})
+}
+
+// addSelfEntry stages the active config, the catalog of Dst, the key
+// metadata and the run history kept in StateDir in a temporary
+// directory and appends an entry archiving it, so every destination
+// carries what is needed to recover the setup that wrote it, see
+// copySelf. The returned directory must be removed after the run.
+func (config *Config) addSelfEntry() (string, error) {
+	dir, err := ioutil.TempDir(config.TmpDir, "tarbu-self-")
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, _SelfConfig), config.raw, 0600); err != nil {
+		return dir, err
+	}
+	// the destinations are not validated yet; one the catalog can't list
+	// is left to isValid to report
+	if records, err := config.inventory(false); err == nil {
+		buf := &bytes.Buffer{}
+		if err := writeCatalogCSV(buf, records); err != nil {
+			return dir, err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, _SelfCatalog), buf.Bytes(), 0600); err != nil {
+			return dir, err
+		}
+	}
+	data, err := json.MarshalIndent(config.selfKeys(), "", "\t")
+	if err != nil {
+		return dir, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, _SelfKeys), append(data, '\n'), 0600); err != nil {
+		return dir, err
+	}
+	// without StateDir the history is in Dst already
+	if config.StateDir != "" {
+		if err := copyHistory(&storage.Local{Dir: config.StateDir}, filepath.Join(dir, _HistoryFile)); err != nil {
+			return dir, err
+		}
+	}
+
+	config.Entries = append(config.Entries, &Entry{
+		Name:     _SelfEntry,
+		Path:     dir,
+		relative: true,
+	})
+	return dir, nil
+}
+
+// copySelf copies the self archive name just written to b to the other
+// destinations of entries and prunes them there, so each of them can
+// bootstrap a recovery. Failures are warnings like those of replicas.
+func (config *Config) copySelf(r *result, b storage.Backend, ent *Entry, name string) {
+	for _, dst := range config.destinations() {
+		if dst == config.Dst {
+			continue
+		}
+		db, err := config.dstBackend(dst)
+		if err != nil {
+			r.warnings = append(r.warnings, fmt.Sprintf("copying self backup failed. dst=%s err=%s", dst, err))
+			continue
+		}
+		rb := config.entryDir(db, ent)
+		if err := copyGeneration(b, rb, ent, name); err != nil {
+			r.warnings = append(r.warnings, fmt.Sprintf("copying self backup failed. dst=%s err=%s", dst, err))
+			continue
+		}
+		if _, err := config.prune(rb, ent); err != nil {
+			r.warnings = append(r.warnings, fmt.Sprintf("pruning self backup failed. dst=%s err=%s", dst, err))
+		}
+	}
+}
+
+// selfKeys returns the key metadata of config. An unreadable attestation
+// key is left to the validation of the run to report.
+func (config *Config) selfKeys() *selfKeys {
+	keys := &selfKeys{Encrypt: config.Encrypt}
+	if strings.Contains(string(config.raw), _SealedPrefix) {
+		keys.SealKey, _ = sealKeyPath()
+	}
+	if a := config.Attestation; a != nil {
+		keys.Attestation = &selfAttestationKey{Key: a.Key}
+		if key, err := readAttestationKey(a.Key); err == nil {
+			pub := key.Public().(ed25519.PublicKey)
+			keys.Attestation.PublicKey, keys.Attestation.KeyID = hex.EncodeToString(pub), keyID(pub)
+		}
+	}
+	return keys
+}
+
+// copyHistory copies the run history in b to path, if there is one.
+func copyHistory(b storage.Backend, path string) error {
+	r, err := b.Open(_HistoryFile)
+	if storage.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
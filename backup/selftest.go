@@ -0,0 +1,299 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// selftestCommand runs a backup of a generated tree through the
+// archive settings of an entry of the config into a temporary
+// destination and checks the result, so an upgrade or a new system can
+// be trusted before the real backups depend on it. -full also corrupts
+// a copy of the archive, which verification must catch, and restores
+// the tree and compares it with the source.
+func selftestCommand(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin, built-in defaults without")
+	entry := fs.String("entry", "", "entry whose compression, encryption and archive settings to test, the first by default")
+	full := fs.Bool("full", false, "also check corruption detection, restore and compare")
+	keep := fs.Bool("keep", false, "keep the temporary directory")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu selftest [-config path] [-entry name] [-full] [-keep]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	config := &Config{}
+	if *configPath != "" {
+		var err error
+		if config, err = loadConfig(*configPath); err != nil {
+			return err
+		}
+	}
+	var ent *Entry
+	if *entry != "" {
+		if ent = config.findEntry(*entry); ent == nil {
+			return fmt.Errorf("entry not found. name=%s", *entry)
+		}
+	} else if len(config.Entries) > 0 {
+		ent = config.Entries[0]
+	}
+
+	dir, err := ioutil.TempDir(config.TmpDir, "tarbu-selftest-")
+	if err != nil {
+		return err
+	}
+	if *keep {
+		fmt.Printf("Testing in %s\n", dir)
+	} else {
+		defer os.RemoveAll(dir)
+	}
+	return config.selftest(ent, dir, *full)
+}
+
+// selftest runs the steps of selftestCommand in dir, with the archive
+// settings of ent, or the defaults when it is nil.
+func (config *Config) selftest(ent *Entry, dir string, full bool) error {
+	src := filepath.Join(dir, "src")
+	if err := makeSelftestTree(src); err != nil {
+		return fmt.Errorf("selftest failed. step=source err=%s", err)
+	}
+	te := &Entry{Name: "selftest", Path: src}
+	if ent != nil {
+		te.Compression, te.CompressionLevel, te.CompressionWorkers, te.ArchiveWorkers = ent.Compression, ent.CompressionLevel, ent.CompressionWorkers, ent.ArchiveWorkers
+		te.PreserveExtended, te.Index, te.SplitSize = ent.PreserveExtended, ent.Index, ent.SplitSize
+	}
+	st := &Config{
+		Dst:                filepath.Join(dir, "dst"),
+		KeepGen:            2,
+		TmpDir:             config.TmpDir,
+		Encrypt:            config.Encrypt,
+		ReadWorkers:        config.ReadWorkers,
+		CompressionWorkers: config.CompressionWorkers,
+		ArchiveWorkers:     config.ArchiveWorkers,
+		Entries:            []*Entry{te},
+	}
+	if err := os.Mkdir(st.Dst, 0700); err != nil {
+		return err
+	}
+	if err := st.isValid(); err != nil {
+		return fmt.Errorf("selftest failed. step=config err=%s", err)
+	}
+	st.runID = newRunID()
+
+	r := &result{name: te.Name}
+	if err := backupEntryImpl(context.Background(), r, st, te); err != nil {
+		return fmt.Errorf("selftest failed. step=backup err=%s", err)
+	}
+	printSuccess("Selftest step passed: step=backup archive=%s size=%s", r.archive, formatSize(r.size))
+
+	b, err := st.entryBackend(te)
+	if err != nil {
+		return err
+	}
+	name, err := findGeneration(b, te, "latest")
+	if err != nil {
+		return err
+	}
+	want, err := readChecksum(b, name)
+	if err != nil {
+		return fmt.Errorf("selftest failed. step=verify err=%s", err)
+	}
+	sum, err := hashObject(b, name)
+	if err != nil {
+		return fmt.Errorf("selftest failed. step=verify err=%s", err)
+	}
+	if got := hex.EncodeToString(sum); got != want {
+		return fmt.Errorf("selftest failed. step=verify sha256=%s want=%s", got, want)
+	}
+	if err := st.verifyArchive(b, te, name); err != nil {
+		return fmt.Errorf("selftest failed. step=verify err=%s", err)
+	}
+	printSuccess("Selftest step passed: step=verify sha256=%s", want)
+	if !full {
+		return nil
+	}
+
+	if err := st.selftestCorruption(te, name, sum); err != nil {
+		return err
+	}
+	printSuccess("Selftest step passed: step=corruption")
+
+	out := filepath.Join(dir, "out")
+	var opts []string
+	if te.PreserveExtended {
+		opts = _ExtendedAttrOpts
+	}
+	if err := st.restoreGeneration(b, te, name, out, opts, true, nil); err != nil {
+		return fmt.Errorf("selftest failed. step=restore err=%s", err)
+	}
+	printSuccess("Selftest step passed: step=restore to=%s", out)
+
+	diffs, err := compareTrees(src, filepath.Join(out, src))
+	if err != nil {
+		return fmt.Errorf("selftest failed. step=compare err=%s", err)
+	}
+	for _, d := range diffs {
+		printError("Selftest mismatch: %s", d)
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("selftest failed. step=compare mismatches=%d", len(diffs))
+	}
+	printSuccess("Selftest step passed: step=compare")
+	return nil
+}
+
+// selftestCorruption stores a copy of name with a byte flipped as the
+// next generation, under the checksum of name, and fails unless
+// verification tells it is corrupt.
+func (config *Config) selftestCorruption(ent *Entry, name string, sum []byte) error {
+	b, err := config.entryBackend(ent)
+	if err != nil {
+		return err
+	}
+	r, err := b.Open(name)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	data[len(data)/2] ^= 0xff
+	corrupt, err := config.archiveName(b, ent)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(corrupt, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	defer b.Delete(append(sidecars(ent, corrupt), corrupt)...)
+	if err := writeChecksum(b, corrupt, sum); err != nil {
+		return err
+	}
+
+	got, err := hashObject(b, corrupt)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(got, sum) {
+		return fmt.Errorf("selftest failed. step=corruption err=checksum matched a corrupt archive")
+	}
+	// the checksum is what verify trusts, a readable archive is only
+	// unlucky
+	if err := config.verifyArchive(b, ent, corrupt); err == nil {
+		printWarning("Corrupt archive still reads as a tar stream: archive=%s", b.Location(corrupt))
+	}
+	return nil
+}
+
+// makeSelftestTree writes the files archives must keep: empty, large and
+// deep files, long and non-ASCII names, links and modes.
+func makeSelftestTree(dir string) error {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 1<<20+123)
+	rnd.Read(random)
+	files := []struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}{
+		{"plain.txt", []byte("hello\n"), 0644},
+		{"empty", nil, 0644},
+		{"random.bin", random, 0600},
+		{"deep/a/b/c/d/file", []byte("deep\n"), 0644},
+		{strings.Repeat("long", 30), []byte("long name\n"), 0644},
+		{"ünïcødé-名前.txt", []byte("unicode\n"), 0644},
+		{"script.sh", []byte("#!/bin/sh\n"), 0755},
+	}
+	for _, f := range files {
+		p := filepath.Join(dir, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(p, f.data, f.mode); err != nil {
+			return err
+		}
+		if err := os.Chmod(p, f.mode); err != nil {
+			return err
+		}
+	}
+	if err := os.Symlink("plain.txt", filepath.Join(dir, "link")); err != nil {
+		return err
+	}
+	if err := os.Link(filepath.Join(dir, "plain.txt"), filepath.Join(dir, "hard")); err != nil {
+		return err
+	}
+	if err := os.Mkdir(filepath.Join(dir, "private"), 0750); err != nil {
+		return err
+	}
+	// a fixed past mtime, which a restore must bring back
+	past := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || fi.Mode()&os.ModeSymlink != 0 {
+			return err
+		}
+		return os.Chtimes(p, past, past)
+	})
+}
+
+// compareTrees returns how the tree restored differs from src, by type,
+// mode, mtime, contents, link targets and hard links.
+func compareTrees(src, restored string) ([]string, error) {
+	var diffs []string
+	err := filepath.Walk(src, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, p)
+		rp := filepath.Join(restored, rel)
+		rfi, err := os.Lstat(rp)
+		if err != nil {
+			diffs = append(diffs, fmt.Sprintf("file=%s err=missing", rel))
+			return nil
+		}
+		if rfi.Mode() != fi.Mode() {
+			diffs = append(diffs, fmt.Sprintf("file=%s mode=%s want=%s", rel, rfi.Mode(), fi.Mode()))
+			return nil
+		}
+		switch {
+		case fi.Mode()&os.ModeSymlink != 0:
+			want, _ := os.Readlink(p)
+			if got, err := os.Readlink(rp); err != nil || got != want {
+				diffs = append(diffs, fmt.Sprintf("file=%s link=%s want=%s", rel, got, want))
+			}
+			return nil
+		case fi.Mode().IsRegular():
+			want, err := hashFile(p)
+			if err != nil {
+				return err
+			}
+			if got, err := hashFile(rp); err != nil || !bytes.Equal(got, want) {
+				diffs = append(diffs, fmt.Sprintf("file=%s err=contents differ", rel))
+			}
+		}
+		if !rfi.ModTime().Equal(fi.ModTime()) {
+			diffs = append(diffs, fmt.Sprintf("file=%s mtime=%s want=%s", rel, rfi.ModTime().UTC(), fi.ModTime().UTC()))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	a, aerr := os.Stat(filepath.Join(restored, "plain.txt"))
+	h, herr := os.Stat(filepath.Join(restored, "hard"))
+	if aerr == nil && herr == nil && !os.SameFile(a, h) {
+		diffs = append(diffs, "file=hard err=hard link restored as a copy")
+	}
+	return diffs, nil
+}
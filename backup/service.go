@@ -0,0 +1,98 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// _ServiceName is the default name of the Windows service.
+const _ServiceName = "tarbu"
+
+// serviceCommand installs, removes or runs tarbu daemon as a Windows
+// service. The service manager starts it with run and the daemon flags
+// given to install. Stop and Shutdown stop it once the running backup
+// finished, as SIGTERM does, and Paramchange reloads the config as
+// SIGHUP does. Its events go to the Application event log too.
+func serviceCommand(args []string) error {
+	const usage = "usage: tarbu service install|uninstall|run [flags]"
+	if len(args) < 1 {
+		return fmt.Errorf(usage)
+	}
+	switch args[0] {
+	case "install":
+		return serviceInstallCommand(args[1:])
+	case "uninstall":
+		return serviceUninstallCommand(args[1:])
+	case "run":
+		return serviceRunCommand(args[1:])
+	}
+	return fmt.Errorf(usage)
+}
+
+func serviceInstallCommand(args []string) error {
+	fs := flag.NewFlagSet("service install", flag.ExitOnError)
+	name := fs.String("name", _ServiceName, "name of the service")
+	d := &daemon{}
+	d.register(fs)
+	fs.Parse(args)
+
+	if d.configPath == "" || d.configPath == "-" {
+		return fmt.Errorf("service needs a config file")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd, err := serviceArgs(fs)
+	if err != nil {
+		return err
+	}
+	if err := installService(*name, append([]string{exe, "service", "run"}, cmd...)); err != nil {
+		return fmt.Errorf("installing service failed. name=%s err=%s", *name, err)
+	}
+	printSuccess("Installed service: name=%s config=%s", *name, d.configPath)
+	return nil
+}
+
+// serviceArgs returns the flags set on fs for service run. Services
+// start in the system directory, so paths are made absolute.
+func serviceArgs(fs *flag.FlagSet) ([]string, error) {
+	var args []string
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		v := f.Value.String()
+		if (f.Name == "config" || f.Name == "log-file") && v != "" && err == nil {
+			v, err = filepath.Abs(v)
+		}
+		args = append(args, "-"+f.Name+"="+v)
+	})
+	return args, err
+}
+
+func serviceUninstallCommand(args []string) error {
+	fs := flag.NewFlagSet("service uninstall", flag.ExitOnError)
+	name := fs.String("name", _ServiceName, "name of the service")
+	fs.Parse(args)
+
+	if err := uninstallService(*name); err != nil {
+		return fmt.Errorf("removing service failed. name=%s err=%s", *name, err)
+	}
+	printSuccess("Removed service: name=%s", *name)
+	return nil
+}
+
+// serviceRunCommand is the command line the service manager starts.
+func serviceRunCommand(args []string) error {
+	fs := flag.NewFlagSet("service run", flag.ExitOnError)
+	name := fs.String("name", _ServiceName, "name of the service")
+	d := &daemon{}
+	d.register(fs)
+	fs.Parse(args)
+
+	if err := d.setup(); err != nil {
+		return err
+	}
+	return runService(*name, d)
+}
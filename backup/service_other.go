@@ -0,0 +1,21 @@
+//go:build !windows
+
+package backup
+
+import "fmt"
+
+// errNoService fails tarbu service outside Windows, where the init
+// system runs tarbu daemon instead.
+var errNoService = fmt.Errorf("services are Windows only, run tarbu daemon under the init system")
+
+func installService(name string, args []string) error {
+	return errNoService
+}
+
+func uninstallService(name string) error {
+	return errNoService
+}
+
+func runService(name string, d *daemon) error {
+	return errNoService
+}
@@ -0,0 +1,332 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	advapi32                     = syscall.NewLazyDLL("advapi32.dll")
+	openSCManager                = advapi32.NewProc("OpenSCManagerW")
+	createService                = advapi32.NewProc("CreateServiceW")
+	openService                  = advapi32.NewProc("OpenServiceW")
+	deleteService                = advapi32.NewProc("DeleteService")
+	closeServiceHandle           = advapi32.NewProc("CloseServiceHandle")
+	startServiceCtrlDispatcher   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	registerServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	setServiceStatus             = advapi32.NewProc("SetServiceStatus")
+	registerEventSource          = advapi32.NewProc("RegisterEventSourceW")
+	deregisterEventSource        = advapi32.NewProc("DeregisterEventSource")
+	reportEvent                  = advapi32.NewProc("ReportEventW")
+	regCreateKeyEx               = advapi32.NewProc("RegCreateKeyExW")
+	regSetValueEx                = advapi32.NewProc("RegSetValueExW")
+	regDeleteKey                 = advapi32.NewProc("RegDeleteKeyW")
+)
+
+const (
+	_SC_MANAGER_ALL_ACCESS     = 0xf003f
+	_SERVICE_ALL_ACCESS        = 0xf01ff
+	_DELETE                    = 0x10000
+	_SERVICE_WIN32_OWN_PROCESS = 0x10
+	_SERVICE_AUTO_START        = 2
+	_SERVICE_ERROR_NORMAL      = 1
+
+	_SERVICE_STOPPED       = 1
+	_SERVICE_START_PENDING = 2
+	_SERVICE_STOP_PENDING  = 3
+	_SERVICE_RUNNING       = 4
+
+	_SERVICE_CONTROL_STOP        = 1
+	_SERVICE_CONTROL_INTERROGATE = 4
+	_SERVICE_CONTROL_SHUTDOWN    = 5
+	_SERVICE_CONTROL_PARAMCHANGE = 6
+	_SERVICE_ACCEPT_STOP         = 1
+	_SERVICE_ACCEPT_SHUTDOWN     = 4
+	_SERVICE_ACCEPT_PARAMCHANGE  = 8
+
+	_EVENTLOG_ERROR_TYPE       = 1
+	_EVENTLOG_WARNING_TYPE     = 2
+	_EVENTLOG_INFORMATION_TYPE = 4
+
+	_ERROR_CALL_NOT_IMPLEMENTED              = 120
+	_ERROR_FAILED_SERVICE_CONTROLLER_CONNECT = syscall.Errno(1063)
+	_ERROR_SERVICE_SPECIFIC_ERROR            = 1066
+	_ERROR_FILE_NOT_FOUND                    = syscall.Errno(2)
+)
+
+// _EventLogKey is where event sources of the Application log are set up.
+const _EventLogKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+
+type serviceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+func openManager() (uintptr, error) {
+	m, _, err := openSCManager.Call(0, 0, _SC_MANAGER_ALL_ACCESS)
+	if m == 0 {
+		return 0, err
+	}
+	return m, nil
+}
+
+// installService creates the auto-started service name running args,
+// and the event source its events are logged with.
+func installService(name string, args []string) error {
+	for i, a := range args {
+		args[i] = syscall.EscapeArg(a)
+	}
+	n, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	display, err := syscall.UTF16PtrFromString("tarbu backups (" + name + ")")
+	if err != nil {
+		return err
+	}
+	cmd, err := syscall.UTF16PtrFromString(strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	m, err := openManager()
+	if err != nil {
+		return err
+	}
+	defer closeServiceHandle.Call(m)
+	h, _, err := createService.Call(m, uintptr(unsafe.Pointer(n)), uintptr(unsafe.Pointer(display)), _SERVICE_ALL_ACCESS, _SERVICE_WIN32_OWN_PROCESS,
+		_SERVICE_AUTO_START, _SERVICE_ERROR_NORMAL, uintptr(unsafe.Pointer(cmd)), 0, 0, 0, 0, 0)
+	if h == 0 {
+		return err
+	}
+	closeServiceHandle.Call(h)
+	return installEventSource(name)
+}
+
+// installEventSource registers name in the Application log with the
+// messages of EventCreate.exe, which show the logged line as it is.
+func installEventSource(name string) error {
+	k, err := syscall.UTF16PtrFromString(_EventLogKey + name)
+	if err != nil {
+		return err
+	}
+	var key syscall.Handle
+	if r, _, _ := regCreateKeyEx.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(k)), 0, 0, 0, syscall.KEY_WRITE, 0,
+		uintptr(unsafe.Pointer(&key)), 0); r != 0 {
+		return syscall.Errno(r)
+	}
+	defer syscall.RegCloseKey(key)
+	file, err := syscall.UTF16FromString(`%SystemRoot%\System32\EventCreate.exe`)
+	if err != nil {
+		return err
+	}
+	types := uint32(_EVENTLOG_ERROR_TYPE | _EVENTLOG_WARNING_TYPE | _EVENTLOG_INFORMATION_TYPE)
+	for _, v := range []struct {
+		name string
+		typ  uint32
+		data unsafe.Pointer
+		size uintptr
+	}{
+		{"EventMessageFile", syscall.REG_EXPAND_SZ, unsafe.Pointer(&file[0]), uintptr(len(file) * 2)},
+		{"TypesSupported", syscall.REG_DWORD, unsafe.Pointer(&types), 4},
+	} {
+		vn, err := syscall.UTF16PtrFromString(v.name)
+		if err != nil {
+			return err
+		}
+		if r, _, _ := regSetValueEx.Call(uintptr(key), uintptr(unsafe.Pointer(vn)), 0, uintptr(v.typ), uintptr(v.data), v.size); r != 0 {
+			return syscall.Errno(r)
+		}
+	}
+	return nil
+}
+
+// uninstallService deletes the service name and its event source.
+func uninstallService(name string) error {
+	n, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	m, err := openManager()
+	if err != nil {
+		return err
+	}
+	defer closeServiceHandle.Call(m)
+	h, _, err := openService.Call(m, uintptr(unsafe.Pointer(n)), _DELETE)
+	if h == 0 {
+		return err
+	}
+	defer closeServiceHandle.Call(h)
+	if r, _, err := deleteService.Call(h); r == 0 {
+		return err
+	}
+	k, err := syscall.UTF16PtrFromString(_EventLogKey + name)
+	if err != nil {
+		return err
+	}
+	if r, _, _ := regDeleteKey.Call(uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(k))); r != 0 && syscall.Errno(r) != _ERROR_FILE_NOT_FOUND {
+		return syscall.Errno(r)
+	}
+	return nil
+}
+
+// service is a daemon running under the service manager, which calls
+// main and control on threads of its own.
+type service struct {
+	name string
+	d    *daemon
+	// sig gets the controls of the service as the signals of tarbu daemon
+	sig chan os.Signal
+	err error
+
+	mu     sync.Mutex
+	handle uintptr
+	status serviceStatus
+}
+
+// runService runs d as the service name until it is stopped.
+func runService(name string, d *daemon) error {
+	n, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	s := &service{name: name, d: d, sig: make(chan os.Signal, 1)}
+	table := []serviceTableEntry{{n, syscall.NewCallback(s.main)}, {}}
+	if r, _, err := startServiceCtrlDispatcher.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+		if err == _ERROR_FAILED_SERVICE_CONTROLLER_CONNECT {
+			return errNotService
+		}
+		return err
+	}
+	return s.err
+}
+
+// errNotService fails service run started from a console.
+var errNotService = fmt.Errorf("service run is started by the service manager, run tarbu daemon from a console")
+
+func (s *service) main(argc, argv uintptr) uintptr {
+	n, _ := syscall.UTF16PtrFromString(s.name)
+	h, _, err := registerServiceCtrlHandlerEx.Call(uintptr(unsafe.Pointer(n)), syscall.NewCallback(s.control), 0)
+	if h == 0 {
+		s.err = err
+		return 0
+	}
+	s.mu.Lock()
+	s.handle = h
+	s.mu.Unlock()
+	s.setState(_SERVICE_START_PENDING)
+	if src, _, _ := registerEventSource.Call(0, uintptr(unsafe.Pointer(n))); src != 0 {
+		logs.report = eventReporter(src)
+		defer func() {
+			logs.report = nil
+			deregisterEventSource.Call(src)
+		}()
+	}
+	s.setState(_SERVICE_RUNNING)
+	printSuccess("Service started: name=%s config=%s", s.name, s.d.configPath)
+	if s.err = s.d.run(s.sig); s.err != nil {
+		printError("Service failed: name=%s err=%s", s.name, s.err)
+		s.mu.Lock()
+		s.status.Win32ExitCode = _ERROR_SERVICE_SPECIFIC_ERROR
+		s.status.ServiceSpecificExitCode = uint32(classify(s.err).code)
+		s.mu.Unlock()
+	}
+	s.setState(_SERVICE_STOPPED)
+	return 0
+}
+
+// control handles the controls of the service manager. Stopping waits
+// for the running backup, the check point moving on meanwhile.
+func (s *service) control(ctrl, evtype, evdata, ctx uintptr) uintptr {
+	switch ctrl {
+	case _SERVICE_CONTROL_STOP, _SERVICE_CONTROL_SHUTDOWN:
+		if s.setState(_SERVICE_STOP_PENDING) {
+			go s.signal(syscall.SIGTERM)
+			go s.stopping()
+		}
+	case _SERVICE_CONTROL_PARAMCHANGE:
+		go s.signal(syscall.SIGHUP)
+	case _SERVICE_CONTROL_INTERROGATE:
+		s.mu.Lock()
+		setServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&s.status)))
+		s.mu.Unlock()
+	default:
+		return _ERROR_CALL_NOT_IMPLEMENTED
+	}
+	return 0
+}
+
+func (s *service) signal(sig os.Signal) {
+	s.sig <- sig
+}
+
+// stopping moves the check point on until the service stopped.
+func (s *service) stopping() {
+	for range time.Tick(10 * time.Second) {
+		s.mu.Lock()
+		if s.status.CurrentState != _SERVICE_STOP_PENDING {
+			s.mu.Unlock()
+			return
+		}
+		s.status.CheckPoint++
+		setServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&s.status)))
+		s.mu.Unlock()
+	}
+}
+
+// setState reports state to the service manager. It is false when the
+// service already was in state.
+func (s *service) setState(state uint32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status.CurrentState == state {
+		return false
+	}
+	s.status.ServiceType = _SERVICE_WIN32_OWN_PROCESS
+	s.status.CurrentState = state
+	s.status.CheckPoint = 0
+	s.status.WaitHint = 0
+	s.status.ControlsAccepted = 0
+	switch state {
+	case _SERVICE_RUNNING:
+		s.status.ControlsAccepted = _SERVICE_ACCEPT_STOP | _SERVICE_ACCEPT_SHUTDOWN | _SERVICE_ACCEPT_PARAMCHANGE
+	case _SERVICE_START_PENDING, _SERVICE_STOP_PENDING:
+		s.status.CheckPoint = 1
+		s.status.WaitHint = 30000
+	}
+	setServiceStatus.Call(s.handle, uintptr(unsafe.Pointer(&s.status)))
+	return true
+}
+
+// eventReporter returns a logger report writing to the event source
+// src, by the level of the event.
+func eventReporter(src uintptr) func(level logLevel, line string) {
+	return func(level logLevel, line string) {
+		typ := _EVENTLOG_INFORMATION_TYPE
+		switch level {
+		case levelError:
+			typ = _EVENTLOG_ERROR_TYPE
+		case levelWarn:
+			typ = _EVENTLOG_WARNING_TYPE
+		}
+		p, err := syscall.UTF16PtrFromString(line)
+		if err != nil {
+			return
+		}
+		reportEvent.Call(src, uintptr(typ), 0, 1, 0, 1, 0, uintptr(unsafe.Pointer(&p)), 0)
+	}
+}
@@ -0,0 +1,51 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	mult   int64
+}{
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+}
+
+// parseSize parses byte sizes like "512M" or "4G" (binary units, an
+// optional trailing B or iB) and plain byte counts.
+func parseSize(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	mult := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(v, u.suffix) {
+			v, mult = strings.TrimSuffix(v, u.suffix), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size. size=%s", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// formatSize renders n in the largest binary unit it reaches, with one
+// decimal, e.g. "1.5GiB". Plain byte counts stay whole.
+func formatSize(n int64) string {
+	sign := ""
+	if n < 0 {
+		sign, n = "-", -n
+	}
+	for _, u := range sizeUnits {
+		if n >= u.mult {
+			return fmt.Sprintf("%s%.1f%siB", sign, float64(n)/float64(u.mult), u.suffix)
+		}
+	}
+	return fmt.Sprintf("%s%dB", sign, n)
+}
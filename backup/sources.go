@@ -0,0 +1,65 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func (config *Config) isPathsValid() error {
+	for _, e := range config.Entries {
+		if len(e.Paths) == 0 {
+			continue
+		}
+		if e.Path != "" {
+			return fmt.Errorf("entry Path and Paths are exclusive. name=%s", e.Name)
+		}
+		if e.Type != "" || e.HashCheck {
+			return fmt.Errorf("entries with Paths can't be typed or hash checked. name=%s", e.Name)
+		}
+		for _, p := range e.Paths {
+			if _, err := filepath.Match(p, ""); err != nil || !filepath.IsAbs(p) {
+				return fmt.Errorf("entry paths must be absolute paths or glob patterns. name=%s path=%s", e.Name, p)
+			}
+		}
+	}
+	return nil
+}
+
+// sources returns the trees ent archives: Path, or Paths with the glob
+// patterns expanded and trees below another one dropped, sorted. Paths
+// without matches are skipped unless nothing matches at all.
+func (ent *Entry) sources() ([]string, error) {
+	if len(ent.Paths) == 0 {
+		return []string{ent.Path}, nil
+	}
+	var paths []string
+	for _, p := range ent.Paths {
+		matches, _ := filepath.Glob(p)
+		if len(matches) == 0 && !hasMeta(p) {
+			// a missing plain path fails the run like Path would
+			if _, err := os.Lstat(p); err != nil {
+				return nil, &SourceReadError{p, err}
+			}
+		}
+		for _, m := range matches {
+			paths = append(paths, filepath.Clean(m))
+		}
+	}
+	if len(paths) == 0 {
+		return nil, &SourceReadError{strings.Join(ent.Paths, ","), fmt.Errorf("no path matches")}
+	}
+	sort.Strings(paths)
+	roots := paths[:1]
+	for _, p := range paths[1:] {
+		last := roots[len(roots)-1]
+		if p != last && !strings.HasPrefix(p, strings.TrimSuffix(last, "/")+"/") {
+			roots = append(roots, p)
+		}
+	}
+	return roots, nil
+}
+
+func hasMeta(p string) bool { return strings.ContainsAny(p, `*?[\`) }
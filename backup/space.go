@@ -0,0 +1,93 @@
+package backup
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+func (config *Config) isMinFreeSpaceValid() error {
+	if config.MinFreeSpace == "" {
+		return nil
+	}
+	n, err := parseSize(config.MinFreeSpace)
+	if err != nil {
+		return fmt.Errorf("config.MinFreeSpace is invalid. err=%s", err)
+	}
+	config.space = &spaceLedger{reserve: n, reserved: map[string]int64{}}
+	return nil
+}
+
+// spaceLedger counts the estimated archives of the entries being
+// archived per destination, so entries archived concurrently don't all
+// count on the same free space.
+type spaceLedger struct {
+	mu sync.Mutex
+	// reserve is MinFreeSpace parsed by isValid
+	reserve  int64
+	reserved map[string]int64
+}
+
+// estimateArchive is the space the next archive of ent likely takes:
+// the largest generation kept, the full backup of incremental entries,
+// or the size of the source files before the first archive.
+func (config *Config) estimateArchive(b storage.Backend, ent *Entry, roots []string, c *census) (int64, error) {
+	gens, err := generations(b, ent)
+	if err != nil {
+		return 0, &DestinationWriteError{config.entryDst(ent), err}
+	}
+	var n int64
+	for _, g := range gens {
+		if g.Size > n {
+			n = g.Size
+		}
+	}
+	if n > 0 {
+		return n, nil
+	}
+	if c == nil {
+		scanned, err := config.scanSources(ent, roots)
+		if err != nil {
+			return 0, &SourceReadError{ent.Path, err}
+		}
+		c = &scanned
+	}
+	return c.bytes, nil
+}
+
+// reserveSpace fails before anything is written when the destination of
+// ent can't take its estimated archive and MinFreeSpace on top, counting
+// the entries archiving into it already. The estimate is held until the
+// returned func is called. Backends not telling their free space pass.
+func (config *Config) reserveSpace(b storage.Backend, ent *Entry, roots []string, c *census) (func(), error) {
+	l := config.space
+	if l == nil {
+		return func() {}, nil
+	}
+	dst := config.entryDst(ent)
+	free, err := storage.Free(b)
+	if err != nil {
+		return nil, &DestinationWriteError{dst, fmt.Errorf("free space is unknown. err=%s", err)}
+	}
+	if free < 0 {
+		return func() {}, nil
+	}
+	need, err := config.estimateArchive(b, ent, roots, c)
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if free-l.reserved[dst]-need < l.reserve {
+		return nil, &DestinationWriteError{dst, fmt.Errorf("not enough free space. free=%s reserved=%s needed=%s min_free=%s",
+			formatSize(free), formatSize(l.reserved[dst]), formatSize(need), formatSize(l.reserve))}
+	}
+	l.reserved[dst] += need
+	return func() {
+		l.mu.Lock()
+		l.reserved[dst] -= need
+		l.mu.Unlock()
+	}, nil
+}
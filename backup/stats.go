@@ -0,0 +1,88 @@
+package backup
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// writeJSON writes v indented, the -json output of the inspection
+// subcommands. Their schemas are kept stable: fields may be added but
+// are not renamed or removed.
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(v)
+}
+
+// entryStats summarizes the generations of one entry in Dst.
+type entryStats struct {
+	Entry       string
+	Generations int
+	Bytes       int64
+	Oldest      *time.Time `json:",omitempty"`
+	Newest      *time.Time `json:",omitempty"`
+}
+
+func statsCommand(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	stats, err := config.stats()
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		return writeJSON(os.Stdout, stats)
+	}
+	fmt.Printf("%-24s %11s %9s  %-23s %-23s\n", "ENTRY", "GENERATIONS", "SIZE", "OLDEST", "NEWEST")
+	for _, s := range stats {
+		oldest, newest := "-", "-"
+		if s.Oldest != nil {
+			oldest = config.formatTime(*s.Oldest)
+			newest = config.formatTime(*s.Newest)
+		}
+		fmt.Printf("%-24s %11d %9s  %-23s %-23s\n", s.Entry, s.Generations, formatSize(s.Bytes), oldest, newest)
+	}
+	return nil
+}
+
+// stats returns the entryStats of every entry and the self backup.
+func (config *Config) stats() ([]entryStats, error) {
+	stats := []entryStats{}
+	entries := config.entriesWithSelf()
+	for _, e := range entries {
+		b, err := config.entryBackend(e)
+		if err != nil {
+			return nil, err
+		}
+		gens, err := generations(b, e)
+		if err != nil {
+			return nil, err
+		}
+		if e.Name == _SelfEntry && len(gens) == 0 {
+			continue
+		}
+		s := entryStats{Entry: e.Name, Generations: len(gens)}
+		for _, g := range gens {
+			s.Bytes += g.Size
+		}
+		// numbered archives don't tell their time
+		if len(gens) > 0 && !e.numbered() {
+			oldest := time.Unix(archiveTime(e, gens[0].Name), 0)
+			newest := time.Unix(archiveTime(e, gens[len(gens)-1].Name), 0)
+			s.Oldest, s.Newest = &oldest, &newest
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
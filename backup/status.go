@@ -0,0 +1,154 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+// statusEntry is the last success and failure of an entry in the run
+// history. Status is "ok", "failing" when the last run failed after a
+// success younger than the threshold, "stale" when the last success is
+// older and "missing" without one. Age and Duration are seconds.
+type statusEntry struct {
+	Entry       string
+	Status      string
+	LastSuccess *time.Time `json:",omitempty"`
+	Age         *int64     `json:",omitempty"`
+	Duration    int64      `json:",omitempty"`
+	Archive     string     `json:",omitempty"`
+	Size        int64      `json:",omitempty"`
+	LastFailure *time.Time `json:",omitempty"`
+	Error       string     `json:",omitempty"`
+	Kind        string     `json:",omitempty"`
+}
+
+// statusCommand shows the last success and failure of the given
+// entries, every entry without arguments, and fails when one has no
+// success younger than -stale, config.StaleAfter by default.
+func statusCommand(args []string) error {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	staleFlag := fs.String("stale", "", "age after which the last success is stale, e.g. 26h or 2d, config.StaleAfter by default")
+	asJSON := fs.Bool("json", false, "print JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu status [-config path] [-stale duration] [-json] [entry...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := config.isHistoryValid(); err != nil {
+		return err
+	}
+	limit := config.staleAfter
+	if *staleFlag != "" {
+		if limit, err = parseDuration(*staleFlag); err != nil || limit <= 0 {
+			return fmt.Errorf("stale age is invalid. stale=%s", *staleFlag)
+		}
+	}
+	entries := config.Entries
+	if config.SelfBackup {
+		entries = config.entriesWithSelf()
+	}
+	if fs.NArg() > 0 {
+		entries = nil
+		for _, n := range fs.Args() {
+			ent := config.findEntry(n)
+			if ent == nil {
+				return fmt.Errorf("entry not found. name=%s", n)
+			}
+			entries = append(entries, ent)
+		}
+	}
+	records, err := config.readHistory(time.Time{})
+	if err != nil {
+		return err
+	}
+	list := buildStatus(entries, records, config.now(), limit)
+
+	if *asJSON {
+		if err := writeJSON(os.Stdout, list); err != nil {
+			return err
+		}
+	} else {
+		config.writeStatusText(list)
+	}
+	stale := 0
+	for _, st := range list {
+		if st.Status == "stale" || st.Status == "missing" {
+			stale++
+		}
+	}
+	if stale > 0 {
+		return fmt.Errorf("backups are stale. entries=%d stale_after=%s", stale, limit)
+	}
+	return nil
+}
+
+// buildStatus folds records, oldest first, into the status of entries.
+// limit zero flags only entries without a success.
+func buildStatus(entries []*Entry, records []historyRecord, now time.Time, limit time.Duration) []*statusEntry {
+	byEntry := map[string]*statusEntry{}
+	list := []*statusEntry{}
+	for _, ent := range entries {
+		st := &statusEntry{Entry: ent.Name}
+		byEntry[ent.Name] = st
+		list = append(list, st)
+	}
+	for _, rec := range records {
+		st := byEntry[rec.Entry]
+		if st == nil || rec.Skipped != "" {
+			continue
+		}
+		at := rec.Start
+		if rec.Error != "" {
+			st.LastFailure, st.Error, st.Kind = &at, rec.Error, rec.Kind
+			continue
+		}
+		st.LastSuccess, st.Archive, st.Size = &at, rec.Archive, rec.Size
+		st.Duration = int64(rec.Duration / time.Second)
+	}
+	for _, st := range list {
+		switch {
+		case st.LastSuccess == nil:
+			st.Status = "missing"
+			continue
+		case st.LastFailure != nil && st.LastFailure.After(*st.LastSuccess):
+			st.Status = "failing"
+		default:
+			st.Status = "ok"
+		}
+		age := now.Sub(*st.LastSuccess).Round(time.Second)
+		secs := int64(age / time.Second)
+		st.Age = &secs
+		if limit > 0 && age > limit {
+			st.Status = "stale"
+		}
+	}
+	return list
+}
+
+func (config *Config) writeStatusText(list []*statusEntry) {
+	fmt.Printf("%-24s %-8s %-23s %8s %9s  %s\n", "ENTRY", "STATUS", "LAST SUCCESS", "AGE", "SIZE", "LAST FAILURE")
+	for _, st := range list {
+		success, age, size, failure := "-", "-", "-", "-"
+		if st.LastSuccess != nil {
+			success, size = config.formatTime(*st.LastSuccess), formatSize(st.Size)
+			age = formatAge(time.Duration(*st.Age) * time.Second)
+		}
+		if st.LastFailure != nil {
+			failure = config.formatTime(*st.LastFailure)
+		}
+		fmt.Printf("%-24s %-8s %-23s %8s %9s  %s\n", st.Entry, st.Status, success, age, size, failure)
+	}
+	for _, st := range list {
+		if st.Status == "failing" {
+			fmt.Printf("\nLast failure of %s at %s:\n  %s\n", st.Entry, config.formatTime(*st.LastFailure), st.Error)
+		}
+	}
+}
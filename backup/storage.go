@@ -0,0 +1,276 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/k3nju/tarbu/internal/archiver"
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// isReadOnly is true when config.ReadOnly or $TARBU_READ_ONLY is set. The
+// environment variable lets a wrapper restrict an invocation regardless
+// of the config it is given.
+func (config *Config) isReadOnly() bool {
+	return config.ReadOnly || os.Getenv("TARBU_READ_ONLY") != ""
+}
+
+// backend returns the storage backend of config.Dst. In read-only mode
+// and dry runs it refuses every write and delete.
+func (config *Config) backend() (storage.Backend, error) {
+	if config.dst != nil {
+		return config.dst, nil
+	}
+	b, err := config.openDst(config.Dst)
+	if err != nil {
+		return nil, err
+	}
+	config.dst = b
+	return b, nil
+}
+
+func (config *Config) openDst(dst string) (storage.Backend, error) {
+	b, err := storage.Open(dst, &storage.Options{
+		Credentials: config.Credentials,
+		TmpDir:      config.TmpDir,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("config.Dst is invalid. dst=%s err=%s", dst, err)
+	}
+	if b, err = config.uploader(dst, b); err != nil {
+		return nil, err
+	}
+	if config.isReadOnly() || config.dryRun {
+		b = storage.ReadOnly(b)
+	}
+	return b, nil
+}
+
+// entryDst is the destination of ent, its own Dst or config.Dst.
+func (config *Config) entryDst(ent *Entry) string {
+	if ent.Dst != "" {
+		return ent.Dst
+	}
+	return config.Dst
+}
+
+// destinations returns config.Dst and the distinct Dst of entries,
+// sorted.
+func (config *Config) destinations() []string {
+	seen := map[string]bool{config.Dst: true}
+	dsts := []string{config.Dst}
+	for _, e := range config.Entries {
+		if !seen[e.Dst] && e.Dst != "" {
+			seen[e.Dst] = true
+			dsts = append(dsts, e.Dst)
+		}
+	}
+	sort.Strings(dsts)
+	return dsts
+}
+
+// dstBackend returns the backend of the destination dst. Entry
+// destinations are opened once, by isDstWritable before entries run
+// concurrently.
+func (config *Config) dstBackend(dst string) (storage.Backend, error) {
+	if dst == "" || dst == config.Dst {
+		return config.backend()
+	}
+	if b, ok := config.entryDsts[dst]; ok {
+		return b, nil
+	}
+	b, err := config.openDst(dst)
+	if err != nil {
+		return nil, err
+	}
+	if config.entryDsts == nil {
+		config.entryDsts = map[string]storage.Backend{}
+	}
+	config.entryDsts[dst] = b
+	return b, nil
+}
+
+// generations returns the archives of ent in b, plain and encrypted,
+// oldest first.
+func generations(b storage.Backend, ent *Entry) ([]storage.Object, error) {
+	objs, err := b.List(ent.Name)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	sizes := map[string]int64{}
+	for _, o := range objs {
+		if isGeneration(ent, o.Name) {
+			names = append(names, o.Name)
+			sizes[o.Name] = o.Size
+		}
+	}
+	if ent.numbered() {
+		// the highest number is the oldest
+		sort.Sort(sort.Reverse(tsSortable{ent, names}))
+	} else {
+		sort.Sort(tsSortable{ent, names})
+	}
+	gens := make([]storage.Object, len(names))
+	for i, n := range names {
+		gens[i] = storage.Object{Name: n, Size: sizes[n]}
+	}
+	return gens, nil
+}
+
+// isGeneration tells whether name is an archive name of ent, plain or
+// encrypted.
+func isGeneration(ent *Entry, name string) bool {
+	_, err := generationKey(ent, name)
+	return err == nil
+}
+
+// cleanTmp deletes the temporary archives and sidecars of ent that
+// runs killed while writing them left in b, and returns their locations.
+func cleanTmp(b storage.Backend, ent *Entry) ([]string, error) {
+	objs, err := b.List(ent.Name)
+	if err != nil {
+		return nil, err
+	}
+	var orphans, locs []string
+	for _, o := range objs {
+		name := strings.TrimSuffix(strings.TrimSuffix(o.Name, storage.TmpSuffix), _ChecksumSuffix)
+		name = storage.WholeName(strings.TrimSuffix(name, _MetaSuffix))
+		if strings.HasSuffix(o.Name, storage.TmpSuffix) && isGeneration(ent, name) {
+			orphans = append(orphans, o.Name)
+			locs = append(locs, b.Location(o.Name))
+		}
+	}
+	if len(orphans) == 0 {
+		return nil, nil
+	}
+	return locs, b.Delete(orphans...)
+}
+
+// generationAt returns the archive name of ent with genKey k.
+func generationAt(b storage.Backend, ent *Entry, k genKey) (string, error) {
+	gens, err := generations(b, ent)
+	if err != nil {
+		return "", err
+	}
+	for _, g := range gens {
+		if archiveKey(ent, g.Name) == k {
+			return g.Name, nil
+		}
+	}
+	return "", fmt.Errorf("generation not found. entry=%s ts=%s", ent.Name, k)
+}
+
+// putError is the error of a failed Put of loc into b: an UploadError
+// for remote destinations, a DestinationWriteError for local ones.
+func putError(b storage.Backend, loc string, err error) error {
+	if storage.IsRemoteBackend(b) {
+		return &UploadError{loc, err}
+	}
+	return &DestinationWriteError{loc, err}
+}
+
+// putArchive streams what write produces into name and returns its size
+// and SHA-256 sum. A failing Put is returned as putError does, other
+// errors of write as they are. Nothing is left behind on failure. A
+// panicking Put panics the caller, which fails its entry only.
+func putArchive(b storage.Backend, name string, write func(io.Writer) error) (int64, []byte, error) {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if v := recover(); v != nil {
+				pr.CloseWithError(fmt.Errorf("upload stopped"))
+				done <- &panicError{v}
+			}
+		}()
+		err := b.Put(name, pr)
+		// unblock write if Put gave up early
+		pr.CloseWithError(fmt.Errorf("upload stopped"))
+		done <- err
+	}()
+
+	cw := &countingWriter{w: pw, h: sha256.New()}
+	werr := write(cw)
+	pw.CloseWithError(werr)
+	perr := <-done
+	if pe, ok := perr.(*panicError); ok {
+		panic(pe.value)
+	}
+	if perr != nil && werr != nil && !errors.Is(perr, werr) {
+		// Put failed on its own, which failed write unless the source
+		// did too
+		switch werr.(type) {
+		case *archiver.SourceError, *SourceReadError:
+		default:
+			werr = nil
+		}
+	}
+	if werr != nil {
+		if perr == nil {
+			// Put stored a partial archive
+			b.Delete(name)
+		}
+		return 0, nil, werr
+	}
+	if perr != nil {
+		return 0, nil, putError(b, b.Location(name), perr)
+	}
+	return cw.n, cw.h.Sum(nil), nil
+}
+
+// countingWriter counts and hashes what is written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+	h hash.Hash
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.h.Write(p[:n])
+	return n, err
+}
+
+// entryBackend returns the backend holding the archives of ent.
+func (config *Config) entryBackend(ent *Entry) (storage.Backend, error) {
+	b, err := config.dstBackend(ent.Dst)
+	if err != nil {
+		return nil, err
+	}
+	return config.entryDir(b, ent), nil
+}
+
+// entryDir is the part of the destination b holding the archives of ent,
+// its directory named after the entry with PerEntrySubdir. Archives
+// split in parts read as whole ones.
+func (config *Config) entryDir(b storage.Backend, ent *Entry) storage.Backend {
+	if config.PerEntrySubdir {
+		b = storage.Sub(b, ent.Name)
+	}
+	return storage.Split(b, ent.splitSize, func(name string) bool { return isGeneration(ent, name) })
+}
+
+func (config *Config) isSplitValid() error {
+	for _, e := range config.Entries {
+		if e.SplitSize == "" {
+			continue
+		}
+		n, err := parseSize(e.SplitSize)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("entry split size must be a positive size. name=%s split_size=%s", e.Name, e.SplitSize)
+		}
+		if e.Repository {
+			return fmt.Errorf("repository entries store chunks, not archives, and can't be split. name=%s", e.Name)
+		}
+		e.splitSize = n
+	}
+	return nil
+}
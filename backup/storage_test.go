@@ -0,0 +1,507 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/archiver"
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// failingBackend fails every Put after reading what it is given.
+type failingBackend struct {
+	*storage.Memory
+}
+
+var errFull = errors.New("destination full")
+
+func (failingBackend) Put(name string, r io.Reader) error {
+	ioutil.ReadAll(r)
+	return errFull
+}
+
+func TestPutArchiveErrors(t *testing.T) {
+	source := &SourceReadError{"/src/p", errors.New("special file found")}
+
+	// a failing source is reported as such and leaves nothing behind
+	m := storage.NewMemory()
+	if _, _, err := putArchive(m, "a", func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return source
+	}); err != source {
+		t.Fatalf("putArchive returned %v, want %v", err, source)
+	}
+	if len(m.Objects) != 0 {
+		t.Fatalf("partial archive left behind: %v", m.Objects)
+	}
+
+	// a failing Put is a destination error, also when it fails write
+	b := failingBackend{storage.NewMemory()}
+	var dwe *DestinationWriteError
+	if _, _, err := putArchive(b, "a", func(w io.Writer) error {
+		_, err := w.Write([]byte("data"))
+		return &archiver.WriteError{Err: err}
+	}); !errors.As(err, &dwe) || dwe.Err != errFull {
+		t.Fatalf("putArchive returned %v, want a DestinationWriteError", err)
+	}
+
+	n, sum, err := putArchive(m, "a", func(w io.Writer) error {
+		_, err := w.Write([]byte("data"))
+		return err
+	})
+	if err != nil || n != 4 || string(m.Objects["a"]) != "data" {
+		t.Fatalf("putArchive stored %q, n=%d err=%v", m.Objects["a"], n, err)
+	}
+	if want := sha256.Sum256([]byte("data")); !bytes.Equal(sum, want[:]) {
+		t.Fatalf("putArchive returned sum %x, want %x", sum, want)
+	}
+
+	// remote destinations fail uploads, with their own exit code
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	s3, err := storage.Open("s3://bucket/dst?endpoint="+url.QueryEscape(srv.URL), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, remote := range []storage.Backend{s3, storage.ReadOnly(s3)} {
+		_, _, err := putArchive(remote, "a", func(w io.Writer) error {
+			_, err := w.Write([]byte("data"))
+			return err
+		})
+		var ue *UploadError
+		if !errors.As(err, &ue) || ue.Dst != "s3://bucket/dst/a" || classify(err).code != _ExitUpload {
+			t.Errorf("putArchive returned %v, want an UploadError", err)
+		}
+	}
+	if err := writeChecksum(s3, "a", sum); errorKind(err) != "upload" {
+		t.Errorf("writeChecksum returned %v, want an upload error", err)
+	}
+}
+
+func TestUploadRetries(t *testing.T) {
+	spool := t.TempDir()
+	for _, config := range []*Config{
+		{UploadRetries: -1},
+		{UploadRetries: 1, UploadRetryDelay: "soon"},
+		{UploadRetryDelay: "0s"},
+		{SpoolUpload: "async"},
+		{Spool: spool, SpoolUpload: "later"},
+		{Spool: filepath.Join(spool, "missing")},
+	} {
+		if err := config.isUploadValid(); err == nil {
+			t.Errorf("upload policy %+v is accepted", config)
+		}
+	}
+
+	// uploads failing for good are retried from the copy, not archived
+	// again
+	var puts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if r.Method == "PUT" {
+			puts++
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("<ListBucketResult></ListBucketResult>"))
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	ent := &Entry{Name: "www", Path: t.TempDir(), Retries: 2, RetryDelay: "1ms"}
+	config := &Config{Dst: "s3://bucket/dst?endpoint=" + url.QueryEscape(srv.URL), KeepGen: 1, Entries: []*Entry{ent},
+		UploadRetries: 2, UploadRetryDelay: "1ms", TmpDir: t.TempDir()}
+	b, err := config.backend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := b.(*storage.Uploader); !ok {
+		t.Fatalf("backend is %T", b)
+	}
+	r := &result{name: ent.Name}
+	if err := config.archiveRetrying(r, ent); errorKind(err) != "upload" {
+		t.Fatalf("archiveRetrying returned %v", err)
+	}
+	if puts != 3 || len(r.warnings) != 0 {
+		t.Errorf("puts=%d warnings=%q", puts, r.warnings)
+	}
+	if left, _ := ioutil.ReadDir(config.TmpDir); len(left) != 0 {
+		t.Errorf("copies left: %d", len(left))
+	}
+
+	// a Spool keeps the copies without retries too
+	spooled := &Config{Dst: config.Dst, Spool: spool}
+	if b, err := spooled.backend(); err != nil {
+		t.Fatal(err)
+	} else if _, ok := b.(*storage.Uploader); !ok {
+		t.Errorf("spooled backend is %T", b)
+	}
+
+	// local destinations are written directly
+	local := &Config{Dst: t.TempDir(), UploadRetries: 2}
+	if b, err := local.backend(); err != nil || storage.IsRemoteBackend(b) {
+		t.Fatalf("backend is %T, err=%v", b, err)
+	} else if _, ok := b.(*storage.Uploader); ok {
+		t.Error("local destination is uploaded")
+	}
+}
+
+func TestReachableWait(t *testing.T) {
+	down := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ioutil.ReadAll(r.Body)
+		if down {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("<ListBucketResult></ListBucketResult>"))
+	}))
+	defer srv.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	dst := "s3://bucket/dst?endpoint=" + url.QueryEscape(srv.URL)
+	spool := t.TempDir()
+
+	for _, tc := range []struct {
+		name    string
+		config  *Config
+		wantErr string
+	}{
+		{"invalid wait", &Config{Dst: dst, Spool: spool, ReachableWait: "soon"}, "ReachableWait"},
+		{"negative wait", &Config{Dst: dst, Spool: spool, ReachableWait: "-1m"}, "ReachableWait"},
+		{"no spool", &Config{Dst: dst, ReachableWait: "10ms"}, "can't be listed"},
+		{"retries without spool", &Config{Dst: dst, UploadRetries: 1, TmpDir: t.TempDir()}, "can't be listed"},
+		{"dry run", &Config{Dst: dst, Spool: spool, dryRun: true}, "can't be listed"},
+		{"spooled", &Config{Dst: dst, Spool: spool, ReachableWait: "10ms"}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.isDstWritable()
+			if tc.wantErr == "" && err != nil || tc.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tc.wantErr)) {
+				t.Fatalf("isDstWritable returned %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	// entries of an offline destination archive into the spool, for the
+	// next run reaching it
+	ent := &Entry{Name: "www", Path: t.TempDir()}
+	config := &Config{Dst: dst, Spool: spool, KeepGen: 1, Entries: []*Entry{ent}}
+	if err := config.isDstWritable(); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.archiveEntry(&result{name: ent.Name}, ent); err != nil {
+		t.Fatalf("archiveEntry offline returned %v", err)
+	}
+	down = false
+	next := &Config{Dst: dst, Spool: spool}
+	ups, err := next.uploaders()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := ups[dst].Flush()
+	if err != nil || len(names) == 0 || !strings.HasPrefix(names[0], "www.") {
+		t.Errorf("Flush returned %v, err=%v", names, err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	m := storage.NewMemory()
+	sum := sha256.Sum256([]byte("data"))
+	if err := writeChecksum(m, "www.tar.gz.100", sum[:]); err != nil {
+		t.Fatal(err)
+	}
+	want := "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
+	if line := string(m.Objects["www.tar.gz.100.sha256"]); line != want+"  www.tar.gz.100\n" {
+		t.Fatalf("checksum file is %q", line)
+	}
+	if got, err := readChecksum(m, "www.tar.gz.100"); err != nil || got != want {
+		t.Fatalf("readChecksum returned %q, err=%v", got, err)
+	}
+
+	// checksum files are not generations
+	m.Objects["www.tar.gz.100"] = []byte("data")
+	gens, err := generations(m, &Entry{Name: "www"})
+	if err != nil || len(gens) != 1 || gens[0].Name != "www.tar.gz.100" {
+		t.Fatalf("generations returned %v, err=%v", gens, err)
+	}
+}
+
+func TestLeaseEntry(t *testing.T) {
+	m := storage.NewMemory()
+	ent := &Entry{Name: "www"}
+	a := &Config{dst: m, Lease: true, leaseTTL: time.Minute, runID: "a"}
+	b := &Config{dst: m, Lease: true, leaseTTL: time.Minute, runID: "b"}
+	l, err := a.leaseEntry(ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.leaseEntry(ent); classify(err).kind != "locked" {
+		t.Fatalf("held lease taken: err=%v", err)
+	}
+	l.release()
+	if _, ok := m.Objects[leaseName(ent)]; ok {
+		t.Fatal("released lease left behind")
+	}
+
+	// the lease of a host that went away expires
+	m.Objects[leaseName(ent)] = []byte(`{"Host":"gone","RunID":"c","Expires":"2020-01-01T00:00:00Z"}`)
+	l, err = b.leaseEntry(ent)
+	if err != nil {
+		t.Fatalf("expired lease not taken over: %s", err)
+	}
+	l.release()
+}
+
+func TestHistoryLease(t *testing.T) {
+	// runs rewriting a journal that can't be appended to take turns
+	m := storage.NewMemory()
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, id := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(i int, id string) {
+			defer wg.Done()
+			config := &Config{dst: m, leaseTTL: 2 * time.Second, runID: id}
+			errs[i] = config.appendHistory([]result{{name: "www"}})
+		}(i, id)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	records, err := (&Config{dst: m}).readHistory(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var runs []string
+	for _, r := range records {
+		runs = append(runs, r.RunID)
+	}
+	sort.Strings(runs)
+	if strings.Join(runs, ",") != "a,b" {
+		t.Errorf("journal has the records of runs %q, want a and b", runs)
+	}
+	if _, ok := m.Objects[_HistoryLease]; ok {
+		t.Error("history lease left behind")
+	}
+
+	m.Objects[_HistoryLease] = []byte(`{"Host":"web1","PID":7,"RunID":"c","Expires":"2999-01-01T00:00:00Z"}`)
+	config := &Config{dst: m, leaseTTL: 100 * time.Millisecond, runID: "d"}
+	if err := config.appendHistory([]result{{name: "www"}}); classify(err).kind != "locked" {
+		t.Errorf("journal rewritten under a held lease: err=%v", err)
+	}
+}
+
+func TestRecompress(t *testing.T) {
+	m := storage.NewMemory()
+	ent := &Entry{Name: "www"}
+	config := &Config{dst: m}
+	tarball := &bytes.Buffer{}
+	if err := archiver.Write(tarball, t.TempDir(), &archiver.Options{Relative: true, NoCompress: true}); err != nil {
+		t.Fatal(err)
+	}
+	gz := &bytes.Buffer{}
+	if err := copyTar(gz, bytes.NewReader(tarball.Bytes()), ent); err != nil {
+		t.Fatal(err)
+	}
+	m.Objects["www.tar.gz.100"] = gz.Bytes()
+	m.Objects["www.tar.gz.100.sha256"] = []byte("old")
+
+	target := &Entry{Name: "www", Compression: "none"}
+	name, err := config.recompress(m, ent, target, "www.tar.gz.100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "www.tar.100" || !bytes.Equal(m.Objects[name], tarball.Bytes()) {
+		t.Fatalf("recompressed to %s, %d bytes", name, len(m.Objects[name]))
+	}
+	if _, ok := m.Objects["www.tar.gz.100"]; ok {
+		t.Error("original archive kept")
+	}
+	if _, ok := m.Objects["www.tar.gz.100.sha256"]; ok {
+		t.Error("original checksum kept")
+	}
+	if _, err := readChecksum(m, name); err != nil {
+		t.Error(err)
+	}
+	if got := archiveCodec(ent, "www.tar.gz.age.100"); got != "gzip" {
+		t.Errorf("codec of an encrypted gzip archive is %q", got)
+	}
+}
+
+func TestRepository(t *testing.T) {
+	src := t.TempDir()
+	big := make([]byte, 6<<20)
+	rand.New(rand.NewSource(1)).Read(big)
+	if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"big": big, "sub/small": []byte("first")}
+	for n, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(src, n), data, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("sub/small", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	m := storage.NewMemory()
+	ent := &Entry{Name: "www", Path: src, Repository: true, relative: true}
+	snapshot := func(ts int64) result {
+		config := &Config{KeepGen: 1, dst: m, clock: fixedClock(time.Unix(ts, 0))}
+		r := result{}
+		if err := config.snapshot(context.Background(), &r, ent, []string{src}, config.archiveOptions(ent)); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	first := snapshot(100)
+	files["sub/small"] = []byte("second")
+	if err := ioutil.WriteFile(filepath.Join(src, "sub/small"), files["sub/small"], 0640); err != nil {
+		t.Fatal(err)
+	}
+	second := snapshot(200)
+	if first.size < 1<<20 || second.size > 1<<10 {
+		t.Errorf("stored %d then %d bytes, unchanged chunks were stored again", first.size, second.size)
+	}
+	if second.pruned != 1 {
+		t.Errorf("pruned %d snapshots, want 1", second.pruned)
+	}
+
+	config := &Config{dst: m}
+	rp, err := config.openRepo(ent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := rp.readSnapshot(snapshotName("www", 200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := t.TempDir()
+	if err := rp.restore(s, dst); err != nil {
+		t.Fatal(err)
+	}
+	for n, data := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dst, n))
+		if err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s restored as %d bytes, want %d. err=%v", n, len(got), len(data), err)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "link")); err != nil || link != "sub/small" {
+		t.Errorf("link restored as %q. err=%v", link, err)
+	}
+
+	// the chunk of the first small file is only in the forgotten snapshot
+	chunks := func() int {
+		n := 0
+		for name := range m.Objects {
+			if strings.HasPrefix(name, _RepoDir+"/chunks/") {
+				n++
+			}
+		}
+		return n
+	}
+	before := chunks()
+	if err := rp.collect(false, true); err != nil {
+		t.Fatal(err)
+	}
+	if after := chunks(); after != before-1 {
+		t.Errorf("%d chunks after prune, want %d", after, before-1)
+	}
+	if _, err := restorePath(dst, "../etc/passwd"); err == nil {
+		t.Error("member name leaving the directory accepted")
+	}
+}
+
+func TestSplitChunks(t *testing.T) {
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	ids := func(data []byte) map[[32]byte]bool {
+		ids := map[[32]byte]bool{}
+		err := splitChunks(bytes.NewReader(data), func(c []byte) error {
+			if len(c) > _ChunkMax {
+				t.Errorf("chunk of %d bytes", len(c))
+			}
+			ids[sha256.Sum256(c)] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	a, b := ids(data), ids(append([]byte("inserted"), data...))
+	shared := 0
+	for id := range a {
+		if b[id] {
+			shared++
+		}
+	}
+	if len(a) < 3 || shared < len(a)-1 {
+		t.Errorf("%d of %d chunks shared after an insert at the start", shared, len(a))
+	}
+}
+
+// spacedBackend reports a fixed amount of free space.
+type spacedBackend struct {
+	*storage.Memory
+	free int64
+}
+
+func (b spacedBackend) Free() (int64, error) { return b.free, nil }
+
+func TestReserveSpace(t *testing.T) {
+	src := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(src, "f"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{MinFreeSpace: "500"}
+	if err := config.isMinFreeSpaceValid(); err != nil {
+		t.Fatal(err)
+	}
+	b := spacedBackend{storage.NewMemory(), 2000}
+	ent := &Entry{Name: "www", Path: src}
+
+	// the first archive is estimated by its files
+	release, err := config.reserveSpace(b, ent, []string{src}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.reserveSpace(b, ent, []string{src}, nil); errorKind(err) != "destination-write" {
+		t.Errorf("second concurrent entry fit in the space of the first. err=%v", err)
+	}
+	release()
+
+	// later ones by their largest generation
+	b.Objects["www.tar.gz.100"] = make([]byte, 1600)
+	if _, err := config.reserveSpace(b, ent, []string{src}, nil); err == nil {
+		t.Error("archive larger than the free space minus MinFreeSpace accepted")
+	}
+	b.free = -1
+	if _, err := config.reserveSpace(b, ent, []string{src}, nil); err != nil {
+		t.Errorf("unknown free space refused. err=%v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package backup
+
+import (
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// _StreamLocation is the archive location of runs writing to stdout.
+const _StreamLocation = "stdout"
+
+// backupCommand is tarbu backup -entry name -stdout: it archives one
+// entry to stdout instead of Dst, for pipes into other tools, e.g.
+//
+//	tarbu backup -entry home -stdout | aws s3 cp - s3://bucket/home.tar.gz
+//
+// Excludes, filters, hooks, dumps, compression and encryption apply as
+// in a run, logs go to stderr. Nothing is read from or written to Dst:
+// there are no checksums, metadata or run history, and no retention.
+func backupCommand(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	entry := fs.String("entry", "", "entry to archive")
+	stdout := fs.Bool("stdout", false, "write the archive to stdout instead of Dst")
+	lf := &logFlags{}
+	lf.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "usage: tarbu backup [-config path] -entry name -stdout")
+		fmt.Fprintln(fs.Output(), "runs backing up to Dst are tarbu without a subcommand")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *entry == "" || !*stdout {
+		fs.Usage()
+		return fmt.Errorf("-entry and -stdout are required")
+	}
+	if err := lf.setup(); err != nil {
+		return err
+	}
+	// stdout carries the archive
+	if logs.file == nil {
+		logs.w = os.Stderr
+		colored = colored && isTerminal(os.Stderr)
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if err := config.discover(); err != nil {
+		return err
+	}
+	ent := config.findEntry(*entry)
+	if ent == nil {
+		return fmt.Errorf("entry not found. name=%s", *entry)
+	}
+	// earlier archives are in Dst, which isn't read
+	if ent.Repository || ent.Incremental || ent.Append {
+		return fmt.Errorf("repository, incremental and appended entries can't be written to stdout. entry=%s", ent.Name)
+	}
+	// only the streamed entry needs its tools
+	config.Entries = []*Entry{ent}
+	checks := []func() error{
+		config.isSpecialFilesValid, config.isFiltersValid, config.isTypeValid, config.isPathsValid,
+		config.isVolumeSnapshotValid, config.isEncryptValid, config.isCompressionValid, config.isTmpDirValid,
+		config.isMemoryValid, config.isThrottleValid, config.isExcludeValid, config.isCmdValid, config.isTimeoutValid,
+	}
+	for _, check := range checks {
+		if err := check(); err != nil {
+			return err
+		}
+	}
+	config.stream = os.Stdout
+	config.runID = runID()
+	stop := config.cancelOnSignal()
+	defer stop()
+
+	r := result{name: ent.Name, start: config.now()}
+	if !config.preCmd(&r, ent) {
+		if r.err == nil {
+			return fmt.Errorf("entry skipped. entry=%s reason=%s", ent.Name, r.skipped)
+		}
+		return r.err
+	}
+	r.err = config.archiveEntry(&r, ent)
+	config.postCmd(&r, ent)
+	r.duration = config.now().Sub(r.start)
+	for _, w := range r.warnings {
+		logs.event(levelWarn, _ColorYellow, "Backup warning", "entry", ent.Name, "run", config.runID, "warn", w)
+	}
+	if r.err != nil {
+		return r.err
+	}
+	logs.event(levelInfo, _ColorGreen, "Backup streamed", "entry", ent.Name, "run", config.runID, "start", r.start,
+		"duration", r.duration, "size", logSize(r.size), "sha256", r.sha256)
+	return nil
+}
+
+// streamArchive writes what write produces to config.stream and returns
+// its size and SHA-256 sum, as putArchive does for Dst.
+func (config *Config) streamArchive(write func(io.Writer) error) (int64, []byte, error) {
+	cw := &countingWriter{w: config.stream, h: sha256.New()}
+	if err := write(cw); err != nil {
+		return 0, nil, err
+	}
+	return cw.n, cw.h.Sum(nil), nil
+}
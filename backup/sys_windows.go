@@ -0,0 +1,76 @@
+package backup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32           = syscall.NewLazyDLL("kernel32.dll")
+	getDiskFreeSpaceEx = kernel32.NewProc("GetDiskFreeSpaceExW")
+	lockFileEx         = kernel32.NewProc("LockFileEx")
+)
+
+const (
+	_LOCKFILE_FAIL_IMMEDIATELY = 0x1
+	_LOCKFILE_EXCLUSIVE_LOCK   = 0x2
+	_ERROR_LOCK_VIOLATION      = syscall.Errno(33)
+)
+
+// dirWritable fails unless the process may create files in dir. ACLs
+// decide that on Windows, so a file is created to tell.
+func dirWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, "tarbu-writable-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// freeSpace returns the bytes available to the user on the volume
+// holding path.
+func freeSpace(path string) (int64, error) {
+	p, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var avail uint64
+	if r, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&avail)), 0, 0); r == 0 {
+		return 0, err
+	}
+	return int64(avail), nil
+}
+
+// sameDevice tells whether a and b are on the same volume.
+func sameDevice(a, b string) (bool, error) {
+	aa, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	ab, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	return strings.EqualFold(filepath.VolumeName(aa), filepath.VolumeName(ab)), nil
+}
+
+// tryLock takes an exclusive lock of f without waiting. held tells a
+// failure is another process holding it.
+func tryLock(f *os.File) (held bool, err error) {
+	var ov syscall.Overlapped
+	r, _, err := lockFileEx.Call(f.Fd(), _LOCKFILE_EXCLUSIVE_LOCK|_LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, uintptr(unsafe.Pointer(&ov)))
+	if r != 0 {
+		return false, nil
+	}
+	return err == _ERROR_LOCK_VIOLATION, err
+}
+
+// fileOwner returns 0, 0: Windows files have SIDs, not uids.
+func fileOwner(fi os.FileInfo) (uid, gid int) {
+	return 0, 0
+}
@@ -0,0 +1,294 @@
+package backup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+)
+
+// entryTemplate generates one entry per item. Items are listed, matched
+// by Glob or printed one per line by Command, at every run. String
+// fields of Entry are text/template strings seeing .Hostname, .Item,
+// .Path and, except in Name itself, .Entry which is the expanded Name.
+// The base function strips directories, e.g. {{base .Path}}.
+type entryTemplate struct {
+	Items   []string `json:",omitempty"`
+	Glob    string   `json:",omitempty"`
+	Command []string `json:",omitempty"`
+	Entry   json.RawMessage
+}
+
+type templateVars struct {
+	Hostname string
+	// Item is the listed item, the base name of a Glob match or a line
+	// printed by Command
+	Item string
+	// Path is the Glob match, otherwise the same as Item
+	Path  string
+	Entry string
+}
+
+// discover returns the variables of every item of t.
+func (t *entryTemplate) discover(host string) ([]templateVars, error) {
+	var vars []templateVars
+	for _, item := range t.Items {
+		vars = append(vars, templateVars{Hostname: host, Item: item, Path: item})
+	}
+	if t.Glob != "" {
+		matchs, err := filepath.Glob(t.Glob)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matchs {
+			vars = append(vars, templateVars{Hostname: host, Item: filepath.Base(m), Path: m})
+		}
+	}
+	if len(t.Command) > 0 {
+		stderr := &bytes.Buffer{}
+		cmd := exec.Command(t.Command[0], t.Command[1:]...)
+		cmd.Stderr = stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("discovery command failed. err=%s", commandError(err, stderr))
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				vars = append(vars, templateVars{Hostname: host, Item: line, Path: line})
+			}
+		}
+	}
+	return vars, nil
+}
+
+// decodeEntry decodes raw on top of config.Defaults, so entries only
+// state what differs.
+func (config *Config) decodeEntry(raw json.RawMessage) (*Entry, error) {
+	e := &Entry{}
+	if len(config.Defaults) > 0 {
+		if err := json.Unmarshal(config.Defaults, e); err != nil {
+			return nil, fmt.Errorf("config.Defaults is invalid. err=%s", err)
+		}
+	}
+	if err := json.Unmarshal(raw, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// stated returns the fields of an entry built in code that aren't zero,
+// as JSON, which is what Defaults leaves to it.
+func stated(e *Entry) (json.RawMessage, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range fields {
+		switch string(v) {
+		case `""`, "0", "false", "null", "[]", "{}":
+			delete(fields, k)
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// expandEntries applies Defaults to Entries and appends the entries
+// generated from Templates. Without data, as for a Config built in code,
+// the fields of Entries that aren't zero are applied.
+func (config *Config) expandEntries(data []byte) error {
+	if len(config.Defaults) == 0 && len(config.Templates) == 0 {
+		return nil
+	}
+
+	var raw struct {
+		Entries []json.RawMessage
+	}
+	if data == nil {
+		for _, e := range config.Entries {
+			r, err := stated(e)
+			if err != nil {
+				return err
+			}
+			raw.Entries = append(raw.Entries, r)
+		}
+	} else if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	config.Entries = nil
+	for _, r := range raw.Entries {
+		e, err := config.decodeEntry(r)
+		if err != nil {
+			return err
+		}
+		config.Entries = append(config.Entries, e)
+	}
+
+	host, _ := os.Hostname()
+	for i, t := range config.Templates {
+		items, err := t.discover(host)
+		if err != nil {
+			return fmt.Errorf("config.Templates[%d] discovery failed. err=%s", i, err)
+		}
+		for _, vars := range items {
+			e, err := config.decodeEntry(t.Entry)
+			if err != nil {
+				return fmt.Errorf("config.Templates[%d] is invalid. err=%s", i, err)
+			}
+			if e.Name, err = expandTemplate(e.Name, vars); err != nil {
+				return fmt.Errorf("config.Templates[%d] is invalid. item=%s err=%s", i, vars.Item, err)
+			}
+			vars.Entry = e.Name
+			if err := expandFields(reflect.ValueOf(e).Elem(), vars); err != nil {
+				return fmt.Errorf("config.Templates[%d] is invalid. item=%s err=%s", i, vars.Item, err)
+			}
+			config.Entries = append(config.Entries, e)
+		}
+	}
+	return nil
+}
+
+// expandFields expands string and []string fields of struct v except Name.
+func expandFields(v reflect.Value, vars templateVars) error {
+	t := v.Type()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if t.Field(i).PkgPath != "" || t.Field(i).Name == "Name" {
+			continue
+		}
+		switch {
+		case f.Kind() == reflect.String:
+			s, err := expandTemplate(f.String(), vars)
+			if err != nil {
+				return err
+			}
+			f.SetString(s)
+		case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+			for j := 0; j < f.Len(); j++ {
+				s, err := expandTemplate(f.Index(j).String(), vars)
+				if err != nil {
+					return err
+				}
+				f.Index(j).SetString(s)
+			}
+		}
+	}
+	return nil
+}
+
+var templateFuncs = template.FuncMap{
+	"base": filepath.Base,
+}
+
+func expandTemplate(s string, vars interface{}) (string, error) {
+	t, err := template.New("").Option("missingkey=error").Funcs(templateFuncs).Parse(s)
+	if err != nil {
+		return "", err
+	}
+	b := &bytes.Buffer{}
+	if err := t.Execute(b, vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// expandVariables expands ${VAR} in config.Dst and in the Name, Path,
+// Paths and Dst of entries, so one config serves a fleet, e.g. with
+// "Dst": "/backups/${HOSTNAME}". VAR is an environment variable, or
+// HOSTNAME, which falls back to the host name, or DATE, the date when
+// the config is loaded as 2006-01-02 or in the layout of ${DATE:layout}.
+// ${VAR:-default} is default when VAR is unset, $$ is a dollar sign.
+func (config *Config) expandVariables() error {
+	now := config.now()
+	if config.location != nil {
+		now = now.In(config.location)
+	}
+	lookup := func(name string) (string, bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			return v, true
+		}
+		switch {
+		case name == "HOSTNAME":
+			host, err := os.Hostname()
+			return host, err == nil
+		case name == "DATE":
+			return now.Format("2006-01-02"), true
+		case strings.HasPrefix(name, "DATE:"):
+			return now.Format(strings.TrimPrefix(name, "DATE:")), true
+		}
+		return "", false
+	}
+	var err error
+	if config.Dst, err = expandVars(config.Dst, lookup); err != nil {
+		return fmt.Errorf("config.Dst is invalid. err=%s", err)
+	}
+	for _, e := range config.Entries {
+		name := e.Name
+		for _, f := range []*string{&e.Name, &e.Path, &e.Dst} {
+			if *f, err = expandVars(*f, lookup); err != nil {
+				return fmt.Errorf("entry is invalid. name=%s err=%s", name, err)
+			}
+		}
+		for i := range e.Paths {
+			if e.Paths[i], err = expandVars(e.Paths[i], lookup); err != nil {
+				return fmt.Errorf("entry is invalid. name=%s err=%s", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// expandVars replaces ${VAR} and ${VAR:-default} in s.
+func expandVars(s string, lookup func(string) (string, bool)) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i == len(s)-1 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			s = s[i+2:]
+			continue
+		case '{':
+		default:
+			// a lone $ is kept, e.g. in Windows share names
+			b.WriteByte('$')
+			s = s[i+1:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("variable is not closed. value=%s", s[i:])
+		}
+		name := s[i+2 : i+end]
+		def, hasDef := "", false
+		if j := strings.Index(name, ":-"); j >= 0 {
+			name, def, hasDef = name[:j], name[j+2:], true
+		}
+		v, ok := lookup(name)
+		switch {
+		case ok && (v != "" || !hasDef):
+		case hasDef:
+			v = def
+		default:
+			return "", fmt.Errorf("variable is not set. var=%s", name)
+		}
+		b.WriteString(v)
+		s = s[i+end+1:]
+	}
+}
@@ -0,0 +1,103 @@
+package backup
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// _ThrottleBurst is how much of a second of its rate a throttle lets
+// through at once after idling.
+const _ThrottleBurst = 0.25
+
+func (config *Config) isThrottleValid() error {
+	if config.MaxReadMBps < 0 || config.MaxWriteMBps < 0 {
+		return fmt.Errorf("config.MaxReadMBps and config.MaxWriteMBps must not be negative. read=%g write=%g", config.MaxReadMBps, config.MaxWriteMBps)
+	}
+	config.readLimit = newThrottle(config.MaxReadMBps * (1 << 20))
+	config.writeLimit = newThrottle(config.MaxWriteMBps * (1 << 20))
+	for _, e := range config.Entries {
+		if e.MaxReadMBps < 0 || e.MaxWriteMBps < 0 {
+			return fmt.Errorf("entry MaxReadMBps and MaxWriteMBps must not be negative. name=%s read=%g write=%g", e.Name, e.MaxReadMBps, e.MaxWriteMBps)
+		}
+		e.readLimit = newThrottle(e.MaxReadMBps * (1 << 20))
+		e.writeLimit = newThrottle(e.MaxWriteMBps * (1 << 20))
+	}
+	return nil
+}
+
+// throttle is a token bucket of bytes shared by the goroutines of a run.
+// A nil throttle doesn't limit.
+type throttle struct {
+	mu sync.Mutex
+	// rate is in bytes per second
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newThrottle returns a throttle of rate bytes per second, nil for zero.
+func newThrottle(rate float64) *throttle {
+	if rate <= 0 {
+		return nil
+	}
+	return &throttle{rate: rate, tokens: rate * _ThrottleBurst, last: time.Now()}
+}
+
+// take accounts for n bytes, sleeping while the bucket is in debt. The
+// bytes are taken before sleeping, so concurrent callers queue behind
+// each other rather than all waking at once.
+func (t *throttle) take(n int) {
+	if t == nil || n <= 0 {
+		return
+	}
+	t.mu.Lock()
+	now := time.Now()
+	t.tokens += now.Sub(t.last).Seconds() * t.rate
+	if max := t.rate * _ThrottleBurst; t.tokens > max {
+		t.tokens = max
+	}
+	t.last = now
+	t.tokens -= float64(n)
+	debt := t.tokens
+	t.mu.Unlock()
+	if debt < 0 {
+		time.Sleep(time.Duration(-debt / t.rate * float64(time.Second)))
+	}
+}
+
+// readThrottle returns the archiver read hook of ent, nil when it isn't
+// limited. A limit of the entry replaces the one of the run.
+func (config *Config) readThrottle(ent *Entry) func(n int) {
+	t := config.readLimit
+	if ent.readLimit != nil {
+		t = ent.readLimit
+	}
+	if t == nil {
+		return nil
+	}
+	return t.take
+}
+
+// writeThrottle wraps the archive writer of ent in its write limit.
+func (config *Config) writeThrottle(ent *Entry, w io.Writer) io.Writer {
+	t := config.writeLimit
+	if ent.writeLimit != nil {
+		t = ent.writeLimit
+	}
+	if t == nil {
+		return w
+	}
+	return &throttledWriter{w, t}
+}
+
+type throttledWriter struct {
+	w     io.Writer
+	limit *throttle
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	tw.limit.take(len(p))
+	return tw.w.Write(p)
+}
@@ -0,0 +1,433 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML parses a TOML config. Dates and times are kept as their
+// RFC 3339 text, config fields holding them are strings.
+func parseTOML(data []byte) (*cfgValue, error) {
+	t := &tomlParser{text: string(data), line: 1}
+	root := &cfgValue{line: 1, v: &cfgObject{}}
+	table := root
+	for {
+		t.skipBlank()
+		if t.pos == len(t.text) {
+			return root, nil
+		}
+		line := t.line
+		var err error
+		switch {
+		case strings.HasPrefix(t.text[t.pos:], "[["):
+			t.pos += 2
+			table, err = t.header(root, line, true)
+		case t.text[t.pos] == '[':
+			t.pos++
+			table, err = t.header(root, line, false)
+		default:
+			err = t.keyValue(table)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := t.endOfLine(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+type tomlParser struct {
+	text string
+	pos  int
+	line int
+	// defined are the tables declared by headers, which TOML forbids to
+	// declare twice
+	defined map[*cfgValue]bool
+}
+
+// errorf formats like fmt.Errorf, adding the line to the key=value
+// pairs of the message.
+func (t *tomlParser) errorf(format string, args ...interface{}) error {
+	if strings.Contains(format, ". ") {
+		format += " line=%d"
+	} else {
+		format += ". line=%d"
+	}
+	return fmt.Errorf("toml "+format, append(args, t.line)...)
+}
+
+// skipSpace skips spaces and tabs.
+func (t *tomlParser) skipSpace() {
+	for t.pos < len(t.text) && (t.text[t.pos] == ' ' || t.text[t.pos] == '\t') {
+		t.pos++
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments.
+func (t *tomlParser) skipBlank() {
+	for t.pos < len(t.text) {
+		switch t.text[t.pos] {
+		case '\n':
+			t.line++
+		case ' ', '\t', '\r':
+		case '#':
+			for t.pos < len(t.text) && t.text[t.pos] != '\n' {
+				t.pos++
+			}
+			continue
+		default:
+			return
+		}
+		t.pos++
+	}
+}
+
+// endOfLine allows only a comment after a key/value or header.
+func (t *tomlParser) endOfLine() error {
+	t.skipSpace()
+	if t.pos < len(t.text) && t.text[t.pos] == '#' {
+		for t.pos < len(t.text) && t.text[t.pos] != '\n' {
+			t.pos++
+		}
+	}
+	if t.pos < len(t.text) && t.text[t.pos] == '\r' {
+		t.pos++
+	}
+	if t.pos < len(t.text) && t.text[t.pos] != '\n' {
+		return t.errorf("expects a new line")
+	}
+	return nil
+}
+
+// key parses a dotted key.
+func (t *tomlParser) key() ([]string, error) {
+	var parts []string
+	for {
+		t.skipSpace()
+		if t.pos == len(t.text) {
+			return nil, t.errorf("key expected")
+		}
+		switch c := t.text[t.pos]; {
+		case c == '"' || c == '\'':
+			s, err := t.str()
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, s)
+		default:
+			start := t.pos
+			for t.pos < len(t.text) && isBareKey(t.text[t.pos]) {
+				t.pos++
+			}
+			if start == t.pos {
+				return nil, t.errorf("key expected")
+			}
+			parts = append(parts, t.text[start:t.pos])
+		}
+		t.skipSpace()
+		if t.pos == len(t.text) || t.text[t.pos] != '.' {
+			return parts, nil
+		}
+		t.pos++
+	}
+}
+
+func isBareKey(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// header parses a [table] or [[array of tables]] header and returns the
+// table it opens.
+func (t *tomlParser) header(root *cfgValue, line int, array bool) (*cfgValue, error) {
+	parts, err := t.key()
+	if err != nil {
+		return nil, err
+	}
+	end := "]"
+	if array {
+		end = "]]"
+	}
+	if !strings.HasPrefix(t.text[t.pos:], end) {
+		return nil, t.errorf("table header isn't closed")
+	}
+	t.pos += len(end)
+	parent, err := t.walk(root, parts[:len(parts)-1], line)
+	if err != nil {
+		return nil, err
+	}
+	o := parent.v.(*cfgObject)
+	last := parts[len(parts)-1]
+	v := o.get(last)
+	if array {
+		if v == nil {
+			v = &cfgValue{line: line, v: []*cfgValue{}}
+			o.set(last, line, v)
+		}
+		a, ok := v.v.([]*cfgValue)
+		if !ok {
+			return nil, t.errorf("key is not an array of tables. key=%s", strings.Join(parts, "."))
+		}
+		table := &cfgValue{line: line, v: &cfgObject{}}
+		v.v = append(a, table)
+		return table, nil
+	}
+	if v == nil {
+		v = &cfgValue{line: line, v: &cfgObject{}}
+		o.set(last, line, v)
+	} else if _, ok := v.v.(*cfgObject); !ok || t.defined[v] {
+		return nil, t.errorf("table is defined twice. table=%s", strings.Join(parts, "."))
+	}
+	if t.defined == nil {
+		t.defined = map[*cfgValue]bool{}
+	}
+	t.defined[v] = true
+	return v, nil
+}
+
+// walk returns the table at parts below v, creating missing ones. The
+// last table of an array of tables is the one walked into.
+func (t *tomlParser) walk(v *cfgValue, parts []string, line int) (*cfgValue, error) {
+	for i, p := range parts {
+		o, ok := v.v.(*cfgObject)
+		if !ok {
+			return nil, t.errorf("key is not a table. key=%s", strings.Join(parts[:i], "."))
+		}
+		next := o.get(p)
+		if next == nil {
+			next = &cfgValue{line: line, v: &cfgObject{}}
+			o.set(p, line, next)
+		}
+		if a, ok := next.v.([]*cfgValue); ok && len(a) > 0 {
+			next = a[len(a)-1]
+		}
+		if _, ok := next.v.(*cfgObject); !ok {
+			return nil, t.errorf("key is not a table. key=%s", strings.Join(parts[:i+1], "."))
+		}
+		v = next
+	}
+	return v, nil
+}
+
+func (t *tomlParser) keyValue(table *cfgValue) error {
+	line := t.line
+	parts, err := t.key()
+	if err != nil {
+		return err
+	}
+	if t.pos == len(t.text) || t.text[t.pos] != '=' {
+		return t.errorf("expects = after the key. key=%s", strings.Join(parts, "."))
+	}
+	t.pos++
+	v, err := t.value()
+	if err != nil {
+		return err
+	}
+	parent, err := t.walk(table, parts[:len(parts)-1], line)
+	if err != nil {
+		return err
+	}
+	return parent.v.(*cfgObject).set(parts[len(parts)-1], line, v)
+}
+
+func (t *tomlParser) value() (*cfgValue, error) {
+	t.skipSpace()
+	v := &cfgValue{line: t.line}
+	if t.pos == len(t.text) {
+		return nil, t.errorf("value expected")
+	}
+	switch c := t.text[t.pos]; {
+	case c == '"' || c == '\'':
+		s, err := t.str()
+		if err != nil {
+			return nil, err
+		}
+		v.v = s
+	case c == '[':
+		t.pos++
+		a := []*cfgValue{}
+		for {
+			t.skipBlank()
+			if t.pos < len(t.text) && t.text[t.pos] == ']' {
+				t.pos++
+				break
+			}
+			e, err := t.value()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, e)
+			t.skipBlank()
+			if t.pos < len(t.text) && t.text[t.pos] == ',' {
+				t.pos++
+			} else if t.pos == len(t.text) || t.text[t.pos] != ']' {
+				return nil, t.errorf("array needs a comma or ]")
+			}
+		}
+		v.v = a
+	case c == '{':
+		t.pos++
+		table := &cfgValue{line: t.line, v: &cfgObject{}}
+		for first := true; ; first = false {
+			t.skipSpace()
+			if t.pos < len(t.text) && t.text[t.pos] == '}' && first {
+				t.pos++
+				break
+			}
+			if err := t.keyValue(table); err != nil {
+				return nil, err
+			}
+			t.skipSpace()
+			if t.pos < len(t.text) && t.text[t.pos] == '}' {
+				t.pos++
+				break
+			}
+			if t.pos == len(t.text) || t.text[t.pos] != ',' {
+				return nil, t.errorf("inline table needs a comma or }")
+			}
+			t.pos++
+		}
+		v.v = table.v
+	default:
+		start := t.pos
+		for t.pos < len(t.text) && strings.IndexByte(" \t\r\n,]}#", t.text[t.pos]) < 0 {
+			t.pos++
+		}
+		word := t.text[start:t.pos]
+		// a date followed by a time, 1979-05-27 07:32:00
+		if len(word) == 10 && word[4] == '-' && strings.HasPrefix(t.text[t.pos:], " ") && t.pos+3 < len(t.text) && isDigit(t.text[t.pos+1]) && isDigit(t.text[t.pos+2]) && t.text[t.pos+3] == ':' {
+			t.pos++
+			for t.pos < len(t.text) && strings.IndexByte(" \t\r\n,]}#", t.text[t.pos]) < 0 {
+				t.pos++
+			}
+			word = t.text[start:t.pos]
+		}
+		switch {
+		case word == "true":
+			v.v = true
+		case word == "false":
+			v.v = false
+		case word == "":
+			return nil, t.errorf("value expected")
+		case isDigit(word[0]) && (strings.Contains(word, ":") || len(word) >= 10 && word[4] == '-'):
+			v.v = word
+		default:
+			n, ok := parseNumber(word)
+			if !ok {
+				return nil, t.errorf("unknown value. value=%s", word)
+			}
+			v.v = n
+		}
+	}
+	return v, nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// str parses basic and literal strings, single or multi-line.
+func (t *tomlParser) str() (string, error) {
+	q := t.text[t.pos : t.pos+1]
+	multi := strings.HasPrefix(t.text[t.pos:], q+q+q)
+	if multi {
+		q = q + q + q
+	}
+	t.pos += len(q)
+	if multi {
+		// a newline right after the quotes is trimmed
+		if strings.HasPrefix(t.text[t.pos:], "\r\n") {
+			t.pos += 2
+			t.line++
+		} else if strings.HasPrefix(t.text[t.pos:], "\n") {
+			t.pos++
+			t.line++
+		}
+	}
+	var b strings.Builder
+	for {
+		if t.pos == len(t.text) {
+			return "", t.errorf("string isn't closed")
+		}
+		if strings.HasPrefix(t.text[t.pos:], q) {
+			n := len(q)
+			if multi {
+				// up to two more quotes belong to the content
+				for n < 5 && t.pos+n < len(t.text) && t.text[t.pos+n] == q[0] {
+					n++
+				}
+				b.WriteString(q[:n-3])
+			}
+			t.pos += n
+			return b.String(), nil
+		}
+		c := t.text[t.pos]
+		switch {
+		case c == '\n':
+			if !multi {
+				return "", t.errorf("string isn't closed")
+			}
+			t.line++
+		case c == '\\' && q[0] == '"':
+			if err := t.escape(&b, multi); err != nil {
+				return "", err
+			}
+			continue
+		}
+		b.WriteByte(c)
+		t.pos++
+	}
+}
+
+// escape writes the escape sequence at pos of a basic string.
+func (t *tomlParser) escape(b *strings.Builder, multi bool) error {
+	t.pos++
+	if t.pos == len(t.text) {
+		return t.errorf("string isn't closed")
+	}
+	c := t.text[t.pos]
+	t.pos++
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case 'e':
+		b.WriteByte(0x1b)
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U':
+		size := 4
+		if c == 'U' {
+			size = 8
+		}
+		if t.pos+size > len(t.text) {
+			return t.errorf("string has a broken escape")
+		}
+		r, err := strconv.ParseUint(t.text[t.pos:t.pos+size], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return t.errorf("string has a broken escape")
+		}
+		b.WriteRune(rune(r))
+		t.pos += size
+	default:
+		// a line ending backslash trims the following whitespace
+		rest := t.text[t.pos-1:]
+		trimmed := strings.TrimLeft(rest, " \t\r")
+		if !multi || !strings.HasPrefix(trimmed, "\n") {
+			return t.errorf("string has an unknown escape. escape=\\%c", c)
+		}
+		for t.pos = t.pos - 1; t.pos < len(t.text) && strings.IndexByte(" \t\r\n", t.text[t.pos]) >= 0; t.pos++ {
+			if t.text[t.pos] == '\n' {
+				t.line++
+			}
+		}
+	}
+	return nil
+}
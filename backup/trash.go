@@ -0,0 +1,82 @@
+package backup
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// _TrashDir is the directory of a destination holding what retention
+// deleted while config.TrashRetention is set.
+const _TrashDir = ".trash"
+
+// _TrashWorkers is the number of objects moved to the trash at once,
+// which copies them on remote destinations.
+const _TrashWorkers = 4
+
+// discard deletes names from b, or moves them to the trash of b when
+// config.TrashRetention is set, where they are named after the time
+// they were trashed: <unix seconds>-<name>. Missing names are skipped.
+func (config *Config) discard(b storage.Backend, names ...string) error {
+	if config.trashRetention == 0 {
+		return b.Delete(names...)
+	}
+	trash := storage.Sub(b, _TrashDir)
+	stamp := strconv.FormatInt(config.now().Unix(), 10) + "-"
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+	)
+	sem := make(chan struct{}, _TrashWorkers)
+	for _, n := range names {
+		n := n
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			err := storage.Move(b, n, trash, stamp+n)
+			if err == nil || storage.IsNotExist(err) {
+				return
+			}
+			mu.Lock()
+			if first == nil {
+				first = err
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if first != nil {
+		return first
+	}
+	return config.emptyTrash(trash)
+}
+
+// emptyTrash deletes what was trashed longer than config.TrashRetention
+// ago. Objects not named by discard are left alone.
+func (config *Config) emptyTrash(trash storage.Backend) error {
+	objs, err := trash.List("")
+	if err != nil {
+		return err
+	}
+	limit := config.now().Add(-config.trashRetention)
+	var del []string
+	for _, o := range objs {
+		i := strings.IndexByte(o.Name, '-')
+		if i < 0 {
+			continue
+		}
+		ts, err := strconv.ParseInt(o.Name[:i], 10, 64)
+		if err != nil {
+			continue
+		}
+		if !time.Unix(ts, 0).After(limit) {
+			del = append(del, o.Name)
+		}
+	}
+	return trash.Delete(del...)
+}
@@ -0,0 +1,180 @@
+package backup
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+func (config *Config) isUploadValid() error {
+	if config.UploadRetries < 0 {
+		return fmt.Errorf("config.UploadRetries must not be negative. upload_retries=%d", config.UploadRetries)
+	}
+	config.uploadRetryDelay = _RetryDelay
+	if config.UploadRetryDelay != "" {
+		d, err := parseDuration(config.UploadRetryDelay)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("config.UploadRetryDelay is invalid. upload_retry_delay=%s", config.UploadRetryDelay)
+		}
+		config.uploadRetryDelay = d
+	}
+	switch config.SpoolUpload {
+	case "":
+	case "async", "flush":
+		if config.Spool == "" {
+			return fmt.Errorf("config.SpoolUpload needs config.Spool. spool_upload=%s", config.SpoolUpload)
+		}
+	default:
+		return fmt.Errorf("config.SpoolUpload must be async or flush. spool_upload=%s", config.SpoolUpload)
+	}
+	if config.Spool != "" {
+		return isDirWritable("config.Spool", config.Spool)
+	}
+	return nil
+}
+
+// uploader makes uploads to the remote backend b of dst go through a
+// local copy, in Spool or TmpDir, with UploadRetries or a Spool. It
+// returns b as it is without them.
+func (config *Config) uploader(dst string, b storage.Backend) (storage.Backend, error) {
+	if config.UploadRetries == 0 && config.Spool == "" || !storage.IsRemoteBackend(b) {
+		return b, nil
+	}
+	if err := config.isUploadValid(); err != nil {
+		return nil, err
+	}
+	dir := config.Spool
+	if dir == "" {
+		dir = config.tmpDir()
+	}
+	opts := storage.UploadOptions{
+		Persist:    config.Spool != "",
+		Defer:      config.SpoolUpload != "",
+		Retries:    config.UploadRetries,
+		RetryDelay: config.uploadRetryDelay,
+		MaxDelay:   _RetryMaxDelay,
+		Done:       func() <-chan struct{} { return config.runContext().Done() },
+		Failed: func(name string, attempt int, wait time.Duration, err error) {
+			logs.event(levelWarn, _ColorYellow, "Upload attempt failed", "dst", dst, "name", name,
+				"attempt", attempt, "retry_in", wait, "err", err)
+		},
+	}
+	if config.SpoolUpload == "async" {
+		if config.queued == nil {
+			config.queued = make(chan struct{}, 1)
+		}
+		opts.Queued = func() {
+			select {
+			case config.queued <- struct{}{}:
+			default:
+			}
+		}
+	}
+	return storage.NewUploader(b, dir, opts), nil
+}
+
+// flushUploads uploads what waits in the Spool for dst, archives of
+// earlier runs included. Failing uploads stay there for the next try,
+// as everything does while dst is offline.
+func flushUploads(dst string, u *storage.Uploader) {
+	if u.Offline() {
+		return
+	}
+	names, err := u.Flush()
+	for _, n := range names {
+		logs.event(levelInfo, "", "Uploaded from spool", "dst", dst, "file", u.Location(n))
+	}
+	if err != nil {
+		printWarning("Uploading from spool failed, the files stay there: dst=%s err=%s", dst, err)
+	}
+}
+
+// uploaders returns the Uploaders of the destinations, by destination.
+func (config *Config) uploaders() (map[string]*storage.Uploader, error) {
+	ups := map[string]*storage.Uploader{}
+	for _, dst := range config.destinations() {
+		b, err := config.dstBackend(dst)
+		if err != nil {
+			return nil, err
+		}
+		if u, ok := b.(*storage.Uploader); ok {
+			ups[dst] = u
+		}
+	}
+	return ups, nil
+}
+
+// startUploads uploads the archives entries leave in the Spool in the
+// background, with SpoolUpload async. The returned func waits for the
+// uploads, those queued until it is called included.
+func (config *Config) startUploads() func() {
+	if config.SpoolUpload != "async" || config.dryRun {
+		return func() {}
+	}
+	ups, err := config.uploaders()
+	if err != nil {
+		printWarning("Starting uploads failed, archives stay in the spool: err=%s", err)
+		return func() {}
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-config.queued:
+			case <-stop:
+				for dst, u := range ups {
+					flushUploads(dst, u)
+				}
+				return
+			}
+			for dst, u := range ups {
+				flushUploads(dst, u)
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// flushCommand uploads what waits in the Spool, the archives of runs
+// with SpoolUpload flush and those of stopped or failed uploads.
+func flushCommand(args []string) error {
+	fs := flag.NewFlagSet("flush", flag.ExitOnError)
+	configPath := fs.String("config", "", "path to JSON, YAML or TOML config file, or - for stdin")
+	fs.Parse(args)
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if config.Spool == "" {
+		return fmt.Errorf("config.Spool is not set, there is nothing to flush")
+	}
+	if config.isReadOnly() {
+		return fmt.Errorf("flush is refused in read-only mode")
+	}
+	ups, err := config.uploaders()
+	if err != nil {
+		return err
+	}
+	uploaded := 0
+	for _, dst := range config.destinations() {
+		if u, ok := ups[dst]; ok {
+			names, err := u.Flush()
+			for _, n := range names {
+				logs.event(levelInfo, "", "Uploaded from spool", "dst", dst, "file", u.Location(n))
+			}
+			uploaded += len(names)
+			if err != nil {
+				return &UploadError{dst, err}
+			}
+		}
+	}
+	printSuccess("Flushed spool: spool=%s uploaded=%d", config.Spool, uploaded)
+	return nil
+}
@@ -0,0 +1,170 @@
+package backup
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/k3nju/tarbu/internal/storage"
+)
+
+// _VerifySampleEvery is how often the daemon verifies a sample by
+// default.
+const _VerifySampleEvery = 7 * 24 * time.Hour
+
+// verifySample makes tarbu daemon re-verify a share of the stored
+// generations at a fixed cadence, so archives rotting in Dst are found
+// before they are needed.
+type verifySample struct {
+	// Percent of the generations of each entry verified, the newest
+	// excluded, at least one when there are any
+	Percent int
+	// Every is the cadence, e.g. "1w", the default
+	Every string `json:",omitempty"`
+
+	// every is Every parsed by isVerifySampleValid
+	every time.Duration
+}
+
+func (config *Config) isVerifySampleValid() error {
+	v := config.VerifySample
+	if v == nil {
+		return nil
+	}
+	if v.Percent <= 0 || v.Percent > 100 {
+		return fmt.Errorf("config.VerifySample.Percent must be 1 to 100. percent=%d", v.Percent)
+	}
+	v.every = _VerifySampleEvery
+	if v.Every != "" {
+		d, err := parseDuration(v.Every)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("config.VerifySample.Every is invalid. every=%s", v.Every)
+		}
+		v.every = d
+	}
+	return nil
+}
+
+// nextVerify returns when the next sample is due: Every after the last
+// one the history records, or after now without one. It is zero
+// without VerifySample.
+func (config *Config) nextVerify(now time.Time) time.Time {
+	if config.VerifySample == nil {
+		return time.Time{}
+	}
+	records, err := config.readVerifications()
+	if err != nil {
+		printWarning("Reading verification history failed: err=%s", err)
+	}
+	last := now
+	if len(records) > 0 {
+		last = records[len(records)-1].Start
+	}
+	return last.Add(config.VerifySample.every)
+}
+
+// sampled is a generation picked for verification.
+type sampled struct {
+	ent *Entry
+	b   storage.Backend
+	gen storage.Object
+}
+
+// sample picks Percent of the generations of every entry, the newest
+// ones left out as the run writing them verified them.
+func (config *Config) sample(rnd *rand.Rand) ([]sampled, error) {
+	var picked []sampled
+	for _, ent := range config.entriesWithSelf() {
+		b, err := config.entryBackend(ent)
+		if err != nil {
+			return nil, err
+		}
+		gens, err := generations(b, ent)
+		if err != nil {
+			return nil, err
+		}
+		if len(gens) < 2 {
+			continue
+		}
+		old := gens[:len(gens)-1]
+		n := (len(old)*config.VerifySample.Percent + 99) / 100
+		for _, i := range rnd.Perm(len(old))[:n] {
+			picked = append(picked, sampled{ent, b, old[i]})
+		}
+	}
+	return picked, nil
+}
+
+// verifySample verifies a sample of the stored generations: their
+// checksum when it was recorded, and that they decrypt, decompress and
+// walk as tar. The results are added to the history, which the catalog
+// shows them from, and a sample with corrupt archives is notified.
+func (config *Config) verifySample(rnd *rand.Rand) []result {
+	start := time.Now()
+	picked, err := config.sample(rnd)
+	if err != nil {
+		printError("Verification sample failed: err=%s", err)
+		return nil
+	}
+	var results []result
+	corrupt := 0
+	for _, s := range picked {
+		r := result{name: s.ent.Name, start: time.Now(), archive: s.b.Location(s.gen.Name), size: s.gen.Size, verified: "ok"}
+		r.sha256, r.err = config.verifyGeneration(s.b, s.ent, s.gen.Name)
+		r.duration = time.Since(r.start)
+		if r.err != nil {
+			r.verified = "corrupt"
+			corrupt++
+			printError("Archive corrupt: entry=%s archive=%s err=%s", r.name, r.archive, r.err)
+		}
+		results = append(results, r)
+	}
+	if len(results) == 0 {
+		return nil
+	}
+	if err := config.appendHistory(results); err != nil {
+		printWarning("Recording verification failed: err=%s", err)
+	}
+	printSuccess("Verification sample finished: archives=%d corrupt=%d", len(results), corrupt)
+	if corrupt > 0 {
+		config.notify(config.summarize(results, start))
+	}
+	return results
+}
+
+// verifyGeneration checks name of ent in b against its recorded
+// checksum, if any, and walks it, returning its hash.
+func (config *Config) verifyGeneration(b storage.Backend, ent *Entry, name string) (string, error) {
+	sum := ""
+	want, err := readChecksum(b, name)
+	if err != nil && !storage.IsNotExist(err) {
+		return "", err
+	}
+	if err == nil {
+		h, err := hashObject(b, name)
+		if err != nil {
+			return "", err
+		}
+		if sum = hex.EncodeToString(h); sum != want {
+			return sum, fmt.Errorf("checksum mismatch. want=%s got=%s", want, sum)
+		}
+	}
+	return sum, config.verifyArchive(b, ent, name)
+}
+
+// runVerifySample verifies a sample as one run, locked like a backup so
+// retention doesn't delete archives being read.
+func (config *Config) runVerifySample() {
+	run := *config
+	run.runID = newRunID()
+	os.Setenv(_RunIDEnv, run.runID)
+	lock, err := run.lockRun()
+	if err != nil {
+		printError("Verification sample failed: run=%s err=%s", run.runID, err)
+		return
+	}
+	defer lock.release()
+	run.verifySample(rand.New(rand.NewSource(time.Now().UnixNano())))
+}
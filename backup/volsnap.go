@@ -0,0 +1,203 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// volumeSnapshot is the Snapshot of an entry: the volume holding the
+// source is snapshotted and archived from the snapshot, so files
+// changing during the run, e.g. of a live database, are archived as they
+// were at one instant. Quiesce and Resume run around taking it.
+type volumeSnapshot struct {
+	// Type is lvm, btrfs or zfs
+	Type string
+	// Volume is the LVM logical volume as vg/lv, the Btrfs subvolume
+	// directory or the ZFS dataset holding the source
+	Volume string
+	// Mount is where Volume is mounted, the source paths must be under
+	// it. It defaults to the subvolume for btrfs and to the mountpoint
+	// of the dataset for zfs.
+	Mount string `json:",omitempty"`
+	// Size is the copy-on-write space of an LVM snapshot, as lvcreate
+	// --size takes it, 1G by default
+	Size string `json:",omitempty"`
+	// MountOptions are added to ro when mounting an LVM snapshot, e.g.
+	// nouuid for XFS
+	MountOptions string `json:",omitempty"`
+}
+
+// snapshotSeq tells apart the snapshots of a run.
+var snapshotSeq int64
+
+func (config *Config) isVolumeSnapshotValid() error {
+	for _, e := range config.Entries {
+		s := e.Snapshot
+		if s == nil {
+			continue
+		}
+		switch s.Type {
+		case "lvm":
+			if s.Mount == "" {
+				return fmt.Errorf("entry.Snapshot.Mount is required for lvm. name=%s", e.Name)
+			}
+			if strings.Count(s.Volume, "/") != 1 {
+				return fmt.Errorf("entry.Snapshot.Volume must be vg/lv for lvm. name=%s volume=%s", e.Name, s.Volume)
+			}
+		case "btrfs":
+			if s.Mount == "" {
+				s.Mount = s.Volume
+			}
+		case "zfs":
+		default:
+			return fmt.Errorf("unknown snapshot type. name=%s type=%s", e.Name, s.Type)
+		}
+		if s.Volume == "" {
+			return fmt.Errorf("entry.Snapshot.Volume is required. name=%s", e.Name)
+		}
+		if e.Type != "" {
+			return fmt.Errorf("entry.Snapshot takes a file entry. name=%s type=%s", e.Name, e.Type)
+		}
+		if s.Mount == "" {
+			continue
+		}
+		paths := e.Paths
+		if len(paths) == 0 {
+			paths = []string{e.Path}
+		}
+		for _, p := range paths {
+			if !underDir(s.Mount, p) {
+				return fmt.Errorf("entry path is not under entry.Snapshot.Mount. name=%s path=%s mount=%s", e.Name, p, s.Mount)
+			}
+		}
+	}
+	return nil
+}
+
+func underDir(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// takenSnapshot is a snapshot mounted at dir, a copy of mount.
+type takenSnapshot struct {
+	dir, mount string
+	// remove undoes what take did, in reverse
+	remove []func() error
+}
+
+// take snapshots the volume, named after the run. On an error what was
+// done is undone.
+func (s *volumeSnapshot) take(runID string) (*takenSnapshot, error) {
+	name := fmt.Sprintf("tarbu-%.8s-%d", runID, atomic.AddInt64(&snapshotSeq, 1))
+	t := &takenSnapshot{mount: s.Mount}
+	err := t.do(s, name)
+	if err != nil {
+		if rerr := t.release(); rerr != nil {
+			err = fmt.Errorf("%s. cleanup=%s", err, rerr)
+		}
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *takenSnapshot) do(s *volumeSnapshot, name string) error {
+	switch s.Type {
+	case "lvm":
+		size := s.Size
+		if size == "" {
+			size = "1G"
+		}
+		vg := s.Volume[:strings.Index(s.Volume, "/")]
+		if err := runCommand("lvcreate", "--snapshot", "--name", name, "--size", size, s.Volume); err != nil {
+			return err
+		}
+		t.remove = append(t.remove, func() error { return runCommand("lvremove", "--force", vg+"/"+name) })
+		dir, err := ioutil.TempDir("", name+"-")
+		if err != nil {
+			return err
+		}
+		t.remove = append(t.remove, func() error { return os.Remove(dir) })
+		opts := "ro"
+		if s.MountOptions != "" {
+			opts += "," + s.MountOptions
+		}
+		if err := runCommand("mount", "-o", opts, "/dev/"+vg+"/"+name, dir); err != nil {
+			return err
+		}
+		t.remove = append(t.remove, func() error { return runCommand("umount", dir) })
+		t.dir = dir
+	case "btrfs":
+		dir := filepath.Join(s.Volume, "."+name)
+		if err := runCommand("btrfs", "subvolume", "snapshot", "-r", s.Volume, dir); err != nil {
+			return err
+		}
+		t.remove = append(t.remove, func() error { return runCommand("btrfs", "subvolume", "delete", dir) })
+		t.dir = dir
+	case "zfs":
+		if t.mount == "" {
+			stderr := &bytes.Buffer{}
+			cmd := exec.Command("zfs", "get", "-H", "-o", "value", "mountpoint", s.Volume)
+			cmd.Stderr = stderr
+			out, err := cmd.Output()
+			if err != nil {
+				return fmt.Errorf("zfs failed. err=%s", commandError(err, stderr))
+			}
+			t.mount = strings.TrimSpace(string(out))
+		}
+		snap := s.Volume + "@" + name
+		if err := runCommand("zfs", "snapshot", snap); err != nil {
+			return err
+		}
+		t.remove = append(t.remove, func() error { return runCommand("zfs", "destroy", snap) })
+		t.dir = filepath.Join(t.mount, ".zfs", "snapshot", name)
+	}
+	return nil
+}
+
+// snapshotSource quiesces the source of ent for as long as taking its
+// snapshot takes.
+func (config *Config) snapshotSource(ent *Entry) (*takenSnapshot, error) {
+	resume, err := quiesce(ent)
+	if err != nil {
+		return nil, err
+	}
+	t, err := ent.Snapshot.take(config.runID)
+	if rerr := resume(); err == nil && rerr != nil {
+		t.release()
+		return nil, rerr
+	}
+	return t, err
+}
+
+// roots maps the source roots into the snapshot.
+func (t *takenSnapshot) roots(roots []string) ([]string, error) {
+	var mapped []string
+	for _, r := range roots {
+		if !underDir(t.mount, r) {
+			return nil, fmt.Errorf("source is not under the snapshot mount. path=%s mount=%s", r, t.mount)
+		}
+		rel, _ := filepath.Rel(t.mount, r)
+		mapped = append(mapped, filepath.Join(t.dir, rel))
+	}
+	return mapped, nil
+}
+
+// release removes the snapshot, keeping on after errors so as little
+// as possible is left behind. The first error is returned.
+func (t *takenSnapshot) release() error {
+	var first error
+	for i := len(t.remove) - 1; i >= 0; i-- {
+		if err := t.remove[i](); err != nil && first == nil {
+			first = err
+		}
+	}
+	t.remove = nil
+	return first
+}
@@ -0,0 +1,513 @@
+package backup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseYAML parses the YAML configs are written in: block mappings and
+// sequences, flow [lists] and {maps}, plain, quoted and | or > block
+// scalars. Anchors, aliases, tags and multiple documents are refused.
+func parseYAML(data []byte) (*cfgValue, error) {
+	p := &yamlParser{}
+	for i, raw := range strings.Split(string(data), "\n") {
+		raw = strings.TrimSuffix(raw, "\r")
+		text := strings.TrimLeft(raw, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, fmt.Errorf("yaml can't be indented with tabs. line=%d", i+1)
+		}
+		text = strings.TrimSpace(stripYAMLComment(text))
+		if len(p.lines) == 0 && text == "---" {
+			text = ""
+		}
+		if text == "---" || text == "..." {
+			return nil, fmt.Errorf("yaml config must be a single document. line=%d", i+1)
+		}
+		p.lines = append(p.lines, yamlLine{num: i + 1, indent: len(raw) - len(strings.TrimLeft(raw, " ")), text: text, raw: raw})
+	}
+	l := p.peek()
+	if l == nil {
+		return nil, fmt.Errorf("yaml config is empty")
+	}
+	if !isYAMLItem(l.text) && yamlKey(l.text) < 0 {
+		return nil, fmt.Errorf("yaml config must be a mapping. line=%d", l.num)
+	}
+	root, err := p.node(l.indent)
+	if err != nil {
+		return nil, err
+	}
+	if l := p.peek(); l != nil {
+		return nil, fmt.Errorf("yaml indentation is off. line=%d", l.num)
+	}
+	return root, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	// text is the line without indentation and comment, raw as read
+	text string
+	raw  string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+// peek returns the next line having content.
+func (p *yamlParser) peek() *yamlLine {
+	for p.i < len(p.lines) && p.lines[p.i].text == "" {
+		p.i++
+	}
+	if p.i == len(p.lines) {
+		return nil
+	}
+	return &p.lines[p.i]
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// yamlKey returns the index of the colon ending the key of a mapping
+// line, -1 for other lines.
+func yamlKey(text string) int {
+	if text == "" || strings.IndexByte("[{|>", text[0]) >= 0 {
+		return -1
+	}
+	if text[0] == '"' || text[0] == '\'' {
+		end := quoteEnd(text)
+		if end < 0 || !strings.HasPrefix(text[end:], ":") {
+			return -1
+		}
+		if end+1 == len(text) || text[end+1] == ' ' {
+			return end
+		}
+		return -1
+	}
+	for i := 0; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return i
+		}
+	}
+	return -1
+}
+
+// quoteEnd returns the index after the quoted string text starts with,
+// -1 if it is unterminated.
+func quoteEnd(text string) int {
+	q := text[0]
+	for i := 1; i < len(text); i++ {
+		switch {
+		case q == '"' && text[i] == '\\':
+			i++
+		case text[i] == q && q == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == q:
+			return i + 1
+		}
+	}
+	return -1
+}
+
+// stripYAMLComment cuts a # comment off text, leaving quoted strings
+// alone. Quotes only open a string where a scalar starts.
+func stripYAMLComment(text string) string {
+	start := true
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		case (c == '"' || c == '\'') && start:
+			end := quoteEnd(text[i:])
+			if end < 0 {
+				return text
+			}
+			i += end - 1
+			start = false
+		case c == ' ' || c == '\t':
+		default:
+			start = strings.IndexByte(":-[{,", c) >= 0
+		}
+	}
+	return text
+}
+
+// node parses the block at indent.
+func (p *yamlParser) node(indent int) (*cfgValue, error) {
+	l := p.peek()
+	switch {
+	case isYAMLItem(l.text):
+		return p.sequence(indent)
+	case yamlKey(l.text) >= 0:
+		return p.mapping(indent)
+	}
+	p.i++
+	return p.value(l.text, l.num, indent-1, false)
+}
+
+func (p *yamlParser) mapping(indent int) (*cfgValue, error) {
+	o := &cfgObject{}
+	v := &cfgValue{line: p.peek().num, v: o}
+	for {
+		l := p.peek()
+		if l == nil || l.indent < indent || (l.indent == indent && isYAMLItem(l.text)) {
+			return v, nil
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("yaml indentation is off. line=%d", l.num)
+		}
+		colon := yamlKey(l.text)
+		if colon < 0 {
+			return nil, fmt.Errorf("yaml mapping key expected. line=%d", l.num)
+		}
+		key := l.text[:colon]
+		if key[0] == '"' || key[0] == '\'' {
+			s, err := yamlQuoted(key, l.num)
+			if err != nil {
+				return nil, err
+			}
+			key = s
+		}
+		p.i++
+		e, err := p.value(strings.TrimSpace(l.text[colon+1:]), l.num, indent, true)
+		if err != nil {
+			return nil, err
+		}
+		if err := o.set(key, l.num, e); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *yamlParser) sequence(indent int) (*cfgValue, error) {
+	a := []*cfgValue{}
+	v := &cfgValue{line: p.peek().num}
+	for {
+		l := p.peek()
+		if l == nil || l.indent < indent || (l.indent == indent && !isYAMLItem(l.text)) {
+			break
+		}
+		if l.indent > indent {
+			return nil, fmt.Errorf("yaml indentation is off. line=%d", l.num)
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if isYAMLItem(rest) || yamlKey(rest) >= 0 {
+			// "- key: value" starts a mapping indented like key
+			l.indent += len(l.text) - len(rest)
+			l.text = rest
+			e, err := p.node(l.indent)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, e)
+			continue
+		}
+		p.i++
+		e, err := p.value(rest, l.num, indent, false)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, e)
+	}
+	v.v = a
+	return v, nil
+}
+
+// value parses the value text following a key or item at indent on
+// line, or the block below it when text is empty. Sequences of mapping
+// values may be indented like the key.
+func (p *yamlParser) value(text string, line, indent int, inMapping bool) (*cfgValue, error) {
+	if text == "" {
+		l := p.peek()
+		switch {
+		case l != nil && l.indent > indent:
+			return p.node(l.indent)
+		case l != nil && l.indent == indent && inMapping && isYAMLItem(l.text):
+			return p.sequence(indent)
+		}
+		return &cfgValue{line: line}, nil
+	}
+	switch text[0] {
+	case '&', '*', '!':
+		return nil, fmt.Errorf("yaml anchors, aliases and tags aren't supported. line=%d", line)
+	case '|', '>':
+		return p.blockScalar(text, line, indent)
+	case '[', '{':
+		// flow collections may go on over several lines
+		for !flowClosed(text) {
+			l := p.peek()
+			if l == nil {
+				return nil, fmt.Errorf("yaml flow collection isn't closed. line=%d", line)
+			}
+			text += " " + l.text
+			p.i++
+		}
+		f := &yamlFlow{text: text, line: line}
+		v, err := f.value()
+		if err != nil {
+			return nil, err
+		}
+		if f.skip(); f.pos < len(f.text) {
+			return nil, fmt.Errorf("yaml has text after a flow collection. line=%d", line)
+		}
+		return v, nil
+	case '"', '\'':
+		end := quoteEnd(text)
+		if end >= 0 && end < len(text) {
+			return nil, fmt.Errorf("yaml has text after a quoted string. line=%d", line)
+		}
+		s, err := yamlQuoted(text, line)
+		if err != nil {
+			return nil, err
+		}
+		return &cfgValue{line: line, v: s}, nil
+	}
+	if yamlKey(text) >= 0 {
+		return nil, fmt.Errorf("yaml mapping must start on its own line. line=%d", line)
+	}
+	return &cfgValue{line: line, v: text, plain: true}, nil
+}
+
+// flowClosed reports whether the brackets of text are balanced.
+func flowClosed(text string) bool {
+	depth := 0
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '"', '\'':
+			end := quoteEnd(text[i:])
+			if end < 0 {
+				return false
+			}
+			i += end - 1
+		case '[', '{':
+			depth++
+		case ']', '}':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// blockScalar parses a | literal or > folded scalar, the lines below
+// line indented more than indent.
+func (p *yamlParser) blockScalar(header string, line, indent int) (*cfgValue, error) {
+	chomp := header[1:]
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		return nil, fmt.Errorf("yaml block scalar header isn't supported. line=%d header=%s", line, header)
+	}
+	var lines []string
+	content := -1
+	for p.i < len(p.lines) {
+		l := p.lines[p.i]
+		if strings.TrimSpace(l.raw) == "" {
+			lines = append(lines, "")
+			p.i++
+			continue
+		}
+		if l.indent <= indent || (content >= 0 && l.indent < content) {
+			break
+		}
+		if content < 0 {
+			content = l.indent
+		}
+		lines = append(lines, l.raw[content:])
+		p.i++
+	}
+	// trailing blank lines are only kept by +
+	n := len(lines)
+	for n > 0 && lines[n-1] == "" {
+		n--
+	}
+	var b strings.Builder
+	for i, s := range lines[:n] {
+		// > folds line breaks between lines of text into spaces
+		switch {
+		case i == 0:
+		case header[0] == '|' || s == "":
+			b.WriteByte('\n')
+		case lines[i-1] == "":
+		case s[0] == ' ' || lines[i-1][0] == ' ':
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(' ')
+		}
+		b.WriteString(s)
+	}
+	switch {
+	case n == 0 || chomp == "-":
+	case chomp == "+":
+		b.WriteString(strings.Repeat("\n", len(lines)-n+1))
+	default:
+		b.WriteByte('\n')
+	}
+	return &cfgValue{line: line, v: b.String()}, nil
+}
+
+// yamlQuoted unquotes a single or double quoted YAML string.
+func yamlQuoted(text string, line int) (string, error) {
+	if quoteEnd(text) != len(text) {
+		return "", fmt.Errorf("yaml string isn't closed. line=%d", line)
+	}
+	body := text[1 : len(text)-1]
+	if text[0] == '\'' {
+		return strings.Replace(body, "''", "'", -1), nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] != '\\' {
+			b.WriteByte(body[i])
+			continue
+		}
+		i++
+		if i == len(body) {
+			return "", fmt.Errorf("yaml string has a broken escape. line=%d", line)
+		}
+		switch c := body[i]; c {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case 'r':
+			b.WriteByte('\r')
+		case '0':
+			b.WriteByte(0)
+		case '"', '\\', '/', ' ':
+			b.WriteByte(c)
+		case 'x', 'u', 'U':
+			size := map[byte]int{'x': 2, 'u': 4, 'U': 8}[c]
+			if i+size >= len(body) {
+				return "", fmt.Errorf("yaml string has a broken escape. line=%d", line)
+			}
+			r, err := strconv.ParseUint(body[i+1:i+1+size], 16, 32)
+			if err != nil || !utf8.ValidRune(rune(r)) {
+				return "", fmt.Errorf("yaml string has a broken escape. line=%d", line)
+			}
+			b.WriteRune(rune(r))
+			i += size
+		default:
+			return "", fmt.Errorf("yaml string has an unknown escape. line=%d escape=\\%c", line, c)
+		}
+	}
+	return b.String(), nil
+}
+
+// yamlFlow parses flow collections, all on the line they start.
+type yamlFlow struct {
+	text string
+	pos  int
+	line int
+}
+
+func (f *yamlFlow) skip() {
+	for f.pos < len(f.text) && f.text[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+func (f *yamlFlow) value() (*cfgValue, error) {
+	f.skip()
+	if f.pos == len(f.text) {
+		return nil, fmt.Errorf("yaml flow collection isn't closed. line=%d", f.line)
+	}
+	switch f.text[f.pos] {
+	case '[':
+		f.pos++
+		a := []*cfgValue{}
+		for {
+			if f.skip(); f.pos < len(f.text) && f.text[f.pos] == ']' {
+				f.pos++
+				return &cfgValue{line: f.line, v: a}, nil
+			}
+			e, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, e)
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.pos++
+		o := &cfgObject{}
+		for {
+			if f.skip(); f.pos < len(f.text) && f.text[f.pos] == '}' {
+				f.pos++
+				return &cfgValue{line: f.line, v: o}, nil
+			}
+			k, err := f.scalar(true)
+			if err != nil {
+				return nil, err
+			}
+			if f.skip(); f.pos == len(f.text) || f.text[f.pos] != ':' {
+				return nil, fmt.Errorf("yaml flow mapping needs key: value. line=%d", f.line)
+			}
+			f.pos++
+			e, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			if err := o.set(k.v.(string), f.line, e); err != nil {
+				return nil, err
+			}
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return f.scalar(false)
+}
+
+// separator consumes the comma after an element, leaving the closing
+// bracket for the caller.
+func (f *yamlFlow) separator(end byte) error {
+	f.skip()
+	switch {
+	case f.pos < len(f.text) && f.text[f.pos] == ',':
+		f.pos++
+		return nil
+	case f.pos < len(f.text) && f.text[f.pos] == end:
+		return nil
+	}
+	return fmt.Errorf("yaml flow collection needs a comma or %c. line=%d", end, f.line)
+}
+
+// scalar parses a quoted or plain scalar, plain ones ending at a flow
+// indicator, or at a colon for keys.
+func (f *yamlFlow) scalar(key bool) (*cfgValue, error) {
+	rest := f.text[f.pos:]
+	if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+		end := quoteEnd(rest)
+		if end < 0 {
+			return nil, fmt.Errorf("yaml string isn't closed. line=%d", f.line)
+		}
+		s, err := yamlQuoted(rest[:end], f.line)
+		if err != nil {
+			return nil, err
+		}
+		f.pos += end
+		return &cfgValue{line: f.line, v: s}, nil
+	}
+	stop := ",[]{}"
+	if key {
+		stop += ":"
+	}
+	end := 0
+	for end < len(rest) && strings.IndexByte(stop, rest[end]) < 0 && !(rest[end] == ':' && (end+1 == len(rest) || rest[end+1] == ' ')) {
+		end++
+	}
+	f.pos += end
+	s := strings.TrimSpace(rest[:end])
+	if s == "" && key {
+		return nil, fmt.Errorf("yaml flow mapping key is empty. line=%d", f.line)
+	}
+	if key {
+		return &cfgValue{line: f.line, v: s}, nil
+	}
+	return &cfgValue{line: f.line, v: s, plain: true}, nil
+}
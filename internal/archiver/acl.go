@@ -0,0 +1,58 @@
+package archiver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// tags of the entries of system.posix_acl_access and
+// system.posix_acl_default, see acl_ea.h
+const (
+	aclUserObj  = 0x01
+	aclUser     = 0x02
+	aclGroupObj = 0x04
+	aclGroup    = 0x08
+	aclMask     = 0x10
+	aclOther    = 0x20
+)
+
+// aclText converts the xattr form of a POSIX ACL to the short text form
+// GNU tar stores in SCHILY.acl.access, e.g. "user::rw-,group::r--".
+func aclText(b []byte) (string, error) {
+	if len(b) < 4 || binary.LittleEndian.Uint32(b) != 2 || (len(b)-4)%8 != 0 {
+		return "", fmt.Errorf("unsupported ACL xattr. size=%d", len(b))
+	}
+	var entries []string
+	for b = b[4:]; len(b) > 0; b = b[8:] {
+		tag := binary.LittleEndian.Uint16(b)
+		perm := binary.LittleEndian.Uint16(b[2:])
+		id := strconv.FormatUint(uint64(binary.LittleEndian.Uint32(b[4:])), 10)
+		var qualifier string
+		switch tag {
+		case aclUserObj:
+			qualifier = "user:"
+		case aclUser:
+			qualifier = "user:" + id
+		case aclGroupObj:
+			qualifier = "group:"
+		case aclGroup:
+			qualifier = "group:" + id
+		case aclMask:
+			qualifier = "mask:"
+		case aclOther:
+			qualifier = "other:"
+		default:
+			return "", fmt.Errorf("unknown ACL tag. tag=%d", tag)
+		}
+		p := []byte("---")
+		for i, c := range "rwx" {
+			if perm&(4>>uint(i)) != 0 {
+				p[i] = byte(c)
+			}
+		}
+		entries = append(entries, qualifier+":"+string(p))
+	}
+	return strings.Join(entries, ","), nil
+}
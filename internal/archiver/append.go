@@ -0,0 +1,60 @@
+package archiver
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+)
+
+// AppendError is a failure reading the archive given as Options.Append.
+type AppendError struct {
+	Err error
+}
+
+func (e *AppendError) Error() string { return "previous archive: " + e.Err.Error() }
+
+func (e *AppendError) Unwrap() error { return e.Err }
+
+// appendFrom copies the members of the tar stream r, minus its global
+// headers, and remembers them so the tree leaves out what they hold.
+func (aw *writer) appendFrom(r io.Reader) error {
+	aw.stored = map[string]*tar.Header{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return &AppendError{err}
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if err := aw.tw.WriteHeader(hdr); err != nil {
+			return aw.writeError(hdr.Name, err)
+		}
+		if _, err := io.CopyBuffer(aw.tw, tr, aw.buf); err != nil {
+			if aw.ew.err != nil {
+				return &WriteError{aw.ew.err}
+			}
+			return &AppendError{fmt.Errorf("member %s: %s", hdr.Name, err)}
+		}
+		aw.stored[hdr.Name] = hdr
+	}
+}
+
+// appended tells whether the last copy of name in Append matches fi, so
+// archiving it again would change nothing.
+func (aw *writer) appended(name string, fi os.FileInfo) bool {
+	hdr, ok := aw.stored[name]
+	if ok && hdr.Typeflag == tar.TypeLink {
+		// links have the size and mode of their target
+		hdr, ok = aw.stored[hdr.Linkname]
+	}
+	if !ok || !hdr.ModTime.Equal(fi.ModTime()) || hdr.FileInfo().Mode() != fi.Mode() {
+		return false
+	}
+	return !fi.Mode().IsRegular() || hdr.Size == fi.Size()
+}
@@ -0,0 +1,580 @@
+// Package archiver writes the .tar.gz archives of tarbu entries with
+// archive/tar and compress/gzip, so no tar binary is needed to back up.
+// Plain tar streams can be written for other compressors to process.
+package archiver
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Options controls what Write puts into an archive.
+type Options struct {
+	// BufferSize is the size of the file read and archive write buffers,
+	// 64K when zero.
+	BufferSize int
+	// Level is the gzip compression level, the gzip default when zero.
+	// NoCompress writes an uncompressed tar instead.
+	Level      int
+	NoCompress bool
+	// GzipWorkers compresses blocks of the stream with this many
+	// goroutines, like pigz, for trees whose archiving is bound by gzip.
+	// Each block is a gzip member of its own, the archive is still one
+	// gzip file. Below 2 a single gzip writer compresses.
+	GzipWorkers int
+	// ReadWorkers reads small files ahead with this many goroutines
+	// while members are written in order. Below 2 files are read one
+	// at a time by the writer.
+	ReadWorkers int
+	// InodeOrder archives the entries of each directory in inode order
+	// rather than by name. Inode numbers roughly follow disk layout, so
+	// on spinning disks this cuts seeking through large trees of small
+	// files, such as maildirs and caches. Members are no longer sorted.
+	InodeOrder bool
+	// Relative stores members relative to the root, as ./name, instead
+	// of under the root path.
+	Relative bool
+	// ExcludeVCS skips version control directories and files, like GNU
+	// tar --exclude-vcs.
+	ExcludeVCS bool
+	// Exclude skips matching paths below the root, and everything in
+	// matching directories.
+	Exclude *Excluder
+	// SecurityAttrs stores file capabilities and SELinux labels in the
+	// records GNU tar --xattrs and --selinux restore.
+	SecurityAttrs bool
+	// Extended stores all extended attributes and POSIX ACLs in the
+	// records GNU tar --xattrs and --acls restore, covering SecurityAttrs.
+	Extended bool
+	// Skip is called for everything below the roots but directories,
+	// after Exclude. Files it returns true for are left out.
+	Skip func(path string, fi os.FileInfo) bool
+	// FollowSymlinks archives what symbolic links point to instead of
+	// the links, like tar -h. Links to directories are walked into,
+	// unless they loop back to a directory being walked. Dangling links
+	// are archived as links.
+	FollowSymlinks bool
+	// Special is called for FIFOs and device nodes. A nil error skips
+	// the file, an error aborts the archive. When nil, they are archived.
+	// Sockets can't be archived and are always skipped.
+	Special func(path string) error
+	// Unchanged is called with the member name of every regular file.
+	// Files it returns true for are left out, which makes incremental
+	// archives. It may be called concurrently with Record.
+	Unchanged func(name string, fi os.FileInfo) bool
+	// Record is called with the SHA-256 of every regular file archived,
+	// hashed as it is read. Hard links get the sum of their target.
+	Record func(name string, fi os.FileInfo, sum []byte)
+	// Changed is called when a file vanishes or changes while it is
+	// archived. On a nil error the archive goes on: vanished files are
+	// left out, changed ones are stored as read, cut or zero padded to
+	// the size first seen, like GNU tar does. When nil, changes abort
+	// the archive. It may be called concurrently from the walk.
+	Changed func(err *ChangeError) error
+	// Retry reads a changed or vanished file once more before calling
+	// Changed. Only files up to 256K, which are read into memory before
+	// their header is written, can be retried.
+	Retry bool
+	// Append is a plain tar stream whose members are copied ahead of the
+	// tree, like tar -r. Paths stored there with the same mode, size and
+	// mtime are left out of the tree, so only new and changed files
+	// follow, winning over their old copies when extracted as tar -u
+	// archives do. Its global headers are dropped.
+	Append io.Reader
+	// Global is written as a PAX global header ahead of the members.
+	Global map[string]string
+	// DropCache drops the cached pages of every file once it was read,
+	// with posix_fadvise DONTNEED, so archiving large trees doesn't evict
+	// the page cache of other programs. DirectIO reads files too large to
+	// be read ahead with O_DIRECT, bypassing the cache, where the
+	// filesystem allows it, and drops the pages of the others. Both only
+	// work on Linux on amd64 and arm64.
+	DropCache bool
+	DirectIO  bool
+	// Context stops the archive with its error once done, between files
+	// and reads.
+	Context context.Context
+	// Read is called with the number of bytes read from files of the
+	// tree before they are archived, so callers can throttle the source.
+	// It may be called concurrently by ReadWorkers.
+	Read func(n int)
+	// Archived is called with the member name of every file once it was
+	// written, in archive order.
+	Archived func(name string, fi os.FileInfo)
+	// Snapshot is a snapshot of the directory SnapshotOf the roots are
+	// read from. Paths under it are stored under SnapshotOf, as the live
+	// tree would be.
+	Snapshot   string
+	SnapshotOf string
+}
+
+// SourceError is a failure reading Path from the source tree.
+type SourceError struct {
+	Path string
+	Err  error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Err)
+}
+
+func (e *SourceError) Unwrap() error { return e.Err }
+
+// WriteError is a failure writing the archive stream.
+type WriteError struct {
+	Err error
+}
+
+func (e *WriteError) Error() string { return e.Err.Error() }
+
+func (e *WriteError) Unwrap() error { return e.Err }
+
+// vcsNames are the names GNU tar --exclude-vcs skips.
+var vcsNames = map[string]bool{
+	"CVS": true, "RCS": true, "SCCS": true, ".git": true, ".gitignore": true,
+	".gitattributes": true, ".gitmodules": true, ".cvsignore": true,
+	".svn": true, ".arch-ids": true, "{arch}": true, "=RELEASE-ID": true,
+	"=meta-update": true, "=update": true, ".bzr": true, ".bzrignore": true,
+	".bzrtags": true, ".hg": true, ".hgignore": true, ".hgtags": true,
+	"_darcs": true,
+}
+
+// errWriter keeps the first error of the destination, so it can be told
+// apart from errors about the source.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.w.Write(p)
+	if err != nil {
+		e.err = err
+	}
+	return n, err
+}
+
+type writer struct {
+	opts  *Options
+	roots []string
+	// root is the tree of roots being walked
+	root  string
+	ew    *errWriter
+	tw    *tar.Writer
+	buf   []byte
+	links map[[2]uint64]string
+	// sums are the hashes of hard link targets, for Record
+	sums map[string][]byte
+	// stored are the members copied from Append by name
+	stored map[string]*tar.Header
+}
+
+// Write archives the tree at root to w as a gzip compressed PAX tar, or
+// a plain one with NoCompress.
+// Members are sorted by name unless InodeOrder is set, symlinks are
+// stored as links and hard links within the tree are stored once.
+func Write(w io.Writer, root string, opts *Options) error {
+	return WriteRoots(w, []string{root}, opts)
+}
+
+// WriteRoots archives several trees one after the other like Write.
+// Hard links are stored once across them. Relative names would collide,
+// so it takes a single root with Relative.
+func WriteRoots(w io.Writer, roots []string, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if len(roots) == 0 || opts.Relative && len(roots) > 1 {
+		return fmt.Errorf("relative archives need exactly one root. roots=%q", roots)
+	}
+	size := opts.BufferSize
+	if size <= 0 {
+		size = 64 << 10
+	}
+	ew := &errWriter{w: w}
+	bw := bufio.NewWriterSize(ew, size)
+	var zw io.WriteCloser = nopCloser{bw}
+	if !opts.NoCompress {
+		level := opts.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if opts.GzipWorkers > 1 {
+			pz, err := newParallelGzip(bw, level, opts.GzipWorkers)
+			if err != nil {
+				return err
+			}
+			// stops the workers when archiving fails
+			defer pz.Close()
+			zw = pz
+		} else {
+			gw, err := gzip.NewWriterLevel(bw, level)
+			if err != nil {
+				return err
+			}
+			zw = gw
+		}
+	}
+	aw := &writer{
+		opts:  opts,
+		root:  filepath.Clean(roots[0]),
+		ew:    ew,
+		tw:    tar.NewWriter(zw),
+		buf:   make([]byte, size),
+		links: map[[2]uint64]string{},
+		sums:  map[string][]byte{},
+	}
+	for _, r := range roots {
+		aw.roots = append(aw.roots, filepath.Clean(r))
+	}
+
+	if opts.Global != nil {
+		hdr := &tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: opts.Global}
+		if err := aw.tw.WriteHeader(hdr); err != nil {
+			return aw.writeError(aw.root, err)
+		}
+	}
+	if opts.Append != nil {
+		if err := aw.appendFrom(opts.Append); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if opts.ReadWorkers > 1 {
+		err = aw.walkParallel(opts.ReadWorkers)
+	} else {
+		err = aw.walk(aw.add)
+	}
+	if err != nil {
+		return err
+	}
+	if err := aw.tw.Close(); err != nil {
+		return aw.writeError(aw.root, err)
+	}
+	if err := zw.Close(); err != nil {
+		return aw.writeError(aw.root, err)
+	}
+	if err := bw.Flush(); err != nil {
+		return aw.writeError(aw.root, err)
+	}
+	return nil
+}
+
+// List calls fn with the path, member name and FileInfo of everything
+// WriteRoots would archive from roots with opts, in the same order,
+// without reading any file. Hard links are listed like other files and
+// Unchanged and Special are called as when writing.
+func List(roots []string, opts *Options, fn func(path, name string, fi os.FileInfo) error) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if len(roots) == 0 || opts.Relative && len(roots) > 1 {
+		return fmt.Errorf("relative archives need exactly one root. roots=%q", roots)
+	}
+	aw := &writer{opts: opts, root: filepath.Clean(roots[0])}
+	for _, r := range roots {
+		aw.roots = append(aw.roots, filepath.Clean(r))
+	}
+	return aw.walk(func(path string, fi os.FileInfo, err error) error {
+		if keep, err := aw.filter(path, fi, err); !keep {
+			return err
+		}
+		return fn(path, aw.name(path, fi.IsDir()), fi)
+	})
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// writeError attributes err to the destination when writing to it
+// failed, to path otherwise.
+func (aw *writer) writeError(path string, err error) error {
+	if aw.ew.err != nil {
+		return &WriteError{aw.ew.err}
+	}
+	return &SourceError{path, err}
+}
+
+func (aw *writer) name(path string, dir bool) string {
+	var name string
+	if aw.opts.Relative {
+		if path == aw.root {
+			return "./"
+		}
+		rel, _ := filepath.Rel(aw.root, path)
+		name = "./" + filepath.ToSlash(rel)
+	} else {
+		if aw.opts.Snapshot != "" {
+			if rel, err := filepath.Rel(aw.opts.Snapshot, path); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				path = filepath.Join(aw.opts.SnapshotOf, rel)
+			}
+		}
+		// like tar, members don't start with /
+		name = strings.TrimLeft(filepath.ToSlash(path), "/")
+	}
+	if dir {
+		name += "/"
+	}
+	return name
+}
+
+func (aw *writer) add(path string, fi os.FileInfo, err error) error {
+	if keep, err := aw.filter(path, fi, err); !keep {
+		return err
+	}
+	return aw.member(path, fi, nil)
+}
+
+// filter tells whether path is archived. The error is the one to return
+// to filepath.Walk, possibly SkipDir.
+func (aw *writer) filter(path string, fi os.FileInfo, err error) (bool, error) {
+	if aw.opts.Context != nil && aw.opts.Context.Err() != nil {
+		return false, aw.opts.Context.Err()
+	}
+	if os.IsNotExist(err) && path != aw.root {
+		return false, aw.changed(&ChangeError{path, true, err})
+	}
+	if err != nil {
+		return false, &SourceError{path, err}
+	}
+	skip := func() (bool, error) {
+		if fi.IsDir() {
+			return false, filepath.SkipDir
+		}
+		return false, nil
+	}
+	if aw.opts.ExcludeVCS && path != aw.root && vcsNames[fi.Name()] {
+		return skip()
+	}
+	if aw.opts.Exclude != nil && path != aw.root {
+		rel, _ := filepath.Rel(aw.root, path)
+		if aw.opts.Exclude.Match(filepath.ToSlash(rel), fi.IsDir()) {
+			return skip()
+		}
+	}
+
+	if aw.opts.Skip != nil && path != aw.root && !fi.IsDir() && aw.opts.Skip(path, fi) {
+		return false, nil
+	}
+
+	mode := fi.Mode()
+	switch {
+	case mode&os.ModeSocket != 0:
+		return false, nil
+	case mode&(os.ModeNamedPipe|os.ModeDevice|os.ModeCharDevice) != 0:
+		if aw.opts.Special != nil {
+			return false, aw.opts.Special(path)
+		}
+	case mode.IsRegular() && aw.opts.Unchanged != nil:
+		if aw.opts.Unchanged(aw.name(path, false), fi) {
+			return false, nil
+		}
+	}
+	// directories already stored are still walked
+	if aw.stored != nil && aw.appended(aw.name(path, fi.IsDir()), fi) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// member writes the header and contents of path. pre holds contents read
+// ahead by walkParallel, nil when the file is read here.
+func (aw *writer) member(path string, fi os.FileInfo, pre *prefetched) error {
+	var f *os.File
+	if fi.Mode().IsRegular() {
+		var err error
+		if fi, pre, err = aw.prepare(path, fi, pre); fi == nil {
+			return err
+		}
+		if pre == nil {
+			if f, err = os.Open(path); os.IsNotExist(err) {
+				return aw.changed(&ChangeError{path, true, err})
+			} else if err != nil {
+				return &SourceError{path, err}
+			}
+			defer f.Close()
+		}
+	}
+
+	mode := fi.Mode()
+	var err error
+	var link string
+	if mode&os.ModeSymlink != 0 {
+		if link, err = os.Readlink(path); err != nil {
+			return &SourceError{path, err}
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return &SourceError{path, err}
+	}
+	hdr.Name = aw.name(path, fi.IsDir())
+	hdr.Format = tar.FormatPAX
+	// only mtime is kept, like GNU tar's ustar fields
+	hdr.AccessTime = time.Time{}
+	hdr.ChangeTime = time.Time{}
+	if mode&os.ModeSymlink == 0 {
+		switch {
+		case aw.opts.Extended:
+			hdr.PAXRecords, err = extendedRecords(path)
+		case aw.opts.SecurityAttrs:
+			hdr.PAXRecords, err = securityRecords(path)
+		}
+		if err != nil {
+			return &SourceError{path, err}
+		}
+	}
+
+	if key, nlink, ok := fileID(fi); ok && mode.IsRegular() && nlink > 1 {
+		if first, ok := aw.links[key]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			aw.links[key] = hdr.Name
+		}
+	}
+
+	if err := aw.tw.WriteHeader(hdr); err != nil {
+		return aw.writeError(path, err)
+	}
+	if hdr.Typeflag == tar.TypeLink && aw.opts.Record != nil {
+		aw.opts.Record(hdr.Name, fi, aw.sums[hdr.Linkname])
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		aw.archived(hdr.Name, fi)
+		return nil
+	}
+
+	var sum []byte
+	if pre != nil {
+		if _, err := aw.tw.Write(pre.data); err != nil {
+			return aw.writeError(path, err)
+		}
+		if aw.opts.Record != nil {
+			s := sha256.Sum256(pre.data)
+			sum = s[:]
+		}
+	} else if sum, err = aw.copyFile(f, fi); err != nil {
+		return err
+	}
+	if aw.opts.Record != nil {
+		if _, nlink, ok := fileID(fi); ok && nlink > 1 {
+			aw.sums[hdr.Name] = sum
+		}
+		aw.opts.Record(hdr.Name, fi, sum)
+	}
+	aw.archived(hdr.Name, fi)
+	return nil
+}
+
+func (aw *writer) archived(name string, fi os.FileInfo) {
+	if aw.opts.Archived != nil {
+		aw.opts.Archived(name, fi)
+	}
+}
+
+// readHook passes the size of every read to Options.Read and stops
+// reading once Options.Context is done.
+type readHook struct {
+	r    io.Reader
+	opts *Options
+}
+
+func (h *readHook) Read(p []byte) (int, error) {
+	if h.opts.Context != nil && h.opts.Context.Err() != nil {
+		return 0, h.opts.Context.Err()
+	}
+	n, err := h.r.Read(p)
+	if n > 0 && h.opts.Read != nil {
+		h.opts.Read(n)
+	}
+	return n, err
+}
+
+// alignedReader reads an O_DIRECT file in whole aligned blocks, as the
+// kernel requires, and serves reads of any size from them.
+type alignedReader struct {
+	f    *os.File
+	buf  []byte
+	data []byte
+}
+
+func (r *alignedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		n, err := r.f.Read(r.buf)
+		if n <= 0 {
+			return 0, err
+		}
+		r.data = r.buf[:n]
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// copyFile writes exactly the size of fi from f. A file that changed
+// as it was read is passed to Changed. The SHA-256 of what was stored is
+// returned when Record is set.
+func (aw *writer) copyFile(f *os.File, fi os.FileInfo) ([]byte, error) {
+	path, size := f.Name(), fi.Size()
+	var w io.Writer = aw.tw
+	h := sha256.New()
+	if aw.opts.Record != nil {
+		w = io.MultiWriter(aw.tw, h)
+	}
+	var src io.Reader = f
+	if aw.opts.DirectIO && setDirect(f) {
+		src = &alignedReader{f: f, buf: alignedBuffer(len(aw.buf))}
+	}
+	if aw.opts.DropCache || aw.opts.DirectIO {
+		defer dropCache(f)
+	}
+	var rd io.Reader = io.LimitReader(src, size)
+	if aw.opts.Read != nil || aw.opts.Context != nil {
+		rd = &readHook{rd, aw.opts}
+	}
+	n, err := io.CopyBuffer(w, rd, aw.buf)
+	if aw.ew.err != nil {
+		return nil, &WriteError{aw.ew.err}
+	}
+	if err != nil {
+		return nil, &SourceError{path, err}
+	}
+
+	var change error
+	if n < size {
+		change = errShrank
+	} else if m, _ := src.Read(make([]byte, 1)); m > 0 {
+		change = errGrew
+	} else if modified(f, fi) {
+		change = errChanged
+	}
+	if change != nil {
+		if err := aw.changed(&ChangeError{path, false, change}); err != nil {
+			return nil, err
+		}
+		// the header promised size bytes
+		if _, err := io.CopyN(w, zeros{}, size-n); err != nil {
+			return nil, aw.writeError(path, err)
+		}
+	}
+	if aw.opts.Record == nil {
+		return nil, nil
+	}
+	return h.Sum(nil), nil
+}
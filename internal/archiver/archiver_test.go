@@ -0,0 +1,607 @@
+//go:build !windows
+
+package archiver
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+type member struct {
+	hdr  *tar.Header
+	body string
+}
+
+func readMembers(t *testing.T, data []byte) ([]string, map[string]member) {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	members := map[string]member{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names, members
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		members[hdr.Name] = member{hdr, string(body)}
+	}
+}
+
+// makeTree creates files, a symlink, a hard link, a FIFO and a .git
+// directory under a new directory.
+func makeTree(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, body := range map[string]string{
+		"b/file":     "in b",
+		"a":          "first",
+		".git/HEAD":  "ref",
+		"b/.gitkeep": "",
+	} {
+		p := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("b/file", filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(root, "a"), filepath.Join(root, "hard")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Mkfifo(filepath.Join(root, "fifo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestWriteRelative(t *testing.T) {
+	root := makeTree(t)
+	buf := &bytes.Buffer{}
+	if err := Write(buf, root, &Options{Relative: true, ExcludeVCS: true}); err != nil {
+		t.Fatal(err)
+	}
+	names, members := readMembers(t, buf.Bytes())
+
+	want := []string{"./", "./a", "./b/", "./b/.gitkeep", "./b/file", "./fifo", "./hard", "./link"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("members %q, want %q", names, want)
+	}
+	if m := members["./a"]; m.body != "first" || m.hdr.Format != tar.FormatPAX {
+		t.Fatalf("unexpected ./a %+v", m)
+	}
+	if m := members["./hard"]; m.hdr.Typeflag != tar.TypeLink || m.hdr.Linkname != "./a" {
+		t.Fatalf("hard link not stored as a link %+v", m.hdr)
+	}
+	if m := members["./link"]; m.hdr.Typeflag != tar.TypeSymlink || m.hdr.Linkname != "b/file" {
+		t.Fatalf("symlink not stored as a link %+v", m.hdr)
+	}
+	if m := members["./fifo"]; m.hdr.Typeflag != tar.TypeFifo {
+		t.Fatalf("fifo not archived %+v", m.hdr)
+	}
+}
+
+func TestWriteAbsoluteNames(t *testing.T) {
+	root := makeTree(t)
+	buf := &bytes.Buffer{}
+	if err := Write(buf, root+"/", nil); err != nil {
+		t.Fatal(err)
+	}
+	_, members := readMembers(t, buf.Bytes())
+	prefix := strings.TrimPrefix(root, "/")
+	for _, n := range []string{prefix + "/", prefix + "/.git/HEAD", prefix + "/b/file"} {
+		if _, ok := members[n]; !ok {
+			t.Fatalf("member missing. name=%q", n)
+		}
+	}
+}
+
+func TestWriteSnapshot(t *testing.T) {
+	root := makeTree(t)
+	buf := &bytes.Buffer{}
+	opts := &Options{Snapshot: root, SnapshotOf: "/srv/live"}
+	if err := Write(buf, filepath.Join(root, "b"), opts); err != nil {
+		t.Fatal(err)
+	}
+	_, members := readMembers(t, buf.Bytes())
+	for _, n := range []string{"srv/live/b/", "srv/live/b/file"} {
+		if _, ok := members[n]; !ok {
+			t.Fatalf("member missing. name=%q members=%v", n, members)
+		}
+	}
+}
+
+func TestWriteSpecial(t *testing.T) {
+	root := makeTree(t)
+	var seen []string
+	opts := &Options{Special: func(p string) error {
+		seen = append(seen, p)
+		return nil
+	}}
+	buf := &bytes.Buffer{}
+	if err := Write(buf, root, opts); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{filepath.Join(root, "fifo")}; !reflect.DeepEqual(seen, want) {
+		t.Fatalf("special files %q, want %q", seen, want)
+	}
+	_, members := readMembers(t, buf.Bytes())
+	if _, ok := members[strings.TrimPrefix(root, "/")+"/fifo"]; ok {
+		t.Fatal("skipped fifo is archived")
+	}
+
+	fail := errors.New("no special files")
+	opts.Special = func(string) error { return fail }
+	if err := Write(io.Discard, root, opts); err != fail {
+		t.Fatalf("Write returned %v, want %v", err, fail)
+	}
+}
+
+func TestWriteSkip(t *testing.T) {
+	root := makeTree(t)
+	var seen []string
+	opts := &Options{Relative: true, Skip: func(p string, fi os.FileInfo) bool {
+		seen = append(seen, filepath.Base(p))
+		return fi.Size() > 4
+	}}
+	buf := &bytes.Buffer{}
+	if err := Write(buf, root, opts); err != nil {
+		t.Fatal(err)
+	}
+	_, members := readMembers(t, buf.Bytes())
+	// the link holds 6 bytes, directories are never skipped
+	for n, want := range map[string]bool{"./a": false, "./hard": false, "./b/file": true, "./b/": true, "./link": false, "./fifo": true} {
+		if _, ok := members[n]; ok != want {
+			t.Errorf("member %s archived=%v", n, ok)
+		}
+	}
+	if len(seen) == 0 {
+		t.Fatal("Skip not called")
+	}
+}
+
+func TestWriteFollowSymlinks(t *testing.T) {
+	root := makeTree(t)
+	if err := os.Symlink(".", filepath.Join(root, "b", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b", filepath.Join(root, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("missing", filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	for _, inodeOrder := range []bool{false, true} {
+		buf := &bytes.Buffer{}
+		opts := &Options{Relative: true, FollowSymlinks: true, InodeOrder: inodeOrder}
+		if err := Write(buf, root, opts); err != nil {
+			t.Fatal(err)
+		}
+		_, members := readMembers(t, buf.Bytes())
+		if m := members["./link"]; m.hdr == nil || m.hdr.Typeflag != tar.TypeReg || m.body != "in b" {
+			t.Errorf("followed link archived as %+v", m.hdr)
+		}
+		if m := members["./dir/file"]; m.hdr == nil || m.body != "in b" {
+			t.Errorf("file under a followed directory link archived as %+v", m.hdr)
+		}
+		if m := members["./dangling"]; m.hdr == nil || m.hdr.Typeflag != tar.TypeSymlink {
+			t.Errorf("dangling link archived as %+v", m.hdr)
+		}
+		// the loop is stored once, not walked into
+		if _, ok := members["./b/loop/"]; !ok {
+			t.Error("looping link not archived")
+		}
+		if _, ok := members["./b/loop/file"]; ok {
+			t.Error("looping link walked into")
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, syscall.ENOSPC }
+
+func TestWriteErrors(t *testing.T) {
+	root := makeTree(t)
+	var we *WriteError
+	if err := Write(failingWriter{}, root, nil); !errors.As(err, &we) || we.Err != syscall.ENOSPC {
+		t.Fatalf("Write returned %v, want a WriteError", err)
+	}
+
+	var se *SourceError
+	missing := filepath.Join(root, "missing")
+	if err := Write(io.Discard, missing, nil); !errors.As(err, &se) || se.Path != missing {
+		t.Fatalf("Write returned %v, want a SourceError", err)
+	}
+}
+
+// TestWriteGNUTar checks GNU tar extracts what Write produces.
+func TestWriteGNUTar(t *testing.T) {
+	if _, err := exec.LookPath("tar"); err != nil {
+		t.Skip("tar is not installed")
+	}
+	root := makeTree(t)
+	archive := filepath.Join(t.TempDir(), "a.tar.gz")
+	f, err := os.Create(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(f, root, &Options{Relative: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	to := t.TempDir()
+	if out, err := exec.Command("tar", "-xzf", archive, "-C", to).CombinedOutput(); err != nil {
+		t.Fatalf("tar failed. err=%s out=%s", err, out)
+	}
+	if data, err := os.ReadFile(filepath.Join(to, "hard")); err != nil || string(data) != "first" {
+		t.Fatalf("hard link extracted as %q, err=%v", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(to, "link")); err != nil || link != "b/file" {
+		t.Fatalf("symlink extracted as %q, err=%v", link, err)
+	}
+}
+
+func TestWriteParallel(t *testing.T) {
+	root := makeTree(t)
+	for i := 0; i < 300; i++ {
+		p := filepath.Join(root, "many", string(rune('a'+i%26)), strings.Repeat("f", 1+i/26))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, bytes.Repeat([]byte{byte(i)}, i*997), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	big := bytes.Repeat([]byte("big"), 200000)
+	if err := os.WriteFile(filepath.Join(root, "many", "big"), big, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	seq, par := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := Write(seq, root, &Options{Relative: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(par, root, &Options{Relative: true, ReadWorkers: 8}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(seq.Bytes(), par.Bytes()) {
+		t.Fatal("parallel reads changed the archive")
+	}
+
+	var we *WriteError
+	if err := Write(failingWriter{}, root, &Options{ReadWorkers: 8, BufferSize: 512}); !errors.As(err, &we) {
+		t.Fatalf("Write returned %v, want a WriteError", err)
+	}
+}
+
+func TestWriteGzipWorkers(t *testing.T) {
+	root := makeTree(t)
+	// several blocks, not all alike
+	data := make([]byte, 3*_GzipBlock+12345)
+	for i := range data {
+		data[i] = byte(i * i >> 7)
+	}
+	if err := os.WriteFile(filepath.Join(root, "large"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	seq, par := &bytes.Buffer{}, &bytes.Buffer{}
+	if err := Write(seq, root, &Options{Relative: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(par, root, &Options{Relative: true, GzipWorkers: 4}); err != nil {
+		t.Fatal(err)
+	}
+	seqNames, seqMembers := readMembers(t, seq.Bytes())
+	parNames, parMembers := readMembers(t, par.Bytes())
+	if !reflect.DeepEqual(seqNames, parNames) {
+		t.Fatalf("members are %v, want %v", parNames, seqNames)
+	}
+	for n, m := range seqMembers {
+		if parMembers[n].body != m.body {
+			t.Errorf("%s differs", n)
+		}
+	}
+	if _, err := exec.LookPath("gzip"); err == nil {
+		cmd := exec.Command("gzip", "-t")
+		cmd.Stdin = bytes.NewReader(par.Bytes())
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Errorf("gzip -t failed. err=%s out=%s", err, out)
+		}
+	}
+
+	var we *WriteError
+	if err := Write(failingWriter{}, root, &Options{GzipWorkers: 4, BufferSize: 512}); !errors.As(err, &we) {
+		t.Fatalf("Write returned %v, want a WriteError", err)
+	}
+}
+
+func TestWriteInodeOrder(t *testing.T) {
+	root := makeTree(t)
+	buf := &bytes.Buffer{}
+	if err := Write(buf, root, &Options{Relative: true, InodeOrder: true, ExcludeVCS: true}); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := readMembers(t, buf.Bytes())
+
+	// every member is there, and directories still precede their contents
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	want := []string{"./", "./a", "./b/", "./b/.gitkeep", "./b/file", "./fifo", "./hard", "./link"}
+	if !reflect.DeepEqual(sorted, want) {
+		t.Fatalf("members %q, want %q", sorted, want)
+	}
+	seen := map[string]bool{}
+	for _, n := range names {
+		if n != "./" && !seen[path.Dir(path.Clean(n))] {
+			t.Fatalf("%s precedes its directory in %q", n, names)
+		}
+		seen[path.Clean(n)] = true
+	}
+
+	var ino []uint64
+	for _, n := range names[1:] {
+		if path.Dir(path.Clean(n)) != "." {
+			continue
+		}
+		fi, err := os.Lstat(filepath.Join(root, n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ino = append(ino, fi.Sys().(*syscall.Stat_t).Ino)
+	}
+	if !sort.SliceIsSorted(ino, func(i, j int) bool { return ino[i] < ino[j] }) {
+		t.Fatalf("top level members are not in inode order: %v", ino)
+	}
+}
+
+// growingFile is a FileInfo claiming a smaller size than the file has.
+type growingFile struct {
+	os.FileInfo
+}
+
+func (growingFile) Size() int64 { return 2 }
+
+func TestWriteChanged(t *testing.T) {
+	root := t.TempDir()
+	p := filepath.Join(root, "f")
+	if err := os.WriteFile(p, []byte("grown"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Lstat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a policy the change fails the archive
+	aw := &writer{opts: &Options{}, root: root, ew: &errWriter{w: io.Discard}, links: map[[2]uint64]string{}, sums: map[string][]byte{}}
+	aw.tw = tar.NewWriter(aw.ew)
+	aw.buf = make([]byte, 512)
+	if err := aw.member(p, growingFile{fi}, nil); err == nil {
+		t.Fatal("grown file is archived")
+	}
+
+	var seen []*ChangeError
+	aw.opts.Changed = func(e *ChangeError) error {
+		seen = append(seen, e)
+		return nil
+	}
+	if err := aw.member(p, growingFile{fi}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 1 || seen[0].Vanished || seen[0].Err != errGrew {
+		t.Fatalf("Changed got %v", seen)
+	}
+
+	// the retry reads the file as it is now
+	seen = nil
+	aw.opts.Retry = true
+	if err := aw.member(p, growingFile{fi}, nil); err != nil || len(seen) != 0 {
+		t.Fatalf("retry failed. err=%v changes=%v", err, seen)
+	}
+
+	if err := os.Remove(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.member(p, fi, nil); err != nil || len(seen) != 1 || !seen[0].Vanished {
+		t.Fatalf("vanished file not reported. err=%v changes=%v", err, seen)
+	}
+}
+
+func TestWriteNoCompress(t *testing.T) {
+	root := makeTree(t)
+	buf := &bytes.Buffer{}
+	if err := Write(buf, root, &Options{Relative: true, NoCompress: true}); err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := tar.NewReader(buf).Next()
+	if err != nil || hdr.Name != "./" {
+		t.Fatalf("plain tar not written. hdr=%v err=%v", hdr, err)
+	}
+	if err := Write(io.Discard, root, &Options{Level: 42}); err == nil {
+		t.Fatal("invalid gzip level accepted")
+	}
+}
+
+func TestWriteBufferSize(t *testing.T) {
+	root := t.TempDir()
+	body := strings.Repeat("0123456789", 500)
+	if err := os.WriteFile(filepath.Join(root, "big"), []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// files and the archive span many buffers
+	for _, size := range []int{0, 512, 1 << 20} {
+		buf := &bytes.Buffer{}
+		if err := Write(buf, root, &Options{Relative: true, BufferSize: size}); err != nil {
+			t.Fatal(err)
+		}
+		if _, members := readMembers(t, buf.Bytes()); members["./big"].body != body {
+			t.Errorf("size %d: ./big has %d bytes, want %d", size, len(members["./big"].body), len(body))
+		}
+	}
+}
+
+func TestWriteAppend(t *testing.T) {
+	root := makeTree(t)
+	prev := &bytes.Buffer{}
+	opts := &Options{Relative: true, ExcludeVCS: true, NoCompress: true, Global: map[string]string{"TARBU.runs": "1"}}
+	if err := Write(prev, root, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "b/file"), []byte("grown in b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "c"), []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	opts = &Options{Relative: true, ExcludeVCS: true, Append: prev, Global: map[string]string{"TARBU.runs": "2"}}
+	if err := Write(buf, root, opts); err != nil {
+		t.Fatal(err)
+	}
+	names, members := readMembers(t, buf.Bytes())
+	want := []string{
+		"pax_global_header", "./", "./a", "./b/", "./b/.gitkeep", "./b/file", "./fifo", "./hard", "./link",
+		// the root changed with c
+		"./", "./b/file", "./c",
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("members %q, want %q", names, want)
+	}
+	if m := members["pax_global_header"]; m.hdr.PAXRecords["TARBU.runs"] != "2" {
+		t.Fatalf("global header not replaced %+v", m.hdr.PAXRecords)
+	}
+	if m := members["./b/file"]; m.body != "grown in b" {
+		t.Fatalf("changed file not appended %+v", m)
+	}
+
+	var aerr *AppendError
+	opts = &Options{Append: strings.NewReader("not a tar stream")}
+	if err := Write(io.Discard, root, opts); !errors.As(err, &aerr) {
+		t.Fatalf("broken previous archive not reported. err=%v", err)
+	}
+}
+
+func TestWriteRoots(t *testing.T) {
+	root := makeTree(t)
+	buf := &bytes.Buffer{}
+	roots := []string{filepath.Join(root, "b"), filepath.Join(root, "a")}
+	if err := WriteRoots(buf, roots, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := readMembers(t, buf.Bytes())
+	prefix := strings.TrimLeft(filepath.ToSlash(root), "/")
+	want := []string{prefix + "/b/", prefix + "/b/.gitkeep", prefix + "/b/file", prefix + "/a"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("members %q, want %q", names, want)
+	}
+	if err := WriteRoots(io.Discard, roots, &Options{Relative: true}); err == nil {
+		t.Fatal("relative archive of several roots written")
+	}
+}
+
+func TestList(t *testing.T) {
+	root := makeTree(t)
+	ex, err := NewExcluder([]string{"b/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := &Options{Relative: true, ExcludeVCS: true, Exclude: ex, Special: func(string) error { return nil }}
+	buf := &bytes.Buffer{}
+	if err := Write(buf, root, opts); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := readMembers(t, buf.Bytes())
+	var names []string
+	err = List([]string{root}, opts, func(_, name string, fi os.FileInfo) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("listed %q, archived %q", names, want)
+	}
+}
+
+func TestWriteDirectIO(t *testing.T) {
+	root := t.TempDir()
+	// not a multiple of the O_DIRECT alignment, larger than read ahead
+	data := bytes.Repeat([]byte("0123456789abcdef"), (_PrefetchMax+5000)/16)
+	data = append(data, "tail"...)
+	if err := os.WriteFile(filepath.Join(root, "big"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "small"), []byte("small"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, opts := range []*Options{{Relative: true, DirectIO: true}, {Relative: true, DropCache: true, ReadWorkers: 2}} {
+		buf := &bytes.Buffer{}
+		if err := Write(buf, root, opts); err != nil {
+			t.Fatal(err)
+		}
+		_, members := readMembers(t, buf.Bytes())
+		if members["./big"].body != string(data) || members["./small"].body != "small" {
+			t.Errorf("contents differ with %+v", opts)
+		}
+	}
+}
+
+func TestACLText(t *testing.T) {
+	entry := func(tag, perm uint16, id uint32) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint16(b, tag)
+		binary.LittleEndian.PutUint16(b[2:], perm)
+		binary.LittleEndian.PutUint32(b[4:], id)
+		return b
+	}
+	acl := []byte{2, 0, 0, 0}
+	acl = append(acl, entry(aclUserObj, 6, 0xffffffff)...)
+	acl = append(acl, entry(aclUser, 5, 1000)...)
+	acl = append(acl, entry(aclGroupObj, 4, 0xffffffff)...)
+	acl = append(acl, entry(aclMask, 7, 0xffffffff)...)
+	acl = append(acl, entry(aclOther, 0, 0xffffffff)...)
+	got, err := aclText(acl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "user::rw-,user:1000:r-x,group::r--,mask::rwx,other::---"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if _, err := aclText(acl[:7]); err == nil {
+		t.Error("truncated ACL accepted")
+	}
+}
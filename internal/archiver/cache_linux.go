@@ -0,0 +1,42 @@
+//go:build linux && (amd64 || arm64)
+
+package archiver
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// _DirectAlign is the buffer and read size alignment O_DIRECT needs on
+// common block devices.
+const _DirectAlign = 4096
+
+const _FadvDontneed = 4
+
+// dropCache asks the kernel to drop the cached pages of f.
+func dropCache(f *os.File) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), 0, 0, _FadvDontneed, 0, 0)
+}
+
+// setDirect switches f to O_DIRECT, which filesystems like tmpfs refuse.
+func setDirect(f *os.File) bool {
+	flags, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_GETFL, 0)
+	if errno != 0 {
+		return false
+	}
+	_, _, errno = syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_SETFL, flags|syscall.O_DIRECT)
+	return errno == 0
+}
+
+// alignedBuffer returns a buffer of at least size bytes, rounded up to
+// and starting at a multiple of _DirectAlign.
+func alignedBuffer(size int) []byte {
+	size = (size + _DirectAlign - 1) / _DirectAlign * _DirectAlign
+	b := make([]byte, size+_DirectAlign)
+	off := int(uintptr(unsafe.Pointer(&b[0])) & (_DirectAlign - 1))
+	if off != 0 {
+		off = _DirectAlign - off
+	}
+	return b[off : off+size]
+}
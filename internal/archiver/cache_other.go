@@ -0,0 +1,13 @@
+//go:build !linux || !(amd64 || arm64)
+
+package archiver
+
+import "os"
+
+// dropCache does nothing where posix_fadvise isn't wired up.
+func dropCache(f *os.File) {}
+
+// setDirect leaves f alone where O_DIRECT isn't wired up.
+func setDirect(f *os.File) bool { return false }
+
+func alignedBuffer(size int) []byte { return make([]byte, size) }
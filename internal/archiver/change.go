@@ -0,0 +1,123 @@
+package archiver
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+var (
+	errShrank  = errors.New("file shrank as we read it")
+	errGrew    = errors.New("file grew as we read it")
+	errChanged = errors.New("file changed as we read it")
+)
+
+// ChangeError is a file that vanished or changed while it was archived.
+type ChangeError struct {
+	Path string
+	// Vanished is set when the file was removed after it was listed.
+	Vanished bool
+	Err      error
+}
+
+func (e *ChangeError) Error() string { return e.Path + ": " + e.Err.Error() }
+
+func (e *ChangeError) Unwrap() error { return e.Err }
+
+// changed applies the change policy to e.
+func (aw *writer) changed(e *ChangeError) error {
+	if aw.opts.Changed == nil {
+		return &SourceError{e.Path, e.Err}
+	}
+	return aw.opts.Changed(e)
+}
+
+// modified tells whether f was written to since fi was taken.
+func modified(f *os.File, fi os.FileInfo) bool {
+	st, err := f.Stat()
+	return err == nil && !st.ModTime().Equal(fi.ModTime())
+}
+
+// readSmall reads a file expected to be as large as fi says. When it
+// changed, the contents read are cut or zero padded to that size and
+// returned with a ChangeError.
+func (aw *writer) readSmall(path string, fi os.FileInfo) *prefetched {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &prefetched{err: &ChangeError{path, true, err}}
+	} else if err != nil {
+		return &prefetched{err: &SourceError{path, err}}
+	}
+	defer f.Close()
+	if aw.opts.DropCache || aw.opts.DirectIO {
+		defer dropCache(f)
+	}
+
+	size := fi.Size()
+	data := make([]byte, size+1)
+	n, err := io.ReadFull(f, data)
+	if aw.opts.Read != nil && n > 0 {
+		aw.opts.Read(n)
+	}
+	pre := &prefetched{data: data[:size]}
+	switch {
+	case err == nil:
+		pre.err = &ChangeError{path, false, errGrew}
+	case err != io.EOF && err != io.ErrUnexpectedEOF:
+		pre.err = &SourceError{path, err}
+	case int64(n) < size:
+		pre.err = &ChangeError{path, false, errShrank}
+	case modified(f, fi):
+		pre.err = &ChangeError{path, false, errChanged}
+	}
+	return pre
+}
+
+// prepare reads a small file ahead when it may be retried, and applies
+// the change policy to files read ahead. A nil FileInfo skips the file.
+func (aw *writer) prepare(path string, fi os.FileInfo, pre *prefetched) (os.FileInfo, *prefetched, error) {
+	if pre == nil && aw.opts.Retry && fi.Size() <= _PrefetchMax {
+		pre = aw.readSmall(path, fi)
+	}
+	if pre == nil {
+		return fi, nil, nil
+	}
+	ce, ok := pre.err.(*ChangeError)
+	if ok && aw.opts.Retry {
+		// a vanished file may have been replaced by a rename
+		nfi, err := aw.lstat(path)
+		switch {
+		case err == nil && nfi.Mode().IsRegular() && nfi.Size() <= _PrefetchMax:
+			fi, pre = nfi, aw.readSmall(path, nfi)
+		case err == nil && nfi.Mode().IsRegular():
+			// grown too large to hold, stream it
+			return nfi, nil, nil
+		case err != nil && !os.IsNotExist(err):
+			return nil, nil, &SourceError{path, err}
+		}
+		ce, ok = pre.err.(*ChangeError)
+	}
+	if !ok {
+		if pre.err != nil {
+			return nil, nil, pre.err
+		}
+		return fi, pre, nil
+	}
+	if err := aw.changed(ce); err != nil {
+		return nil, nil, err
+	}
+	if ce.Vanished {
+		return nil, nil, nil
+	}
+	return fi, pre, nil
+}
+
+// zeros pads members of files that shrank.
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -0,0 +1,107 @@
+package archiver
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// excludePattern is one gitignore style pattern.
+type excludePattern struct {
+	negate  bool
+	dirOnly bool
+	// anchored patterns match from the root, others match any suffix
+	anchored bool
+	segs     []string
+}
+
+// Excluder matches paths relative to an archive root against gitignore
+// style patterns:
+//
+//	*.log          a name at any depth
+//	/build         build at the root only
+//	cache/         directories only
+//	**/tmp/*.swp   ** matches any number of directories
+//	!keep.log      re-include what an earlier pattern excluded
+//
+// The last matching pattern decides. As in git, a file in an excluded
+// directory can't be re-included.
+type Excluder struct {
+	patterns []excludePattern
+}
+
+// NewExcluder compiles patterns, rejecting malformed ones.
+func NewExcluder(patterns []string) (*Excluder, error) {
+	e := &Excluder{}
+	for _, p := range patterns {
+		src := p
+		var ep excludePattern
+		if strings.HasPrefix(p, "!") {
+			ep.negate, p = true, p[1:]
+		}
+		if strings.HasSuffix(p, "/") {
+			ep.dirOnly, p = true, strings.TrimRight(p, "/")
+		}
+		if strings.Contains(p, "/") {
+			ep.anchored = true
+		}
+		p = strings.TrimPrefix(p, "/")
+		if p == "" {
+			return nil, fmt.Errorf("empty exclude pattern. pattern=%q", src)
+		}
+		ep.segs = strings.Split(p, "/")
+		for _, s := range ep.segs {
+			if _, err := path.Match(s, ""); err != nil {
+				return nil, fmt.Errorf("bad exclude pattern. pattern=%q", src)
+			}
+		}
+		e.patterns = append(e.patterns, ep)
+	}
+	return e, nil
+}
+
+// Match reports whether rel, a slash separated path relative to the
+// root, is excluded.
+func (e *Excluder) Match(rel string, dir bool) bool {
+	segs := strings.Split(rel, "/")
+	excluded := false
+	for _, p := range e.patterns {
+		if p.dirOnly && !dir {
+			continue
+		}
+		if p.match(segs) {
+			excluded = !p.negate
+		}
+	}
+	return excluded
+}
+
+func (p *excludePattern) match(segs []string) bool {
+	if p.anchored {
+		return matchSegs(p.segs, segs)
+	}
+	// an unanchored pattern is a single name, matched at any depth
+	ok, _ := path.Match(p.segs[0], segs[len(segs)-1])
+	return ok
+}
+
+func matchSegs(pat, segs []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegs(pat[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], segs[0]); !ok {
+			return false
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
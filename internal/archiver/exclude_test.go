@@ -0,0 +1,40 @@
+package archiver
+
+import "testing"
+
+func TestExcluder(t *testing.T) {
+	e, err := NewExcluder([]string{"*.log", "!keep.log", "/build", "cache/", "**/tmp/*.swp", "a/**/z"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		rel  string
+		dir  bool
+		want bool
+	}{
+		{"x.log", false, true},
+		{"deep/er/x.log", false, true},
+		{"deep/keep.log", false, false},
+		{"build", true, true},
+		{"src/build", true, false},
+		{"cache", true, true},
+		{"cache", false, false},
+		{"src/cache", true, true},
+		{"tmp/a.swp", false, true},
+		{"x/y/tmp/a.swp", false, true},
+		{"x/tmp/a.txt", false, false},
+		{"a/z", false, true},
+		{"a/b/c/z", false, true},
+		{"b/a/z", false, false},
+	} {
+		if got := e.Match(c.rel, c.dir); got != c.want {
+			t.Errorf("Match(%q, %v) = %v, want %v", c.rel, c.dir, got, c.want)
+		}
+	}
+
+	for _, bad := range []string{"", "/", "!", "[a"} {
+		if _, err := NewExcluder([]string{bad}); err == nil {
+			t.Errorf("pattern %q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package archiver
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// _GzipBlock is how much of the tar stream each gzip member holds when
+// compressing in parallel. Members don't share a dictionary, larger
+// blocks lose less ratio to that.
+const _GzipBlock = 1 << 20
+
+// GzipMemory approximates what compressing with workers goroutines
+// allocates: the blocks queued and their compressed copies, and a flate
+// writer per worker.
+func GzipMemory(workers int) int64 {
+	return int64(2*workers+2)*2*_GzipBlock + int64(workers)*(1<<20)
+}
+
+type gzipBlock struct {
+	data []byte
+	out  bytes.Buffer
+	err  error
+	done chan struct{}
+}
+
+// parallelGzip compresses blocks of the stream concurrently, like pigz,
+// each into a gzip member of its own written to w in order. RFC 1952
+// makes the members one gzip file, which gzip, tar and compress/gzip
+// read whole.
+type parallelGzip struct {
+	w     io.Writer
+	level int
+	buf   []byte
+	// order holds the blocks by position for the writer, jobs the same
+	// blocks for the workers
+	order   chan *gzipBlock
+	jobs    chan *gzipBlock
+	workers sync.WaitGroup
+	written chan struct{}
+	blocks  int
+	closed  bool
+
+	mu  sync.Mutex
+	err error
+}
+
+func newParallelGzip(w io.Writer, level, workers int) (*parallelGzip, error) {
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, level); err != nil {
+		return nil, err
+	}
+	z := &parallelGzip{
+		w:       w,
+		level:   level,
+		buf:     make([]byte, 0, _GzipBlock),
+		order:   make(chan *gzipBlock, 2*workers),
+		jobs:    make(chan *gzipBlock, workers),
+		written: make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		z.workers.Add(1)
+		go z.compress()
+	}
+	go z.write()
+	return z, nil
+}
+
+func (z *parallelGzip) compress() {
+	defer z.workers.Done()
+	for b := range z.jobs {
+		// the level was checked by newParallelGzip
+		gw, _ := gzip.NewWriterLevel(&b.out, z.level)
+		_, b.err = gw.Write(b.data)
+		if err := gw.Close(); b.err == nil {
+			b.err = err
+		}
+		b.data = nil
+		close(b.done)
+	}
+}
+
+// write writes the compressed blocks in order, until the first error.
+func (z *parallelGzip) write() {
+	defer close(z.written)
+	for b := range z.order {
+		<-b.done
+		if z.failed() != nil {
+			continue
+		}
+		err := b.err
+		if err == nil {
+			_, err = z.w.Write(b.out.Bytes())
+		}
+		if err != nil {
+			z.mu.Lock()
+			z.err = err
+			z.mu.Unlock()
+		}
+	}
+}
+
+func (z *parallelGzip) failed() error {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.err
+}
+
+func (z *parallelGzip) Write(p []byte) (int, error) {
+	if err := z.failed(); err != nil {
+		return 0, err
+	}
+	n := len(p)
+	for len(p) > 0 {
+		c := copy(z.buf[len(z.buf):cap(z.buf)], p)
+		z.buf = z.buf[:len(z.buf)+c]
+		p = p[c:]
+		if len(z.buf) == cap(z.buf) {
+			z.flush()
+		}
+	}
+	return n, nil
+}
+
+// flush hands the buffered block to the workers.
+func (z *parallelGzip) flush() {
+	b := &gzipBlock{data: z.buf, done: make(chan struct{})}
+	z.order <- b
+	z.jobs <- b
+	z.blocks++
+	z.buf = make([]byte, 0, _GzipBlock)
+}
+
+// Close compresses what is buffered and waits for every block to be
+// written. An empty stream is still a gzip member. Closing again does
+// nothing, so it can be deferred for failures.
+func (z *parallelGzip) Close() error {
+	if z.closed {
+		return z.failed()
+	}
+	z.closed = true
+	if len(z.buf) > 0 || z.blocks == 0 {
+		z.flush()
+	}
+	close(z.jobs)
+	close(z.order)
+	z.workers.Wait()
+	<-z.written
+	return z.failed()
+}
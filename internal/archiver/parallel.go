@@ -0,0 +1,92 @@
+package archiver
+
+import (
+	"errors"
+	"os"
+	"sync"
+)
+
+// _PrefetchMax is the largest file read ahead. Larger files are streamed
+// by the writer, so read ahead memory stays below about
+// 9 * ReadWorkers * _PrefetchMax.
+const _PrefetchMax = 256 << 10
+
+var errStopped = errors.New("archive writer stopped")
+
+type prefetched struct {
+	data []byte
+	err  error
+}
+
+type walkJob struct {
+	path  string
+	fi    os.FileInfo
+	pre   *prefetched
+	ready chan struct{}
+}
+
+// walkParallel walks the tree in one goroutine while workers read small
+// files ahead, keeping the member order of a sequential walk. On trees of
+// many small files this overlaps the per-file open and read latency that
+// otherwise dominates.
+func (aw *writer) walkParallel(workers int) error {
+	queue := make(chan *walkJob, 4*workers)
+	reads := make(chan *walkJob, 4*workers)
+	stop := make(chan struct{})
+
+	var walkErr error
+	go func() {
+		defer close(reads)
+		defer close(queue)
+		walkErr = aw.walk(func(path string, fi os.FileInfo, err error) error {
+			if keep, err := aw.filter(path, fi, err); !keep {
+				return err
+			}
+			j := &walkJob{path: path, fi: fi}
+			if fi.Mode().IsRegular() && fi.Size() <= _PrefetchMax {
+				j.ready = make(chan struct{})
+				select {
+				case reads <- j:
+				case <-stop:
+					return errStopped
+				}
+			}
+			select {
+			case queue <- j:
+			case <-stop:
+				return errStopped
+			}
+			return nil
+		})
+	}()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range reads {
+				j.pre = aw.readSmall(j.path, j.fi)
+				close(j.ready)
+			}
+		}()
+	}
+
+	var err error
+	for j := range queue {
+		if err != nil {
+			continue
+		}
+		if j.ready != nil {
+			<-j.ready
+		}
+		if err = aw.member(j.path, j.fi, j.pre); err != nil {
+			close(stop)
+		}
+	}
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	return walkErr
+}
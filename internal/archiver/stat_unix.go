@@ -0,0 +1,19 @@
+//go:build !windows
+
+package archiver
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileID returns the device and inode of fi, which tell hard links
+// apart, and its link count. ok is false where the platform doesn't
+// tell.
+func fileID(fi os.FileInfo) (id [2]uint64, nlink uint64, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return id, 0, false
+	}
+	return [2]uint64{uint64(st.Dev), uint64(st.Ino)}, uint64(st.Nlink), true
+}
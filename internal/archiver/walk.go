@@ -0,0 +1,112 @@
+package archiver
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// walk calls fn for each root and everything below it like
+// filepath.Walk. With InodeOrder, the entries of each directory are
+// visited by inode number instead of by name, with FollowSymlinks
+// links are visited as their targets.
+func (aw *writer) walk(fn filepath.WalkFunc) error {
+	for _, root := range aw.roots {
+		aw.root = root
+		if err := aw.walkRoot(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (aw *writer) walkRoot(fn filepath.WalkFunc) error {
+	if !aw.opts.InodeOrder && !aw.opts.FollowSymlinks {
+		return filepath.Walk(aw.root, fn)
+	}
+	fi, err := aw.lstat(aw.root)
+	if err != nil {
+		err = fn(aw.root, nil, err)
+	} else {
+		err = aw.walkDir(aw.root, fi, fn, map[[2]uint64]bool{})
+	}
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+// lstat is os.Lstat, or os.Stat with FollowSymlinks for links that
+// aren't dangling.
+func (aw *writer) lstat(path string) (os.FileInfo, error) {
+	fi, err := os.Lstat(path)
+	if err == nil && aw.opts.FollowSymlinks && fi.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Stat(path); err == nil {
+			return target, nil
+		}
+	}
+	return fi, err
+}
+
+// walkDir walks like filepath.Walk, visiting the entries of directories
+// in inode order with InodeOrder and following links with
+// FollowSymlinks. walking holds the directories being walked, which
+// followed links must not lead back to.
+func (aw *writer) walkDir(path string, fi os.FileInfo, fn filepath.WalkFunc, walking map[[2]uint64]bool) error {
+	if !fi.IsDir() {
+		return fn(path, fi, nil)
+	}
+	id, _, ok := fileID(fi)
+	if ok && walking[id] {
+		// a link looping back is archived as an empty directory
+		return fn(path, fi, nil)
+	}
+	d, err := os.Open(path)
+	var fis []os.FileInfo
+	if err == nil {
+		// Readdir lstats in directory order, which is cheap on any disk
+		fis, err = d.Readdir(-1)
+		d.Close()
+	}
+	if ferr := fn(path, fi, nil); ferr != nil {
+		return ferr
+	}
+	if err != nil {
+		// report the unreadable directory like filepath.Walk
+		return fn(path, fi, err)
+	}
+	if aw.opts.FollowSymlinks {
+		for i, c := range fis {
+			if c.Mode()&os.ModeSymlink == 0 {
+				continue
+			}
+			if t, err := aw.lstat(filepath.Join(path, c.Name())); err == nil {
+				fis[i] = t
+			}
+		}
+	}
+	sort.Slice(fis, func(i, j int) bool {
+		if aw.opts.InodeOrder {
+			if a, b := inode(fis[i]), inode(fis[j]); a != b {
+				return a < b
+			}
+		}
+		return fis[i].Name() < fis[j].Name()
+	})
+	if ok {
+		walking[id] = true
+		defer delete(walking, id)
+	}
+	for _, c := range fis {
+		err := aw.walkDir(filepath.Join(path, c.Name()), c, fn, walking)
+		if err != nil && !(err == filepath.SkipDir && c.IsDir()) {
+			return err
+		}
+	}
+	return nil
+}
+
+func inode(fi os.FileInfo) uint64 {
+	id, _, _ := fileID(fi)
+	return id[1]
+}
@@ -0,0 +1,99 @@
+package archiver
+
+import (
+	"strings"
+	"syscall"
+)
+
+// securityRecords returns the PAX records GNU tar uses for the file
+// capabilities and the SELinux label of path.
+func securityRecords(path string) (map[string]string, error) {
+	records := map[string]string{}
+	if v, err := getxattr(path, "security.capability"); err != nil {
+		return nil, err
+	} else if v != "" {
+		records["SCHILY.xattr.security.capability"] = v
+	}
+	if v, err := getxattr(path, "security.selinux"); err != nil {
+		return nil, err
+	} else if v != "" {
+		records["RHT.security.selinux"] = strings.TrimRight(v, "\x00")
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return records, nil
+}
+
+// extendedRecords returns the PAX records GNU tar --xattrs and --acls
+// use for all extended attributes of path: POSIX ACLs as text, the
+// SELinux label as with securityRecords and the rest as they are.
+func extendedRecords(path string) (map[string]string, error) {
+	names, err := listxattr(path)
+	if err != nil {
+		return nil, err
+	}
+	records := map[string]string{}
+	for _, n := range names {
+		v, err := getxattr(path, n)
+		if err != nil {
+			return nil, err
+		}
+		switch n {
+		case "system.posix_acl_access", "system.posix_acl_default":
+			acl, err := aclText([]byte(v))
+			if err != nil {
+				return nil, err
+			}
+			records["SCHILY.acl."+strings.TrimPrefix(n, "system.posix_acl_")] = acl
+		case "security.selinux":
+			records["RHT.security.selinux"] = strings.TrimRight(v, "\x00")
+		default:
+			records["SCHILY.xattr."+n] = v
+		}
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	return records, nil
+}
+
+// listxattr returns the names of the extended attributes of path.
+func listxattr(path string) ([]string, error) {
+	for size := 256; ; size *= 4 {
+		buf := make([]byte, size)
+		n, err := syscall.Listxattr(path, buf)
+		switch err {
+		case nil:
+			var names []string
+			for _, n := range strings.Split(string(buf[:n]), "\x00") {
+				if n != "" {
+					names = append(names, n)
+				}
+			}
+			return names, nil
+		case syscall.ERANGE:
+			continue
+		case syscall.ENOTSUP:
+			return nil, nil
+		}
+		return nil, err
+	}
+}
+
+// getxattr returns "" for unset attributes and filesystems without them.
+func getxattr(path, attr string) (string, error) {
+	for size := 256; ; size *= 4 {
+		buf := make([]byte, size)
+		n, err := syscall.Getxattr(path, attr, buf)
+		switch err {
+		case nil:
+			return string(buf[:n]), nil
+		case syscall.ERANGE:
+			continue
+		case syscall.ENODATA, syscall.ENOTSUP:
+			return "", nil
+		}
+		return "", err
+	}
+}
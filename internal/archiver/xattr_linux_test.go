@@ -0,0 +1,63 @@
+package archiver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteSecurityAttrs(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"ping", "plain"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// cap_net_bind_service+ep as vfs_cap_data revision 2
+	capability := make([]byte, 20)
+	binary.LittleEndian.PutUint32(capability, 0x02000001)
+	binary.LittleEndian.PutUint32(capability[4:], 1<<10)
+	if err := syscall.Setxattr(filepath.Join(root, "ping"), "security.capability", capability, 0); err != nil {
+		t.Skipf("file capabilities can't be set here: %s", err)
+	}
+	user := syscall.Setxattr(filepath.Join(root, "ping"), "user.origin", []byte("test"), 0) == nil
+
+	for _, tc := range []struct {
+		name string
+		opts Options
+		// recorded are the PAX records wanted of ping
+		recorded map[string]string
+	}{
+		{"none", Options{}, nil},
+		{"security", Options{SecurityAttrs: true}, map[string]string{"SCHILY.xattr.security.capability": string(capability)}},
+		{"extended", Options{Extended: true}, map[string]string{"SCHILY.xattr.security.capability": string(capability), "SCHILY.xattr.user.origin": "test"}},
+	} {
+		buf := &bytes.Buffer{}
+		tc.opts.Relative = true
+		if err := Write(buf, root, &tc.opts); err != nil {
+			t.Fatalf("%s: %s", tc.name, err)
+		}
+		_, members := readMembers(t, buf.Bytes())
+		got := members["./ping"].hdr.PAXRecords
+		for k, v := range tc.recorded {
+			if k == "SCHILY.xattr.user.origin" && !user {
+				continue
+			}
+			if got[k] != v {
+				t.Errorf("%s: ping has %s=%q, want %q", tc.name, k, got[k], v)
+			}
+		}
+		if _, ok := got["SCHILY.xattr.user.origin"]; ok && !tc.opts.Extended {
+			t.Errorf("%s: user attributes recorded", tc.name)
+		}
+		if tc.recorded == nil && got["SCHILY.xattr.security.capability"] != "" {
+			t.Errorf("%s: capabilities recorded", tc.name)
+		}
+		if c := members["./plain"].hdr.PAXRecords["SCHILY.xattr.security.capability"]; c != "" {
+			t.Errorf("%s: plain has capabilities %q", tc.name, c)
+		}
+	}
+}
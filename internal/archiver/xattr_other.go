@@ -0,0 +1,15 @@
+//go:build !linux
+
+package archiver
+
+// securityRecords stores nothing where capabilities and SELinux labels
+// don't exist.
+func securityRecords(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// extendedRecords stores nothing, extended attributes are only read on
+// Linux.
+func extendedRecords(path string) (map[string]string, error) {
+	return nil, nil
+}
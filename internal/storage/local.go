@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Local is a destination directory.
+type Local struct {
+	Dir string
+	// sub directories are made on demand, see Sub
+	sub bool
+}
+
+// TmpSuffix ends the names Local writes objects under before renaming
+// them into place, so a killed run leaves no truncated object behind.
+const TmpSuffix = ".tmp"
+
+func (l *Local) path(name string) string { return filepath.Join(l.Dir, name) }
+
+func (l *Local) Put(name string, r io.Reader) error {
+	if l.sub {
+		if err := os.MkdirAll(l.Dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(l.path(name + TmpSuffix))
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	// the data must be on disk before the name is
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), l.path(name)); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (l *Local) Open(name string) (io.ReadCloser, error) {
+	f, err := os.Open(l.path(name))
+	if os.IsNotExist(err) {
+		return nil, &notExist{name}
+	}
+	return f, err
+}
+
+func (l *Local) List(prefix string) ([]Object, error) {
+	fis, err := ioutil.ReadDir(l.Dir)
+	if l.sub && os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var objs []Object
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() && strings.HasPrefix(fi.Name(), prefix) {
+			objs = append(objs, Object{fi.Name(), fi.Size()})
+		}
+	}
+	return objs, nil
+}
+
+func (l *Local) Delete(names ...string) error {
+	for _, n := range names {
+		if err := os.Remove(l.path(n)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *Local) Location(name string) string { return l.path(name) }
+
+func (l *Local) Rename(from, to string) error {
+	return os.Rename(l.path(from), l.path(to))
+}
+
+func (l *Local) Free() (int64, error) {
+	n, err := freeSpace(l.Dir)
+	if l.sub && os.IsNotExist(err) {
+		// made by the first Put
+		n, err = freeSpace(filepath.Dir(l.Dir))
+	}
+	return n, err
+}
+
+func (l *Local) Append(name string, data []byte) error {
+	f, err := os.OpenFile(l.path(name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// Memory keeps objects in memory, for tests.
+type Memory struct {
+	mu      sync.Mutex
+	Objects map[string][]byte
+}
+
+func NewMemory() *Memory {
+	return &Memory{Objects: map[string][]byte{}}
+}
+
+func (m *Memory) Put(name string, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Objects[name] = data
+	return nil
+}
+
+func (m *Memory) Open(name string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.Objects[name]
+	if !ok {
+		return nil, &notExist{name}
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *Memory) List(prefix string) ([]Object, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var objs []Object
+	for n, data := range m.Objects {
+		if strings.HasPrefix(n, prefix) {
+			objs = append(objs, Object{n, int64(len(data))})
+		}
+	}
+	return sortObjects(objs), nil
+}
+
+func (m *Memory) Delete(names ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, n := range names {
+		delete(m.Objects, n)
+	}
+	return nil
+}
+
+func (m *Memory) Location(name string) string { return "memory://" + name }
+
+func (m *Memory) Rename(from, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.Objects[from]
+	if !ok {
+		return &notExist{from}
+	}
+	delete(m.Objects, from)
+	m.Objects[to] = data
+	return nil
+}
@@ -0,0 +1,37 @@
+package storage
+
+import (
+	"os"
+)
+
+// Move moves name of b to to in dst, e.g. a Sub of b. Directories of
+// one filesystem rename, other backends copy and delete. A missing name
+// is an error satisfying IsNotExist.
+func Move(b Backend, name string, dst Backend, to string) error {
+	if from, ok := b.(*Local); ok {
+		if into, ok := dst.(*Local); ok {
+			if into.sub {
+				if err := os.MkdirAll(into.Dir, 0755); err != nil {
+					return err
+				}
+			}
+			err := os.Rename(from.path(name), into.path(to))
+			if os.IsNotExist(err) {
+				if _, serr := os.Stat(from.path(name)); os.IsNotExist(serr) {
+					return &notExist{name}
+				}
+			}
+			return err
+		}
+	}
+	r, err := b.Open(name)
+	if err != nil {
+		return err
+	}
+	err = dst.Put(to, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	return b.Delete(name)
+}
@@ -0,0 +1,70 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket letting through rate requests a second
+// on average, in bursts of up to burst. Providers like Backblaze and
+// Wasabi answer large prunes and listings with storms of 429s otherwise.
+// A nil rateLimiter doesn't limit.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter reads the rate and burst query parameters of a
+// destination URL, nil without rate.
+func newRateLimiter(q url.Values) (*rateLimiter, error) {
+	if q.Get("rate") == "" {
+		return nil, nil
+	}
+	rate, err := strconv.ParseFloat(q.Get("rate"), 64)
+	if err != nil || rate <= 0 {
+		return nil, fmt.Errorf("rate must be a positive number of requests a second. rate=%s", q.Get("rate"))
+	}
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	if b := q.Get("burst"); b != "" {
+		n, err := strconv.Atoi(b)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("burst must be a positive number of requests. burst=%s", b)
+		}
+		burst = float64(n)
+	}
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst}, nil
+}
+
+// wait blocks until a request may be sent.
+func (l *rateLimiter) wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+	if l.tokens < 1 {
+		// later callers queue behind the lock
+		d := time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+		time.Sleep(d)
+		l.last = l.last.Add(d)
+		l.tokens = 1
+	}
+	l.tokens--
+}
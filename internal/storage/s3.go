@@ -0,0 +1,741 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// _S3DeleteBatch is the most keys a DeleteObjects request takes.
+const _S3DeleteBatch = 1000
+
+// _S3Retries bounds retries of throttled and failed requests.
+const _S3Retries = 5
+
+// _S3PartSize is the size of the first parts of multipart uploads,
+// doubled every _S3PartGrowth parts so the 10000 parts S3 allows cover
+// archives of many terabytes. Smaller objects are sent with one PUT.
+const (
+	_S3PartSize   = 16 << 20
+	_S3PartGrowth = 1000
+	_S3MaxParts   = 10000
+)
+
+// S3 stores objects under a prefix of an S3 bucket. The URL is
+//
+//	s3://bucket/prefix?profile=name&region=eu-west-1&endpoint=https://host
+//
+// An endpoint selects an S3 compatible service addressed path style.
+// In versioned buckets deletes leave delete markers, versions=purge
+// removes every version of deleted objects instead.
+// rate limits requests to so many a second, in bursts of up to burst.
+// Keys come from the profile, or AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY
+// and AWS_SESSION_TOKEN.
+type S3 struct {
+	bucket   string
+	prefix   string
+	region   string
+	endpoint *url.URL
+	// pathStyle puts the bucket in the path instead of the host name
+	pathStyle bool
+	creds     Credentials
+	client    *http.Client
+	now       func() time.Time
+	sleep     func(time.Duration)
+	// limit is shared by the Sub backends
+	limit *rateLimiter
+	// purge makes Delete remove all versions of objects
+	purge bool
+	// partSize is _S3PartSize but in tests
+	partSize int
+}
+
+func newS3(u *url.URL, creds *Credentials, opts *Options) (*S3, error) {
+	s := &S3{
+		bucket:   u.Host,
+		prefix:   strings.Trim(u.Path, "/"),
+		client:   http.DefaultClient,
+		now:      time.Now,
+		sleep:    time.Sleep,
+		partSize: _S3PartSize,
+	}
+	if s.bucket == "" {
+		return nil, fmt.Errorf("s3 destination needs a bucket. dst=%s", u)
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	if creds != nil {
+		s.creds = *creds
+	} else {
+		s.creds = Credentials{
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	if s.creds.AccessKeyID == "" || s.creds.SecretAccessKey == "" {
+		return nil, fmt.Errorf("s3 destination has no access key. dst=%s", u)
+	}
+
+	q := u.Query()
+	var err error
+	if s.limit, err = newRateLimiter(q); err != nil {
+		return nil, err
+	}
+	switch q.Get("versions") {
+	case "", "marker":
+	case "purge":
+		s.purge = true
+	default:
+		return nil, fmt.Errorf("unknown s3 versions mode. versions=%s", q.Get("versions"))
+	}
+	s.region = q.Get("region")
+	if s.region == "" {
+		s.region = s.creds.Region
+	}
+	if s.region == "" {
+		s.region = os.Getenv("AWS_REGION")
+	}
+	if s.region == "" {
+		s.region = "us-east-1"
+	}
+	endpoint := q.Get("endpoint")
+	if endpoint != "" {
+		s.pathStyle = true
+	} else {
+		endpoint = "https://s3." + s.region + ".amazonaws.com"
+	}
+	if s.endpoint, err = url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("s3 endpoint is invalid. endpoint=%s", endpoint)
+	}
+	return s, nil
+}
+
+// objectURL returns the URL of key, which is relative to the bucket.
+func (s *S3) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + s.bucket + "/" + key
+	} else {
+		u.Host = s.bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	// send the path encoded as it is signed
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+	return &u
+}
+
+func (s *S3) Location(name string) string {
+	return "s3://" + s.bucket + "/" + s.prefix + name
+}
+
+// Put streams r in parts of a multipart upload, holding one part in
+// memory, or with one PUT when r fits in a part. A failed upload is
+// aborted so its parts aren't billed.
+func (s *S3) Put(name string, r io.Reader) error {
+	return s.put(name, r, &UploadState{}, nil)
+}
+
+// PutResumable is Put carrying on with the multipart upload st records,
+// which it updates and saves after every part. A failure leaves the
+// upload for the next attempt, and an upload the bucket dropped in the
+// meantime starts over.
+func (s *S3) PutResumable(name string, r io.ReadSeeker, st *UploadState, save func() error) error {
+	var off int64
+	for num := 1; num <= len(st.Parts); num++ {
+		off += int64(s.partLen(st, num))
+	}
+	if _, err := r.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	err := s.put(name, r, st, save)
+	var se *s3StatusError
+	if !errors.As(err, &se) || se.Code != "NoSuchUpload" {
+		return err
+	}
+	*st = UploadState{}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.put(name, r, st, save)
+}
+
+// AbortUpload drops the parts of the upload of name st records.
+func (s *S3) AbortUpload(name string, st *UploadState) error {
+	return s.abortMultipart(s.prefix+name, st.ID, nil)
+}
+
+// partLen is the size of part num of the upload st records.
+func (s *S3) partLen(st *UploadState, num int) int {
+	size := st.PartSize
+	if size == 0 {
+		size = s.partSize
+	}
+	return size << uint((num-1)/_S3PartGrowth)
+}
+
+// put uploads r as name from the part after those st records. Without
+// save a failed multipart upload is aborted.
+func (s *S3) put(name string, r io.Reader, st *UploadState, save func() error) error {
+	key := s.prefix + name
+	fail := func(err error) error {
+		if save == nil {
+			return s.abortMultipart(key, st.ID, err)
+		}
+		return err
+	}
+	if st.PartSize == 0 {
+		st.PartSize = s.partSize
+	}
+	var buf []byte
+	for num := len(st.Parts) + 1; ; num++ {
+		if n := s.partLen(st, num); len(buf) != n {
+			buf = make([]byte, n)
+		}
+		n, err := io.ReadFull(r, buf)
+		last := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !last {
+			return fail(err)
+		}
+		if num == 1 && last {
+			_, err = s.do("PUT", key, nil, bytesBody(buf[:n]), nil)
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		if num > _S3MaxParts {
+			return fail(fmt.Errorf("s3 upload exceeds %d parts. key=%s", _S3MaxParts, key))
+		}
+		if st.ID == "" {
+			if st.ID, err = s.createMultipart(key); err != nil {
+				return err
+			}
+		}
+		etag, err := s.uploadPart(key, st.ID, num, buf[:n])
+		if err != nil {
+			return fail(err)
+		}
+		st.Parts = append(st.Parts, etag)
+		if save != nil {
+			if err := save(); err != nil {
+				return err
+			}
+		}
+		if last {
+			break
+		}
+	}
+	parts := make([]s3Part, len(st.Parts))
+	for i, etag := range st.Parts {
+		parts[i] = s3Part{i + 1, etag}
+	}
+	if err := s.completeMultipart(key, st.ID, parts); err != nil {
+		return fail(err)
+	}
+	return nil
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+func bytesBody(data []byte) s3Body {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	return func() (io.Reader, int64, string, error) {
+		// a fresh reader per attempt, the client closes request bodies
+		return bytes.NewReader(data), int64(len(data)), hash, nil
+	}
+}
+
+func (s *S3) createMultipart(key string) (string, error) {
+	body, _, err := s.request("POST", key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var res struct {
+		UploadId string
+	}
+	if err := xml.Unmarshal(body, &res); err != nil || res.UploadId == "" {
+		return "", fmt.Errorf("s3 create multipart upload response is broken. key=%s", key)
+	}
+	return res.UploadId, nil
+}
+
+func (s *S3) uploadPart(key, id string, num int, data []byte) (string, error) {
+	q := url.Values{"partNumber": {strconv.Itoa(num)}, "uploadId": {id}}
+	_, header, err := s.request("PUT", key, q, bytesBody(data), nil)
+	if err != nil {
+		return "", err
+	}
+	etag := header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("s3 upload part response has no ETag. key=%s part=%d", key, num)
+	}
+	return etag, nil
+}
+
+func (s *S3) completeMultipart(key, id string, parts []s3Part) error {
+	buf := &bytes.Buffer{}
+	buf.WriteString("<CompleteMultipartUpload>")
+	for _, p := range parts {
+		fmt.Fprintf(buf, "<Part><PartNumber>%d</PartNumber><ETag>", p.PartNumber)
+		xml.EscapeText(buf, []byte(p.ETag))
+		buf.WriteString("</ETag></Part>")
+	}
+	buf.WriteString("</CompleteMultipartUpload>")
+	body, _, err := s.request("POST", key, url.Values{"uploadId": {id}}, bytesBody(buf.Bytes()), nil)
+	if err != nil {
+		return err
+	}
+	// failures after the 200 status are in the body
+	var e struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if xml.Unmarshal(body, &e) == nil && e.XMLName.Local == "Error" {
+		return fmt.Errorf("s3 complete multipart upload failed. key=%s code=%s message=%s", key, e.Code, e.Message)
+	}
+	return nil
+}
+
+// abortMultipart drops the parts of upload id, if one was created, and
+// returns err, nil when err is.
+func (s *S3) abortMultipart(key, id string, err error) error {
+	if id == "" {
+		return err
+	}
+	if _, _, aerr := s.request("DELETE", key, url.Values{"uploadId": {id}}, nil, nil); aerr != nil {
+		if err == nil {
+			return aerr
+		}
+		return fmt.Errorf("%s, aborting the upload failed too. upload_id=%s err=%s", err, id, aerr)
+	}
+	return err
+}
+
+func (s *S3) Open(name string) (io.ReadCloser, error) {
+	resp, err := s.send("GET", s.prefix+name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, &notExist{name}
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error("GET", name, resp)
+	}
+	return resp.Body, nil
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key  string
+		Size int64
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (s *S3) List(prefix string) ([]Object, error) {
+	var objs []Object
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.prefix + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		body, err := s.do("GET", "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res s3ListResult
+		if err := xml.Unmarshal(body, &res); err != nil {
+			return nil, fmt.Errorf("s3 list response is broken. err=%s", err)
+		}
+		for _, c := range res.Contents {
+			name := strings.TrimPrefix(c.Key, s.prefix)
+			// objects in "subdirectories" are not archives of this
+			// destination
+			if !strings.Contains(name, "/") {
+				objs = append(objs, Object{name, c.Size})
+			}
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" {
+			return sortObjects(objs), nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+type s3DeleteResult struct {
+	Error []struct {
+		Key     string
+		Code    string
+		Message string
+	}
+}
+
+// Delete removes names with DeleteObjects, up to 1000 keys a request.
+// With versions=purge their versions are listed and deleted instead.
+func (s *S3) Delete(names ...string) error {
+	if s.purge {
+		var vs []Version
+		for _, n := range names {
+			all, err := s.listVersions(n)
+			if err != nil {
+				return err
+			}
+			for _, v := range all {
+				if v.Name == n {
+					vs = append(vs, v.Version)
+				}
+			}
+		}
+		return s.DeleteVersions(vs...)
+	}
+	objs := make([]Version, len(names))
+	for i, n := range names {
+		objs[i].Name = n
+	}
+	return s.deleteObjects(objs)
+}
+
+// DeleteVersions removes versions for good.
+func (s *S3) DeleteVersions(vs ...Version) error {
+	for _, v := range vs {
+		if v.ID == "" {
+			return fmt.Errorf("s3 version has no id. name=%s", v.Name)
+		}
+	}
+	return s.deleteObjects(vs)
+}
+
+type s3Version struct {
+	Version
+	latest bool
+}
+
+type s3ListVersionsResult struct {
+	Versions []struct {
+		Key       string
+		VersionId string
+		IsLatest  bool
+		Size      int64
+	} `xml:"Version"`
+	DeleteMarkers []struct {
+		Key       string
+		VersionId string
+		IsLatest  bool
+	} `xml:"DeleteMarker"`
+	IsTruncated         bool
+	NextKeyMarker       string
+	NextVersionIdMarker string
+}
+
+// listVersions returns every version and delete marker of the keys
+// under prefix.
+func (s *S3) listVersions(prefix string) ([]s3Version, error) {
+	var vs []s3Version
+	keyMarker, idMarker := "", ""
+	for {
+		q := url.Values{"versions": {""}, "prefix": {s.prefix + prefix}}
+		if keyMarker != "" {
+			q.Set("key-marker", keyMarker)
+			q.Set("version-id-marker", idMarker)
+		}
+		body, err := s.do("GET", "", q, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var res s3ListVersionsResult
+		if err := xml.Unmarshal(body, &res); err != nil {
+			return nil, fmt.Errorf("s3 list versions response is broken. err=%s", err)
+		}
+		for _, v := range res.Versions {
+			vs = append(vs, s3Version{Version{Name: strings.TrimPrefix(v.Key, s.prefix), ID: v.VersionId, Size: v.Size}, v.IsLatest})
+		}
+		for _, m := range res.DeleteMarkers {
+			vs = append(vs, s3Version{Version{Name: strings.TrimPrefix(m.Key, s.prefix), ID: m.VersionId, DeleteMarker: true}, m.IsLatest})
+		}
+		if !res.IsTruncated || res.NextKeyMarker == "" {
+			return vs, nil
+		}
+		keyMarker, idMarker = res.NextKeyMarker, res.NextVersionIdMarker
+	}
+}
+
+// Versions returns the old versions and the delete markers under prefix.
+func (s *S3) Versions(prefix string) ([]Version, error) {
+	all, err := s.listVersions(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var vs []Version
+	for _, v := range all {
+		if !v.latest || v.DeleteMarker {
+			vs = append(vs, v.Version)
+		}
+	}
+	sort.Slice(vs, func(i, j int) bool {
+		if vs[i].Name != vs[j].Name {
+			return vs[i].Name < vs[j].Name
+		}
+		return vs[i].ID < vs[j].ID
+	})
+	return vs, nil
+}
+
+// deleteObjects removes objs, the given versions of those with an ID.
+func (s *S3) deleteObjects(objs []Version) error {
+	for len(objs) > 0 {
+		n := len(objs)
+		if n > _S3DeleteBatch {
+			n = _S3DeleteBatch
+		}
+		batch := objs[:n]
+		objs = objs[n:]
+
+		buf := &bytes.Buffer{}
+		buf.WriteString("<Delete><Quiet>true</Quiet>")
+		for _, o := range batch {
+			buf.WriteString("<Object><Key>")
+			xml.EscapeText(buf, []byte(s.prefix+o.Name))
+			buf.WriteString("</Key>")
+			if o.ID != "" {
+				buf.WriteString("<VersionId>")
+				xml.EscapeText(buf, []byte(o.ID))
+				buf.WriteString("</VersionId>")
+			}
+			buf.WriteString("</Object>")
+		}
+		buf.WriteString("</Delete>")
+		data := buf.Bytes()
+		sum := md5.Sum(data)
+		hash := sha256.Sum256(data)
+		headers := http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+
+		body, err := s.do("POST", "", url.Values{"delete": {""}}, func() (io.Reader, int64, string, error) {
+			return bytes.NewReader(data), int64(len(data)), hex.EncodeToString(hash[:]), nil
+		}, headers)
+		if err != nil {
+			return err
+		}
+		var res s3DeleteResult
+		if err := xml.Unmarshal(body, &res); err != nil {
+			return fmt.Errorf("s3 delete response is broken. err=%s", err)
+		}
+		if len(res.Error) > 0 {
+			e := res.Error[0]
+			return fmt.Errorf("s3 delete failed for %d keys. key=%s code=%s message=%s", len(res.Error), e.Key, e.Code, e.Message)
+		}
+	}
+	return nil
+}
+
+type s3Body func() (io.Reader, int64, string, error)
+
+// do sends a request expecting 2xx and returns the response body.
+func (s *S3) do(method, key string, query url.Values, body s3Body, headers http.Header) ([]byte, error) {
+	data, _, err := s.request(method, key, query, body, headers)
+	return data, err
+}
+
+// request sends a request expecting 2xx and returns the response body
+// and headers. Throttled requests, server errors and dropped
+// connections are retried with backoff.
+func (s *S3) request(method, key string, query url.Values, body s3Body, headers http.Header) ([]byte, http.Header, error) {
+	for attempt := 0; ; attempt++ {
+		wait := time.Duration(1<<uint(attempt)) * 200 * time.Millisecond
+		resp, err := s.send(method, key, query, body, headers)
+		var data []byte
+		if err == nil {
+			data, err = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		if err != nil {
+			if isDropped(err) && attempt < _S3Retries {
+				s.sleep(wait)
+				continue
+			}
+			return nil, nil, err
+		}
+		if resp.StatusCode/100 == 2 {
+			return data, resp.Header, nil
+		}
+		if (resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests) && attempt < _S3Retries {
+			if n, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && n > 0 {
+				wait = time.Duration(n) * time.Second
+			}
+			s.sleep(wait)
+			continue
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return nil, nil, s3Error(method, key, resp)
+	}
+}
+
+// isDropped reports whether err is a connection reset or closed by the
+// server, which a new connection may not see.
+func isDropped(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+func (s *S3) send(method, key string, query url.Values, body s3Body, headers http.Header) (*http.Response, error) {
+	var r io.Reader
+	size := int64(0)
+	hash := emptySHA256
+	if body != nil {
+		var err error
+		if r, size, hash, err = body(); err != nil {
+			return nil, err
+		}
+	}
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), r)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = size
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	s.sign(req, hash)
+	s.limit.wait()
+	return s.client.Do(req)
+}
+
+// s3StatusError is a request S3 answered with an error status.
+type s3StatusError struct {
+	Method  string
+	Key     string
+	Code    string
+	Message string
+}
+
+func (e *s3StatusError) Error() string {
+	return fmt.Sprintf("s3 %s failed. key=%s code=%s message=%s", e.Method, e.Key, e.Code, e.Message)
+}
+
+func s3Error(method, key string, resp *http.Response) error {
+	e := &s3StatusError{Method: method, Key: key}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	xml.Unmarshal(data, e)
+	if e.Code == "" {
+		e.Code = resp.Status
+	}
+	return e
+}
+
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// sign adds an AWS signature version 4 Authorization header covering
+// every header of req.
+func (s *S3) sign(req *http.Request, payloadHash string) {
+	t := s.now().UTC()
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", t.Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	var names []string
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	canonHeaders := &strings.Builder{}
+	for _, k := range names {
+		fmt.Fprintf(canonHeaders, "%s:%s\n", k, headers[k])
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		signed,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + t.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.creds.SecretAccessKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.creds.AccessKeyID, scope, signed, sig))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// uriEncode percent-encodes s as SigV4 requires, keeping / unless
+// encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	b := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes query sorted by key, as sent and as signed.
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// SFTP stores objects in a directory of an SSH server, through the
+// OpenSSH sftp client in batch mode. The URL is
+//
+//	sftp://user@host:port/path?profile=name
+//
+// The profile can name an IdentityFile and a KnownHostsFile, otherwise
+// the user's ssh configuration applies.
+type SFTP struct {
+	target string
+	port   string
+	dir    string
+	creds  *Credentials
+	tmpDir string
+	// sub directories are made on demand, see Sub
+	sub bool
+}
+
+func newSFTP(u *url.URL, creds *Credentials, opts *Options) (*SFTP, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("sftp destination needs a host. dst=%s", u)
+	}
+	s := &SFTP{target: u.Hostname(), port: u.Port(), dir: u.Path, creds: creds, tmpDir: opts.TmpDir}
+	user := u.User.Username()
+	if user == "" && creds != nil {
+		user = creds.User
+	}
+	if user != "" {
+		s.target = user + "@" + s.target
+	}
+	if s.dir == "" {
+		s.dir = "."
+	}
+	return s, nil
+}
+
+func (s *SFTP) Location(name string) string {
+	return "sftp://" + s.target + path.Join("/", s.dir, name)
+}
+
+// quote quotes an argument of an sftp batch command.
+func (s *SFTP) quote(p string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(p) + `"`
+}
+
+func (s *SFTP) remote(name string) string { return s.quote(path.Join(s.dir, name)) }
+
+// run runs batch commands, stopping at the first failing one.
+func (s *SFTP) run(cmds ...string) ([]byte, error) {
+	args := []string{"-q", "-b", "-", "-o", "BatchMode=yes"}
+	if s.port != "" {
+		args = append(args, "-P", s.port)
+	}
+	if s.creds != nil && s.creds.IdentityFile != "" {
+		args = append(args, "-i", s.creds.IdentityFile)
+	}
+	if s.creds != nil && s.creds.KnownHostsFile != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+s.creds.KnownHostsFile)
+	}
+	args = append(args, s.target)
+
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := exec.Command("sftp", args...)
+	cmd.Stdin = strings.NewReader(strings.Join(cmds, "\n") + "\n")
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("sftp failed. target=%s err=%s: %s", s.target, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+func (s *SFTP) Put(name string, r io.Reader) error {
+	sp, err := spool(r, s.tmpDir)
+	if err != nil {
+		return err
+	}
+	defer sp.Close()
+	// upload under a temporary name so a failed put leaves nothing
+	tmp := path.Join(s.dir, "."+name+".part")
+	cmds := []string{"put " + s.quote(sp.Name()) + " " + s.quote(tmp), "rename " + s.quote(tmp) + " " + s.remote(name)}
+	if s.sub {
+		// - ignores the failure when it exists
+		cmds = append([]string{"-mkdir " + s.quote(s.dir)}, cmds...)
+	}
+	if _, err := s.run(cmds...); err != nil {
+		s.run("-rm " + s.quote(tmp))
+		return err
+	}
+	return nil
+}
+
+func (s *SFTP) Open(name string) (io.ReadCloser, error) {
+	objs, err := s.List(name)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, o := range objs {
+		found = found || o.Name == name
+	}
+	if !found {
+		return nil, &notExist{name}
+	}
+
+	f, err := ioutil.TempFile(s.tmpDir, "tarbu-download-")
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	if _, err := s.run("get " + s.remote(name) + " " + s.quote(f.Name())); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	sf, err := os.Open(f.Name())
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &spooled{File: sf}, nil
+}
+
+// List parses ls -ln, whose 5th column is the size and whose name is
+// the rest of the line after the date.
+func (s *SFTP) List(prefix string) ([]Object, error) {
+	ls := "ls -ln " + s.quote(s.dir)
+	if s.sub {
+		// a missing directory lists empty
+		ls = "-" + ls
+	}
+	out, err := s.run(ls)
+	if err != nil {
+		return nil, err
+	}
+	var objs []Object
+	for _, l := range strings.Split(string(out), "\n") {
+		f := strings.Fields(l)
+		if len(f) < 9 || !strings.HasPrefix(f[0], "-") {
+			continue
+		}
+		size, err := strconv.ParseInt(f[4], 10, 64)
+		if err != nil {
+			continue
+		}
+		// names may have spaces, take everything after the 8th field
+		rest := l
+		for i := 0; i < 8; i++ {
+			rest = strings.TrimLeft(rest, " ")
+			rest = rest[strings.IndexByte(rest, ' '):]
+		}
+		name := path.Base(strings.TrimLeft(rest, " "))
+		if strings.HasPrefix(name, prefix) {
+			objs = append(objs, Object{name, size})
+		}
+	}
+	return sortObjects(objs), nil
+}
+
+// Free asks df, which needs the statvfs extension of OpenSSH servers.
+func (s *SFTP) Free() (int64, error) {
+	df := "df " + s.quote(s.dir)
+	if s.sub {
+		df = "df " + s.quote(path.Dir(s.dir))
+	}
+	out, err := s.run(df)
+	if err != nil {
+		return -1, nil
+	}
+	// a header line, then size, used and available in KiB
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	f := strings.Fields(lines[len(lines)-1])
+	if len(f) < 3 {
+		return -1, nil
+	}
+	avail, err := strconv.ParseInt(f[2], 10, 64)
+	if err != nil {
+		return -1, nil
+	}
+	return avail << 10, nil
+}
+
+func (s *SFTP) Rename(from, to string) error {
+	// rename refuses to replace files
+	_, err := s.run("-rm "+s.remote(to), "rename "+s.remote(from)+" "+s.remote(to))
+	return err
+}
+
+func (s *SFTP) Delete(names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	var cmds []string
+	for _, n := range names {
+		// - keeps going when a name is already gone
+		cmds = append(cmds, "-rm "+s.remote(n))
+	}
+	_, err := s.run(cmds...)
+	return err
+}
@@ -0,0 +1,223 @@
+package storage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// partSuffix separates the name of a split object from the part number.
+const partSuffix = ".part"
+
+// Split returns a backend storing the objects archive accepts the name
+// of in parts of up to size bytes, named <name>.part001, <name>.part002
+// and so on, for media and object stores limiting the object size. A
+// part set lists, opens, renames and deletes as the one object name
+// whatever size is, so parts keep working after splitting is turned
+// off. A size of 0 stores objects whole.
+func Split(b Backend, size int64, archive func(name string) bool) Backend {
+	return &split{b, size, archive}
+}
+
+type split struct {
+	b       Backend
+	size    int64
+	archive func(name string) bool
+}
+
+func partName(name string, i int) string {
+	return fmt.Sprintf("%s%s%03d", name, partSuffix, i)
+}
+
+// WholeName returns the name of the object a part belongs to, name when
+// it isn't a part.
+func WholeName(name string) string {
+	i := strings.LastIndex(name, partSuffix)
+	if i < 0 {
+		return name
+	}
+	n := name[i+len(partSuffix):]
+	if len(n) < 3 || strings.IndexFunc(n, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+		return name
+	}
+	return name[:i]
+}
+
+// parts returns the parts of name in order.
+func (s *split) parts(name string) ([]Object, error) {
+	objs, err := s.b.List(name + partSuffix)
+	if err != nil {
+		return nil, err
+	}
+	var parts []Object
+	for _, o := range objs {
+		if WholeName(o.Name) == name {
+			parts = append(parts, o)
+		}
+	}
+	// names sort by number only up to part999
+	sort.Slice(parts, func(i, j int) bool { return partNumber(parts[i].Name) < partNumber(parts[j].Name) })
+	return parts, nil
+}
+
+func partNumber(name string) int {
+	n, _ := strconv.Atoi(name[strings.LastIndex(name, partSuffix)+len(partSuffix):])
+	return n
+}
+
+func (s *split) Put(name string, r io.Reader) error {
+	if s.size <= 0 || !s.archive(name) {
+		return s.b.Put(name, r)
+	}
+	old, err := s.parts(name)
+	if err != nil {
+		return err
+	}
+	br := bufio.NewReaderSize(r, 1<<16)
+	var written []string
+	for i := 1; ; i++ {
+		part := partName(name, i)
+		if err := s.b.Put(part, io.LimitReader(br, s.size)); err != nil {
+			s.b.Delete(written...)
+			return err
+		}
+		written = append(written, part)
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		} else if err != nil {
+			s.b.Delete(written...)
+			return err
+		}
+	}
+	// what a larger or unsplit object of the name left
+	stale := []string{name}
+	for _, o := range old {
+		if partNumber(o.Name) > len(written) {
+			stale = append(stale, o.Name)
+		}
+	}
+	return s.b.Delete(stale...)
+}
+
+func (s *split) Open(name string) (io.ReadCloser, error) {
+	rc, err := s.b.Open(name)
+	if !IsNotExist(err) || !s.archive(name) {
+		return rc, err
+	}
+	parts, perr := s.parts(name)
+	if perr != nil {
+		return nil, perr
+	}
+	if len(parts) == 0 {
+		return nil, err
+	}
+	return &partReader{b: s.b, parts: parts}, nil
+}
+
+func (s *split) List(prefix string) ([]Object, error) {
+	objs, err := s.b.List(prefix)
+	if err != nil {
+		return nil, err
+	}
+	var out []Object
+	whole := map[string]int{}
+	for _, o := range objs {
+		name := WholeName(o.Name)
+		if name == o.Name || !s.archive(name) {
+			out = append(out, o)
+			continue
+		}
+		if i, ok := whole[name]; ok {
+			out[i].Size += o.Size
+			continue
+		}
+		whole[name] = len(out)
+		out = append(out, Object{Name: name, Size: o.Size})
+	}
+	return sortObjects(out), nil
+}
+
+func (s *split) Delete(names ...string) error {
+	var del []string
+	for _, n := range names {
+		del = append(del, n)
+		if !s.archive(n) {
+			continue
+		}
+		parts, err := s.parts(n)
+		if err != nil {
+			return err
+		}
+		for _, p := range parts {
+			del = append(del, p.Name)
+		}
+	}
+	return s.b.Delete(del...)
+}
+
+func (s *split) Location(name string) string { return s.b.Location(name) }
+
+func (s *split) Rename(from, to string) error {
+	rn, ok := s.b.(Renamer)
+	if !ok {
+		return fmt.Errorf("destination can't rename. name=%s", from)
+	}
+	if !s.archive(from) {
+		return rn.Rename(from, to)
+	}
+	parts, err := s.parts(from)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		return rn.Rename(from, to)
+	}
+	for i, p := range parts {
+		if err := rn.Rename(p.Name, partName(to, i+1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partReader reads the parts of an object one after another.
+type partReader struct {
+	b     Backend
+	parts []Object
+	rc    io.ReadCloser
+}
+
+func (p *partReader) Read(buf []byte) (int, error) {
+	for {
+		if p.rc == nil {
+			if len(p.parts) == 0 {
+				return 0, io.EOF
+			}
+			rc, err := p.b.Open(p.parts[0].Name)
+			if err != nil {
+				return 0, err
+			}
+			p.rc, p.parts = rc, p.parts[1:]
+		}
+		n, err := p.rc.Read(buf)
+		if err == io.EOF {
+			err = p.rc.Close()
+			p.rc = nil
+			if n > 0 || err != nil {
+				return n, err
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (p *partReader) Close() error {
+	if p.rc == nil {
+		return nil
+	}
+	return p.rc.Close()
+}
@@ -0,0 +1,42 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spooled is an upload copied to a temporary file, for protocols that
+// need the length or hash before the body.
+type spooled struct {
+	*os.File
+	size   int64
+	sha256 string
+}
+
+func spool(r io.Reader, dir string) (*spooled, error) {
+	f, err := ioutil.TempFile(dir, "tarbu-upload-")
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &spooled{f, n, hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// Close removes the temporary file.
+func (s *spooled) Close() error {
+	err := s.File.Close()
+	os.Remove(s.Name())
+	return err
+}
@@ -0,0 +1,341 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SSH stores objects in a directory of a host running tarbu, through
+// the OpenSSH client running tarbu receive on the host. Unlike SFTP,
+// archives are streamed without spooling. The URL is
+//
+//	ssh://user@host:port/path?profile=name&tarbu=/usr/local/bin/tarbu
+//
+// tarbu is the remote command, tarbu on the PATH of the login by
+// default. The profile can name an IdentityFile and a KnownHostsFile,
+// otherwise the user's ssh configuration applies.
+type SSH struct {
+	target string
+	port   string
+	dir    string
+	tarbu  string
+	creds  *Credentials
+	// sub directories are made on demand, see Sub
+	sub bool
+}
+
+// _FrameSize is the most a Put frame carries.
+const _FrameSize = 1 << 20
+
+func newSSH(u *url.URL, creds *Credentials) (*SSH, error) {
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("ssh destination needs a host. dst=%s", u)
+	}
+	s := &SSH{target: u.Hostname(), port: u.Port(), dir: u.Path, tarbu: u.Query().Get("tarbu"), creds: creds}
+	user := u.User.Username()
+	if user == "" && creds != nil {
+		user = creds.User
+	}
+	if user != "" {
+		s.target = user + "@" + s.target
+	}
+	if s.dir == "" {
+		s.dir = "."
+	}
+	if s.tarbu == "" {
+		s.tarbu = "tarbu"
+	}
+	return s, nil
+}
+
+func (s *SSH) Location(name string) string {
+	return "ssh://" + s.target + path.Join("/", s.dir, name)
+}
+
+// shellQuote quotes an argument of the remote command, which the login
+// shell of the host parses.
+func shellQuote(arg string) string {
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
+
+// command returns ssh running tarbu receive op on the directory.
+func (s *SSH) command(op string, args ...string) *exec.Cmd {
+	sshArgs := []string{"-o", "BatchMode=yes"}
+	if s.port != "" {
+		sshArgs = append(sshArgs, "-p", s.port)
+	}
+	if s.creds != nil && s.creds.IdentityFile != "" {
+		sshArgs = append(sshArgs, "-i", s.creds.IdentityFile)
+	}
+	if s.creds != nil && s.creds.KnownHostsFile != "" {
+		sshArgs = append(sshArgs, "-o", "UserKnownHostsFile="+s.creds.KnownHostsFile)
+	}
+	remote := []string{s.tarbu, "receive"}
+	if s.sub {
+		remote = append(remote, "-sub")
+	}
+	remote = append(remote, op, shellQuote(s.dir))
+	for _, a := range args {
+		remote = append(remote, shellQuote(a))
+	}
+	// -- ends the options, the remote command may start with a dash
+	sshArgs = append(sshArgs, "--", s.target, strings.Join(remote, " "))
+	return exec.Command("ssh", sshArgs...)
+}
+
+// run runs op, returning its output.
+func (s *SSH) run(stdin io.Reader, op string, args ...string) ([]byte, error) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd := s.command(op, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return nil, s.error(err, stderr)
+	}
+	return stdout.Bytes(), nil
+}
+
+func (s *SSH) error(err error, stderr *bytes.Buffer) error {
+	return fmt.Errorf("ssh failed. target=%s err=%s: %s", s.target, err, strings.TrimSpace(stderr.String()))
+}
+
+// Put frames r, so a connection lost midway ends the remote input
+// without its final empty frame, and nothing is stored.
+func (s *SSH) Put(name string, r io.Reader) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeFrames(pw, r))
+	}()
+	_, err := s.run(pr, "put", name)
+	pr.Close()
+	return err
+}
+
+func (s *SSH) Open(name string) (io.ReadCloser, error) {
+	objs, err := s.List(name)
+	if err != nil {
+		return nil, err
+	}
+	found := false
+	for _, o := range objs {
+		found = found || o.Name == name
+	}
+	if !found {
+		return nil, &notExist{name}
+	}
+
+	stderr := &bytes.Buffer{}
+	cmd := s.command("get", name)
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &sshReader{s: s, cmd: cmd, r: stdout, stderr: stderr}, nil
+}
+
+// sshReader reads the output of a remote get. Its end is an error if
+// the remote command failed.
+type sshReader struct {
+	s      *SSH
+	cmd    *exec.Cmd
+	r      io.Reader
+	stderr *bytes.Buffer
+	waited bool
+}
+
+func (r *sshReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err == io.EOF {
+		if werr := r.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (r *sshReader) wait() error {
+	if r.waited {
+		return nil
+	}
+	r.waited = true
+	if err := r.cmd.Wait(); err != nil {
+		return r.s.error(err, r.stderr)
+	}
+	return nil
+}
+
+func (r *sshReader) Close() error {
+	if r.waited {
+		return nil
+	}
+	// stopped reading early
+	r.cmd.Process.Kill()
+	r.waited = true
+	r.cmd.Wait()
+	return nil
+}
+
+func (s *SSH) List(prefix string) ([]Object, error) {
+	out, err := s.run(nil, "list", prefix)
+	if err != nil {
+		return nil, err
+	}
+	var objs []Object
+	if err := json.Unmarshal(out, &objs); err != nil {
+		return nil, fmt.Errorf("tarbu receive listed garbage. target=%s err=%s", s.target, err)
+	}
+	return sortObjects(objs), nil
+}
+
+func (s *SSH) Delete(names ...string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	_, err := s.run(nil, "delete", names...)
+	return err
+}
+
+func (s *SSH) Rename(from, to string) error {
+	_, err := s.run(nil, "rename", from, to)
+	return err
+}
+
+func (s *SSH) Free() (int64, error) {
+	out, err := s.run(nil, "free")
+	if err != nil {
+		return -1, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+}
+
+// writeFrames writes r to w as frames of a 4 byte big-endian length and
+// as much data, then an empty frame.
+func writeFrames(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 4+_FrameSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := w.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// frameReader reads what writeFrames wrote. Input ending before the
+// empty frame is io.ErrUnexpectedEOF.
+type frameReader struct {
+	r    *bufio.Reader
+	left uint32
+	done bool
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	if f.done {
+		return 0, io.EOF
+	}
+	if f.left == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(f.r, hdr[:]); err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if f.left = binary.BigEndian.Uint32(hdr[:]); f.left == 0 {
+			f.done = true
+			return 0, io.EOF
+		}
+		if f.left > _FrameSize {
+			return 0, fmt.Errorf("frame is too large. size=%d", f.left)
+		}
+	}
+	if uint32(len(p)) > f.left {
+		p = p[:f.left]
+	}
+	n, err := f.r.Read(p)
+	f.left -= uint32(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Receive serves an SSH backend on the host, as tarbu receive: args are
+// [-sub] op dir and the arguments of op, in and out are the connection.
+// The local directory dir holds the objects.
+func Receive(args []string, in io.Reader, out io.Writer) error {
+	sub := len(args) > 0 && args[0] == "-sub"
+	if sub {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		return fmt.Errorf("operation and directory are required")
+	}
+	op, dir, args := args[0], args[1], args[2:]
+	l := &Local{Dir: filepath.FromSlash(dir), sub: sub}
+	nargs := map[string]int{"put": 1, "get": 1, "list": 1, "rename": 2, "free": 0}
+	if n, ok := nargs[op]; ok && len(args) != n {
+		return fmt.Errorf("wrong number of arguments. op=%s args=%d", op, len(args))
+	}
+	for _, a := range args {
+		// names are flat, the list prefix may be empty
+		if strings.ContainsAny(a, `/\`) || a == ".." || (a == "" && op != "list") {
+			return fmt.Errorf("invalid object name. name=%s", a)
+		}
+	}
+	switch op {
+	case "put":
+		return l.Put(args[0], &frameReader{r: bufio.NewReader(in)})
+	case "get":
+		r, err := l.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(out, r)
+		return err
+	case "list":
+		objs, err := l.List(args[0])
+		if err != nil {
+			return err
+		}
+		if objs == nil {
+			objs = []Object{}
+		}
+		return json.NewEncoder(out).Encode(objs)
+	case "delete":
+		return l.Delete(args...)
+	case "rename":
+		return l.Rename(args[0], args[1])
+	case "free":
+		n, err := l.Free()
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(out, n)
+		return err
+	}
+	return fmt.Errorf("unknown receive operation. op=%s", op)
+}
@@ -0,0 +1,248 @@
+// Package storage puts, lists and deletes archives in a destination,
+// which is a local directory or a remote backend selected by the scheme
+// of the destination URL.
+package storage
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Object is an archive or file in a destination.
+type Object struct {
+	Name string
+	Size int64
+}
+
+// Backend stores objects under flat names, relative to the destination.
+type Backend interface {
+	// Put stores the contents of r as name, replacing an existing
+	// object. A failed Put leaves no object behind.
+	Put(name string, r io.Reader) error
+	// Open reads name. A missing object is an error satisfying
+	// IsNotExist.
+	Open(name string) (io.ReadCloser, error)
+	// List returns the objects whose names start with prefix, sorted
+	// by name.
+	List(prefix string) ([]Object, error)
+	// Delete removes names. Missing names are not an error.
+	Delete(names ...string) error
+	// Location is a human readable path or URL of name.
+	Location(name string) string
+}
+
+// Appender is implemented by backends that can append to an object in
+// place, which is cheaper than reading and rewriting it.
+type Appender interface {
+	Append(name string, data []byte) error
+}
+
+// Renamer is implemented by backends that can rename objects, replacing
+// an existing object named to.
+type Renamer interface {
+	Rename(from, to string) error
+}
+
+// UploadState is the progress of an upload a Resumer carries on with:
+// its ID and the ETags of the parts uploaded so far, in order.
+type UploadState struct {
+	ID       string   `json:",omitempty"`
+	PartSize int      `json:",omitempty"`
+	Parts    []string `json:",omitempty"`
+}
+
+// Resumer is implemented by backends whose uploads can carry on where a
+// stopped one left off, e.g. in a process started after a crash.
+type Resumer interface {
+	// PutResumable puts the contents of r as name, skipping the parts
+	// st records and calling save whenever st changed.
+	PutResumable(name string, r io.ReadSeeker, st *UploadState, save func() error) error
+	// AbortUpload discards the upload of name st records.
+	AbortUpload(name string, st *UploadState) error
+}
+
+// Version is a version of an object in a versioned bucket.
+type Version struct {
+	Name string
+	ID   string
+	Size int64
+	// DeleteMarker is set for the markers deletes leave
+	DeleteMarker bool
+}
+
+// Versioner is implemented by backends that can keep old versions of
+// replaced and deleted objects, like S3 buckets with versioning.
+type Versioner interface {
+	// Versions returns the noncurrent versions and the delete markers
+	// of the objects whose names start with prefix, subdirectories
+	// included.
+	Versions(prefix string) ([]Version, error)
+	// DeleteVersions removes versions for good.
+	DeleteVersions(vs ...Version) error
+}
+
+// Spacer is implemented by backends that can tell the space left.
+type Spacer interface {
+	// Free returns the bytes available, -1 when the server doesn't say.
+	Free() (int64, error)
+}
+
+// Free returns the bytes available in the backend under the wrappers of
+// b, -1 when it can't tell.
+func Free(b Backend) (int64, error) {
+	switch w := b.(type) {
+	case readOnly:
+		return Free(w.Backend)
+	case *prefixed:
+		return Free(w.b)
+	case *split:
+		return Free(w.b)
+	case *Uploader:
+		return Free(w.b)
+	}
+	if s, ok := b.(Spacer); ok {
+		return s.Free()
+	}
+	return -1, nil
+}
+
+// CanRename reports whether the backend under the wrappers of b is a
+// Renamer.
+func CanRename(b Backend) bool {
+	switch w := b.(type) {
+	case readOnly:
+		return CanRename(w.Backend)
+	case *prefixed:
+		return CanRename(w.b)
+	case *split:
+		return CanRename(w.b)
+	case *Uploader:
+		return CanRename(w.b)
+	}
+	_, ok := b.(Renamer)
+	return ok
+}
+
+// IsRemoteBackend reports whether the backend under the wrappers of b
+// sends objects over the network.
+func IsRemoteBackend(b Backend) bool {
+	switch w := b.(type) {
+	case readOnly:
+		return IsRemoteBackend(w.Backend)
+	case *prefixed:
+		return IsRemoteBackend(w.b)
+	case *split:
+		return IsRemoteBackend(w.b)
+	case *Uploader:
+		return IsRemoteBackend(w.b)
+	case *S3, *SFTP, *SSH, *WebDAV:
+		return true
+	}
+	return false
+}
+
+// Credentials is a named set of secrets destinations refer to with a
+// profile query parameter, so destinations with different keys can
+// share a config.
+type Credentials struct {
+	// S3
+	AccessKeyID     string `json:",omitempty"`
+	SecretAccessKey string `json:",omitempty"`
+	SessionToken    string `json:",omitempty"`
+	Region          string `json:",omitempty"`
+	// WebDAV, SFTP and SSH
+	User     string `json:",omitempty"`
+	Password string `json:",omitempty"`
+	// SFTP and SSH
+	IdentityFile   string `json:",omitempty"`
+	KnownHostsFile string `json:",omitempty"`
+}
+
+// Options are what backends need from the configuration.
+type Options struct {
+	// Credentials are the profiles destinations may refer to.
+	Credentials map[string]*Credentials
+	// TmpDir holds uploads spooled to learn their length.
+	TmpDir string
+}
+
+// notExist is returned by Open for missing objects.
+type notExist struct {
+	name string
+}
+
+func (e *notExist) Error() string { return fmt.Sprintf("object not found. name=%s", e.name) }
+
+// IsNotExist reports whether err is about a missing object.
+func IsNotExist(err error) bool {
+	_, ok := err.(*notExist)
+	return ok
+}
+
+// IsRemote is false for local directory destinations.
+func IsRemote(dst string) bool {
+	u, err := url.Parse(dst)
+	return err == nil && u.Scheme != "" && u.Scheme != "file" && strings.Contains(dst, "://")
+}
+
+// Open returns the backend for dst: a local directory, or an s3://,
+// sftp://, ssh://, webdav:// or webdavs:// URL.
+func Open(dst string, opts *Options) (Backend, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	if !IsRemote(dst) {
+		return &Local{Dir: strings.TrimPrefix(dst, "file://")}, nil
+	}
+	u, err := url.Parse(dst)
+	if err != nil {
+		return nil, err
+	}
+	var creds *Credentials
+	if p := u.Query().Get("profile"); p != "" {
+		if creds = opts.Credentials[p]; creds == nil {
+			return nil, fmt.Errorf("credentials profile not found. profile=%s", p)
+		}
+	}
+	switch u.Scheme {
+	case "s3":
+		return newS3(u, creds, opts)
+	case "sftp":
+		return newSFTP(u, creds, opts)
+	case "ssh":
+		return newSSH(u, creds)
+	case "webdav", "webdavs":
+		return newWebDAV(u, creds, opts)
+	}
+	return nil, fmt.Errorf("unknown destination scheme. scheme=%s", u.Scheme)
+}
+
+func sortObjects(objs []Object) []Object {
+	sort.Slice(objs, func(i, j int) bool { return objs[i].Name < objs[j].Name })
+	return objs
+}
+
+// ReadOnly refuses all writes to b, so a read-only invocation can't
+// modify a destination whatever the caller does.
+func ReadOnly(b Backend) Backend {
+	return readOnly{b}
+}
+
+type readOnly struct {
+	Backend
+}
+
+func (r readOnly) Put(name string, _ io.Reader) error {
+	return fmt.Errorf("destination is read-only. name=%s", name)
+}
+
+func (r readOnly) Rename(from, to string) error {
+	return fmt.Errorf("destination is read-only. name=%s", from)
+}
+
+func (r readOnly) Delete(names ...string) error {
+	return fmt.Errorf("destination is read-only. names=%s", strings.Join(names, ","))
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+)
+
+// Sub returns a backend for the directory dir of b. The directory is
+// made by the first Put, until then it lists empty.
+func Sub(b Backend, dir string) Backend {
+	switch b := b.(type) {
+	case readOnly:
+		return readOnly{Sub(b.Backend, dir)}
+	case *Uploader:
+		// copies are uploaded by the directory's backend
+		u := *b
+		u.b, u.sub = Sub(b.b, dir), path.Join(b.sub, dir)
+		return &u
+	case *Local:
+		return &Local{Dir: filepath.Join(b.Dir, dir), sub: true}
+	case *S3:
+		// prefixes need no directory
+		s := *b
+		s.prefix += dir + "/"
+		return &s
+	case *SFTP:
+		s := *b
+		s.dir, s.sub = path.Join(b.dir, dir), true
+		return &s
+	case *SSH:
+		s := *b
+		s.dir, s.sub = path.Join(b.dir, dir), true
+		return &s
+	case *WebDAV:
+		base := *b.base
+		base.Path += dir + "/"
+		w := *b
+		w.base, w.sub = &base, true
+		return &w
+	}
+	return &prefixed{b, dir + "/"}
+}
+
+// prefixed is Sub of backends with flat names, like Memory.
+type prefixed struct {
+	b      Backend
+	prefix string
+}
+
+func (p *prefixed) Put(name string, r io.Reader) error { return p.b.Put(p.prefix+name, r) }
+
+func (p *prefixed) Open(name string) (io.ReadCloser, error) {
+	rc, err := p.b.Open(p.prefix + name)
+	if IsNotExist(err) {
+		return nil, &notExist{name}
+	}
+	return rc, err
+}
+
+func (p *prefixed) List(prefix string) ([]Object, error) {
+	objs, err := p.b.List(p.prefix + prefix)
+	if err != nil {
+		return nil, err
+	}
+	for i := range objs {
+		objs[i].Name = objs[i].Name[len(p.prefix):]
+	}
+	return objs, nil
+}
+
+func (p *prefixed) Delete(names ...string) error {
+	full := make([]string, len(names))
+	for i, n := range names {
+		full[i] = p.prefix + n
+	}
+	return p.b.Delete(full...)
+}
+
+func (p *prefixed) Location(name string) string { return p.b.Location(p.prefix + name) }
+
+func (p *prefixed) Rename(from, to string) error {
+	rn, ok := p.b.(Renamer)
+	if !ok {
+		return fmt.Errorf("destination can't rename. name=%s", from)
+	}
+	return rn.Rename(p.prefix+from, p.prefix+to)
+}
@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UploadOptions are the retry policy of an Uploader.
+type UploadOptions struct {
+	// Retries is how many times a failed upload is tried again. The
+	// first retry waits RetryDelay, each one after twice as long up to
+	// MaxDelay.
+	Retries    int
+	RetryDelay time.Duration
+	MaxDelay   time.Duration
+	// Failed is called with every failed attempt that is retried.
+	Failed func(name string, attempt int, wait time.Duration, err error)
+	// Done returns a channel stopping the retries when closed.
+	Done func() <-chan struct{}
+	// Persist keeps the copies in dir with the progress of their
+	// uploads until they are done, for Flush in a later process. Until
+	// then List, Open, Delete and Rename see them as objects of b.
+	Persist bool
+	// Defer makes Put of persisted copies return without uploading
+	// them, which is left to Flush, and call Queued.
+	Defer  bool
+	Queued func()
+}
+
+// Uploader is a Backend copying what is put into a local file first and
+// uploading it to b from there, so that a failed upload is tried again
+// without having to produce the object again.
+type Uploader struct {
+	b    Backend
+	dir  string
+	opts UploadOptions
+	// root is b before Sub made it the backend of the directory sub
+	root Backend
+	sub  string
+	// mu guards the records in dir and offline, for u and its Subs
+	mu      *sync.Mutex
+	offline *bool
+	// wait waits d between attempts and is false when Done was closed
+	wait func(d time.Duration) bool
+}
+
+// NewUploader returns an Uploader to b copying into dir.
+func NewUploader(b Backend, dir string, opts UploadOptions) *Uploader {
+	u := &Uploader{b: b, dir: dir, opts: opts, root: b, mu: &sync.Mutex{}, offline: new(bool)}
+	u.wait = func(d time.Duration) bool {
+		var done <-chan struct{}
+		if u.opts.Done != nil {
+			done = u.opts.Done()
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			return true
+		case <-done:
+			return false
+		}
+	}
+	return u
+}
+
+// pendingUpload is the record of a persisted copy, named after Dst,
+// Dir and Name so a later Put of the name replaces it.
+type pendingUpload struct {
+	Dst string
+	// Dir is the directory of Dst the Uploader was a Sub of
+	Dir  string `json:",omitempty"`
+	Name string
+	// Copy is the file name of the copy in the directory of the record
+	Copy  string
+	State UploadState
+}
+
+// _PendingSuffix ends the records of persisted copies.
+const _PendingSuffix = ".upload.json"
+
+// Put retries resume the upload where the Resumer b supports it. A
+// failed upload is aborted, and the copy removed either way.
+func (u *Uploader) Put(name string, r io.Reader) error {
+	p := &pendingUpload{Dst: u.root.Location(""), Dir: u.sub, Name: name}
+	var err error
+	if !u.opts.Persist {
+		var sp *spooled
+		if sp, err = spool(r, u.dir); err != nil {
+			return fmt.Errorf("copying upload failed. name=%s err=%s", name, err)
+		}
+		err = u.upload(name, sp.File, &p.State, func() error { return nil })
+		sp.Close()
+	} else {
+		if err := u.persist(p, r); err != nil {
+			return fmt.Errorf("copying upload failed. name=%s err=%s", name, err)
+		}
+		if u.opts.Defer || u.Offline() {
+			if u.opts.Queued != nil {
+				u.opts.Queued()
+			}
+			return nil
+		}
+		f, ferr := os.Open(u.copyPath(p))
+		if ferr != nil {
+			u.finish(p)
+			return ferr
+		}
+		err = u.upload(name, f, &p.State, func() error { return u.update(p) })
+		f.Close()
+		u.finish(p)
+	}
+	if rs, ok := u.b.(Resumer); ok && err != nil && p.State.ID != "" {
+		rs.AbortUpload(name, &p.State)
+	}
+	return err
+}
+
+// GoOffline makes u keep what is put for Flush without uploading it, for
+// a destination that can't be reached. List and Open see the copies
+// waiting in dir only, Delete and Rename of anything else fail. It needs
+// Persist.
+func (u *Uploader) GoOffline() error {
+	if !u.opts.Persist {
+		return fmt.Errorf("uploads can't wait offline without persisted copies. dst=%s", u.Location(""))
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	*u.offline = true
+	return nil
+}
+
+// Offline tells whether GoOffline was called on u or one of its Subs.
+func (u *Uploader) Offline() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return *u.offline
+}
+
+// errOffline fails what needs the remote backend while offline.
+func (u *Uploader) errOffline(name string) error {
+	return fmt.Errorf("destination is offline. name=%s", u.Location(name))
+}
+
+func (u *Uploader) recordPath(p *pendingUpload) string {
+	sum := sha256.Sum256([]byte(p.Dst + "\x00" + path.Join(p.Dir, p.Name)))
+	return filepath.Join(u.dir, "tarbu-upload-"+hex.EncodeToString(sum[:16])+_PendingSuffix)
+}
+
+func (u *Uploader) copyPath(p *pendingUpload) string {
+	return filepath.Join(u.dir, p.Copy)
+}
+
+// persist copies r into dir and records p for it, replacing the copy
+// an earlier Put of the name left.
+func (u *Uploader) persist(p *pendingUpload, r io.Reader) error {
+	f, err := ioutil.TempFile(u.dir, "tarbu-copy-")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	p.Copy = filepath.Base(f.Name())
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	old, _ := u.read(u.recordPath(p))
+	if err := u.save(p); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if old != nil {
+		os.Remove(u.copyPath(old))
+	}
+	return nil
+}
+
+// read reads the record rec.
+func (u *Uploader) read(rec string) (*pendingUpload, error) {
+	data, err := ioutil.ReadFile(rec)
+	if err != nil {
+		return nil, err
+	}
+	p := &pendingUpload{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("upload record is broken. path=%s err=%s", rec, err)
+	}
+	return p, nil
+}
+
+// save writes the record of p. u.mu is held.
+func (u *Uploader) save(p *pendingUpload) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	rec := u.recordPath(p)
+	if err := ioutil.WriteFile(rec+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(rec+".tmp", rec)
+}
+
+// current tells whether the record of p still is about its copy, which
+// a later Put of the name replaces. u.mu is held.
+func (u *Uploader) current(p *pendingUpload) bool {
+	cur, err := u.read(u.recordPath(p))
+	return err == nil && cur.Copy == p.Copy
+}
+
+// update saves the progress of the upload of p, unless its copy was
+// replaced meanwhile.
+func (u *Uploader) update(p *pendingUpload) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !u.current(p) {
+		return nil
+	}
+	return u.save(p)
+}
+
+// finish removes the copy of p and its record, unless the record is
+// about a later copy.
+func (u *Uploader) finish(p *pendingUpload) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.current(p) {
+		os.Remove(u.recordPath(p))
+	}
+	os.Remove(u.copyPath(p))
+}
+
+// pending returns the records of the copies put into u, by name.
+func (u *Uploader) pending() (map[string]*pendingUpload, error) {
+	found := map[string]*pendingUpload{}
+	if !u.opts.Persist {
+		return found, nil
+	}
+	recs, err := filepath.Glob(filepath.Join(u.dir, "tarbu-upload-*"+_PendingSuffix))
+	if err != nil {
+		return nil, err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, rec := range recs {
+		p, err := u.read(rec)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if p.Dst == u.root.Location("") && p.Dir == u.sub {
+			found[p.Name] = p
+		}
+	}
+	return found, nil
+}
+
+// upload puts the contents of f as name, retrying as opts say. A
+// Resumer carries on from the parts st records.
+func (u *Uploader) upload(name string, f *os.File, st *UploadState, save func() error) error {
+	rs, resumable := u.b.(Resumer)
+	delay := u.opts.RetryDelay
+	for attempt := 1; ; attempt++ {
+		var err error
+		if resumable {
+			err = rs.PutResumable(name, f, st, save)
+		} else if _, err = f.Seek(0, io.SeekStart); err == nil {
+			err = u.b.Put(name, f)
+		}
+		if err == nil || attempt > u.opts.Retries {
+			return err
+		}
+		if u.opts.Failed != nil {
+			u.opts.Failed(name, attempt, delay, err)
+		}
+		if !u.wait(delay) {
+			return err
+		}
+		if delay *= 2; u.opts.MaxDelay > 0 && delay > u.opts.MaxDelay {
+			delay = u.opts.MaxDelay
+		}
+	}
+}
+
+// Flush uploads the persisted copies waiting in dir for the destination
+// of u, its subdirectories included: those of deferred Puts and those
+// processes stopping while uploading left. It returns their names.
+// Copies failing again are kept for the next Flush.
+func (u *Uploader) Flush() ([]string, error) {
+	u = u.top()
+	if !u.opts.Persist {
+		return nil, nil
+	}
+	recs, err := filepath.Glob(filepath.Join(u.dir, "tarbu-upload-*"+_PendingSuffix))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, rec := range recs {
+		u.mu.Lock()
+		p, err := u.read(rec)
+		u.mu.Unlock()
+		if os.IsNotExist(err) {
+			// uploaded or deleted meanwhile
+			continue
+		}
+		if err != nil {
+			return names, err
+		}
+		if p.Dst != u.root.Location("") {
+			continue
+		}
+		dst := u
+		if p.Dir != "" {
+			dst = Sub(u, p.Dir).(*Uploader)
+		}
+		f, err := os.Open(u.copyPath(p))
+		if os.IsNotExist(err) {
+			u.finish(p)
+			continue
+		}
+		if err != nil {
+			return names, err
+		}
+		err = dst.upload(p.Name, f, &p.State, func() error { return u.update(p) })
+		f.Close()
+		if err != nil {
+			return names, err
+		}
+		u.finish(p)
+		names = append(names, path.Join(p.Dir, p.Name))
+	}
+	return names, nil
+}
+
+func (u *Uploader) Open(name string) (io.ReadCloser, error) {
+	pending, err := u.pending()
+	if err != nil {
+		return nil, err
+	}
+	if p, ok := pending[name]; ok {
+		return os.Open(u.copyPath(p))
+	}
+	if u.Offline() {
+		return nil, u.errOffline(name)
+	}
+	return u.b.Open(name)
+}
+
+// List lists the copies waiting for Flush with the objects of b.
+func (u *Uploader) List(prefix string) ([]Object, error) {
+	var objs []Object
+	if !u.Offline() {
+		var err error
+		if objs, err = u.b.List(prefix); err != nil {
+			return nil, err
+		}
+	}
+	pending, err := u.pending()
+	if err != nil || len(pending) == 0 {
+		return objs, err
+	}
+	var merged []Object
+	for _, o := range objs {
+		if pending[o.Name] == nil {
+			merged = append(merged, o)
+		}
+	}
+	for name, p := range pending {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if fi, err := os.Stat(u.copyPath(p)); err == nil {
+			merged = append(merged, Object{name, fi.Size()})
+		}
+	}
+	return sortObjects(merged), nil
+}
+
+// Delete drops the copies of names waiting for Flush too.
+func (u *Uploader) Delete(names ...string) error {
+	pending, err := u.pending()
+	if err != nil {
+		return err
+	}
+	offline := u.Offline()
+	for _, n := range names {
+		if p, ok := pending[n]; ok {
+			u.finish(p)
+		} else if offline {
+			return u.errOffline(n)
+		}
+	}
+	if offline {
+		return nil
+	}
+	return u.b.Delete(names...)
+}
+
+func (u *Uploader) Location(name string) string { return u.b.Location(name) }
+
+// Rename renames a copy waiting for Flush by rewriting its record.
+func (u *Uploader) Rename(from, to string) error {
+	pending, err := u.pending()
+	if err != nil {
+		return err
+	}
+	if p, ok := pending[to]; ok {
+		u.finish(p)
+	}
+	if p, ok := pending[from]; ok {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		rec := u.recordPath(p)
+		p.Name = to
+		if err := u.save(p); err != nil {
+			return err
+		}
+		return os.Remove(rec)
+	}
+	if u.Offline() {
+		return u.errOffline(from)
+	}
+	rn, ok := u.b.(Renamer)
+	if !ok {
+		return fmt.Errorf("destination can't rename. name=%s", from)
+	}
+	return rn.Rename(from, to)
+}
+
+// top is the Uploader u is a Sub of.
+func (u *Uploader) top() *Uploader {
+	t := *u
+	t.b, t.sub = u.root, ""
+	return &t
+}
+
+// AsVersioner returns b as a Versioner, looking through an Uploader.
+func AsVersioner(b Backend) (Versioner, bool) {
+	if u, ok := b.(*Uploader); ok {
+		b = u.b
+	}
+	v, ok := b.(Versioner)
+	return v, ok
+}
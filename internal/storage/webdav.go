@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// WebDAV stores objects in a collection of a WebDAV server. The URL is
+//
+//	webdavs://host/path?profile=name
+//
+// webdavs uses https, webdav plain http. The profile's User and Password
+// authenticate with basic auth. rate and burst limit requests like S3.
+type WebDAV struct {
+	base   *url.URL
+	creds  *Credentials
+	tmpDir string
+	client *http.Client
+	// sub collections are made on demand, see Sub
+	sub   bool
+	limit *rateLimiter
+}
+
+func newWebDAV(u *url.URL, creds *Credentials, opts *Options) (*WebDAV, error) {
+	base := *u
+	base.Scheme = "https"
+	if u.Scheme == "webdav" {
+		base.Scheme = "http"
+	}
+	base.RawQuery = ""
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+	base.RawPath = ""
+	limit, err := newRateLimiter(u.Query())
+	if err != nil {
+		return nil, err
+	}
+	return &WebDAV{base: &base, creds: creds, tmpDir: opts.TmpDir, client: http.DefaultClient, limit: limit}, nil
+}
+
+func (w *WebDAV) url(name string) string {
+	u := *w.base
+	u.Path += name
+	return u.String()
+}
+
+// Location keeps name unescaped, so it ends with the name as listed.
+func (w *WebDAV) Location(name string) string { return w.base.String() + name }
+
+func (w *WebDAV) request(method, name string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, w.url(name), body)
+	if err != nil {
+		return nil, err
+	}
+	if w.creds != nil && w.creds.User != "" {
+		req.SetBasicAuth(w.creds.User, w.creds.Password)
+	}
+	return req, nil
+}
+
+func (w *WebDAV) do(req *http.Request, want ...int) (*http.Response, error) {
+	w.limit.wait()
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range want {
+		if resp.StatusCode == c {
+			return resp, nil
+		}
+	}
+	resp.Body.Close()
+	return resp, fmt.Errorf("webdav %s failed. url=%s status=%s", req.Method, req.URL, resp.Status)
+}
+
+func (w *WebDAV) Put(name string, r io.Reader) error {
+	// many servers refuse chunked uploads, so send a length
+	sp, err := spool(r, w.tmpDir)
+	if err != nil {
+		return err
+	}
+	defer sp.Close()
+	if w.sub {
+		req, err := w.request("MKCOL", "", nil)
+		if err != nil {
+			return err
+		}
+		// 405 is an existing collection
+		resp, err := w.do(req, http.StatusCreated, http.StatusMethodNotAllowed)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	req, err := w.request("PUT", name, io.NewSectionReader(sp.File, 0, sp.size))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = sp.size
+	resp, err := w.do(req, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (w *WebDAV) Open(name string) (io.ReadCloser, error) {
+	req, err := w.request("GET", name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.do(req, http.StatusOK)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, &notExist{name}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+const _PropfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/></prop></propfind>`
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				Length string `xml:"getcontentlength"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func (w *WebDAV) List(prefix string) ([]Object, error) {
+	req, err := w.request("PROPFIND", "", strings.NewReader(_PropfindBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := w.do(req, http.StatusMultiStatus)
+	if w.sub && resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var ms davMultistatus
+	if err := xml.Unmarshal(data, &ms); err != nil {
+		return nil, fmt.Errorf("webdav listing is broken. err=%s", err)
+	}
+
+	var objs []Object
+	for _, r := range ms.Responses {
+		collection, size := false, int64(0)
+		for _, ps := range r.Propstat {
+			if ps.Prop.ResourceType.Collection != nil {
+				collection = true
+			}
+			if ps.Prop.Length != "" {
+				size, _ = strconv.ParseInt(ps.Prop.Length, 10, 64)
+			}
+		}
+		if collection {
+			continue
+		}
+		href, err := url.PathUnescape(r.Href)
+		if err != nil {
+			continue
+		}
+		// hrefs may be absolute URLs or paths
+		if u, err := url.Parse(href); err == nil && u.Path != "" {
+			href = u.Path
+		}
+		name := path.Base(href)
+		if strings.HasPrefix(name, prefix) {
+			objs = append(objs, Object{name, size})
+		}
+	}
+	return sortObjects(objs), nil
+}
+
+const _QuotaBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><quota-available-bytes/></prop></propfind>`
+
+// Free reads the RFC 4331 quota of the collection.
+func (w *WebDAV) Free() (int64, error) {
+	req, err := w.request("PROPFIND", "", strings.NewReader(_QuotaBody))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml")
+	resp, err := w.do(req, http.StatusMultiStatus)
+	if w.sub && resp != nil && resp.StatusCode == http.StatusNotFound {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var ms struct {
+		Available []string `xml:"response>propstat>prop>quota-available-bytes"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return 0, fmt.Errorf("webdav quota is broken. err=%s", err)
+	}
+	for _, a := range ms.Available {
+		if n, err := strconv.ParseInt(strings.TrimSpace(a), 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	return -1, nil
+}
+
+func (w *WebDAV) Rename(from, to string) error {
+	req, err := w.request("MOVE", from, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Destination", w.url(to))
+	req.Header.Set("Overwrite", "T")
+	resp, err := w.do(req, http.StatusCreated, http.StatusNoContent)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (w *WebDAV) Delete(names ...string) error {
+	for _, n := range names {
+		req, err := w.request("DELETE", n, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := w.do(req, http.StatusNoContent, http.StatusOK, http.StatusNotFound)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}